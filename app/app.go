@@ -22,9 +22,11 @@ func Start(cfg *config.Config, lgr *zap.Logger) {
 	db := database.NewDBInstance(dbClient, lgr)
 
 	mc := initializers.InitMGClient(cfg.EmailConfig)
+	ks := initializers.InitKeyStore(cfg.Sessions, db, lgr)
+	ts := initializers.InitThrottleStore(cfg.Throttle, db, lgr)
 
-	svc := service.NewService(db, mc, lgr)
-	rtr := router.NewRouter(svc, cfg.JWT, cfg.VECfg, lgr)
+	svc := service.NewService(db, mc, ks, ts, cfg.WebAuthn, cfg.OIDC, cfg.Throttle, cfg.Decoy, lgr)
+	rtr := router.NewRouter(svc, ks, cfg.JWT, cfg.KDF, cfg.VECfg, cfg.Admin, lgr)
 
 	srv := &http.Server{
 		Addr:    cfg.HTTP.GetListenAddr(),
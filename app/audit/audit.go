@@ -0,0 +1,89 @@
+// Package audit keeps the security history of accounts: logins, token refreshes and account changes, whether
+// they succeeded or not.
+package audit
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/database"
+	"github.com/sid-sun/arche-api/app/types"
+	"go.uber.org/zap"
+)
+
+// Event types
+const (
+	EventSignup             = "signup"
+	EventActivation         = "activation"
+	EventVerificationResent = "verification_resent"
+	EventLogin              = "login"
+	EventLoginUnlocked      = "login_unlocked"
+	EventTwoFactorLogin     = "two_factor_login"
+	EventMagicLinkLogin     = "magic_link_login"
+	EventPasskeyLogin       = "passkey_login"
+	EventSRPLogin           = "srp_login"
+	EventOIDCLogin          = "oidc_login"
+	EventSessionUnlock      = "session_unlock"
+	EventTokenRefresh       = "token_refresh"
+	EventLogout             = "logout"
+	EventLogoutAll          = "logout_all"
+	EventSessionRevoked     = "session_revoked"
+	EventPasswordChange     = "password_change"
+	EventAccountRecovery    = "account_recovery"
+	EventRecoveryCodeReset  = "recovery_code_reset"
+	EventEmailChange        = "email_change"
+	EventKeyRotationRequest = "key_rotation_request"
+	EventKeyRotation        = "key_rotation"
+)
+
+// Outcomes
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	// OutcomeThrottled is an attempt turned away by the login throttle without being checked
+	OutcomeThrottled = "throttled"
+)
+
+// Log records security events, recording is best effort and never fails the request being recorded
+type Log interface {
+	Record(userID types.UserID, eventType string, outcome string, client types.ClientInfo)
+	List(userID types.UserID, before int64, limit int) ([]types.AuditEvent, *erx.Erx)
+}
+
+type log struct {
+	table database.AuditEventsTable
+	lgr   *zap.Logger
+}
+
+func NewLog(table database.AuditEventsTable, lgr *zap.Logger) Log {
+	return &log{
+		table: table,
+		lgr:   lgr,
+	}
+}
+
+// Record appends an event, userID is 0 when the attempt matched no account
+func (l *log) Record(userID types.UserID, eventType string, outcome string, client types.ClientInfo) {
+	errx := l.table.Append(types.AuditEvent{
+		UserID:    userID,
+		Type:      eventType,
+		Outcome:   outcome,
+		IPAddress: client.IPAddress,
+		UserAgent: client.UserAgent,
+		CreatedAt: time.Now(),
+	})
+	if errx != nil {
+		l.lgr.Error(fmt.Sprintf("[Audit] [Record] [Append] %s %s for user %d: %s", eventType, outcome, userID, errx.String()))
+	}
+}
+
+// List returns a page of a user's events, newest first, before is the event id the page starts below, 0 for the first page
+func (l *log) List(userID types.UserID, before int64, limit int) ([]types.AuditEvent, *erx.Erx) {
+	events, errx := l.table.List(userID, before, limit)
+	if errx != nil {
+		l.lgr.Debug(fmt.Sprintf("[Audit] [List] [List] %s", errx.String()))
+		return nil, errx
+	}
+	return events, nil
+}
@@ -0,0 +1,50 @@
+package audit
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type fakeTable struct {
+	events []types.AuditEvent
+	err    *erx.Erx
+}
+
+func (f *fakeTable) Append(event types.AuditEvent) *erx.Erx {
+	if f.err != nil {
+		return f.err
+	}
+	f.events = append(f.events, event)
+	return nil
+}
+
+func (f *fakeTable) List(userID types.UserID, before int64, limit int) ([]types.AuditEvent, *erx.Erx) {
+	return f.events, nil
+}
+
+func TestRecord(t *testing.T) {
+	table := &fakeTable{}
+	l := NewLog(table, zap.NewNop())
+
+	client := types.ClientInfo{DeviceLabel: "Jane's laptop", UserAgent: "curl/7.68.0", IPAddress: "10.0.0.1"}
+	l.Record(7, EventLogin, OutcomeFailure, client)
+
+	assert.Len(t, table.events, 1)
+	event := table.events[0]
+	assert.Equal(t, types.UserID(7), event.UserID)
+	assert.Equal(t, EventLogin, event.Type)
+	assert.Equal(t, OutcomeFailure, event.Outcome)
+	assert.Equal(t, "10.0.0.1", event.IPAddress)
+	assert.Equal(t, "curl/7.68.0", event.UserAgent)
+	assert.False(t, event.CreatedAt.IsZero())
+
+	// A failing write is logged and swallowed, the request being recorded goes on
+	table.err = erx.WithArgs(errors.New("connection reset"), erx.SeverityError)
+	assert.NotPanics(t, func() { l.Record(7, EventLogout, OutcomeSuccess, client) })
+	assert.Len(t, table.events, 1)
+}
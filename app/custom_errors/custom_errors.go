@@ -8,3 +8,25 @@ const DuplicateRecordInsertion = erx.Kind("DuplicateRecordInsertion")
 const NoRowsInResultSet = erx.Kind("NoRowsInResultSet")
 const NoRowsAffected = erx.Kind("NoRowsAffected")
 const InvalidEmailAddress = erx.Kind("InvalidEmailAddress")
+const IntegrityCheckFailed = erx.Kind("IntegrityCheckFailed")
+const InvalidRefreshToken = erx.Kind("InvalidRefreshToken")
+const RefreshTokenReused = erx.Kind("RefreshTokenReused")
+const InvalidChallengeToken = erx.Kind("InvalidChallengeToken")
+const InvalidTwoFactorCode = erx.Kind("InvalidTwoFactorCode")
+const TwoFactorAlreadyEnabled = erx.Kind("TwoFactorAlreadyEnabled")
+const TwoFactorNotEnabled = erx.Kind("TwoFactorNotEnabled")
+const InvalidWebAuthnResponse = erx.Kind("InvalidWebAuthnResponse")
+const WebAuthnCeremonyExpired = erx.Kind("WebAuthnCeremonyExpired")
+const PasswordlessNotAvailable = erx.Kind("PasswordlessNotAvailable")
+const InvalidVerificationToken = erx.Kind("InvalidVerificationToken")
+const VerificationTokenExpired = erx.Kind("VerificationTokenExpired")
+const InvalidMagicLink = erx.Kind("InvalidMagicLink")
+const InvalidUnlockToken = erx.Kind("InvalidUnlockToken")
+const InvalidAccessToken = erx.Kind("InvalidAccessToken")
+const OIDCNotConfigured = erx.Kind("OIDCNotConfigured")
+const InvalidOIDCState = erx.Kind("InvalidOIDCState")
+const OIDCLoginFailed = erx.Kind("OIDCLoginFailed")
+const InvalidSearchQuery = erx.Kind("InvalidSearchQuery")
+const ZeroKnowledgeAccount = erx.Kind("ZeroKnowledgeAccount")
+const InvalidSRPHandshake = erx.Kind("InvalidSRPHandshake")
+const SRPProofMismatch = erx.Kind("SRPProofMismatch")
@@ -0,0 +1,194 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/types"
+	"go.uber.org/zap"
+)
+
+type AccessTokensTable interface {
+	Create(token types.AccessToken) *erx.Erx
+	Get(tokenID string) (types.AccessToken, *erx.Erx)
+	List(userID types.UserID) ([]types.AccessToken, *erx.Erx)
+	Touch(tokenID string, lastUsedAt time.Time) *erx.Erx
+	Delete(userID types.UserID, tokenID string) *erx.Erx
+}
+
+type accessTokens struct {
+	lgr *zap.Logger
+	db  *sql.DB
+}
+
+func (a *accessTokens) Create(token types.AccessToken) *erx.Erx {
+	query := `INSERT INTO access_tokens (token_id, user_id, name, secret_hash, scopes, wrapped_key, created_at, expires_at)
+VALUES (@tokenID, @userID, @name, @secretHash, @scopes, @wrappedKey, @createdAt, @expiresAt)`
+
+	_, err := a.db.Exec(query, sql.Named("tokenID", token.TokenID), sql.Named("userID", token.UserID),
+		sql.Named("name", token.Name), sql.Named("secretHash", token.SecretHash), sql.Named("scopes", strings.Join(token.Scopes, " ")),
+		sql.Named("wrappedKey", token.WrappedKey), sql.Named("createdAt", token.CreatedAt.UTC()), sql.Named("expiresAt", token.ExpiresAt.UTC()))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			a.lgr.Error(fmt.Sprintf("[Database] [AccessTokens] [Create] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		a.lgr.Debug(fmt.Sprintf("[Database] [AccessTokens] [Create] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	return nil
+}
+
+func (a *accessTokens) Get(tokenID string) (types.AccessToken, *erx.Erx) {
+	query := `SELECT t.user_id, t.name, t.secret_hash, t.scopes, t.wrapped_key, t.created_at, t.expires_at, t.last_used_at,
+CAST(CASE WHEN u.key_bundle IS NULL THEN 0 ELSE 1 END AS bit)
+FROM access_tokens t JOIN users u ON u.user_id = t.user_id WHERE t.token_id = @tokenID`
+
+	token := types.AccessToken{TokenID: tokenID}
+	var scopes string
+	var lastUsedAt sql.NullTime
+
+	row := a.db.QueryRow(query, sql.Named("tokenID", tokenID))
+	err := row.Scan(&token.UserID, &token.Name, &token.SecretHash, &scopes, &token.WrappedKey, &token.CreatedAt,
+		&token.ExpiresAt, &lastUsedAt, &token.ZeroKnowledge)
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			a.lgr.Error(fmt.Sprintf("[Database] [AccessTokens] [Get] [Scan] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return types.AccessToken{}, errx
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			errx = erx.WithArgs(errx, erx.SeverityInfo, custom_errors.NoRowsInResultSet)
+			a.lgr.Info(fmt.Sprintf("[Database] [AccessTokens] [Get] [Scan] [ErrSQLNoResultsInSet] %s", errx.String()))
+			return types.AccessToken{}, errx
+		}
+		a.lgr.Debug(fmt.Sprintf("[Database] [AccessTokens] [Get] [Scan] %s", errx.Error()))
+		return types.AccessToken{}, errx
+	}
+
+	token.Scopes = strings.Fields(scopes)
+	token.LastUsedAt = lastUsedAt.Time
+	return token, nil
+}
+
+// List returns the user's tokens without their wrapped keys
+func (a *accessTokens) List(userID types.UserID) ([]types.AccessToken, *erx.Erx) {
+	query := `SELECT token_id, name, scopes, created_at, expires_at, last_used_at
+FROM access_tokens WHERE user_id = @userID ORDER BY created_at`
+
+	rows, err := a.db.Query(query, sql.Named("userID", userID))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			a.lgr.Error(fmt.Sprintf("[Database] [AccessTokens] [List] [Query] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		a.lgr.Debug(fmt.Sprintf("[Database] [AccessTokens] [List] [Query] %s", err.Error()))
+		return nil, errx
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			a.lgr.Debug(fmt.Sprintf("[Database] [AccessTokens] [List] [Close] %s", err.Error()))
+		}
+	}(rows)
+	tokens := *new([]types.AccessToken)
+
+	for rows.Next() {
+		token := types.AccessToken{UserID: userID}
+		var scopes string
+		var lastUsedAt sql.NullTime
+
+		err = rows.Scan(&token.TokenID, &token.Name, &scopes, &token.CreatedAt, &token.ExpiresAt, &lastUsedAt)
+		if err != nil {
+			sqlErr, errx := checkForSQLError(err)
+			if sqlErr != nil {
+				errx = erx.WithArgs(errx, erx.SeverityError)
+				a.lgr.Error(fmt.Sprintf("[Database] [AccessTokens] [List] [Scan] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+				return nil, errx
+			}
+			a.lgr.Debug(fmt.Sprintf("[Database] [AccessTokens] [List] [Scan] %s", err.Error()))
+			return nil, errx
+		}
+
+		token.Scopes = strings.Fields(scopes)
+		token.LastUsedAt = lastUsedAt.Time
+		tokens = append(tokens, token)
+	}
+
+	if err := rows.Err(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			a.lgr.Error(fmt.Sprintf("[Database] [AccessTokens] [List] [Err] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		a.lgr.Debug(fmt.Sprintf("[Database] [AccessTokens] [List] [Err] %s", err.Error()))
+		return nil, errx
+	}
+
+	return tokens, nil
+}
+
+func (a *accessTokens) Touch(tokenID string, lastUsedAt time.Time) *erx.Erx {
+	query := `UPDATE access_tokens SET last_used_at = @lastUsedAt WHERE token_id = @tokenID`
+
+	_, err := a.db.Exec(query, sql.Named("lastUsedAt", lastUsedAt.UTC()), sql.Named("tokenID", tokenID))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			a.lgr.Error(fmt.Sprintf("[Database] [AccessTokens] [Touch] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		a.lgr.Debug(fmt.Sprintf("[Database] [AccessTokens] [Touch] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	return nil
+}
+
+func (a *accessTokens) Delete(userID types.UserID, tokenID string) *erx.Erx {
+	query := `DELETE FROM access_tokens WHERE user_id = @userID AND token_id = @tokenID`
+
+	res, err := a.db.Exec(query, sql.Named("userID", userID), sql.Named("tokenID", tokenID))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			a.lgr.Error(fmt.Sprintf("[Database] [AccessTokens] [Delete] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		a.lgr.Debug(fmt.Sprintf("[Database] [AccessTokens] [Delete] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	var count int64
+	if count, err = res.RowsAffected(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			a.lgr.Error(fmt.Sprintf("[Database] [AccessTokens] [Delete] [RowsAffected] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		a.lgr.Debug(fmt.Sprintf("[Database] [AccessTokens] [Delete] [RowsAffected] %s", err.Error()))
+		return errx
+	}
+
+	if count == 0 {
+		return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/types"
+	"go.uber.org/zap"
+)
+
+// AuditEventsTable is append only, events are never updated and are only deleted along with their account
+type AuditEventsTable interface {
+	Append(event types.AuditEvent) *erx.Erx
+	List(userID types.UserID, before int64, limit int) ([]types.AuditEvent, *erx.Erx)
+}
+
+type auditEvents struct {
+	lgr *zap.Logger
+	db  *sql.DB
+}
+
+func (a *auditEvents) Append(event types.AuditEvent) *erx.Erx {
+	query := `INSERT INTO audit_events (user_id, event_type, outcome, ip_address, user_agent, created_at)
+VALUES (@userID, @eventType, @outcome, @ipAddress, @userAgent, @createdAt)`
+
+	userID := sql.NullInt64{Int64: int64(event.UserID), Valid: event.UserID != 0}
+	_, err := a.db.Exec(query, sql.Named("userID", userID), sql.Named("eventType", event.Type),
+		sql.Named("outcome", event.Outcome), sql.Named("ipAddress", event.IPAddress),
+		sql.Named("userAgent", event.UserAgent), sql.Named("createdAt", event.CreatedAt.UTC()))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			a.lgr.Error(fmt.Sprintf("[Database] [AuditEvents] [Append] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		a.lgr.Debug(fmt.Sprintf("[Database] [AuditEvents] [Append] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	return nil
+}
+
+// List returns up to limit events of a user, newest first, starting below the event id before when it is not 0
+func (a *auditEvents) List(userID types.UserID, before int64, limit int) ([]types.AuditEvent, *erx.Erx) {
+	query := `SELECT TOP (@limit) event_id, event_type, outcome, ip_address, user_agent, created_at FROM audit_events
+WHERE user_id = @userID AND (@before = 0 OR event_id < @before) ORDER BY event_id DESC`
+
+	rows, err := a.db.Query(query, sql.Named("limit", limit), sql.Named("userID", userID), sql.Named("before", before))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			a.lgr.Error(fmt.Sprintf("[Database] [AuditEvents] [List] [Query] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		a.lgr.Debug(fmt.Sprintf("[Database] [AuditEvents] [List] [Query] %s", err.Error()))
+		return nil, errx
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			a.lgr.Debug(fmt.Sprintf("[Database] [AuditEvents] [List] [Close] %s", err.Error()))
+		}
+	}(rows)
+	events := *new([]types.AuditEvent)
+
+	for rows.Next() {
+		event := types.AuditEvent{UserID: userID}
+
+		err = rows.Scan(&event.EventID, &event.Type, &event.Outcome, &event.IPAddress, &event.UserAgent, &event.CreatedAt)
+		if err != nil {
+			sqlErr, errx := checkForSQLError(err)
+			if sqlErr != nil {
+				errx = erx.WithArgs(errx, erx.SeverityError)
+				a.lgr.Error(fmt.Sprintf("[Database] [AuditEvents] [List] [Scan] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+				return nil, errx
+			}
+			a.lgr.Debug(fmt.Sprintf("[Database] [AuditEvents] [List] [Scan] %s", err.Error()))
+			return nil, errx
+		}
+		events = append(events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			a.lgr.Error(fmt.Sprintf("[Database] [AuditEvents] [List] [Err] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		a.lgr.Debug(fmt.Sprintf("[Database] [AuditEvents] [List] [Err] %s", err.Error()))
+		return nil, errx
+	}
+
+	return events, nil
+}
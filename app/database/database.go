@@ -6,9 +6,19 @@ import (
 )
 
 type DB struct {
-	Users   UsersTable
-	Folders FoldersTable
-	Notes   NotesTable
+	Users         UsersTable
+	Folders       FoldersTable
+	Notes         NotesTable
+	SessionKeys   SessionKeysTable
+	RefreshTokens RefreshTokensTable
+	Sessions      SessionsTable
+	TwoFactor     TwoFactorTable
+	WebAuthn      WebAuthnCredentialsTable
+	AccessTokens  AccessTokensTable
+	Identities    IdentitiesTable
+	LoginFailures LoginFailuresTable
+	AuditEvents   AuditEventsTable
+	KeyRotations  KeyRotationsTable
 }
 
 func NewDBInstance(dbClient *sql.DB, lgr *zap.Logger) *DB {
@@ -25,5 +35,45 @@ func NewDBInstance(dbClient *sql.DB, lgr *zap.Logger) *DB {
 			lgr: lgr,
 			db:  dbClient,
 		},
+		SessionKeys: &sessionKeys{
+			lgr: lgr,
+			db:  dbClient,
+		},
+		RefreshTokens: &refreshTokens{
+			lgr: lgr,
+			db:  dbClient,
+		},
+		Sessions: &sessions{
+			lgr: lgr,
+			db:  dbClient,
+		},
+		TwoFactor: &twoFactor{
+			lgr: lgr,
+			db:  dbClient,
+		},
+		WebAuthn: &webAuthnCredentials{
+			lgr: lgr,
+			db:  dbClient,
+		},
+		AccessTokens: &accessTokens{
+			lgr: lgr,
+			db:  dbClient,
+		},
+		Identities: &identities{
+			lgr: lgr,
+			db:  dbClient,
+		},
+		LoginFailures: &loginFailures{
+			lgr: lgr,
+			db:  dbClient,
+		},
+		AuditEvents: &auditEvents{
+			lgr: lgr,
+			db:  dbClient,
+		},
+		KeyRotations: &keyRotations{
+			lgr: lgr,
+			db:  dbClient,
+		},
 	}
 }
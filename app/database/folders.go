@@ -23,7 +23,7 @@ type folders struct {
 }
 
 func (f *folders) Get(folderID types.FolderID, userID types.UserID) ([]types.FolderContent, *erx.Erx) {
-	query := `SELECT note_id, name FROM notes WHERE folder_id=(SELECT folder_id FROM folders WHERE user_id=@user_id AND folder_id=@folder_id)`
+	query := `SELECT note_id, name, data_key FROM notes WHERE folder_id=(SELECT folder_id FROM folders WHERE user_id=@user_id AND folder_id=@folder_id)`
 
 	rows, err := f.db.Query(query, sql.Named("user_id", userID), sql.Named("folder_id", folderID))
 	if err != nil {
@@ -48,8 +48,9 @@ func (f *folders) Get(folderID types.FolderID, userID types.UserID) ([]types.Fol
 	for rows.Next() {
 		var noteID types.NoteID
 		var name string
+		var dataKey sql.NullString
 
-		err = rows.Scan(&noteID, &name)
+		err = rows.Scan(&noteID, &name, &dataKey)
 		if err != nil {
 			sqlErr, errx := checkForSQLError(err)
 			if sqlErr != nil {
@@ -62,8 +63,9 @@ func (f *folders) Get(folderID types.FolderID, userID types.UserID) ([]types.Fol
 		}
 
 		folderContents = append(folderContents, types.FolderContent{
-			NoteID: noteID,
-			Name:   name,
+			NoteID:     noteID,
+			Name:       name,
+			WrappedKey: dataKey.String,
 		})
 	}
 
@@ -141,30 +143,27 @@ func (f *folders) GetAll(userID types.UserID) ([]types.Folder, *erx.Erx) {
 	return folders, nil
 }
 
+// Delete removes a folder along with the notes in it, so that no note is left without an owner
 func (f *folders) Delete(folderID types.FolderID, userID types.UserID) *erx.Erx {
-	query := `DELETE FROM folders WHERE folder_id=@folder_id AND user_id=@user_id`
+	folderQuery := `DELETE FROM folders WHERE folder_id=@folder_id AND user_id=@user_id`
+	tokensQuery := `DELETE FROM note_tokens WHERE note_id IN (SELECT note_id FROM notes WHERE folder_id=@folder_id)`
+	notesQuery := `DELETE FROM notes WHERE folder_id=@folder_id`
 
-	res, err := f.db.Exec(query, sql.Named("folder_id", folderID), sql.Named("user_id", userID))
+	tx, err := f.db.Begin()
 	if err != nil {
 		sqlErr, errx := checkForSQLError(err)
 		if sqlErr != nil {
 			errx = erx.WithArgs(errx, erx.SeverityError)
-			f.lgr.Error(fmt.Sprintf("[Database] [Folders] [Delete] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			f.lgr.Error(fmt.Sprintf("[Database] [Folders] [Delete] [Begin] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
 			return errx
 		}
-		f.lgr.Debug(fmt.Sprintf("[Database] [Folders] [Delete] [Exec] %s", err.Error()))
+		f.lgr.Debug(fmt.Sprintf("[Database] [Folders] [Delete] [Begin] %s", err.Error()))
 		return errx
 	}
+	defer rollback(tx, "Delete", f.lgr)
 
-	var count int64
-	if count, err = res.RowsAffected(); err != nil {
-		sqlErr, errx := checkForSQLError(err)
-		if sqlErr != nil {
-			errx = erx.WithArgs(errx, erx.SeverityError)
-			f.lgr.Error(fmt.Sprintf("[Database] [Folders] [Delete] [RowsAffected] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
-			return errx
-		}
-		f.lgr.Debug(fmt.Sprintf("[Database] [Folders] [Delete] [RowsAffected] %s", err.Error()))
+	count, errx := execInTx(tx, "Folders", "Delete", f.lgr, folderQuery, sql.Named("folder_id", folderID), sql.Named("user_id", userID))
+	if errx != nil {
 		return errx
 	}
 
@@ -172,7 +171,14 @@ func (f *folders) Delete(folderID types.FolderID, userID types.UserID) *erx.Erx
 		return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
 	}
 
-	return nil
+	// Ownership of the folder was checked by the statement above
+	for _, query := range []string{tokensQuery, notesQuery} {
+		if _, errx = execInTx(tx, "Folders", "Delete", f.lgr, query, sql.Named("folder_id", folderID)); errx != nil {
+			return errx
+		}
+	}
+
+	return commit(tx, "Folders", "Delete", f.lgr)
 }
 
 func (f *folders) Create(name string, userID types.UserID) (types.FolderID, *erx.Erx) {
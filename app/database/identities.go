@@ -0,0 +1,182 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/types"
+	"go.uber.org/zap"
+)
+
+type IdentitiesTable interface {
+	GetUserID(issuer string, subject string) (types.UserID, *erx.Erx)
+	List(userID types.UserID) ([]types.Identity, *erx.Erx)
+	Link(identity types.Identity, vault types.KeyWrap) *erx.Erx
+	Unlink(userID types.UserID, issuer string) *erx.Erx
+}
+
+type identities struct {
+	lgr *zap.Logger
+	db  *sql.DB
+}
+
+func (i *identities) GetUserID(issuer string, subject string) (types.UserID, *erx.Erx) {
+	query := `SELECT user_id FROM user_identities WHERE issuer = @issuer AND subject = @subject`
+
+	var userID types.UserID
+	row := i.db.QueryRow(query, sql.Named("issuer", issuer), sql.Named("subject", subject))
+	err := row.Scan(&userID)
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			i.lgr.Error(fmt.Sprintf("[Database] [Identities] [GetUserID] [Scan] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return 0, errx
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			errx = erx.WithArgs(errx, erx.SeverityInfo, custom_errors.NoRowsInResultSet)
+			i.lgr.Info(fmt.Sprintf("[Database] [Identities] [GetUserID] [Scan] [ErrSQLNoResultsInSet] %s", errx.String()))
+			return 0, errx
+		}
+		i.lgr.Debug(fmt.Sprintf("[Database] [Identities] [GetUserID] [Scan] %s", errx.Error()))
+		return 0, errx
+	}
+
+	return userID, nil
+}
+
+func (i *identities) List(userID types.UserID) ([]types.Identity, *erx.Erx) {
+	query := `SELECT issuer, subject, email, created_at FROM user_identities WHERE user_id = @userID ORDER BY created_at`
+
+	rows, err := i.db.Query(query, sql.Named("userID", userID))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			i.lgr.Error(fmt.Sprintf("[Database] [Identities] [List] [Query] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		i.lgr.Debug(fmt.Sprintf("[Database] [Identities] [List] [Query] %s", err.Error()))
+		return nil, errx
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			i.lgr.Debug(fmt.Sprintf("[Database] [Identities] [List] [Close] %s", err.Error()))
+		}
+	}(rows)
+	linked := *new([]types.Identity)
+
+	for rows.Next() {
+		identity := types.Identity{UserID: userID}
+		var email sql.NullString
+
+		err = rows.Scan(&identity.Issuer, &identity.Subject, &email, &identity.CreatedAt)
+		if err != nil {
+			sqlErr, errx := checkForSQLError(err)
+			if sqlErr != nil {
+				errx = erx.WithArgs(errx, erx.SeverityError)
+				i.lgr.Error(fmt.Sprintf("[Database] [Identities] [List] [Scan] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+				return nil, errx
+			}
+			i.lgr.Debug(fmt.Sprintf("[Database] [Identities] [List] [Scan] %s", err.Error()))
+			return nil, errx
+		}
+
+		identity.Email = email.String
+		linked = append(linked, identity)
+	}
+
+	if err := rows.Err(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			i.lgr.Error(fmt.Sprintf("[Database] [Identities] [List] [Err] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		i.lgr.Debug(fmt.Sprintf("[Database] [Identities] [List] [Err] %s", err.Error()))
+		return nil, errx
+	}
+
+	return linked, nil
+}
+
+// Link records the identity and stores the vault wrap of the data key in one transaction
+// An identity already linked to any account, or a second identity of the same issuer, is a DuplicateRecordInsertion
+func (i *identities) Link(identity types.Identity, vault types.KeyWrap) *erx.Erx {
+	tx, err := i.db.Begin()
+	if err != nil {
+		i.lgr.Debug(fmt.Sprintf("[Database] [Identities] [Link] [Begin] %s", err.Error()))
+		return erx.WithArgs(err, erx.SeverityDebug)
+	}
+	defer rollback(tx, "Identities", i.lgr)
+
+	query := `INSERT INTO user_identities (issuer, subject, user_id, email, created_at)
+VALUES (@issuer, @subject, @userID, @email, @createdAt)`
+
+	_, err = tx.Exec(query, sql.Named("issuer", identity.Issuer), sql.Named("subject", identity.Subject),
+		sql.Named("userID", identity.UserID), sql.Named("email", identity.Email), sql.Named("createdAt", identity.CreatedAt.UTC()))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			switch sqlErr.Number {
+			case 2601, 2627:
+				errx = erx.WithArgs(errx, custom_errors.DuplicateRecordInsertion, erx.SeverityInfo)
+				i.lgr.Info(fmt.Sprintf("[Database] [Identities] [Link] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+				return errx
+			}
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			i.lgr.Error(fmt.Sprintf("[Database] [Identities] [Link] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		i.lgr.Debug(fmt.Sprintf("[Database] [Identities] [Link] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	count, errx := execInTx(tx, "Identities", "Link", i.lgr,
+		`UPDATE users SET vault_key = @vaultKey, vault_kdf_salt = @vaultSalt, vault_kdf_params = @vaultParams WHERE user_id = @userID`,
+		sql.Named("vaultKey", vault.Key), sql.Named("vaultSalt", vault.Salt), sql.Named("vaultParams", vault.Params),
+		sql.Named("userID", identity.UserID))
+	if errx != nil {
+		return errx
+	}
+	if count == 0 {
+		return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+	}
+
+	return commit(tx, "Identities", "Link", i.lgr)
+}
+
+// Unlink removes the user's identity at issuer, the vault wrap is dropped along with the last identity
+func (i *identities) Unlink(userID types.UserID, issuer string) *erx.Erx {
+	tx, err := i.db.Begin()
+	if err != nil {
+		i.lgr.Debug(fmt.Sprintf("[Database] [Identities] [Unlink] [Begin] %s", err.Error()))
+		return erx.WithArgs(err, erx.SeverityDebug)
+	}
+	defer rollback(tx, "Identities", i.lgr)
+
+	count, errx := execInTx(tx, "Identities", "Unlink", i.lgr,
+		`DELETE FROM user_identities WHERE user_id = @userID AND issuer = @issuer`,
+		sql.Named("userID", userID), sql.Named("issuer", issuer))
+	if errx != nil {
+		return errx
+	}
+	if count == 0 {
+		return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+	}
+
+	_, errx = execInTx(tx, "Identities", "Unlink", i.lgr,
+		`UPDATE users SET vault_key = NULL, vault_kdf_salt = NULL, vault_kdf_params = NULL
+WHERE user_id = @userID AND NOT EXISTS (SELECT 1 FROM user_identities WHERE user_id = @userID)`,
+		sql.Named("userID", userID))
+	if errx != nil {
+		return errx
+	}
+
+	return commit(tx, "Identities", "Unlink", i.lgr)
+}
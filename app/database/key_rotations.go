@@ -0,0 +1,401 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/types"
+	"go.uber.org/zap"
+)
+
+// KeyRotationsTable tracks rotations of users' data keys, a row lives from the request until the new key is swapped in
+// Folders and notes are re-encrypted in id order, the cursors are the last ids already under the new key
+type KeyRotationsTable interface {
+	Request(userID types.UserID) ([]string, *erx.Erx)
+	Get(userID types.UserID) (types.KeyRotation, *erx.Erx)
+	SetPendingKey(userID types.UserID, pendingKey string) *erx.Erx
+	FolderBatch(userID types.UserID, after types.FolderID, limit int) ([]types.Folder, *erx.Erx)
+	NoteBatch(userID types.UserID, after types.NoteID, limit int) ([]types.Note, *erx.Erx)
+	StoreFolders(userID types.UserID, folders []types.Folder) *erx.Erx
+	StoreNotes(userID types.UserID, notes []types.Note, tokens map[types.NoteID][]string) *erx.Erx
+	Finish(userID types.UserID, keyHash string, password types.KeyWrap, recovery types.KeyWrap, totpSecret string) *erx.Erx
+}
+
+type keyRotations struct {
+	lgr *zap.Logger
+	db  *sql.DB
+}
+
+// Request marks the user's key for rotation and, in the same transaction, revokes every session and drops every
+// other copy of the key which cannot be re-wrapped without its secret: personal access tokens, the passkey PRF
+// wraps and the vault wrap. It returns the ids of the sessions that were live
+func (k *keyRotations) Request(userID types.UserID) ([]string, *erx.Erx) {
+	requestQuery := `IF NOT EXISTS (SELECT 1 FROM key_rotations WHERE user_id = @userID)
+INSERT INTO key_rotations (user_id, requested_at) VALUES (@userID, @requestedAt)`
+	credentialsQueries := []string{
+		`DELETE FROM access_tokens WHERE user_id = @userID`,
+		`UPDATE webauthn_credentials SET wrapped_key = NULL WHERE user_id = @userID`,
+		`UPDATE users SET vault_key = NULL, vault_kdf_salt = NULL, vault_kdf_params = NULL WHERE user_id = @userID`,
+	}
+
+	tx, err := k.db.Begin()
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			k.lgr.Error(fmt.Sprintf("[Database] [KeyRotations] [Request] [Begin] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		k.lgr.Debug(fmt.Sprintf("[Database] [KeyRotations] [Request] [Begin] %s", err.Error()))
+		return nil, errx
+	}
+	defer rollback(tx, "Request", k.lgr)
+
+	_, errx := execInTx(tx, "KeyRotations", "Request", k.lgr, requestQuery, sql.Named("userID", userID),
+		sql.Named("requestedAt", time.Now().UTC()))
+	if errx != nil {
+		return nil, errx
+	}
+
+	sessionIDs, errx := revokeAllSessions(tx, userID, "Request", k.lgr)
+	if errx != nil {
+		return nil, errx
+	}
+
+	for _, query := range credentialsQueries {
+		if _, errx = execInTx(tx, "KeyRotations", "Request", k.lgr, query, sql.Named("userID", userID)); errx != nil {
+			return nil, errx
+		}
+	}
+
+	if errx = commit(tx, "KeyRotations", "Request", k.lgr); errx != nil {
+		return nil, errx
+	}
+
+	return sessionIDs, nil
+}
+
+func (k *keyRotations) Get(userID types.UserID) (types.KeyRotation, *erx.Erx) {
+	query := `SELECT pending_key, folder_cursor, note_cursor, requested_at FROM key_rotations WHERE user_id = @userID`
+
+	var pendingKey sql.NullString
+	rotation := types.KeyRotation{UserID: userID}
+
+	row := k.db.QueryRow(query, sql.Named("userID", userID))
+	err := row.Scan(&pendingKey, &rotation.FolderCursor, &rotation.NoteCursor, &rotation.RequestedAt)
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			k.lgr.Error(fmt.Sprintf("[Database] [KeyRotations] [Get] [Scan] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return types.KeyRotation{}, errx
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			errx = erx.WithArgs(errx, erx.SeverityInfo, custom_errors.NoRowsInResultSet)
+			k.lgr.Info(fmt.Sprintf("[Database] [KeyRotations] [Get] [Scan] [ErrSQLNoResultsInSet] %s", errx.String()))
+			return types.KeyRotation{}, errx
+		}
+		k.lgr.Debug(fmt.Sprintf("[Database] [KeyRotations] [Get] [Scan] %s", errx.Error()))
+		return types.KeyRotation{}, errx
+	}
+
+	rotation.PendingKey = pendingKey.String
+	return rotation, nil
+}
+
+// SetPendingKey stores the new key sealed under the current one, it never replaces a key set by an earlier run
+func (k *keyRotations) SetPendingKey(userID types.UserID, pendingKey string) *erx.Erx {
+	query := `UPDATE key_rotations SET pending_key = @pendingKey WHERE user_id = @userID AND pending_key IS NULL`
+
+	res, err := k.db.Exec(query, sql.Named("pendingKey", pendingKey), sql.Named("userID", userID))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			k.lgr.Error(fmt.Sprintf("[Database] [KeyRotations] [SetPendingKey] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		k.lgr.Debug(fmt.Sprintf("[Database] [KeyRotations] [SetPendingKey] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	var count int64
+	if count, err = res.RowsAffected(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			k.lgr.Error(fmt.Sprintf("[Database] [KeyRotations] [SetPendingKey] [RowsAffected] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		k.lgr.Debug(fmt.Sprintf("[Database] [KeyRotations] [SetPendingKey] [RowsAffected] %s", err.Error()))
+		return errx
+	}
+
+	if count == 0 {
+		return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+	}
+
+	return nil
+}
+
+// FolderBatch returns up to limit of the user's folders with ids above after, in id order
+func (k *keyRotations) FolderBatch(userID types.UserID, after types.FolderID, limit int) ([]types.Folder, *erx.Erx) {
+	query := `SELECT TOP (@limit) folder_id, name FROM folders WHERE user_id = @userID AND folder_id > @after ORDER BY folder_id`
+
+	rows, err := k.db.Query(query, sql.Named("limit", limit), sql.Named("userID", userID), sql.Named("after", after))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			k.lgr.Error(fmt.Sprintf("[Database] [KeyRotations] [FolderBatch] [Query] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		k.lgr.Debug(fmt.Sprintf("[Database] [KeyRotations] [FolderBatch] [Query] %s", err.Error()))
+		return nil, errx
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			k.lgr.Debug(fmt.Sprintf("[Database] [KeyRotations] [FolderBatch] [Close] %s", err.Error()))
+		}
+	}(rows)
+	folders := *new([]types.Folder)
+
+	for rows.Next() {
+		folder := types.Folder{UserID: userID}
+
+		err = rows.Scan(&folder.FolderID, &folder.Name)
+		if err != nil {
+			sqlErr, errx := checkForSQLError(err)
+			if sqlErr != nil {
+				errx = erx.WithArgs(errx, erx.SeverityError)
+				k.lgr.Error(fmt.Sprintf("[Database] [KeyRotations] [FolderBatch] [Scan] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+				return nil, errx
+			}
+			k.lgr.Debug(fmt.Sprintf("[Database] [KeyRotations] [FolderBatch] [Scan] %s", err.Error()))
+			return nil, errx
+		}
+
+		folders = append(folders, folder)
+	}
+
+	if err := rows.Err(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			k.lgr.Error(fmt.Sprintf("[Database] [KeyRotations] [FolderBatch] [Err] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		k.lgr.Debug(fmt.Sprintf("[Database] [KeyRotations] [FolderBatch] [Err] %s", err.Error()))
+		return nil, errx
+	}
+
+	return folders, nil
+}
+
+// NoteBatch returns up to limit of the user's notes with ids above after, in id order
+func (k *keyRotations) NoteBatch(userID types.UserID, after types.NoteID, limit int) ([]types.Note, *erx.Erx) {
+	query := `SELECT TOP (@limit) notes.note_id, notes.name, notes.data, notes.data_key, notes.folder_id
+FROM notes JOIN folders f ON notes.folder_id = f.folder_id
+WHERE f.user_id = @userID AND notes.note_id > @after ORDER BY notes.note_id`
+
+	rows, err := k.db.Query(query, sql.Named("limit", limit), sql.Named("userID", userID), sql.Named("after", after))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			k.lgr.Error(fmt.Sprintf("[Database] [KeyRotations] [NoteBatch] [Query] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		k.lgr.Debug(fmt.Sprintf("[Database] [KeyRotations] [NoteBatch] [Query] %s", err.Error()))
+		return nil, errx
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			k.lgr.Debug(fmt.Sprintf("[Database] [KeyRotations] [NoteBatch] [Close] %s", err.Error()))
+		}
+	}(rows)
+	notes := *new([]types.Note)
+
+	for rows.Next() {
+		var note types.Note
+		var dataKey sql.NullString
+
+		err = rows.Scan(&note.NoteID, &note.Name, &note.Data, &dataKey, &note.FolderID)
+		if err != nil {
+			sqlErr, errx := checkForSQLError(err)
+			if sqlErr != nil {
+				errx = erx.WithArgs(errx, erx.SeverityError)
+				k.lgr.Error(fmt.Sprintf("[Database] [KeyRotations] [NoteBatch] [Scan] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+				return nil, errx
+			}
+			k.lgr.Debug(fmt.Sprintf("[Database] [KeyRotations] [NoteBatch] [Scan] %s", err.Error()))
+			return nil, errx
+		}
+
+		note.WrappedKey = dataKey.String
+		notes = append(notes, note)
+	}
+
+	if err := rows.Err(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			k.lgr.Error(fmt.Sprintf("[Database] [KeyRotations] [NoteBatch] [Err] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		k.lgr.Debug(fmt.Sprintf("[Database] [KeyRotations] [NoteBatch] [Err] %s", err.Error()))
+		return nil, errx
+	}
+
+	return notes, nil
+}
+
+// StoreFolders writes re-encrypted folders and moves the folder cursor past them in one transaction
+func (k *keyRotations) StoreFolders(userID types.UserID, folders []types.Folder) *erx.Erx {
+	if len(folders) == 0 {
+		return nil
+	}
+
+	query := `UPDATE folders SET name = @name WHERE folder_id = @folderID AND user_id = @userID`
+	cursorQuery := `UPDATE key_rotations SET folder_cursor = @cursor WHERE user_id = @userID`
+
+	tx, err := k.db.Begin()
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			k.lgr.Error(fmt.Sprintf("[Database] [KeyRotations] [StoreFolders] [Begin] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		k.lgr.Debug(fmt.Sprintf("[Database] [KeyRotations] [StoreFolders] [Begin] %s", err.Error()))
+		return errx
+	}
+	defer rollback(tx, "StoreFolders", k.lgr)
+
+	for _, folder := range folders {
+		_, errx := execInTx(tx, "KeyRotations", "StoreFolders", k.lgr, query, sql.Named("name", folder.Name),
+			sql.Named("folderID", folder.FolderID), sql.Named("userID", userID))
+		if errx != nil {
+			return errx
+		}
+	}
+
+	count, errx := execInTx(tx, "KeyRotations", "StoreFolders", k.lgr, cursorQuery,
+		sql.Named("cursor", folders[len(folders)-1].FolderID), sql.Named("userID", userID))
+	if errx != nil {
+		return errx
+	}
+
+	if count == 0 {
+		return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+	}
+
+	return commit(tx, "KeyRotations", "StoreFolders", k.lgr)
+}
+
+// StoreNotes writes re-encrypted notes with their search tokens under the new key and moves the note cursor past
+// them in one transaction
+func (k *keyRotations) StoreNotes(userID types.UserID, notes []types.Note, tokens map[types.NoteID][]string) *erx.Erx {
+	if len(notes) == 0 {
+		return nil
+	}
+
+	query := `UPDATE notes SET name = @name, data = @data, data_key = @dataKey, search_indexed = 1
+WHERE note_id = @noteID AND folder_id IN (SELECT folder_id FROM folders WHERE user_id = @userID)`
+	cursorQuery := `UPDATE key_rotations SET note_cursor = @cursor WHERE user_id = @userID`
+
+	tx, err := k.db.Begin()
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			k.lgr.Error(fmt.Sprintf("[Database] [KeyRotations] [StoreNotes] [Begin] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		k.lgr.Debug(fmt.Sprintf("[Database] [KeyRotations] [StoreNotes] [Begin] %s", err.Error()))
+		return errx
+	}
+	defer rollback(tx, "StoreNotes", k.lgr)
+
+	for _, note := range notes {
+		count, errx := execInTx(tx, "KeyRotations", "StoreNotes", k.lgr, query, sql.Named("name", note.Name), sql.Named("data", note.Data),
+			sql.Named("dataKey", note.WrappedKey), sql.Named("noteID", note.NoteID), sql.Named("userID", userID))
+		if errx != nil {
+			return errx
+		}
+
+		// A note deleted since the batch was read keeps no tokens
+		if count == 0 {
+			continue
+		}
+
+		if errx = replaceNoteTokens(tx, "KeyRotations", "StoreNotes", note.NoteID, tokens[note.NoteID], k.lgr); errx != nil {
+			return errx
+		}
+	}
+
+	count, errx := execInTx(tx, "KeyRotations", "StoreNotes", k.lgr, cursorQuery,
+		sql.Named("cursor", notes[len(notes)-1].NoteID), sql.Named("userID", userID))
+	if errx != nil {
+		return errx
+	}
+
+	if count == 0 {
+		return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+	}
+
+	return commit(tx, "KeyRotations", "StoreNotes", k.lgr)
+}
+
+// Finish swaps the new key in, replacing the key hash, the password and recovery wraps and the TOTP secret,
+// and ends the rotation in one transaction. An empty totpSecret leaves the stored one as it is
+func (k *keyRotations) Finish(userID types.UserID, keyHash string, password types.KeyWrap, recovery types.KeyWrap, totpSecret string) *erx.Erx {
+	usersQuery := `UPDATE users SET key_hash = @keyHash, encryption_key = @key, kdf_salt = @salt, kdf_params = @params,
+recovery_key = @recoveryKey, recovery_kdf_salt = @recoverySalt, recovery_kdf_params = @recoveryParams`
+	args := []interface{}{sql.Named("keyHash", keyHash), sql.Named("key", password.Key), sql.Named("salt", password.Salt),
+		sql.Named("params", password.Params), sql.Named("recoveryKey", recovery.Key), sql.Named("recoverySalt", recovery.Salt),
+		sql.Named("recoveryParams", recovery.Params), sql.Named("userID", userID)}
+	if totpSecret != "" {
+		usersQuery += `, totp_secret = @totpSecret`
+		args = append(args, sql.Named("totpSecret", totpSecret))
+	}
+	usersQuery += ` WHERE user_id = @userID`
+	rotationQuery := `DELETE FROM key_rotations WHERE user_id = @userID`
+
+	tx, err := k.db.Begin()
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			k.lgr.Error(fmt.Sprintf("[Database] [KeyRotations] [Finish] [Begin] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		k.lgr.Debug(fmt.Sprintf("[Database] [KeyRotations] [Finish] [Begin] %s", err.Error()))
+		return errx
+	}
+	defer rollback(tx, "Finish", k.lgr)
+
+	// Deleting the rotation first makes a concurrent run which already finished fail here instead of swapping twice
+	count, errx := execInTx(tx, "KeyRotations", "Finish", k.lgr, rotationQuery, sql.Named("userID", userID))
+	if errx != nil {
+		return errx
+	}
+
+	if count == 0 {
+		return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+	}
+
+	if _, errx = execInTx(tx, "KeyRotations", "Finish", k.lgr, usersQuery, args...); errx != nil {
+		return errx
+	}
+
+	return commit(tx, "KeyRotations", "Finish", k.lgr)
+}
@@ -0,0 +1,190 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/nsnikhil/erx"
+	"go.uber.org/zap"
+)
+
+// LoginFailuresTable backs the SQL throttle store, keys are throttle keys such as "email:<address>"
+type LoginFailuresTable interface {
+	Record(key string, failedAt time.Time, purgeBefore time.Time) *erx.Erx
+	Reserve(key string, failedAt time.Time, purgeBefore time.Time, allow func(failures []time.Time) bool) *erx.Erx
+	Refund(key string, failedAt time.Time) *erx.Erx
+	Since(key string, since time.Time) ([]time.Time, *erx.Erx)
+	Delete(key string) *erx.Erx
+}
+
+type loginFailures struct {
+	lgr *zap.Logger
+	db  *sql.DB
+}
+
+// Record adds a failure, failures of key older than purgeBefore are purged in the same batch
+func (l *loginFailures) Record(key string, failedAt time.Time, purgeBefore time.Time) *erx.Erx {
+	query := `DELETE FROM login_failures WHERE throttle_key = @key AND failed_at < @purgeBefore;
+INSERT INTO login_failures (throttle_key, failed_at) VALUES (@key, @failedAt);`
+
+	_, err := l.db.Exec(query, sql.Named("key", key), sql.Named("purgeBefore", purgeBefore.UTC()),
+		sql.Named("failedAt", failedAt.UTC()))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			l.lgr.Error(fmt.Sprintf("[Database] [LoginFailures] [Record] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		l.lgr.Debug(fmt.Sprintf("[Database] [LoginFailures] [Record] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	return nil
+}
+
+func (l *loginFailures) Since(key string, since time.Time) ([]time.Time, *erx.Erx) {
+	query := `SELECT failed_at FROM login_failures WHERE throttle_key = @key AND failed_at >= @since ORDER BY failed_at`
+
+	rows, err := l.db.Query(query, sql.Named("key", key), sql.Named("since", since.UTC()))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			l.lgr.Error(fmt.Sprintf("[Database] [LoginFailures] [Since] [Query] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		l.lgr.Debug(fmt.Sprintf("[Database] [LoginFailures] [Since] [Query] %s", err.Error()))
+		return nil, errx
+	}
+
+	return l.scan(rows, "Since")
+}
+
+// Reserve records a failure at failedAt when allow accepts the failures of key since purgeBefore, which are read under
+// an update lock held until the insert, so concurrent attempts on one key each see the ones before them
+func (l *loginFailures) Reserve(key string, failedAt time.Time, purgeBefore time.Time, allow func(failures []time.Time) bool) *erx.Erx {
+	selectQuery := `SELECT failed_at FROM login_failures WITH (UPDLOCK, HOLDLOCK)
+WHERE throttle_key = @key AND failed_at >= @purgeBefore ORDER BY failed_at`
+	recordQuery := `DELETE FROM login_failures WHERE throttle_key = @key AND failed_at < @purgeBefore;
+INSERT INTO login_failures (throttle_key, failed_at) VALUES (@key, @failedAt);`
+
+	tx, err := l.db.Begin()
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			l.lgr.Error(fmt.Sprintf("[Database] [LoginFailures] [Reserve] [Begin] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		l.lgr.Debug(fmt.Sprintf("[Database] [LoginFailures] [Reserve] [Begin] %s", err.Error()))
+		return errx
+	}
+	defer rollback(tx, "Reserve", l.lgr)
+
+	rows, err := tx.Query(selectQuery, sql.Named("key", key), sql.Named("purgeBefore", purgeBefore.UTC()))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			l.lgr.Error(fmt.Sprintf("[Database] [LoginFailures] [Reserve] [Query] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		l.lgr.Debug(fmt.Sprintf("[Database] [LoginFailures] [Reserve] [Query] %s", err.Error()))
+		return errx
+	}
+
+	failures, errx := l.scan(rows, "Reserve")
+	if errx != nil {
+		return errx
+	}
+
+	if !allow(failures) {
+		return commit(tx, "LoginFailures", "Reserve", l.lgr)
+	}
+
+	_, errx = execInTx(tx, "LoginFailures", "Reserve", l.lgr, recordQuery, sql.Named("key", key),
+		sql.Named("purgeBefore", purgeBefore.UTC()), sql.Named("failedAt", failedAt.UTC()))
+	if errx != nil {
+		return errx
+	}
+
+	return commit(tx, "LoginFailures", "Reserve", l.lgr)
+}
+
+// Refund removes a failure recorded by Reserve
+func (l *loginFailures) Refund(key string, failedAt time.Time) *erx.Erx {
+	query := `DELETE TOP (1) FROM login_failures WHERE throttle_key = @key AND failed_at = @failedAt`
+
+	_, err := l.db.Exec(query, sql.Named("key", key), sql.Named("failedAt", failedAt.UTC()))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			l.lgr.Error(fmt.Sprintf("[Database] [LoginFailures] [Refund] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		l.lgr.Debug(fmt.Sprintf("[Database] [LoginFailures] [Refund] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	return nil
+}
+
+// scan reads the failure times of rows and closes them
+func (l *loginFailures) scan(rows *sql.Rows, caller string) ([]time.Time, *erx.Erx) {
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			l.lgr.Debug(fmt.Sprintf("[Database] [LoginFailures] [%s] [Close] %s", caller, err.Error()))
+		}
+	}(rows)
+	var failures []time.Time
+
+	for rows.Next() {
+		var failedAt time.Time
+		if err := rows.Scan(&failedAt); err != nil {
+			sqlErr, errx := checkForSQLError(err)
+			if sqlErr != nil {
+				errx = erx.WithArgs(errx, erx.SeverityError)
+				l.lgr.Error(fmt.Sprintf("[Database] [LoginFailures] [%s] [Scan] [sqlErr] %d : %s", caller, sqlErr.Number, sqlErr.Error()))
+				return nil, errx
+			}
+			l.lgr.Debug(fmt.Sprintf("[Database] [LoginFailures] [%s] [Scan] %s", caller, err.Error()))
+			return nil, errx
+		}
+		failures = append(failures, failedAt)
+	}
+
+	if err := rows.Err(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			l.lgr.Error(fmt.Sprintf("[Database] [LoginFailures] [%s] [Err] [sqlErr] %d : %s", caller, sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		l.lgr.Debug(fmt.Sprintf("[Database] [LoginFailures] [%s] [Err] %s", caller, err.Error()))
+		return nil, errx
+	}
+
+	return failures, nil
+}
+
+func (l *loginFailures) Delete(key string) *erx.Erx {
+	query := `DELETE FROM login_failures WHERE throttle_key = @key`
+
+	_, err := l.db.Exec(query, sql.Named("key", key))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			l.lgr.Error(fmt.Sprintf("[Database] [LoginFailures] [Delete] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		l.lgr.Debug(fmt.Sprintf("[Database] [LoginFailures] [Delete] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	return nil
+}
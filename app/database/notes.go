@@ -3,6 +3,7 @@ package database
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 
 	"github.com/nsnikhil/erx"
 	"github.com/sid-sun/arche-api/app/custom_errors"
@@ -13,18 +14,24 @@ import (
 type NotesTable interface {
 	Get(noteID types.NoteID, userID types.UserID) (types.Note, *erx.Erx)
 	GetAll(userID types.UserID) ([]types.Note, *erx.Erx)
-	Create(name string, data string, folderID types.FolderID, userID types.UserID) (types.NoteID, *erx.Erx)
-	Update(note types.Note, userID types.UserID) *erx.Erx
+	Create(name string, data string, wrappedKey string, tokens []string, folderID types.FolderID, userID types.UserID) (types.NoteID, *erx.Erx)
+	Update(note types.Note, tokens []string, userID types.UserID) *erx.Erx
 	Delete(noteID types.NoteID, userID types.UserID) *erx.Erx
+	Search(userID types.UserID, tokens []string) ([]types.Note, *erx.Erx)
+	Unindexed(userID types.UserID, limit int) ([]types.Note, *erx.Erx)
+	Index(userID types.UserID, tokens map[types.NoteID][]string) *erx.Erx
 }
 
+// noteTokensPerInsert keeps inserts of search tokens well below the 2100 parameters SQL Server takes per statement
+const noteTokensPerInsert = 500
+
 type notes struct {
 	lgr *zap.Logger
 	db  *sql.DB
 }
 
 func (n *notes) Get(noteID types.NoteID, userID types.UserID) (types.Note, *erx.Erx) {
-	query := `SELECT notes.name, notes.data, f.folder_id FROM notes INNER JOIN folders AS f ON (f.folder_id = notes.folder_id) WHERE user_id=@user_id AND note_id=@note_id`
+	query := `SELECT notes.name, notes.data, notes.data_key, f.folder_id FROM notes INNER JOIN folders AS f ON (f.folder_id = notes.folder_id) WHERE user_id=@user_id AND note_id=@note_id`
 
 	row := n.db.QueryRow(query, sql.Named("user_id", userID), sql.Named("note_id", noteID))
 	err := row.Err()
@@ -41,7 +48,8 @@ func (n *notes) Get(noteID types.NoteID, userID types.UserID) (types.Note, *erx.
 
 	var folderID types.FolderID
 	var name, data string
-	err = row.Scan(&name, &data, &folderID)
+	var dataKey sql.NullString
+	err = row.Scan(&name, &data, &dataKey, &folderID)
 	if err != nil {
 		sqlErr, errx := checkForSQLError(err)
 		if sqlErr != nil {
@@ -54,15 +62,16 @@ func (n *notes) Get(noteID types.NoteID, userID types.UserID) (types.Note, *erx.
 	}
 
 	return types.Note{
-		NoteID:   noteID,
-		Name:     name,
-		Data:     data,
-		FolderID: folderID,
+		NoteID:     noteID,
+		Name:       name,
+		Data:       data,
+		FolderID:   folderID,
+		WrappedKey: dataKey.String,
 	}, nil
 }
 
 func (n *notes) GetAll(userID types.UserID) ([]types.Note, *erx.Erx) {
-	query := `SELECT notes.note_id, notes.name, notes.data, notes.folder_id
+	query := `SELECT notes.note_id, notes.name, notes.data, notes.data_key, notes.folder_id
 FROM notes INNER JOIN folders AS f ON (f.folder_id = notes.folder_id) WHERE user_id=@userID`
 
 	rows, err := n.db.Query(query, sql.Named("userID", userID))
@@ -90,8 +99,9 @@ FROM notes INNER JOIN folders AS f ON (f.folder_id = notes.folder_id) WHERE user
 		var folderID types.FolderID
 		var data string
 		var name string
+		var dataKey sql.NullString
 
-		err = rows.Scan(&noteID, &name, &data, &folderID)
+		err = rows.Scan(&noteID, &name, &data, &dataKey, &folderID)
 		if err != nil {
 			sqlErr, errx := checkForSQLError(err)
 			if sqlErr != nil {
@@ -104,10 +114,11 @@ FROM notes INNER JOIN folders AS f ON (f.folder_id = notes.folder_id) WHERE user
 		}
 
 		notesSlice = append(notesSlice, types.Note{
-			NoteID:   noteID,
-			FolderID: folderID,
-			Data:     data,
-			Name:     name,
+			NoteID:     noteID,
+			FolderID:   folderID,
+			Data:       data,
+			Name:       name,
+			WrappedKey: dataKey.String,
 		})
 
 	}
@@ -126,26 +137,27 @@ FROM notes INNER JOIN folders AS f ON (f.folder_id = notes.folder_id) WHERE user
 	return notesSlice, nil
 }
 
-func (n *notes) Create(name string, data string, folderID types.FolderID, userID types.UserID) (types.NoteID, *erx.Erx) {
-	query := `INSERT INTO notes (data, name, folder_id) OUTPUT inserted.note_id 
-VALUES (@data, @name, (SELECT folder_id FROM folders WHERE user_id=@userID AND  folder_id=@folderID))`
+// Create stores a note along with its search tokens
+func (n *notes) Create(name string, data string, wrappedKey string, tokens []string, folderID types.FolderID, userID types.UserID) (types.NoteID, *erx.Erx) {
+	query := `INSERT INTO notes (data, name, data_key, search_indexed, folder_id) OUTPUT inserted.note_id 
+VALUES (@data, @name, @dataKey, 1, (SELECT folder_id FROM folders WHERE user_id=@userID AND  folder_id=@folderID))`
 
-	row := n.db.QueryRow(query, sql.Named("data", data), sql.Named("name", name),
-		sql.Named("userID", userID), sql.Named("folderID", folderID))
-	err := row.Err()
+	tx, err := n.db.Begin()
 	if err != nil {
 		sqlErr, errx := checkForSQLError(err)
 		if sqlErr != nil {
 			errx = erx.WithArgs(errx, erx.SeverityError)
-			n.lgr.Error(fmt.Sprintf("[Database] [Notes] [Create] [QueryRow] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			n.lgr.Error(fmt.Sprintf("[Database] [Notes] [Create] [Begin] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
 			return 0, errx
 		}
-		n.lgr.Debug(fmt.Sprintf("[Database] [Notes] [Create] [QueryRow] %s", err.Error()))
+		n.lgr.Debug(fmt.Sprintf("[Database] [Notes] [Create] [Begin] %s", err.Error()))
 		return 0, errx
 	}
+	defer rollback(tx, "Create", n.lgr)
 
 	var noteID types.NoteID
-	err = row.Scan(&noteID)
+	err = tx.QueryRow(query, sql.Named("data", data), sql.Named("name", name), sql.Named("dataKey", wrappedKey),
+		sql.Named("userID", userID), sql.Named("folderID", folderID)).Scan(&noteID)
 	if err != nil {
 		sqlErr, errx := checkForSQLError(err)
 		if sqlErr != nil {
@@ -157,35 +169,38 @@ VALUES (@data, @name, (SELECT folder_id FROM folders WHERE user_id=@userID AND
 		return 0, errx
 	}
 
+	if errx := replaceNoteTokens(tx, "Notes", "Create", noteID, tokens, n.lgr); errx != nil {
+		return 0, errx
+	}
+
+	if errx := commit(tx, "Notes", "Create", n.lgr); errx != nil {
+		return 0, errx
+	}
+
 	return noteID, nil
 }
 
-func (n *notes) Update(note types.Note, userID types.UserID) *erx.Erx {
-	query := `UPDATE notes SET name = @name, data = @data 
+// Update stores a note and replaces its search tokens
+func (n *notes) Update(note types.Note, tokens []string, userID types.UserID) *erx.Erx {
+	query := `UPDATE notes SET name = @name, data = @data, data_key = @dataKey, search_indexed = 1
 WHERE note_id = @noteID AND folder_id = (SELECT folder_id FROM folders WHERE folder_id = (SELECT notes.folder_id FROM notes WHERE note_id = @noteID) AND user_id = @userID)`
 
-	res, err := n.db.Exec(query, sql.Named("name", note.Name), sql.Named("data", note.Data),
-		sql.Named("noteID", note.NoteID), sql.Named("userID", userID))
+	tx, err := n.db.Begin()
 	if err != nil {
 		sqlErr, errx := checkForSQLError(err)
 		if sqlErr != nil {
 			errx = erx.WithArgs(errx, erx.SeverityError)
-			n.lgr.Error(fmt.Sprintf("[Database] [Notes] [Update] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			n.lgr.Error(fmt.Sprintf("[Database] [Notes] [Update] [Begin] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
 			return errx
 		}
-		n.lgr.Debug(fmt.Sprintf("[Database] [Notes] [Update] [Exec] %s", err.Error()))
+		n.lgr.Debug(fmt.Sprintf("[Database] [Notes] [Update] [Begin] %s", err.Error()))
 		return errx
 	}
+	defer rollback(tx, "Update", n.lgr)
 
-	var count int64
-	if count, err = res.RowsAffected(); err != nil {
-		sqlErr, errx := checkForSQLError(err)
-		if sqlErr != nil {
-			errx = erx.WithArgs(errx, erx.SeverityError)
-			n.lgr.Error(fmt.Sprintf("[Database] [Notes] [Update] [RowsAffected] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
-			return errx
-		}
-		n.lgr.Debug(fmt.Sprintf("[Database] [Notes] [Update] [RowsAffected] %s", err.Error()))
+	count, errx := execInTx(tx, "Notes", "Update", n.lgr, query, sql.Named("name", note.Name), sql.Named("data", note.Data),
+		sql.Named("dataKey", note.WrappedKey), sql.Named("noteID", note.NoteID), sql.Named("userID", userID))
+	if errx != nil {
 		return errx
 	}
 
@@ -193,41 +208,241 @@ WHERE note_id = @noteID AND folder_id = (SELECT folder_id FROM folders WHERE fol
 		return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
 	}
 
-	return nil
+	// Ownership of the note was checked by the statement above
+	if errx = replaceNoteTokens(tx, "Notes", "Update", note.NoteID, tokens, n.lgr); errx != nil {
+		return errx
+	}
+
+	return commit(tx, "Notes", "Update", n.lgr)
 }
 
 func (n *notes) Delete(noteID types.NoteID, userID types.UserID) *erx.Erx {
 	query := `DELETE FROM notes WHERE note_id = @noteID AND folder_id = 
                                               (SELECT folder_id FROM folders WHERE folder_id = (
                                                   SELECT notes.folder_id FROM notes WHERE note_id = @noteID) AND user_id = @userID)`
+	tokensQuery := `DELETE FROM note_tokens WHERE note_id = @noteID`
 
-	res, err := n.db.Exec(query, sql.Named("noteID", noteID), sql.Named("userID", userID))
-
+	tx, err := n.db.Begin()
 	if err != nil {
 		sqlErr, errx := checkForSQLError(err)
 		if sqlErr != nil {
 			errx = erx.WithArgs(errx, erx.SeverityError)
-			n.lgr.Error(fmt.Sprintf("[Database] [Notes] [Delete] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			n.lgr.Error(fmt.Sprintf("[Database] [Notes] [Delete] [Begin] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
 			return errx
 		}
-		n.lgr.Debug(fmt.Sprintf("[Database] [Notes] [Delete] [Exec] %s", err.Error()))
+		n.lgr.Debug(fmt.Sprintf("[Database] [Notes] [Delete] [Begin] %s", err.Error()))
 		return errx
 	}
+	defer rollback(tx, "Delete", n.lgr)
+
+	count, errx := execInTx(tx, "Notes", "Delete", n.lgr, query, sql.Named("noteID", noteID), sql.Named("userID", userID))
+	if errx != nil {
+		return errx
+	}
+
+	if count == 0 {
+		return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+	}
+
+	// Ownership of the note was checked by the statement above
+	if _, errx = execInTx(tx, "Notes", "Delete", n.lgr, tokensQuery, sql.Named("noteID", noteID)); errx != nil {
+		return errx
+	}
+
+	return commit(tx, "Notes", "Delete", n.lgr)
+}
+
+// Search returns the user's notes which carry every one of tokens
+func (n *notes) Search(userID types.UserID, tokens []string) ([]types.Note, *erx.Erx) {
+	placeholders := make([]string, len(tokens))
+	args := []interface{}{sql.Named("userID", userID), sql.Named("count", len(tokens))}
+	for i, token := range tokens {
+		placeholders[i] = fmt.Sprintf("@token%d", i)
+		args = append(args, sql.Named(fmt.Sprintf("token%d", i), token))
+	}
+
+	query := `SELECT notes.note_id, notes.name, notes.data, notes.data_key, notes.folder_id
+FROM notes JOIN folders f ON notes.folder_id = f.folder_id
+WHERE f.user_id = @userID AND notes.note_id IN (
+    SELECT note_id FROM note_tokens WHERE token IN (` + strings.Join(placeholders, ", ") + `)
+    GROUP BY note_id HAVING COUNT(*) = @count)
+ORDER BY notes.note_id`
+
+	rows, err := n.db.Query(query, args...)
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			n.lgr.Error(fmt.Sprintf("[Database] [Notes] [Search] [Query] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		n.lgr.Debug(fmt.Sprintf("[Database] [Notes] [Search] [Query] %s", err.Error()))
+		return nil, errx
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			n.lgr.Debug(fmt.Sprintf("[Database] [Notes] [Search] [Close] %s", err.Error()))
+		}
+	}(rows)
+	notesSlice := *new([]types.Note)
+
+	for rows.Next() {
+		var note types.Note
+		var dataKey sql.NullString
+
+		err = rows.Scan(&note.NoteID, &note.Name, &note.Data, &dataKey, &note.FolderID)
+		if err != nil {
+			sqlErr, errx := checkForSQLError(err)
+			if sqlErr != nil {
+				errx = erx.WithArgs(errx, erx.SeverityError)
+				n.lgr.Error(fmt.Sprintf("[Database] [Notes] [Search] [Scan] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+				return nil, errx
+			}
+			n.lgr.Debug(fmt.Sprintf("[Database] [Notes] [Search] [Scan] %s", err.Error()))
+			return nil, errx
+		}
+
+		note.WrappedKey = dataKey.String
+		notesSlice = append(notesSlice, note)
+	}
+
+	if err := rows.Err(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			n.lgr.Error(fmt.Sprintf("[Database] [Notes] [Search] [Err] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		n.lgr.Debug(fmt.Sprintf("[Database] [Notes] [Search] [Err] %s", err.Error()))
+		return nil, errx
+	}
+
+	return notesSlice, nil
+}
+
+// Unindexed returns up to limit of the user's notes which are not in the search index yet
+func (n *notes) Unindexed(userID types.UserID, limit int) ([]types.Note, *erx.Erx) {
+	query := `SELECT TOP (@limit) notes.note_id, notes.name, notes.data, notes.data_key, notes.folder_id
+FROM notes JOIN folders f ON notes.folder_id = f.folder_id
+WHERE f.user_id = @userID AND notes.search_indexed = 0 ORDER BY notes.note_id`
+
+	rows, err := n.db.Query(query, sql.Named("limit", limit), sql.Named("userID", userID))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			n.lgr.Error(fmt.Sprintf("[Database] [Notes] [Unindexed] [Query] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		n.lgr.Debug(fmt.Sprintf("[Database] [Notes] [Unindexed] [Query] %s", err.Error()))
+		return nil, errx
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			n.lgr.Debug(fmt.Sprintf("[Database] [Notes] [Unindexed] [Close] %s", err.Error()))
+		}
+	}(rows)
+	notesSlice := *new([]types.Note)
+
+	for rows.Next() {
+		var note types.Note
+		var dataKey sql.NullString
+
+		err = rows.Scan(&note.NoteID, &note.Name, &note.Data, &dataKey, &note.FolderID)
+		if err != nil {
+			sqlErr, errx := checkForSQLError(err)
+			if sqlErr != nil {
+				errx = erx.WithArgs(errx, erx.SeverityError)
+				n.lgr.Error(fmt.Sprintf("[Database] [Notes] [Unindexed] [Scan] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+				return nil, errx
+			}
+			n.lgr.Debug(fmt.Sprintf("[Database] [Notes] [Unindexed] [Scan] %s", err.Error()))
+			return nil, errx
+		}
+
+		note.WrappedKey = dataKey.String
+		notesSlice = append(notesSlice, note)
+	}
+
+	if err := rows.Err(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			n.lgr.Error(fmt.Sprintf("[Database] [Notes] [Unindexed] [Err] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		n.lgr.Debug(fmt.Sprintf("[Database] [Notes] [Unindexed] [Err] %s", err.Error()))
+		return nil, errx
+	}
+
+	return notesSlice, nil
+}
+
+// Index stores the search tokens of notes returned by Unindexed in one transaction. Notes which were
+// deleted or written in the meantime are skipped, the latter already carry tokens of their current words
+func (n *notes) Index(userID types.UserID, tokens map[types.NoteID][]string) *erx.Erx {
+	query := `UPDATE notes SET search_indexed = 1
+WHERE note_id = @noteID AND search_indexed = 0 AND folder_id IN (SELECT folder_id FROM folders WHERE user_id = @userID)`
 
-	var count int64
-	if count, err = res.RowsAffected(); err != nil {
+	tx, err := n.db.Begin()
+	if err != nil {
 		sqlErr, errx := checkForSQLError(err)
 		if sqlErr != nil {
 			errx = erx.WithArgs(errx, erx.SeverityError)
-			n.lgr.Error(fmt.Sprintf("[Database] [Notes] [Delete] [RowsAffected] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			n.lgr.Error(fmt.Sprintf("[Database] [Notes] [Index] [Begin] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
 			return errx
 		}
-		n.lgr.Debug(fmt.Sprintf("[Database] [Notes] [Delete] [RowsAffected] %s", err.Error()))
+		n.lgr.Debug(fmt.Sprintf("[Database] [Notes] [Index] [Begin] %s", err.Error()))
 		return errx
 	}
+	defer rollback(tx, "Index", n.lgr)
 
-	if count == 0 {
-		return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+	for noteID, noteTokens := range tokens {
+		count, errx := execInTx(tx, "Notes", "Index", n.lgr, query, sql.Named("noteID", noteID), sql.Named("userID", userID))
+		if errx != nil {
+			return errx
+		}
+
+		if count == 0 {
+			continue
+		}
+
+		if errx = replaceNoteTokens(tx, "Notes", "Index", noteID, noteTokens, n.lgr); errx != nil {
+			return errx
+		}
+	}
+
+	return commit(tx, "Notes", "Index", n.lgr)
+}
+
+// replaceNoteTokens swaps the search tokens of a note inside tx, the caller has to have checked the note is the user's
+func replaceNoteTokens(tx *sql.Tx, table string, caller string, noteID types.NoteID, tokens []string, lgr *zap.Logger) *erx.Erx {
+	_, errx := execInTx(tx, table, caller, lgr, `DELETE FROM note_tokens WHERE note_id = @noteID`, sql.Named("noteID", noteID))
+	if errx != nil {
+		return errx
+	}
+
+	for start := 0; start < len(tokens); start += noteTokensPerInsert {
+		end := start + noteTokensPerInsert
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+
+		values := make([]string, 0, end-start)
+		args := []interface{}{sql.Named("noteID", noteID)}
+		for i, token := range tokens[start:end] {
+			values = append(values, fmt.Sprintf("(@noteID, @token%d)", i))
+			args = append(args, sql.Named(fmt.Sprintf("token%d", i), token))
+		}
+
+		query := `INSERT INTO note_tokens (note_id, token) VALUES ` + strings.Join(values, ", ")
+		if _, errx = execInTx(tx, table, caller, lgr, query, args...); errx != nil {
+			return errx
+		}
 	}
 
 	return nil
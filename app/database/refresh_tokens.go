@@ -0,0 +1,71 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/types"
+	"go.uber.org/zap"
+)
+
+type RefreshTokensTable interface {
+	Create(tokenID string, familyID string, userID types.UserID, expiresAt time.Time) *erx.Erx
+	Use(tokenID string) (types.RefreshToken, *erx.Erx)
+}
+
+type refreshTokens struct {
+	lgr *zap.Logger
+	db  *sql.DB
+}
+
+func (r *refreshTokens) Create(tokenID string, familyID string, userID types.UserID, expiresAt time.Time) *erx.Erx {
+	query := `INSERT INTO refresh_tokens (token_id, family_id, user_id, expires_at) VALUES (@tokenID, @familyID, @userID, @expiresAt)`
+
+	_, err := r.db.Exec(query, sql.Named("tokenID", tokenID), sql.Named("familyID", familyID),
+		sql.Named("userID", userID), sql.Named("expiresAt", expiresAt.UTC()))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			r.lgr.Error(fmt.Sprintf("[Database] [RefreshTokens] [Create] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		r.lgr.Debug(fmt.Sprintf("[Database] [RefreshTokens] [Create] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	return nil
+}
+
+// Use marks a refresh token as used and returns its state from before the update
+// so a token which was already used can be told apart, in a single statement
+func (r *refreshTokens) Use(tokenID string) (types.RefreshToken, *erx.Erx) {
+	query := `UPDATE refresh_tokens SET used = 1
+OUTPUT deleted.family_id, deleted.user_id, deleted.expires_at, deleted.used, deleted.revoked WHERE token_id = @tokenID`
+
+	token := types.RefreshToken{TokenID: tokenID}
+
+	row := r.db.QueryRow(query, sql.Named("tokenID", tokenID))
+	err := row.Scan(&token.FamilyID, &token.UserID, &token.ExpiresAt, &token.Used, &token.Revoked)
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			r.lgr.Error(fmt.Sprintf("[Database] [RefreshTokens] [Use] [Scan] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return types.RefreshToken{}, errx
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			errx = erx.WithArgs(errx, erx.SeverityInfo, custom_errors.NoRowsInResultSet)
+			r.lgr.Info(fmt.Sprintf("[Database] [RefreshTokens] [Use] [Scan] [ErrSQLNoResultsInSet] %s", errx.String()))
+			return types.RefreshToken{}, errx
+		}
+		r.lgr.Debug(fmt.Sprintf("[Database] [RefreshTokens] [Use] [Scan] %s", errx.Error()))
+		return types.RefreshToken{}, errx
+	}
+
+	return token, nil
+}
@@ -0,0 +1,162 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"go.uber.org/zap"
+)
+
+type SessionKeysTable interface {
+	Put(sessionID string, sealedKey string, expiresAt time.Time) *erx.Erx
+	Get(sessionID string) (string, *erx.Erx)
+	Extend(sessionID string, expiresAt time.Time) *erx.Erx
+	Replace(sessionID string, sealedKey string, expiresAt time.Time) *erx.Erx
+	Delete(sessionID string) *erx.Erx
+}
+
+type sessionKeys struct {
+	lgr *zap.Logger
+	db  *sql.DB
+}
+
+// Put stores or replaces a sealed session key, expired keys are purged in the same batch
+func (s *sessionKeys) Put(sessionID string, sealedKey string, expiresAt time.Time) *erx.Erx {
+	query := `DELETE FROM session_keys WHERE expires_at < @now OR session_id = @sessionID;
+INSERT INTO session_keys (session_id, sealed_key, expires_at) VALUES (@sessionID, @sealedKey, @expiresAt);`
+
+	_, err := s.db.Exec(query, sql.Named("now", time.Now().UTC()), sql.Named("sessionID", sessionID),
+		sql.Named("sealedKey", sealedKey), sql.Named("expiresAt", expiresAt.UTC()))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			s.lgr.Error(fmt.Sprintf("[Database] [SessionKeys] [Put] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		s.lgr.Debug(fmt.Sprintf("[Database] [SessionKeys] [Put] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	return nil
+}
+
+func (s *sessionKeys) Get(sessionID string) (string, *erx.Erx) {
+	query := `SELECT sealed_key FROM session_keys WHERE session_id = @sessionID AND expires_at > @now`
+
+	var sealedKey string
+
+	row := s.db.QueryRow(query, sql.Named("sessionID", sessionID), sql.Named("now", time.Now().UTC()))
+	err := row.Scan(&sealedKey)
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			s.lgr.Error(fmt.Sprintf("[Database] [SessionKeys] [Get] [Scan] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return "", errx
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			errx = erx.WithArgs(errx, erx.SeverityInfo, custom_errors.NoRowsInResultSet)
+			s.lgr.Info(fmt.Sprintf("[Database] [SessionKeys] [Get] [Scan] [ErrSQLNoResultsInSet] %s", errx.String()))
+			return "", errx
+		}
+		s.lgr.Debug(fmt.Sprintf("[Database] [SessionKeys] [Get] [Scan] %s", errx.Error()))
+		return "", errx
+	}
+
+	return sealedKey, nil
+}
+
+// Extend moves the expiry of a key which has not expired or been deleted, it never brings one back
+func (s *sessionKeys) Extend(sessionID string, expiresAt time.Time) *erx.Erx {
+	query := `UPDATE session_keys SET expires_at = @expiresAt WHERE session_id = @sessionID AND expires_at > @now`
+
+	res, err := s.db.Exec(query, sql.Named("expiresAt", expiresAt.UTC()), sql.Named("sessionID", sessionID),
+		sql.Named("now", time.Now().UTC()))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			s.lgr.Error(fmt.Sprintf("[Database] [SessionKeys] [Extend] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		s.lgr.Debug(fmt.Sprintf("[Database] [SessionKeys] [Extend] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	var count int64
+	if count, err = res.RowsAffected(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			s.lgr.Error(fmt.Sprintf("[Database] [SessionKeys] [Extend] [RowsAffected] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		s.lgr.Debug(fmt.Sprintf("[Database] [SessionKeys] [Extend] [RowsAffected] %s", err.Error()))
+		return errx
+	}
+
+	if count == 0 {
+		return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+	}
+
+	return nil
+}
+
+// Replace swaps the sealed key of a session which has not expired or been deleted, it never brings one back
+func (s *sessionKeys) Replace(sessionID string, sealedKey string, expiresAt time.Time) *erx.Erx {
+	query := `UPDATE session_keys SET sealed_key = @sealedKey, expires_at = @expiresAt WHERE session_id = @sessionID AND expires_at > @now`
+
+	res, err := s.db.Exec(query, sql.Named("sealedKey", sealedKey), sql.Named("expiresAt", expiresAt.UTC()),
+		sql.Named("sessionID", sessionID), sql.Named("now", time.Now().UTC()))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			s.lgr.Error(fmt.Sprintf("[Database] [SessionKeys] [Replace] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		s.lgr.Debug(fmt.Sprintf("[Database] [SessionKeys] [Replace] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	var count int64
+	if count, err = res.RowsAffected(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			s.lgr.Error(fmt.Sprintf("[Database] [SessionKeys] [Replace] [RowsAffected] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		s.lgr.Debug(fmt.Sprintf("[Database] [SessionKeys] [Replace] [RowsAffected] %s", err.Error()))
+		return errx
+	}
+
+	if count == 0 {
+		return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+	}
+
+	return nil
+}
+
+func (s *sessionKeys) Delete(sessionID string) *erx.Erx {
+	query := `DELETE FROM session_keys WHERE session_id = @sessionID`
+
+	_, err := s.db.Exec(query, sql.Named("sessionID", sessionID))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			s.lgr.Error(fmt.Sprintf("[Database] [SessionKeys] [Delete] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		s.lgr.Debug(fmt.Sprintf("[Database] [SessionKeys] [Delete] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	return nil
+}
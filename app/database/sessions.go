@@ -0,0 +1,311 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/types"
+	"go.uber.org/zap"
+)
+
+type SessionsTable interface {
+	Create(session types.Session) *erx.Erx
+	Touch(sessionID string, ipAddress string, userAgent string, lastSeenAt time.Time) *erx.Erx
+	List(userID types.UserID) ([]types.Session, *erx.Erx)
+	Revoke(sessionID string, userID types.UserID) *erx.Erx
+	RevokeAll(userID types.UserID) ([]string, *erx.Erx)
+}
+
+type sessions struct {
+	lgr *zap.Logger
+	db  *sql.DB
+}
+
+func (s *sessions) Create(session types.Session) *erx.Erx {
+	query := `INSERT INTO sessions (session_id, user_id, device_label, user_agent, ip_address, created_at, last_seen_at)
+VALUES (@sessionID, @userID, @deviceLabel, @userAgent, @ipAddress, @createdAt, @createdAt)`
+
+	_, err := s.db.Exec(query, sql.Named("sessionID", session.SessionID), sql.Named("userID", session.UserID),
+		sql.Named("deviceLabel", session.DeviceLabel), sql.Named("userAgent", session.UserAgent),
+		sql.Named("ipAddress", session.IPAddress), sql.Named("createdAt", session.CreatedAt.UTC()))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			s.lgr.Error(fmt.Sprintf("[Database] [Sessions] [Create] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		s.lgr.Debug(fmt.Sprintf("[Database] [Sessions] [Create] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	return nil
+}
+
+// Touch records where and when a live session was last used
+func (s *sessions) Touch(sessionID string, ipAddress string, userAgent string, lastSeenAt time.Time) *erx.Erx {
+	query := `UPDATE sessions SET ip_address = @ipAddress, user_agent = @userAgent, last_seen_at = @lastSeenAt
+WHERE session_id = @sessionID AND revoked = 0`
+
+	res, err := s.db.Exec(query, sql.Named("ipAddress", ipAddress), sql.Named("userAgent", userAgent),
+		sql.Named("lastSeenAt", lastSeenAt.UTC()), sql.Named("sessionID", sessionID))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			s.lgr.Error(fmt.Sprintf("[Database] [Sessions] [Touch] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		s.lgr.Debug(fmt.Sprintf("[Database] [Sessions] [Touch] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	var count int64
+	if count, err = res.RowsAffected(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			s.lgr.Error(fmt.Sprintf("[Database] [Sessions] [Touch] [RowsAffected] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		s.lgr.Debug(fmt.Sprintf("[Database] [Sessions] [Touch] [RowsAffected] %s", err.Error()))
+		return errx
+	}
+
+	if count == 0 {
+		return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+	}
+
+	return nil
+}
+
+// List returns the live sessions of a user, most recently used first
+func (s *sessions) List(userID types.UserID) ([]types.Session, *erx.Erx) {
+	query := `SELECT session_id, device_label, user_agent, ip_address, created_at, last_seen_at FROM sessions
+WHERE user_id = @userID AND revoked = 0 ORDER BY last_seen_at DESC`
+
+	rows, err := s.db.Query(query, sql.Named("userID", userID))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			s.lgr.Error(fmt.Sprintf("[Database] [Sessions] [List] [Query] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		s.lgr.Debug(fmt.Sprintf("[Database] [Sessions] [List] [Query] %s", err.Error()))
+		return nil, errx
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			s.lgr.Debug(fmt.Sprintf("[Database] [Sessions] [List] [Close] %s", err.Error()))
+		}
+	}(rows)
+	sessionList := *new([]types.Session)
+
+	for rows.Next() {
+		session := types.Session{UserID: userID}
+
+		err = rows.Scan(&session.SessionID, &session.DeviceLabel, &session.UserAgent, &session.IPAddress,
+			&session.CreatedAt, &session.LastSeenAt)
+		if err != nil {
+			sqlErr, errx := checkForSQLError(err)
+			if sqlErr != nil {
+				errx = erx.WithArgs(errx, erx.SeverityError)
+				s.lgr.Error(fmt.Sprintf("[Database] [Sessions] [List] [Scan] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+				return nil, errx
+			}
+			s.lgr.Debug(fmt.Sprintf("[Database] [Sessions] [List] [Scan] %s", err.Error()))
+			return nil, errx
+		}
+
+		sessionList = append(sessionList, session)
+	}
+
+	if err := rows.Err(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			s.lgr.Error(fmt.Sprintf("[Database] [Sessions] [List] [Err] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		s.lgr.Debug(fmt.Sprintf("[Database] [Sessions] [List] [Err] %s", err.Error()))
+		return nil, errx
+	}
+
+	return sessionList, nil
+}
+
+// Revoke marks a session of the user as revoked along with every refresh token of its family
+func (s *sessions) Revoke(sessionID string, userID types.UserID) *erx.Erx {
+	sessionQuery := `UPDATE sessions SET revoked = 1 WHERE session_id = @sessionID AND user_id = @userID AND revoked = 0`
+	tokensQuery := `UPDATE refresh_tokens SET revoked = 1 WHERE family_id = @sessionID AND user_id = @userID`
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			s.lgr.Error(fmt.Sprintf("[Database] [Sessions] [Revoke] [Begin] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		s.lgr.Debug(fmt.Sprintf("[Database] [Sessions] [Revoke] [Begin] %s", err.Error()))
+		return errx
+	}
+	defer rollback(tx, "Revoke", s.lgr)
+
+	res, err := tx.Exec(sessionQuery, sql.Named("sessionID", sessionID), sql.Named("userID", userID))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			s.lgr.Error(fmt.Sprintf("[Database] [Sessions] [Revoke] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		s.lgr.Debug(fmt.Sprintf("[Database] [Sessions] [Revoke] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	var count int64
+	if count, err = res.RowsAffected(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			s.lgr.Error(fmt.Sprintf("[Database] [Sessions] [Revoke] [RowsAffected] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		s.lgr.Debug(fmt.Sprintf("[Database] [Sessions] [Revoke] [RowsAffected] %s", err.Error()))
+		return errx
+	}
+
+	if count == 0 {
+		return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+	}
+
+	if _, err = tx.Exec(tokensQuery, sql.Named("sessionID", sessionID), sql.Named("userID", userID)); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			s.lgr.Error(fmt.Sprintf("[Database] [Sessions] [Revoke] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		s.lgr.Debug(fmt.Sprintf("[Database] [Sessions] [Revoke] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	if err = tx.Commit(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			s.lgr.Error(fmt.Sprintf("[Database] [Sessions] [Revoke] [Commit] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		s.lgr.Debug(fmt.Sprintf("[Database] [Sessions] [Revoke] [Commit] %s", err.Error()))
+		return errx
+	}
+
+	return nil
+}
+
+// RevokeAll revokes every live session of a user, returning their ids
+func (s *sessions) RevokeAll(userID types.UserID) ([]string, *erx.Erx) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			s.lgr.Error(fmt.Sprintf("[Database] [Sessions] [RevokeAll] [Begin] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		s.lgr.Debug(fmt.Sprintf("[Database] [Sessions] [RevokeAll] [Begin] %s", err.Error()))
+		return nil, errx
+	}
+	defer rollback(tx, "RevokeAll", s.lgr)
+
+	sessionIDs, errx := revokeAllSessions(tx, userID, "RevokeAll", s.lgr)
+	if errx != nil {
+		return nil, errx
+	}
+
+	if err = tx.Commit(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			s.lgr.Error(fmt.Sprintf("[Database] [Sessions] [RevokeAll] [Commit] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		s.lgr.Debug(fmt.Sprintf("[Database] [Sessions] [RevokeAll] [Commit] %s", err.Error()))
+		return nil, errx
+	}
+
+	return sessionIDs, nil
+}
+
+// revokeAllSessions revokes the sessions and refresh tokens of a user inside tx, returning the revoked session ids
+func revokeAllSessions(tx *sql.Tx, userID types.UserID, caller string, lgr *zap.Logger) ([]string, *erx.Erx) {
+	sessionsQuery := `UPDATE sessions SET revoked = 1 OUTPUT inserted.session_id WHERE user_id = @userID AND revoked = 0`
+	tokensQuery := `UPDATE refresh_tokens SET revoked = 1 WHERE user_id = @userID AND revoked = 0`
+
+	rows, err := tx.Query(sessionsQuery, sql.Named("userID", userID))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			lgr.Error(fmt.Sprintf("[Database] [Sessions] [%s] [Query] [sqlErr] %d : %s", caller, sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		lgr.Debug(fmt.Sprintf("[Database] [Sessions] [%s] [Query] %s", caller, err.Error()))
+		return nil, errx
+	}
+
+	sessionIDs := *new([]string)
+	for rows.Next() {
+		var sessionID string
+
+		if err = rows.Scan(&sessionID); err != nil {
+			_ = rows.Close()
+			sqlErr, errx := checkForSQLError(err)
+			if sqlErr != nil {
+				errx = erx.WithArgs(errx, erx.SeverityError)
+				lgr.Error(fmt.Sprintf("[Database] [Sessions] [%s] [Scan] [sqlErr] %d : %s", caller, sqlErr.Number, sqlErr.Error()))
+				return nil, errx
+			}
+			lgr.Debug(fmt.Sprintf("[Database] [Sessions] [%s] [Scan] %s", caller, err.Error()))
+			return nil, errx
+		}
+
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+
+	// The rows have to be closed before the transaction can run another statement
+	if err = rows.Close(); err == nil {
+		err = rows.Err()
+	}
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			lgr.Error(fmt.Sprintf("[Database] [Sessions] [%s] [Err] [sqlErr] %d : %s", caller, sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		lgr.Debug(fmt.Sprintf("[Database] [Sessions] [%s] [Err] %s", caller, err.Error()))
+		return nil, errx
+	}
+
+	if _, err = tx.Exec(tokensQuery, sql.Named("userID", userID)); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			lgr.Error(fmt.Sprintf("[Database] [Sessions] [%s] [Exec] [sqlErr] %d : %s", caller, sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		lgr.Debug(fmt.Sprintf("[Database] [Sessions] [%s] [Exec] %s", caller, err.Error()))
+		return nil, errx
+	}
+
+	return sessionIDs, nil
+}
@@ -0,0 +1,187 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/types"
+	"go.uber.org/zap"
+)
+
+type TwoFactorTable interface {
+	GetTOTP(userID types.UserID) (types.TOTP, *erx.Erx)
+	SetTOTPSecret(userID types.UserID, secret string) *erx.Erx
+	EnableTOTP(userID types.UserID, step int64, backupCodeHashes []string) *erx.Erx
+	DisableTOTP(userID types.UserID) *erx.Erx
+	UseTOTPStep(userID types.UserID, step int64) *erx.Erx
+	UseBackupCode(userID types.UserID, codeHash string) *erx.Erx
+}
+
+type twoFactor struct {
+	lgr *zap.Logger
+	db  *sql.DB
+}
+
+func (t *twoFactor) GetTOTP(userID types.UserID) (types.TOTP, *erx.Erx) {
+	query := `SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE user_id = @userID`
+
+	var secret sql.NullString
+	var totp types.TOTP
+
+	row := t.db.QueryRow(query, sql.Named("userID", userID))
+	err := row.Scan(&secret, &totp.Enabled, &totp.LastStep)
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			t.lgr.Error(fmt.Sprintf("[Database] [TwoFactor] [GetTOTP] [Scan] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return types.TOTP{}, errx
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			errx = erx.WithArgs(errx, erx.SeverityInfo, custom_errors.NoRowsInResultSet)
+			t.lgr.Info(fmt.Sprintf("[Database] [TwoFactor] [GetTOTP] [Scan] [ErrSQLNoResultsInSet] %s", errx.String()))
+			return types.TOTP{}, errx
+		}
+		t.lgr.Debug(fmt.Sprintf("[Database] [TwoFactor] [GetTOTP] [Scan] %s", errx.Error()))
+		return types.TOTP{}, errx
+	}
+
+	totp.Secret = secret.String
+	return totp, nil
+}
+
+// SetTOTPSecret stores a new, not yet confirmed, secret; it never replaces the secret of enabled 2FA
+func (t *twoFactor) SetTOTPSecret(userID types.UserID, secret string) *erx.Erx {
+	query := `UPDATE users SET totp_secret = @secret, totp_last_step = 0 WHERE user_id = @userID AND totp_enabled = 0`
+
+	return t.execOne("SetTOTPSecret", query, sql.Named("secret", secret), sql.Named("userID", userID))
+}
+
+// EnableTOTP turns on a confirmed secret and replaces the backup codes in one transaction
+func (t *twoFactor) EnableTOTP(userID types.UserID, step int64, backupCodeHashes []string) *erx.Erx {
+	enableQuery := `UPDATE users SET totp_enabled = 1, totp_last_step = @step
+WHERE user_id = @userID AND totp_enabled = 0 AND totp_secret IS NOT NULL`
+	clearQuery := `DELETE FROM totp_backup_codes WHERE user_id = @userID`
+	insertQuery := `INSERT INTO totp_backup_codes (user_id, code_hash) VALUES (@userID, @codeHash)`
+
+	tx, err := t.db.Begin()
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			t.lgr.Error(fmt.Sprintf("[Database] [TwoFactor] [EnableTOTP] [Begin] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		t.lgr.Debug(fmt.Sprintf("[Database] [TwoFactor] [EnableTOTP] [Begin] %s", err.Error()))
+		return errx
+	}
+	defer rollback(tx, "EnableTOTP", t.lgr)
+
+	res, err := tx.Exec(enableQuery, sql.Named("step", step), sql.Named("userID", userID))
+	if err == nil {
+		var count int64
+		if count, err = res.RowsAffected(); err == nil && count == 0 {
+			return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec(clearQuery, sql.Named("userID", userID))
+	}
+	for i := 0; err == nil && i < len(backupCodeHashes); i++ {
+		_, err = tx.Exec(insertQuery, sql.Named("userID", userID), sql.Named("codeHash", backupCodeHashes[i]))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			t.lgr.Error(fmt.Sprintf("[Database] [TwoFactor] [EnableTOTP] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		t.lgr.Debug(fmt.Sprintf("[Database] [TwoFactor] [EnableTOTP] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	return nil
+}
+
+// DisableTOTP removes the secret along with any unused backup codes
+func (t *twoFactor) DisableTOTP(userID types.UserID) *erx.Erx {
+	query := `UPDATE users SET totp_secret = NULL, totp_enabled = 0, totp_last_step = 0 WHERE user_id = @userID;
+DELETE FROM totp_backup_codes WHERE user_id = @userID;`
+
+	tx, err := t.db.Begin()
+	if err == nil {
+		defer rollback(tx, "DisableTOTP", t.lgr)
+		if _, err = tx.Exec(query, sql.Named("userID", userID)); err == nil {
+			err = tx.Commit()
+		}
+	}
+
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			t.lgr.Error(fmt.Sprintf("[Database] [TwoFactor] [DisableTOTP] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		t.lgr.Debug(fmt.Sprintf("[Database] [TwoFactor] [DisableTOTP] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	return nil
+}
+
+// UseTOTPStep records the time step of an accepted code, failing if it or a later step was already used
+// so a code can not be replayed within its validity window
+func (t *twoFactor) UseTOTPStep(userID types.UserID, step int64) *erx.Erx {
+	query := `UPDATE users SET totp_last_step = @step WHERE user_id = @userID AND totp_enabled = 1 AND totp_last_step < @step`
+
+	return t.execOne("UseTOTPStep", query, sql.Named("step", step), sql.Named("userID", userID))
+}
+
+// UseBackupCode consumes a backup code, failing if it does not exist or was already used
+func (t *twoFactor) UseBackupCode(userID types.UserID, codeHash string) *erx.Erx {
+	query := `DELETE FROM totp_backup_codes WHERE user_id = @userID AND code_hash = @codeHash`
+
+	return t.execOne("UseBackupCode", query, sql.Named("userID", userID), sql.Named("codeHash", codeHash))
+}
+
+// execOne runs a statement which has to affect at least one row
+func (t *twoFactor) execOne(caller string, query string, args ...interface{}) *erx.Erx {
+	res, err := t.db.Exec(query, args...)
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			t.lgr.Error(fmt.Sprintf("[Database] [TwoFactor] [%s] [Exec] [sqlErr] %d : %s", caller, sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		t.lgr.Debug(fmt.Sprintf("[Database] [TwoFactor] [%s] [Exec] %s", caller, err.Error()))
+		return errx
+	}
+
+	var count int64
+	if count, err = res.RowsAffected(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			t.lgr.Error(fmt.Sprintf("[Database] [TwoFactor] [%s] [RowsAffected] [sqlErr] %d : %s", caller, sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		t.lgr.Debug(fmt.Sprintf("[Database] [TwoFactor] [%s] [RowsAffected] %s", caller, err.Error()))
+		return errx
+	}
+
+	if count == 0 {
+		return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+	}
+
+	return nil
+}
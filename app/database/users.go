@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/nsnikhil/erx"
 	"github.com/sid-sun/arche-api/app/custom_errors"
@@ -13,10 +14,20 @@ import (
 
 type UsersTable interface {
 	Get(emailID string) (types.User, *erx.Erx)
-	GetVerificationStatus(emailID string) (bool, string, *erx.Erx)
+	GetByID(userID types.UserID) (types.User, *erx.Erx)
+	UpdateEncryptionKey(userID types.UserID, encryptionKey string, kdfSalt string, kdfParams string, srp types.SRPVerifier) ([]string, *erx.Erx)
+	UpgradeEncryptionKey(userID types.UserID, encryptionKey string, kdfSalt string, kdfParams string) *erx.Erx
+	RecoverAccount(userID types.UserID, encryptionKey string, kdfSalt string, kdfParams string, recovery types.KeyWrap, srp types.SRPVerifier) ([]string, *erx.Erx)
+	SetSRPVerifier(userID types.UserID, srp types.SRPVerifier) *erx.Erx
+	UpdateRecoveryKey(userID types.UserID, recovery types.KeyWrap) *erx.Erx
+	Delete(userID types.UserID) ([]string, *erx.Erx)
+	SetPendingEmail(userID types.UserID, emailID string, vetkn string) *erx.Erx
+	ConfirmEmailChange(vetkn string, notBefore time.Time) *erx.Erx
+	GetVerificationStatus(emailID string) (bool, *erx.Erx)
 	UpdateVerificationToken(emailID string, vetkn string) *erx.Erx
-	Create(emailID string, encryptionKey string, keyHash string, vetkn string) (types.UserID, *erx.Erx)
-	VerifyUser(vetkn string) *erx.Erx
+	Create(emailID string, encryptionKey string, keyHash string, kdfSalt string, kdfParams string, recovery types.KeyWrap, srp types.SRPVerifier, keyBundle string, vetkn string) (types.UserID, *erx.Erx)
+	UpdateKeyBundle(userID types.UserID, keyBundle string) *erx.Erx
+	VerifyUser(vetkn string, notBefore time.Time) (types.UserID, *erx.Erx)
 }
 
 type users struct {
@@ -24,23 +35,72 @@ type users struct {
 	db  *sql.DB
 }
 
-func (u *users) VerifyUser(vetkn string) *erx.Erx {
-	query := `UPDATE users SET verified = 1 WHERE verification_key=@veKey;`
+// VerifyUser marks the user holding the hashed token vetkn as verified and clears the token, so it works once
+// Tokens issued before notBefore are rejected with VerificationTokenExpired
+func (u *users) VerifyUser(vetkn string, notBefore time.Time) (types.UserID, *erx.Erx) {
+	query := `UPDATE users SET verified = 1, verification_key = NULL, verification_issued_at = NULL
+OUTPUT inserted.user_id
+WHERE verification_key = @veKey AND verification_issued_at >= @notBefore;`
 
-	res, err := u.db.Exec(query, sql.Named("veKey", vetkn))
+	var userID types.UserID
+	err := u.db.QueryRow(query, sql.Named("veKey", vetkn), sql.Named("notBefore", notBefore.UTC())).Scan(&userID)
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, u.rejectVerificationToken("VerifyUser", "verification_key", vetkn)
+		}
 		sqlErr, errx := checkForSQLError(err)
 		if sqlErr != nil {
 			errx = erx.WithArgs(errx, erx.SeverityError)
 			u.lgr.Error(fmt.Sprintf("[Database] [Users] [VerifyUser] [Scan] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return 0, errx
+		}
+		u.lgr.Debug(fmt.Sprintf("[Database] [Users] [VerifyUser] [Scan] %s", errx.Error()))
+		return 0, errx
+	}
+
+	return userID, nil
+}
+
+// rejectVerificationToken tells apart a token that expired from one that was never issued or is already used,
+// column is one of the token columns of the users table
+func (u *users) rejectVerificationToken(caller string, column string, vetkn string) *erx.Erx {
+	query := fmt.Sprintf(`SELECT COUNT(1) FROM users WHERE %s = @veKey`, column)
+
+	var count int
+	err := u.db.QueryRow(query, sql.Named("veKey", vetkn)).Scan(&count)
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			u.lgr.Error(fmt.Sprintf("[Database] [Users] [%s] [Scan] [sqlErr] %d : %s", caller, sqlErr.Number, sqlErr.Error()))
 			return errx
 		}
-		if errors.Is(err, sql.ErrNoRows) {
-			errx = erx.WithArgs(errx, erx.SeverityInfo, custom_errors.NoRowsInResultSet)
-			u.lgr.Info(fmt.Sprintf("[Database] [Users] [VerifyUser] [Scan] [ErrSQLNoResultsInSet] %s", errx.String()))
+		u.lgr.Debug(fmt.Sprintf("[Database] [Users] [%s] [Scan] %s", caller, err.Error()))
+		return errx
+	}
+
+	if count == 0 {
+		return erx.WithArgs(custom_errors.InvalidVerificationToken, erx.SeverityInfo)
+	}
+	return erx.WithArgs(custom_errors.VerificationTokenExpired, erx.SeverityInfo)
+}
+
+// SetPendingEmail records the address a user wants to move to, along with the token that confirms it
+// A newer request replaces an older one that was never confirmed
+func (u *users) SetPendingEmail(userID types.UserID, emailID string, vetkn string) *erx.Erx {
+	query := `UPDATE users SET pending_email = @email, email_change_key = @veKey, email_change_issued_at = @issuedAt
+WHERE user_id = @userID`
+
+	res, err := u.db.Exec(query, sql.Named("email", emailID), sql.Named("veKey", vetkn),
+		sql.Named("issuedAt", time.Now().UTC()), sql.Named("userID", userID))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			u.lgr.Error(fmt.Sprintf("[Database] [Users] [SetPendingEmail] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
 			return errx
 		}
-		u.lgr.Debug(fmt.Sprintf("[Database] [Users] [VerifyUser] [Scan] %s", errx.Error()))
+		u.lgr.Debug(fmt.Sprintf("[Database] [Users] [SetPendingEmail] [Exec] %s", err.Error()))
 		return errx
 	}
 
@@ -49,10 +109,10 @@ func (u *users) VerifyUser(vetkn string) *erx.Erx {
 		sqlErr, errx := checkForSQLError(err)
 		if sqlErr != nil {
 			errx = erx.WithArgs(errx, erx.SeverityError)
-			u.lgr.Error(fmt.Sprintf("[Database] [Users] [VerifyUser] [RowsAffected] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			u.lgr.Error(fmt.Sprintf("[Database] [Users] [SetPendingEmail] [RowsAffected] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
 			return errx
 		}
-		u.lgr.Debug(fmt.Sprintf("[Database] [Users] [VerifyUser] [RowsAffected] %s", err.Error()))
+		u.lgr.Debug(fmt.Sprintf("[Database] [Users] [SetPendingEmail] [RowsAffected] %s", err.Error()))
 		return errx
 	}
 
@@ -63,10 +123,54 @@ func (u *users) VerifyUser(vetkn string) *erx.Erx {
 	return nil
 }
 
+// ConfirmEmailChange moves the user holding the hashed token vetkn over to their pending address
+// The address may have been taken since the change was requested, which surfaces as DuplicateRecordInsertion
+func (u *users) ConfirmEmailChange(vetkn string, notBefore time.Time) *erx.Erx {
+	query := `UPDATE users SET email = pending_email, pending_email = NULL, email_change_key = NULL, email_change_issued_at = NULL
+WHERE email_change_key = @veKey AND email_change_issued_at >= @notBefore AND pending_email IS NOT NULL`
+
+	res, err := u.db.Exec(query, sql.Named("veKey", vetkn), sql.Named("notBefore", notBefore.UTC()))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			switch sqlErr.Number {
+			case 2601:
+				errx = erx.WithArgs(errx, custom_errors.DuplicateRecordInsertion, erx.SeverityInfo)
+				u.lgr.Info(fmt.Sprintf("[Database] [Users] [ConfirmEmailChange] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			default:
+				errx = erx.WithArgs(errx, erx.SeverityError)
+				u.lgr.Error(fmt.Sprintf("[Database] [Users] [ConfirmEmailChange] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			}
+			return errx
+		}
+		u.lgr.Debug(fmt.Sprintf("[Database] [Users] [ConfirmEmailChange] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	var count int64
+	if count, err = res.RowsAffected(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			u.lgr.Error(fmt.Sprintf("[Database] [Users] [ConfirmEmailChange] [RowsAffected] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		u.lgr.Debug(fmt.Sprintf("[Database] [Users] [ConfirmEmailChange] [RowsAffected] %s", err.Error()))
+		return errx
+	}
+
+	if count == 0 {
+		return u.rejectVerificationToken("ConfirmEmailChange", "email_change_key", vetkn)
+	}
+
+	return nil
+}
+
+// UpdateVerificationToken replaces the hashed verification token of a user, restarting its lifetime
 func (u *users) UpdateVerificationToken(emailID string, vetkn string) *erx.Erx {
-	query := `UPDATE users SET verification_key = @veKey WHERE email=@email`
+	query := `UPDATE users SET verification_key = @veKey, verification_issued_at = @issuedAt WHERE email=@email`
 
-	_, err := u.db.Exec(query, sql.Named("email", emailID), sql.Named("veKey", vetkn))
+	_, err := u.db.Exec(query, sql.Named("email", emailID), sql.Named("veKey", vetkn), sql.Named("issuedAt", time.Now().UTC()))
 	if err != nil {
 		sqlErr, errx := checkForSQLError(err)
 		if sqlErr != nil {
@@ -86,43 +190,50 @@ func (u *users) UpdateVerificationToken(emailID string, vetkn string) *erx.Erx {
 	return nil
 }
 
-func (u *users) GetVerificationStatus(emailID string) (bool, string, *erx.Erx) {
-	query := `SELECT verified, verification_key FROM users WHERE email=@email;`
+func (u *users) GetVerificationStatus(emailID string) (bool, *erx.Erx) {
+	query := `SELECT verified FROM users WHERE email=@email;`
 
 	var verified bool
-	var verificationKey sql.NullString
 
 	row := u.db.QueryRow(query, sql.Named("email", emailID))
-	err := row.Scan(&verified, &verificationKey)
+	err := row.Scan(&verified)
 	if err != nil {
 		sqlErr, errx := checkForSQLError(err)
 		if sqlErr != nil {
 			errx = erx.WithArgs(errx, erx.SeverityError)
 			u.lgr.Error(fmt.Sprintf("[Database] [Users] [GetVerificationStatus] [Scan] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
-			return false, "", errx
+			return false, errx
 		}
 		if errors.Is(err, sql.ErrNoRows) {
 			errx = erx.WithArgs(errx, erx.SeverityInfo, custom_errors.NoRowsInResultSet)
 			u.lgr.Info(fmt.Sprintf("[Database] [Users] [GetVerificationStatus] [Scan] [ErrSQLNoResultsInSet] %s", errx.String()))
-			return false, "", errx
+			return false, errx
 		}
 		u.lgr.Debug(fmt.Sprintf("[Database] [Users] [GetVerificationStatus] [Scan] %s", errx.Error()))
-		return false, "", errx
+		return false, errx
 	}
 
-	return verified, verificationKey.String, nil
+	return verified, nil
 }
 
 func (u *users) Get(emailID string) (types.User, *erx.Erx) {
-	query := `SELECT user_id, encryption_key, key_hash, verification_key, verified FROM users WHERE email=@email;`
+	query := `SELECT user_id, encryption_key, key_hash, kdf_salt, kdf_params,
+recovery_key, recovery_kdf_salt, recovery_kdf_params, vault_key, vault_kdf_salt, vault_kdf_params, verification_key, verified, totp_enabled,
+CAST(CASE WHEN EXISTS (SELECT 1 FROM webauthn_credentials c WHERE c.user_id = users.user_id) THEN 1 ELSE 0 END AS bit),
+CAST(CASE WHEN EXISTS (SELECT 1 FROM key_rotations r WHERE r.user_id = users.user_id) THEN 1 ELSE 0 END AS bit), key_bundle,
+srp_salt, srp_verifier, srp_kdf_params FROM users WHERE email=@email;`
 
 	var userID types.UserID
 	var encryptionKey, keyHash string
-	var verificationKey sql.NullString
-	var verificationStatus bool
+	var kdfSalt, kdfParams, verificationKey sql.NullString
+	var recoveryKey, recoverySalt, recoveryParams sql.NullString
+	var vaultKey, vaultSalt, vaultParams, keyBundle sql.NullString
+	var srpSalt, srpVerifier, srpParams sql.NullString
+	var verificationStatus, totpEnabled, webAuthnEnabled, keyRotationPending bool
 
 	row := u.db.QueryRow(query, sql.Named("email", emailID))
-	err := row.Scan(&userID, &encryptionKey, &keyHash, &verificationKey, &verificationStatus)
+	err := row.Scan(&userID, &encryptionKey, &keyHash, &kdfSalt, &kdfParams, &recoveryKey, &recoverySalt, &recoveryParams, &vaultKey, &vaultSalt, &vaultParams, &verificationKey, &verificationStatus, &totpEnabled, &webAuthnEnabled, &keyRotationPending, &keyBundle,
+		&srpSalt, &srpVerifier, &srpParams)
 	if err != nil {
 		sqlErr, errx := checkForSQLError(err)
 		if sqlErr != nil {
@@ -140,23 +251,373 @@ func (u *users) Get(emailID string) (types.User, *erx.Erx) {
 	}
 
 	return types.User{
-		ID:              userID,
-		Email:           emailID,
-		EncryptionKey:   encryptionKey,
-		KeyHash:         keyHash,
-		VerificationKey: verificationKey.String,
-		Verified:        verificationStatus,
+		ID:            userID,
+		Email:         emailID,
+		EncryptionKey: encryptionKey,
+		KeyHash:       keyHash,
+		KDFSalt:       kdfSalt.String,
+		KDFParams:     kdfParams.String,
+		Recovery: types.KeyWrap{
+			Key:    recoveryKey.String,
+			Salt:   recoverySalt.String,
+			Params: recoveryParams.String,
+		},
+		Vault: types.KeyWrap{
+			Key:    vaultKey.String,
+			Salt:   vaultSalt.String,
+			Params: vaultParams.String,
+		},
+		SRP: types.SRPVerifier{
+			Salt:     srpSalt.String,
+			Verifier: srpVerifier.String,
+			Params:   srpParams.String,
+		},
+		VerificationKey:    verificationKey.String,
+		Verified:           verificationStatus,
+		TOTPEnabled:        totpEnabled,
+		WebAuthnEnabled:    webAuthnEnabled,
+		KeyRotationPending: keyRotationPending,
+		ZeroKnowledge:      keyBundle.Valid,
+		KeyBundle:          keyBundle.String,
+	}, nil
+}
+
+func (u *users) GetByID(userID types.UserID) (types.User, *erx.Erx) {
+	query := `SELECT email, encryption_key, key_hash, kdf_salt, kdf_params,
+recovery_key, recovery_kdf_salt, recovery_kdf_params, vault_key, vault_kdf_salt, vault_kdf_params, verification_key, verified, totp_enabled,
+CAST(CASE WHEN EXISTS (SELECT 1 FROM webauthn_credentials c WHERE c.user_id = users.user_id) THEN 1 ELSE 0 END AS bit),
+CAST(CASE WHEN EXISTS (SELECT 1 FROM key_rotations r WHERE r.user_id = users.user_id) THEN 1 ELSE 0 END AS bit), key_bundle,
+srp_salt, srp_verifier, srp_kdf_params FROM users WHERE user_id=@userID;`
+
+	var email, encryptionKey, keyHash string
+	var kdfSalt, kdfParams, verificationKey sql.NullString
+	var recoveryKey, recoverySalt, recoveryParams sql.NullString
+	var vaultKey, vaultSalt, vaultParams, keyBundle sql.NullString
+	var srpSalt, srpVerifier, srpParams sql.NullString
+	var verificationStatus, totpEnabled, webAuthnEnabled, keyRotationPending bool
+
+	row := u.db.QueryRow(query, sql.Named("userID", userID))
+	err := row.Scan(&email, &encryptionKey, &keyHash, &kdfSalt, &kdfParams, &recoveryKey, &recoverySalt, &recoveryParams, &vaultKey, &vaultSalt, &vaultParams, &verificationKey, &verificationStatus, &totpEnabled, &webAuthnEnabled, &keyRotationPending, &keyBundle,
+		&srpSalt, &srpVerifier, &srpParams)
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			u.lgr.Error(fmt.Sprintf("[Database] [Users] [GetByID] [Scan] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return types.User{}, errx
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			errx = erx.WithArgs(errx, erx.SeverityInfo, custom_errors.NoRowsInResultSet)
+			u.lgr.Info(fmt.Sprintf("[Database] [Users] [GetByID] [Scan] [ErrSQLNoResultsInSet] %s", errx.String()))
+			return types.User{}, errx
+		}
+		u.lgr.Debug(fmt.Sprintf("[Database] [Users] [GetByID] [Scan] %s", errx.Error()))
+		return types.User{}, errx
+	}
+
+	return types.User{
+		ID:            userID,
+		Email:         email,
+		EncryptionKey: encryptionKey,
+		KeyHash:       keyHash,
+		KDFSalt:       kdfSalt.String,
+		KDFParams:     kdfParams.String,
+		Recovery: types.KeyWrap{
+			Key:    recoveryKey.String,
+			Salt:   recoverySalt.String,
+			Params: recoveryParams.String,
+		},
+		Vault: types.KeyWrap{
+			Key:    vaultKey.String,
+			Salt:   vaultSalt.String,
+			Params: vaultParams.String,
+		},
+		SRP: types.SRPVerifier{
+			Salt:     srpSalt.String,
+			Verifier: srpVerifier.String,
+			Params:   srpParams.String,
+		},
+		VerificationKey:    verificationKey.String,
+		Verified:           verificationStatus,
+		TOTPEnabled:        totpEnabled,
+		WebAuthnEnabled:    webAuthnEnabled,
+		KeyRotationPending: keyRotationPending,
+		ZeroKnowledge:      keyBundle.Valid,
+		KeyBundle:          keyBundle.String,
 	}, nil
 }
 
-func (u *users) Create(emailID string, encryptionKey string, keyHash string, vetkn string) (types.UserID, *erx.Erx) {
-	query := `INSERT INTO users (email, encryption_key, key_hash, verification_key) OUTPUT inserted.user_id
-	VALUES (@email, @key, @hash, @veKey);`
+// UpdateEncryptionKey stores a data key re-wrapped under a new password along with the password's SRP verifier
+// and revokes every refresh token of the user in one transaction, returning the session ids which were revoked
+func (u *users) UpdateEncryptionKey(userID types.UserID, encryptionKey string, kdfSalt string, kdfParams string, srp types.SRPVerifier) ([]string, *erx.Erx) {
+	return u.updateEncryptionKey("UpdateEncryptionKey", true, userID, encryptionKey, kdfSalt, kdfParams, nil, &srp)
+}
+
+// UpgradeEncryptionKey stores a data key re-wrapped under the same password with stronger KDF parameters
+// Unlike UpdateEncryptionKey, outstanding refresh tokens stay valid
+func (u *users) UpgradeEncryptionKey(userID types.UserID, encryptionKey string, kdfSalt string, kdfParams string) *erx.Erx {
+	_, errx := u.updateEncryptionKey("UpgradeEncryptionKey", false, userID, encryptionKey, kdfSalt, kdfParams, nil, nil)
+	return errx
+}
+
+// RecoverAccount stores a data key re-wrapped under a new password along with a new recovery wrap and the
+// password's SRP verifier, revoking every session of the user in the same transaction
+func (u *users) RecoverAccount(userID types.UserID, encryptionKey string, kdfSalt string, kdfParams string, recovery types.KeyWrap, srp types.SRPVerifier) ([]string, *erx.Erx) {
+	return u.updateEncryptionKey("RecoverAccount", true, userID, encryptionKey, kdfSalt, kdfParams, &recovery, &srp)
+}
+
+// SetSRPVerifier stores the SRP verifier of the user's current password
+func (u *users) SetSRPVerifier(userID types.UserID, srp types.SRPVerifier) *erx.Erx {
+	query := `UPDATE users SET srp_salt = @srpSalt, srp_verifier = @srpVerifier, srp_kdf_params = @srpParams WHERE user_id = @userID`
+
+	res, err := u.db.Exec(query, sql.Named("srpSalt", srp.Salt), sql.Named("srpVerifier", srp.Verifier),
+		sql.Named("srpParams", srp.Params), sql.Named("userID", userID))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			u.lgr.Error(fmt.Sprintf("[Database] [Users] [SetSRPVerifier] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		u.lgr.Debug(fmt.Sprintf("[Database] [Users] [SetSRPVerifier] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	var count int64
+	if count, err = res.RowsAffected(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			u.lgr.Error(fmt.Sprintf("[Database] [Users] [SetSRPVerifier] [RowsAffected] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		u.lgr.Debug(fmt.Sprintf("[Database] [Users] [SetSRPVerifier] [RowsAffected] %s", err.Error()))
+		return errx
+	}
+
+	if count == 0 {
+		return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+	}
+
+	return nil
+}
+
+func (u *users) UpdateRecoveryKey(userID types.UserID, recovery types.KeyWrap) *erx.Erx {
+	query := `UPDATE users SET recovery_key = @recoveryKey, recovery_kdf_salt = @recoverySalt, recovery_kdf_params = @recoveryParams
+WHERE user_id = @userID`
+
+	res, err := u.db.Exec(query, sql.Named("recoveryKey", recovery.Key), sql.Named("recoverySalt", recovery.Salt),
+		sql.Named("recoveryParams", recovery.Params), sql.Named("userID", userID))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			u.lgr.Error(fmt.Sprintf("[Database] [Users] [UpdateRecoveryKey] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		u.lgr.Debug(fmt.Sprintf("[Database] [Users] [UpdateRecoveryKey] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	var count int64
+	if count, err = res.RowsAffected(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			u.lgr.Error(fmt.Sprintf("[Database] [Users] [UpdateRecoveryKey] [RowsAffected] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		u.lgr.Debug(fmt.Sprintf("[Database] [Users] [UpdateRecoveryKey] [RowsAffected] %s", err.Error()))
+		return errx
+	}
+
+	if count == 0 {
+		return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+	}
+
+	return nil
+}
+
+// Delete erases the user with every note, folder, second factor, session and refresh token they own in one
+// transaction, returning the ids of the sessions that were live. An anonymous record of the deletion is kept
+// which holds neither the user id nor the email address
+func (u *users) Delete(userID types.UserID) ([]string, *erx.Erx) {
+	tokensQuery := `DELETE FROM note_tokens WHERE note_id IN
+(SELECT note_id FROM notes WHERE folder_id IN (SELECT folder_id FROM folders WHERE user_id = @userID))`
+	notesQuery := `DELETE FROM notes WHERE folder_id IN (SELECT folder_id FROM folders WHERE user_id = @userID)`
+	foldersQuery := `DELETE FROM folders WHERE user_id = @userID`
+	credentialsQueries := []string{
+		`DELETE FROM totp_backup_codes WHERE user_id = @userID`,
+		`DELETE FROM webauthn_credentials WHERE user_id = @userID`,
+		`DELETE FROM access_tokens WHERE user_id = @userID`,
+		`DELETE FROM user_identities WHERE user_id = @userID`,
+		`DELETE FROM key_rotations WHERE user_id = @userID`,
+		`DELETE FROM refresh_tokens WHERE user_id = @userID`,
+		`DELETE FROM sessions WHERE user_id = @userID`,
+	}
+	// The audit log holds addresses and user agents, so it is erased along with the rest of the account
+	auditQuery := `DELETE FROM audit_events WHERE user_id = @userID`
+	userQuery := `DELETE FROM users WHERE user_id = @userID`
+	recordQuery := `INSERT INTO account_deletions (deleted_at, notes_deleted, folders_deleted) VALUES (@deletedAt, @notes, @folders)`
+
+	tx, err := u.db.Begin()
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			u.lgr.Error(fmt.Sprintf("[Database] [Users] [Delete] [Begin] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		u.lgr.Debug(fmt.Sprintf("[Database] [Users] [Delete] [Begin] %s", err.Error()))
+		return nil, errx
+	}
+	defer rollback(tx, "Delete", u.lgr)
+
+	// Revoking first hands back the live session ids, so their keys can be dropped from the key store
+	sessionIDs, errx := revokeAllSessions(tx, userID, "Delete", u.lgr)
+	if errx != nil {
+		return nil, errx
+	}
+
+	if _, errx = execInTx(tx, "Users", "Delete", u.lgr, tokensQuery, sql.Named("userID", userID)); errx != nil {
+		return nil, errx
+	}
+
+	notesDeleted, errx := execInTx(tx, "Users", "Delete", u.lgr, notesQuery, sql.Named("userID", userID))
+	if errx != nil {
+		return nil, errx
+	}
+
+	foldersDeleted, errx := execInTx(tx, "Users", "Delete", u.lgr, foldersQuery, sql.Named("userID", userID))
+	if errx != nil {
+		return nil, errx
+	}
+
+	for _, query := range credentialsQueries {
+		if _, errx = execInTx(tx, "Users", "Delete", u.lgr, query, sql.Named("userID", userID)); errx != nil {
+			return nil, errx
+		}
+	}
+
+	if _, errx = execInTx(tx, "Users", "Delete", u.lgr, auditQuery, sql.Named("userID", userID)); errx != nil {
+		return nil, errx
+	}
+
+	count, errx := execInTx(tx, "Users", "Delete", u.lgr, userQuery, sql.Named("userID", userID))
+	if errx != nil {
+		return nil, errx
+	}
+
+	if count == 0 {
+		return nil, erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+	}
+
+	_, errx = execInTx(tx, "Users", "Delete", u.lgr, recordQuery, sql.Named("deletedAt", time.Now().UTC()),
+		sql.Named("notes", notesDeleted), sql.Named("folders", foldersDeleted))
+	if errx != nil {
+		return nil, errx
+	}
+
+	if errx = commit(tx, "Users", "Delete", u.lgr); errx != nil {
+		return nil, errx
+	}
+
+	return sessionIDs, nil
+}
+
+// updateEncryptionKey replaces the password wrap of the data key, and the recovery wrap when one is given
+func (u *users) updateEncryptionKey(caller string, revokeSessions bool, userID types.UserID, encryptionKey string, kdfSalt string, kdfParams string, recovery *types.KeyWrap, srp *types.SRPVerifier) ([]string, *erx.Erx) {
+	query := `UPDATE users SET encryption_key = @key, kdf_salt = @salt, kdf_params = @params`
+	args := []interface{}{sql.Named("key", encryptionKey), sql.Named("salt", kdfSalt), sql.Named("params", kdfParams), sql.Named("userID", userID)}
+	if recovery != nil {
+		query += `, recovery_key = @recoveryKey, recovery_kdf_salt = @recoverySalt, recovery_kdf_params = @recoveryParams`
+		args = append(args, sql.Named("recoveryKey", recovery.Key), sql.Named("recoverySalt", recovery.Salt),
+			sql.Named("recoveryParams", recovery.Params))
+	}
+	if srp != nil {
+		query += `, srp_salt = @srpSalt, srp_verifier = @srpVerifier, srp_kdf_params = @srpParams`
+		args = append(args, sql.Named("srpSalt", srp.Salt), sql.Named("srpVerifier", srp.Verifier), sql.Named("srpParams", srp.Params))
+	}
+	query += ` WHERE user_id = @userID`
+
+	tx, err := u.db.Begin()
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			u.lgr.Error(fmt.Sprintf("[Database] [Users] [%s] [Begin] [sqlErr] %d : %s", caller, sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		u.lgr.Debug(fmt.Sprintf("[Database] [Users] [%s] [Begin] %s", caller, err.Error()))
+		return nil, errx
+	}
+	defer rollback(tx, caller, u.lgr)
+
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			u.lgr.Error(fmt.Sprintf("[Database] [Users] [%s] [Exec] [sqlErr] %d : %s", caller, sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		u.lgr.Debug(fmt.Sprintf("[Database] [Users] [%s] [Exec] %s", caller, err.Error()))
+		return nil, errx
+	}
+
+	var count int64
+	if count, err = res.RowsAffected(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			u.lgr.Error(fmt.Sprintf("[Database] [Users] [%s] [RowsAffected] [sqlErr] %d : %s", caller, sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		u.lgr.Debug(fmt.Sprintf("[Database] [Users] [%s] [RowsAffected] %s", caller, err.Error()))
+		return nil, errx
+	}
+
+	if count == 0 {
+		return nil, erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+	}
+
+	var sessionIDs []string
+	if revokeSessions {
+		var errx *erx.Erx
+		if sessionIDs, errx = revokeAllSessions(tx, userID, caller, u.lgr); errx != nil {
+			return nil, errx
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			u.lgr.Error(fmt.Sprintf("[Database] [Users] [%s] [Commit] [sqlErr] %d : %s", caller, sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		u.lgr.Debug(fmt.Sprintf("[Database] [Users] [%s] [Commit] %s", caller, err.Error()))
+		return nil, errx
+	}
+
+	return sessionIDs, nil
+}
+
+// Create stores a new user, an empty keyBundle creates an account whose folders and notes the server encrypts
+func (u *users) Create(emailID string, encryptionKey string, keyHash string, kdfSalt string, kdfParams string, recovery types.KeyWrap, srp types.SRPVerifier, keyBundle string, vetkn string) (types.UserID, *erx.Erx) {
+	query := `INSERT INTO users (email, encryption_key, key_hash, kdf_salt, kdf_params, recovery_key, recovery_kdf_salt, recovery_kdf_params,
+	srp_salt, srp_verifier, srp_kdf_params, key_bundle, verification_key, verification_issued_at)
+	OUTPUT inserted.user_id VALUES (@email, @key, @hash, @salt, @params, @recoveryKey, @recoverySalt, @recoveryParams,
+	@srpSalt, @srpVerifier, @srpParams, @keyBundle, @veKey, @issuedAt);`
 
 	var userID types.UserID
+	bundle := sql.NullString{String: keyBundle, Valid: keyBundle != ""}
 
 	row := u.db.QueryRow(query, sql.Named("email", emailID), sql.Named("key", encryptionKey),
-		sql.Named("hash", keyHash), sql.Named("veKey", vetkn))
+		sql.Named("hash", keyHash), sql.Named("salt", kdfSalt), sql.Named("params", kdfParams),
+		sql.Named("recoveryKey", recovery.Key), sql.Named("recoverySalt", recovery.Salt),
+		sql.Named("recoveryParams", recovery.Params), sql.Named("srpSalt", srp.Salt), sql.Named("srpVerifier", srp.Verifier),
+		sql.Named("srpParams", srp.Params), sql.Named("keyBundle", bundle), sql.Named("veKey", vetkn), sql.Named("issuedAt", time.Now().UTC()))
 	err := row.Err()
 	if err != nil {
 		sqlErr, errx := checkForSQLError(err)
@@ -189,3 +650,39 @@ func (u *users) Create(emailID string, encryptionKey string, keyHash string, vet
 
 	return userID, nil
 }
+
+// UpdateKeyBundle replaces the key bundle of a zero-knowledge account, other accounts are left as they are
+// and get NoRowsAffected
+func (u *users) UpdateKeyBundle(userID types.UserID, keyBundle string) *erx.Erx {
+	query := `UPDATE users SET key_bundle = @keyBundle WHERE user_id = @userID AND key_bundle IS NOT NULL`
+
+	res, err := u.db.Exec(query, sql.Named("keyBundle", keyBundle), sql.Named("userID", userID))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			u.lgr.Error(fmt.Sprintf("[Database] [Users] [UpdateKeyBundle] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		u.lgr.Debug(fmt.Sprintf("[Database] [Users] [UpdateKeyBundle] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	var count int64
+	if count, err = res.RowsAffected(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			u.lgr.Error(fmt.Sprintf("[Database] [Users] [UpdateKeyBundle] [RowsAffected] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		u.lgr.Debug(fmt.Sprintf("[Database] [Users] [UpdateKeyBundle] [RowsAffected] %s", err.Error()))
+		return errx
+	}
+
+	if count == 0 {
+		return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+	}
+
+	return nil
+}
@@ -1,8 +1,13 @@
 package database
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
+
 	mssql "github.com/denisenkom/go-mssqldb"
 	"github.com/nsnikhil/erx"
+	"go.uber.org/zap"
 )
 
 func checkForSQLError(err error) (*mssql.Error, *erx.Erx) {
@@ -14,3 +19,54 @@ func checkForSQLError(err error) (*mssql.Error, *erx.Erx) {
 	}
 	return nil, errx
 }
+
+// rollback is meant to be deferred right after a transaction begins, it is a no-op once the transaction is committed
+func rollback(tx *sql.Tx, caller string, lgr *zap.Logger) {
+	if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+		lgr.Debug(fmt.Sprintf("[Database] [%s] [Rollback] %s", caller, err.Error()))
+	}
+}
+
+// execInTx runs a statement inside tx, returning the number of rows it affected
+func execInTx(tx *sql.Tx, table string, caller string, lgr *zap.Logger, query string, args ...interface{}) (int64, *erx.Erx) {
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			lgr.Error(fmt.Sprintf("[Database] [%s] [%s] [Exec] [sqlErr] %d : %s", table, caller, sqlErr.Number, sqlErr.Error()))
+			return 0, errx
+		}
+		lgr.Debug(fmt.Sprintf("[Database] [%s] [%s] [Exec] %s", table, caller, err.Error()))
+		return 0, errx
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			lgr.Error(fmt.Sprintf("[Database] [%s] [%s] [RowsAffected] [sqlErr] %d : %s", table, caller, sqlErr.Number, sqlErr.Error()))
+			return 0, errx
+		}
+		lgr.Debug(fmt.Sprintf("[Database] [%s] [%s] [RowsAffected] %s", table, caller, err.Error()))
+		return 0, errx
+	}
+
+	return count, nil
+}
+
+// commit commits tx, logging failures the same way as any other statement
+func commit(tx *sql.Tx, table string, caller string, lgr *zap.Logger) *erx.Erx {
+	if err := tx.Commit(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			lgr.Error(fmt.Sprintf("[Database] [%s] [%s] [Commit] [sqlErr] %d : %s", table, caller, sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		lgr.Debug(fmt.Sprintf("[Database] [%s] [%s] [Commit] %s", table, caller, err.Error()))
+		return errx
+	}
+	return nil
+}
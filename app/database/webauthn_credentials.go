@@ -0,0 +1,221 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/types"
+	"go.uber.org/zap"
+)
+
+type WebAuthnCredentialsTable interface {
+	Create(credential types.WebAuthnCredential) *erx.Erx
+	Get(userID types.UserID, credentialID string) (types.WebAuthnCredential, *erx.Erx)
+	List(userID types.UserID) ([]types.WebAuthnCredential, *erx.Erx)
+	UpdateSignCount(userID types.UserID, credentialID string, signCount uint32, lastUsedAt time.Time) *erx.Erx
+	Delete(userID types.UserID, credentialID string) *erx.Erx
+}
+
+type webAuthnCredentials struct {
+	lgr *zap.Logger
+	db  *sql.DB
+}
+
+func (w *webAuthnCredentials) Create(credential types.WebAuthnCredential) *erx.Erx {
+	query := `INSERT INTO webauthn_credentials (user_id, credential_id, name, public_key, algorithm, sign_count, prf_salt, wrapped_key, created_at)
+VALUES (@userID, @credentialID, @name, @publicKey, @algorithm, @signCount, @prfSalt, @wrappedKey, @createdAt)`
+
+	var wrappedKey sql.NullString
+	if credential.WrappedKey != "" {
+		wrappedKey = sql.NullString{String: credential.WrappedKey, Valid: true}
+	}
+
+	_, err := w.db.Exec(query, sql.Named("userID", credential.UserID), sql.Named("credentialID", credential.CredentialID),
+		sql.Named("name", credential.Name), sql.Named("publicKey", credential.PublicKey), sql.Named("algorithm", credential.Algorithm),
+		sql.Named("signCount", int64(credential.SignCount)), sql.Named("prfSalt", credential.PRFSalt),
+		sql.Named("wrappedKey", wrappedKey), sql.Named("createdAt", credential.CreatedAt.UTC()))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			w.lgr.Error(fmt.Sprintf("[Database] [WebAuthnCredentials] [Create] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		w.lgr.Debug(fmt.Sprintf("[Database] [WebAuthnCredentials] [Create] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	return nil
+}
+
+func (w *webAuthnCredentials) Get(userID types.UserID, credentialID string) (types.WebAuthnCredential, *erx.Erx) {
+	query := `SELECT name, public_key, algorithm, sign_count, prf_salt, wrapped_key, created_at, last_used_at
+FROM webauthn_credentials WHERE user_id = @userID AND credential_id = @credentialID`
+
+	credential := types.WebAuthnCredential{UserID: userID, CredentialID: credentialID}
+	var signCount int64
+	var wrappedKey sql.NullString
+	var lastUsedAt sql.NullTime
+
+	row := w.db.QueryRow(query, sql.Named("userID", userID), sql.Named("credentialID", credentialID))
+	err := row.Scan(&credential.Name, &credential.PublicKey, &credential.Algorithm, &signCount, &credential.PRFSalt,
+		&wrappedKey, &credential.CreatedAt, &lastUsedAt)
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			w.lgr.Error(fmt.Sprintf("[Database] [WebAuthnCredentials] [Get] [Scan] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return types.WebAuthnCredential{}, errx
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			errx = erx.WithArgs(errx, erx.SeverityInfo, custom_errors.NoRowsInResultSet)
+			w.lgr.Info(fmt.Sprintf("[Database] [WebAuthnCredentials] [Get] [Scan] [ErrSQLNoResultsInSet] %s", errx.String()))
+			return types.WebAuthnCredential{}, errx
+		}
+		w.lgr.Debug(fmt.Sprintf("[Database] [WebAuthnCredentials] [Get] [Scan] %s", errx.Error()))
+		return types.WebAuthnCredential{}, errx
+	}
+
+	credential.SignCount = uint32(signCount)
+	credential.WrappedKey = wrappedKey.String
+	credential.LastUsedAt = lastUsedAt.Time
+	return credential, nil
+}
+
+func (w *webAuthnCredentials) List(userID types.UserID) ([]types.WebAuthnCredential, *erx.Erx) {
+	query := `SELECT credential_id, name, public_key, algorithm, sign_count, prf_salt, wrapped_key, created_at, last_used_at
+FROM webauthn_credentials WHERE user_id = @userID ORDER BY created_at`
+
+	rows, err := w.db.Query(query, sql.Named("userID", userID))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			w.lgr.Error(fmt.Sprintf("[Database] [WebAuthnCredentials] [List] [Query] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		w.lgr.Debug(fmt.Sprintf("[Database] [WebAuthnCredentials] [List] [Query] %s", err.Error()))
+		return nil, errx
+	}
+
+	defer func(rows *sql.Rows) {
+		err := rows.Close()
+		if err != nil {
+			w.lgr.Debug(fmt.Sprintf("[Database] [WebAuthnCredentials] [List] [Close] %s", err.Error()))
+		}
+	}(rows)
+	credentials := *new([]types.WebAuthnCredential)
+
+	for rows.Next() {
+		credential := types.WebAuthnCredential{UserID: userID}
+		var signCount int64
+		var wrappedKey sql.NullString
+		var lastUsedAt sql.NullTime
+
+		err = rows.Scan(&credential.CredentialID, &credential.Name, &credential.PublicKey, &credential.Algorithm, &signCount,
+			&credential.PRFSalt, &wrappedKey, &credential.CreatedAt, &lastUsedAt)
+		if err != nil {
+			sqlErr, errx := checkForSQLError(err)
+			if sqlErr != nil {
+				errx = erx.WithArgs(errx, erx.SeverityError)
+				w.lgr.Error(fmt.Sprintf("[Database] [WebAuthnCredentials] [List] [Scan] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+				return nil, errx
+			}
+			w.lgr.Debug(fmt.Sprintf("[Database] [WebAuthnCredentials] [List] [Scan] %s", err.Error()))
+			return nil, errx
+		}
+
+		credential.SignCount = uint32(signCount)
+		credential.WrappedKey = wrappedKey.String
+		credential.LastUsedAt = lastUsedAt.Time
+		credentials = append(credentials, credential)
+	}
+
+	if err := rows.Err(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			w.lgr.Error(fmt.Sprintf("[Database] [WebAuthnCredentials] [List] [Err] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return nil, errx
+		}
+		w.lgr.Debug(fmt.Sprintf("[Database] [WebAuthnCredentials] [List] [Err] %s", err.Error()))
+		return nil, errx
+	}
+
+	return credentials, nil
+}
+
+// UpdateSignCount stores the counter of an assertion, it fails if a concurrent assertion already moved the counter past it
+func (w *webAuthnCredentials) UpdateSignCount(userID types.UserID, credentialID string, signCount uint32, lastUsedAt time.Time) *erx.Erx {
+	query := `UPDATE webauthn_credentials SET sign_count = @signCount, last_used_at = @lastUsedAt
+WHERE user_id = @userID AND credential_id = @credentialID AND (sign_count < @signCount OR sign_count = 0)`
+
+	res, err := w.db.Exec(query, sql.Named("signCount", int64(signCount)), sql.Named("lastUsedAt", lastUsedAt.UTC()),
+		sql.Named("userID", userID), sql.Named("credentialID", credentialID))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			w.lgr.Error(fmt.Sprintf("[Database] [WebAuthnCredentials] [UpdateSignCount] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		w.lgr.Debug(fmt.Sprintf("[Database] [WebAuthnCredentials] [UpdateSignCount] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	var count int64
+	if count, err = res.RowsAffected(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			w.lgr.Error(fmt.Sprintf("[Database] [WebAuthnCredentials] [UpdateSignCount] [RowsAffected] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		w.lgr.Debug(fmt.Sprintf("[Database] [WebAuthnCredentials] [UpdateSignCount] [RowsAffected] %s", err.Error()))
+		return errx
+	}
+
+	if count == 0 {
+		return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+	}
+
+	return nil
+}
+
+func (w *webAuthnCredentials) Delete(userID types.UserID, credentialID string) *erx.Erx {
+	query := `DELETE FROM webauthn_credentials WHERE user_id = @userID AND credential_id = @credentialID`
+
+	res, err := w.db.Exec(query, sql.Named("userID", userID), sql.Named("credentialID", credentialID))
+	if err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			w.lgr.Error(fmt.Sprintf("[Database] [WebAuthnCredentials] [Delete] [Exec] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		w.lgr.Debug(fmt.Sprintf("[Database] [WebAuthnCredentials] [Delete] [Exec] %s", err.Error()))
+		return errx
+	}
+
+	var count int64
+	if count, err = res.RowsAffected(); err != nil {
+		sqlErr, errx := checkForSQLError(err)
+		if sqlErr != nil {
+			errx = erx.WithArgs(errx, erx.SeverityError)
+			w.lgr.Error(fmt.Sprintf("[Database] [WebAuthnCredentials] [Delete] [RowsAffected] [sqlErr] %d : %s", sqlErr.Number, sqlErr.Error()))
+			return errx
+		}
+		w.lgr.Debug(fmt.Sprintf("[Database] [WebAuthnCredentials] [Delete] [RowsAffected] %s", err.Error()))
+		return errx
+	}
+
+	if count == 0 {
+		return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/http/resperr"
+	"github.com/sid-sun/arche-api/app/service"
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/app/utils"
+	"go.uber.org/zap"
+)
+
+// maxAccessTokenDays caps how long a personal access token can live
+const maxAccessTokenDays = 365
+
+// CreateAccessTokenHandler issues a personal access token with its own copy of the session's data key,
+// the token is part of the response only once
+func CreateAccessTokenHandler(svc service.AccessTokensService, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+
+		d, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [AccessTokens] [CreateAccessTokenHandler] [ReadAll] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "could not read request body"), w, lgr)
+			return
+		}
+
+		var data types.CreateAccessTokenRequest
+		err = json.Unmarshal(d, &data)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [AccessTokens] [CreateAccessTokenHandler] [Unmarshal] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "an error occoured when unmarshaling JSON"), w, lgr)
+			return
+		}
+		data.Name = strings.TrimSpace(data.Name)
+
+		if data.Name == "" {
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "name cannot be empty"), w, lgr)
+			return
+		}
+
+		if data.ExpiresInDays < 1 || data.ExpiresInDays > maxAccessTokenDays {
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest,
+				fmt.Sprintf("expires_in_days must be between 1 and %d", maxAccessTokenDays)), w, lgr)
+			return
+		}
+
+		scopes, ok := normalizeScopes(data.Scopes)
+		if !ok {
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest,
+				fmt.Sprintf("scopes must be a non empty list of %s", strings.Join(types.AccessTokenScopes, ", "))), w, lgr)
+			return
+		}
+
+		expiresAt := time.Now().AddDate(0, 0, data.ExpiresInDays)
+		accessToken, token, errx := svc.Create(claims, data.Name, scopes, expiresAt)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [AccessTokens] [CreateAccessTokenHandler] [Create] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		resp := types.CreateAccessTokenResponse{
+			AccessToken: accessToken,
+			Token:       token,
+		}
+
+		utils.WriteSuccessResponse(http.StatusCreated, resp, w, lgr)
+	}
+}
+
+func ListAccessTokensHandler(svc service.AccessTokensService, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+
+		tokens, errx := svc.List(claims.UserID)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [AccessTokens] [ListAccessTokensHandler] [List] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		utils.WriteSuccessResponse(http.StatusOK, tokens, w, lgr)
+	}
+}
+
+func RevokeAccessTokenHandler(svc service.AccessTokensService, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+		paramsMap := req.Context().Value("url_params").(map[string]string)
+
+		if paramsMap["tokenID"] == "" {
+			lgr.Info("[Handlers] [AccessTokens] [RevokeAccessTokenHandler] tokenID URL parameter empty")
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "tokenID parameter not specified"), w, lgr)
+			return
+		}
+
+		errx := svc.Revoke(claims.UserID, paramsMap["tokenID"])
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [AccessTokens] [RevokeAccessTokenHandler] [Revoke] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			if errx.Kind() == custom_errors.NoRowsAffected {
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusNotFound, "access token does not exist"), w, lgr)
+				return
+			}
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		utils.WriteSuccessResponse(http.StatusOK, types.RevokeAccessTokenResponse{TokenID: paramsMap["tokenID"], Revoked: true}, w, lgr)
+	}
+}
+
+// normalizeScopes drops duplicates and reports whether every scope is known
+func normalizeScopes(requested []string) ([]string, bool) {
+	if len(requested) == 0 {
+		return nil, false
+	}
+
+	seen := make(map[string]bool)
+	scopes := make([]string, 0, len(requested))
+	for _, scope := range requested {
+		known := false
+		for _, s := range types.AccessTokenScopes {
+			if scope == s {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return nil, false
+		}
+
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, true
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/sid-sun/arche-api/app/audit"
+	"github.com/sid-sun/arche-api/app/http/resperr"
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/app/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultSecurityEventsLimit = 50
+	maxSecurityEventsLimit     = 200
+)
+
+// SecurityEventsHandler pages through the audit log of the signed in user, newest first
+// ?limit= sets the page size and ?before= takes the next_before of the previous page
+func SecurityEventsHandler(auditLog audit.Log, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+		query := req.URL.Query()
+
+		limit := defaultSecurityEventsLimit
+		if raw := query.Get("limit"); raw != "" {
+			var err error
+			if limit, err = strconv.Atoi(raw); err != nil || limit < 1 || limit > maxSecurityEventsLimit {
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest,
+					fmt.Sprintf("limit must be between 1 and %d", maxSecurityEventsLimit)), w, lgr)
+				return
+			}
+		}
+
+		var before int64
+		if raw := query.Get("before"); raw != "" {
+			var err error
+			if before, err = strconv.ParseInt(raw, 10, 64); err != nil || before < 1 {
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "before must be an event id"), w, lgr)
+				return
+			}
+		}
+
+		events, errx := auditLog.List(claims.UserID, before, limit)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [Audit] [SecurityEventsHandler] [List] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		resp := types.SecurityEventsResponse{
+			Events: events,
+		}
+		// A full page may be followed by another one, a short page is the last
+		if len(events) == limit {
+			resp.NextBefore = events[len(events)-1].EventID
+		}
+
+		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+	}
+}
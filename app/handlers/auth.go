@@ -3,17 +3,18 @@ package handlers
 import (
 	"fmt"
 	"net/http"
-	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/sid-sun/arche-api/app/audit"
+	"github.com/sid-sun/arche-api/app/custom_errors"
 	"github.com/sid-sun/arche-api/app/http/resperr"
+	"github.com/sid-sun/arche-api/app/service"
 	"github.com/sid-sun/arche-api/app/types"
 	"github.com/sid-sun/arche-api/app/utils"
 	"github.com/sid-sun/arche-api/config"
 	"go.uber.org/zap"
 )
 
-func RefreshTokenHandler(jwtCfg *config.JWTConfig, lgr *zap.Logger) http.HandlerFunc {
+func RefreshTokenHandler(svc service.SessionsService, auditLog audit.Log, jwtCfg *config.JWTConfig, lgr *zap.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		token := req.Header.Get("refresh_token")
 		if token == "" {
@@ -24,37 +25,131 @@ func RefreshTokenHandler(jwtCfg *config.JWTConfig, lgr *zap.Logger) http.Handler
 
 		var claims types.AccessTokenClaims
 		var err error
-		if claims, err = utils.ValidateJWT(token, jwtCfg.GetSecret(), lgr); err != nil {
+		if claims, err = utils.ValidateJWT(token, jwtCfg, lgr); err != nil {
 			lgr.Debug(fmt.Sprintf("[Handlers] [RefreshTokenHandler] [ValidateJWT] %s", err.Error()))
 			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, err.Error()), w, lgr)
 			return
 		}
 
-		accessTokenClaims := types.AccessTokenClaims{
-			UserID:        claims.UserID,
-			EncryptionKey: claims.EncryptionKey,
-			StandardClaims: jwt.StandardClaims{
-				NotBefore: time.Now().Unix(),
-				ExpiresAt: time.Now().Add(time.Minute * 15).Unix(),
-			},
-		}
-
-		tkn, err := utils.IssueJWT(accessTokenClaims, jwtCfg.GetSecret(), lgr)
-		if err != nil {
-			lgr.Debug(fmt.Sprintf("[Handlers] [RefreshTokenHandler] [IssueJWT] %s", err.Error()))
-			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, err.Error()), w, lgr)
+		// Every refresh hands out a new refresh token, the one sent here can not be used again
+		accessToken, refreshToken, errx := svc.Refresh(claims, clientInfo(req, ""), jwtCfg)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [RefreshTokenHandler] [Refresh] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			switch errx.Kind() {
+			case custom_errors.InvalidRefreshToken:
+				auditLog.Record(claims.UserID, audit.EventTokenRefresh, audit.OutcomeFailure, clientInfo(req, ""))
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "refresh token is no longer valid"), w, lgr)
+			case custom_errors.RefreshTokenReused:
+				auditLog.Record(claims.UserID, audit.EventTokenRefresh, audit.OutcomeFailure, clientInfo(req, ""))
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "refresh token was already used, session has been revoked"), w, lgr)
+			default:
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			}
 			return
 		}
 
+		auditLog.Record(claims.UserID, audit.EventTokenRefresh, audit.OutcomeSuccess, clientInfo(req, ""))
+
 		resp := types.LoginUserResponse{
-			AuthenticationToken: tkn,
-			RefreshToken:        token,
+			AuthenticationToken: accessToken,
+			RefreshToken:        refreshToken,
 			VerificationPending: false,
 		}
 		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
 	}
 }
 
+func LogoutHandler(svc service.SessionsService, auditLog audit.Log, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+
+		errx := svc.Revoke(claims.UserID, claims.SessionID)
+		if errx != nil && errx.Kind() != custom_errors.NoRowsAffected {
+			errMsg := fmt.Sprintf("[Handlers] [LogoutHandler] [Revoke] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		auditLog.Record(claims.UserID, audit.EventLogout, audit.OutcomeSuccess, clientInfo(req, ""))
+		utils.WriteSuccessResponse(http.StatusOK, types.LogoutResponse{LoggedOut: true}, w, lgr)
+	}
+}
+
+func LogoutAllHandler(svc service.SessionsService, auditLog audit.Log, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+
+		errx := svc.RevokeAll(claims.UserID)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [LogoutAllHandler] [RevokeAll] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		auditLog.Record(claims.UserID, audit.EventLogoutAll, audit.OutcomeSuccess, clientInfo(req, ""))
+		utils.WriteSuccessResponse(http.StatusOK, types.LogoutResponse{LoggedOut: true}, w, lgr)
+	}
+}
+
+func ListSessionsHandler(svc service.SessionsService, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+
+		sessionList, errx := svc.List(claims.UserID)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [ListSessionsHandler] [List] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		resp := make([]types.SessionInfo, len(sessionList))
+		for i, session := range sessionList {
+			resp[i] = types.SessionInfo{
+				SessionID:   session.SessionID,
+				DeviceLabel: session.DeviceLabel,
+				UserAgent:   session.UserAgent,
+				IPAddress:   session.IPAddress,
+				CreatedAt:   session.CreatedAt,
+				LastSeenAt:  session.LastSeenAt,
+				Current:     session.SessionID == claims.SessionID,
+			}
+		}
+		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+	}
+}
+
+func RevokeSessionHandler(svc service.SessionsService, auditLog audit.Log, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+		paramsMap := req.Context().Value("url_params").(map[string]string)
+
+		if paramsMap["sessionID"] == "" {
+			lgr.Info("[Handlers] [RevokeSessionHandler] sessionID URL parameter empty")
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "sessionID parameter not specified"), w, lgr)
+			return
+		}
+
+		errx := svc.Revoke(claims.UserID, paramsMap["sessionID"])
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [RevokeSessionHandler] [Revoke] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			if errx.Kind() == custom_errors.NoRowsAffected {
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusNotFound, "session does not exist"), w, lgr)
+				return
+			}
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		auditLog.Record(claims.UserID, audit.EventSessionRevoked, audit.OutcomeSuccess, clientInfo(req, ""))
+		utils.WriteSuccessResponse(http.StatusOK, types.RevokeSessionResponse{SessionID: paramsMap["sessionID"], Revoked: true}, w, lgr)
+	}
+}
+
 func ValidateTokenHandler(lgr *zap.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		// If claims are present on context then tokens are already validated by auth middleware
@@ -68,3 +163,11 @@ func ValidateTokenHandler(lgr *zap.Logger) http.HandlerFunc {
 		utils.WriteSuccessResponse(http.StatusOK, "claims are valid", w, lgr)
 	}
 }
+
+// JWKSHandler publishes the public keys tokens are signed with, so other services can verify them
+func JWKSHandler(cfg *config.JWTConfig, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		utils.WriteJSONResponse(http.StatusOK, utils.JWKS(cfg), w, lgr)
+	}
+}
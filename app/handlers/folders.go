@@ -80,7 +80,7 @@ func GetFolderHandler(svc service.FoldersService, lgr *zap.Logger) http.HandlerF
 		if errx != nil {
 			errMsg := fmt.Sprintf("[Handlers] [GetFolderHandler] [Get] %v", errx.String())
 			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
-			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			writeIntegrityFailure(errx, w, lgr)
 			return
 		}
 
@@ -96,7 +96,7 @@ func GetFoldersHandler(svc service.FoldersService, lgr *zap.Logger) http.Handler
 		if errx != nil {
 			errMsg := fmt.Sprintf("[Handlers] [GetFoldersHandler] [GetAll] %v", errx.String())
 			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
-			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			writeIntegrityFailure(errx, w, lgr)
 			return
 		}
 
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/http/resperr"
+	"github.com/sid-sun/arche-api/app/service"
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/app/utils"
+	"go.uber.org/zap"
+)
+
+// maxKeyBundleLength bounds the opaque key bundle of zero-knowledge accounts
+const maxKeyBundleLength = 8192
+
+// GetKeyBundleHandler returns the key bundle of a zero-knowledge account, clients holding a personal access
+// token fetch it here as they never see a login response
+func GetKeyBundleHandler(svc service.UsersService, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+
+		usr, errx := svc.GetUserByID(claims.UserID)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [KeyBundle] [GetKeyBundleHandler] [GetUserByID] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		resp := types.KeyBundleResponse{
+			ZeroKnowledge: usr.ZeroKnowledge,
+			KeyBundle:     usr.KeyBundle,
+		}
+
+		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+	}
+}
+
+// UpdateKeyBundleHandler stores a key bundle the client re-wrapped, after a password change for instance
+// The server cannot tell whether the bundle still opens the account's data, that is up to the client
+func UpdateKeyBundleHandler(svc service.UsersService, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+
+		d, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [KeyBundle] [UpdateKeyBundleHandler] [ReadAll] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "could not read request body"), w, lgr)
+			return
+		}
+
+		var data types.UpdateKeyBundleRequest
+		err = json.Unmarshal(d, &data)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [KeyBundle] [UpdateKeyBundleHandler] [Unmarshal] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "an error occoured when unmarshaling JSON"), w, lgr)
+			return
+		}
+
+		if errMsg := validateKeyBundle(data.KeyBundle); errMsg != "" {
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, errMsg), w, lgr)
+			return
+		}
+
+		errx := svc.UpdateKeyBundle(claims.UserID, data.KeyBundle)
+		if errx != nil {
+			if errx.Kind() == custom_errors.NoRowsAffected {
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusConflict, "account is not in zero-knowledge mode"), w, lgr)
+				return
+			}
+			errMsg := fmt.Sprintf("[Handlers] [KeyBundle] [UpdateKeyBundleHandler] [UpdateKeyBundle] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		utils.WriteSuccessResponse(http.StatusOK, types.UpdateKeyBundleResponse{Updated: true}, w, lgr)
+	}
+}
+
+// validateKeyBundle returns why a key bundle is rejected, or an empty string when it is accepted
+func validateKeyBundle(keyBundle string) string {
+	if keyBundle == "" {
+		return "key bundle cannot be empty"
+	}
+	if len(keyBundle) > maxKeyBundleLength {
+		return fmt.Sprintf("key bundle cannot be longer than %d characters", maxKeyBundleLength)
+	}
+	return ""
+}
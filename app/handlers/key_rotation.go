@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/audit"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/http/resperr"
+	"github.com/sid-sun/arche-api/app/service"
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/app/utils"
+	"github.com/sid-sun/arche-api/config"
+	"go.uber.org/zap"
+)
+
+// RotateKeyHandler replaces the data key of the signed in user once the password is re-confirmed
+// Every session is revoked and the response carries the recovery code of the new key
+func RotateKeyHandler(svc service.UsersService, rotationSvc service.KeyRotationService, auditLog audit.Log, kdfCfg *config.KDFConfig, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+
+		d, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [KeyRotation] [RotateKeyHandler] [ReadAll] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "could not read request body"), w, lgr)
+			return
+		}
+
+		var data types.RotateKeyRequest
+		err = json.Unmarshal(d, &data)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [KeyRotation] [RotateKeyHandler] [Unmarshal] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "an error occoured when unmarshaling JSON"), w, lgr)
+			return
+		}
+
+		usr, errx := svc.GetUserByID(claims.UserID)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [KeyRotation] [RotateKeyHandler] [GetUserByID] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		key, ok, err := unwrapUserKey(usr, data.Password, lgr)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [KeyRotation] [RotateKeyHandler] [unwrapUserKey] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, err.Error()), w, lgr)
+			return
+		}
+
+		if !ok {
+			auditLog.Record(usr.ID, audit.EventKeyRotation, audit.OutcomeFailure, clientInfo(req, ""))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "incorrect password"), w, lgr)
+			return
+		}
+
+		errx = rotationSvc.Request(usr.ID)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [KeyRotation] [RotateKeyHandler] [Request] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		// From here on the rotation is pending, if it fails now the next password login finishes it
+		_, recoveryCode, errx := finishKeyRotation(rotationSvc, usr, key, data.Password, kdfCfg, lgr)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [KeyRotation] [RotateKeyHandler] [finishKeyRotation] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		auditLog.Record(usr.ID, audit.EventKeyRotation, audit.OutcomeSuccess, clientInfo(req, ""))
+
+		resp := types.RotateKeyResponse{
+			Rotated:      true,
+			RecoveryCode: recoveryCode,
+		}
+
+		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+	}
+}
+
+// RequestKeyRotationHandler lets an operator rotate a user's data key, which cannot be done without the user's
+// password. The user is signed out everywhere and the rotation is carried out at their next password login
+func RequestKeyRotationHandler(svc service.UsersService, rotationSvc service.KeyRotationService, auditLog audit.Log, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		paramsMap := req.Context().Value("url_params").(map[string]string)
+
+		userID, err := strconv.Atoi(paramsMap["userID"])
+		if err != nil {
+			lgr.Info(fmt.Sprintf("[Handlers] [KeyRotation] [RequestKeyRotationHandler] [Atoi] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "userID parameter is not valid"), w, lgr)
+			return
+		}
+
+		usr, errx := svc.GetUserByID(types.UserID(userID))
+		if errx != nil {
+			if errx.Kind() == custom_errors.NoRowsInResultSet {
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusNotFound, "user does not exist"), w, lgr)
+				return
+			}
+			errMsg := fmt.Sprintf("[Handlers] [KeyRotation] [RequestKeyRotationHandler] [GetUserByID] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		errx = rotationSvc.Request(usr.ID)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [KeyRotation] [RequestKeyRotationHandler] [Request] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		auditLog.Record(usr.ID, audit.EventKeyRotationRequest, audit.OutcomeSuccess, clientInfo(req, ""))
+		utils.WriteSuccessResponse(http.StatusAccepted, types.RequestKeyRotationResponse{UserID: usr.ID, Requested: true}, w, lgr)
+	}
+}
+
+// finishKeyRotation carries out the pending rotation of usr's key, key being the current key unwrapped with password
+// It returns the new key and the recovery code which replaces the previous one
+func finishKeyRotation(rotationSvc service.KeyRotationService, usr types.User, key []byte, password string, kdfCfg *config.KDFConfig, lgr *zap.Logger) ([]byte, string, *erx.Erx) {
+	newKey, errx := rotationSvc.Prepare(usr.ID, key)
+	if errx != nil {
+		return nil, "", errx
+	}
+
+	kdfParams := utils.NewKDFParams(kdfCfg)
+	passwordWrap, err := wrapKeyCopy(newKey, password, kdfParams, lgr)
+	if err != nil {
+		lgr.Debug(fmt.Sprintf("[Handlers] [KeyRotation] [finishKeyRotation] [wrapKeyCopy] %v", err))
+		return nil, "", erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	recovery, recoveryCode, err := wrapRecoveryKey(newKey, kdfParams, lgr)
+	if err != nil {
+		lgr.Debug(fmt.Sprintf("[Handlers] [KeyRotation] [finishKeyRotation] [wrapRecoveryKey] %v", err))
+		return nil, "", erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	if errx = rotationSvc.Complete(usr.ID, key, newKey, passwordWrap, recovery); errx != nil {
+		return nil, "", errx
+	}
+
+	return newKey, recoveryCode, nil
+}
@@ -0,0 +1,295 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/sid-sun/arche-api/app/audit"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/http/resperr"
+	"github.com/sid-sun/arche-api/app/service"
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/app/utils"
+	"github.com/sid-sun/arche-api/config"
+	"go.uber.org/zap"
+)
+
+// RequestMagicLinkHandler emails a single use login link, the response is the same whether or not
+// the address belongs to an account so it cannot be used to find out who is signed up
+func RequestMagicLinkHandler(svc service.UsersService, sessionsSvc service.SessionsService, veCfg *config.VerificationEmailConfig, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		d, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [MagicLink] [RequestMagicLinkHandler] [ReadAll] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "could not read request body"), w, lgr)
+			return
+		}
+
+		var data types.MagicLinkRequest
+		err = json.Unmarshal(d, &data)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [MagicLink] [RequestMagicLinkHandler] [Unmarshal] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "an error occoured when unmarshaling JSON"), w, lgr)
+			return
+		}
+		data.Email = strings.ToLower(data.Email)
+
+		if errx := validateEmail(data.Email); errx != nil {
+			lgr.Info(fmt.Sprintf("[Handlers] [MagicLink] [validateEmail] [InvalidEmail] %v", errx.String()))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "email address is not valid"), w, lgr)
+			return
+		}
+
+		if veCfg.GetLoginLinkURL() == "" {
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusNotFound, "login links are not configured"), w, lgr)
+			return
+		}
+
+		resp := types.MagicLinkResponse{
+			Requested: true,
+		}
+
+		usr, errx := svc.GetUser(data.Email)
+		if errx != nil {
+			if errx.Kind() != custom_errors.NoRowsInResultSet {
+				errMsg := fmt.Sprintf("[Handlers] [MagicLink] [RequestMagicLinkHandler] [GetUser] %s", errx.Error())
+				utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			}
+			utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+			return
+		}
+
+		// Unverified accounts have to activate first, the link would prove nothing new about the address
+		if !usr.Verified {
+			lgr.Info("[Handlers] [MagicLink] [RequestMagicLinkHandler] [VerifiedCheck] User is not verified")
+			utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+			return
+		}
+
+		token, errx := sessionsSvc.StartMagicLink(usr.ID)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [MagicLink] [RequestMagicLinkHandler] [StartMagicLink] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+			return
+		}
+
+		errx = svc.SendMagicLinkEmail(usr.Email, token, veCfg)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [MagicLink] [RequestMagicLinkHandler] [SendMagicLinkEmail] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+		}
+
+		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+	}
+}
+
+// RedeemMagicLinkHandler trades a login link for a restricted session, the data key is wrapped under the
+// password so the session cannot decrypt anything until it is unlocked through UnlockSessionHandler
+func RedeemMagicLinkHandler(svc service.UsersService, sessionsSvc service.SessionsService, auditLog audit.Log, cfg *config.JWTConfig, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		d, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [MagicLink] [RedeemMagicLinkHandler] [ReadAll] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "could not read request body"), w, lgr)
+			return
+		}
+
+		var data types.RedeemMagicLinkRequest
+		err = json.Unmarshal(d, &data)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [MagicLink] [RedeemMagicLinkHandler] [Unmarshal] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "an error occoured when unmarshaling JSON"), w, lgr)
+			return
+		}
+
+		userID, errx := sessionsSvc.RedeemMagicLink(data.Token)
+		if errx != nil {
+			if errx.Kind() == custom_errors.InvalidMagicLink {
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "login link is not valid or has expired"), w, lgr)
+				return
+			}
+			errMsg := fmt.Sprintf("[Handlers] [MagicLink] [RedeemMagicLinkHandler] [RedeemMagicLink] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		// The account may have been deleted while the link was in flight
+		usr, errx := svc.GetUserByID(userID)
+		if errx != nil {
+			if errx.Kind() == custom_errors.NoRowsInResultSet {
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "login link is not valid or has expired"), w, lgr)
+				return
+			}
+			errMsg := fmt.Sprintf("[Handlers] [MagicLink] [RedeemMagicLinkHandler] [GetUserByID] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		// Restricted sessions are not handed the key bundle, it comes with the unlock
+		resp := types.LoginUserResponse{
+			Restricted:    true,
+			ZeroKnowledge: usr.ZeroKnowledge,
+		}
+
+		resp.AuthenticationToken, resp.RefreshToken, errx = sessionsSvc.Start(userID, nil, clientInfo(req, data.DeviceLabel), cfg)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [MagicLink] [RedeemMagicLinkHandler] [Start] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		auditLog.Record(userID, audit.EventMagicLinkLogin, audit.OutcomeSuccess, clientInfo(req, data.DeviceLabel))
+		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+	}
+}
+
+// UnlockSessionHandler gives a restricted session the data key once the password, and the TOTP code when
+// two-factor authentication is enabled, are confirmed
+// Wrong passwords and codes are throttled like logins, and a session sending too many wrong codes is revoked
+func UnlockSessionHandler(svc service.UsersService, twoFactorSvc service.TwoFactorService, sessionsSvc service.SessionsService, throttleSvc service.LoginThrottleService, auditLog audit.Log, veCfg *config.VerificationEmailConfig, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+
+		if !claims.Restricted {
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "session is not restricted"), w, lgr)
+			return
+		}
+
+		d, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [MagicLink] [UnlockSessionHandler] [ReadAll] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "could not read request body"), w, lgr)
+			return
+		}
+
+		var data types.UnlockSessionRequest
+		err = json.Unmarshal(d, &data)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [MagicLink] [UnlockSessionHandler] [Unmarshal] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "an error occoured when unmarshaling JSON"), w, lgr)
+			return
+		}
+
+		usr, errx := svc.GetUserByID(claims.UserID)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [MagicLink] [UnlockSessionHandler] [GetUserByID] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		// A passkey assertion cannot be checked here, such accounts log in with the passkey instead
+		if usr.WebAuthnEnabled && !usr.TOTPEnabled {
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusForbidden, "account is protected by a passkey, log in with it instead"), w, lgr)
+			return
+		}
+
+		client := clientInfo(req, "")
+		decision, errx := throttleSvc.Check(usr.Email, client.IPAddress)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [MagicLink] [UnlockSessionHandler] [Check] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		if !decision.Allowed() {
+			lgr.Info(fmt.Sprintf("[Handlers] [MagicLink] [UnlockSessionHandler] [Check] throttled for %v, locked: %t", decision.RetryAfter, decision.Locked))
+			auditLog.Record(usr.ID, audit.EventSessionUnlock, audit.OutcomeThrottled, client)
+			writeThrottled(decision.RetryAfter, w, lgr)
+			return
+		}
+
+		key, ok, err := unwrapUserKey(usr, data.Password, lgr)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [MagicLink] [UnlockSessionHandler] [unwrapUserKey] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, err.Error()), w, lgr)
+			return
+		}
+
+		if !ok {
+			auditLog.Record(usr.ID, audit.EventSessionUnlock, audit.OutcomeFailure, client)
+			countFailedLogin(svc, throttleSvc, decision, usr, usr.Email, veCfg, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "incorrect password"), w, lgr)
+			return
+		}
+
+		// Sessions only get the key once the rotation is done, which takes a password login
+		if usr.KeyRotationPending {
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusConflict, "the encryption key is being rotated, log in with the password to finish it"), w, lgr)
+			return
+		}
+
+		if usr.TOTPEnabled {
+			if errx = twoFactorSvc.VerifyCode(usr.ID, key, data.Code); errx != nil {
+				errMsg := fmt.Sprintf("[Handlers] [MagicLink] [UnlockSessionHandler] [VerifyCode] %s", errx.Error())
+				utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+				if errx.Kind() == custom_errors.InvalidTwoFactorCode {
+					auditLog.Record(usr.ID, audit.EventSessionUnlock, audit.OutcomeFailure, client)
+					countFailedLogin(svc, throttleSvc, decision, usr, usr.Email, veCfg, lgr)
+					if failSessionCode(sessionsSvc, throttleSvc, usr.ID, claims.SessionID, lgr) {
+						utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "too many incorrect two-factor codes, session was revoked"), w, lgr)
+						return
+					}
+				}
+				writeTwoFactorFailure(errx.Kind(), errx.String(), w, lgr)
+				return
+			}
+		}
+
+		if errx = throttleSvc.Succeed(decision, usr.Email, client.IPAddress); errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [MagicLink] [UnlockSessionHandler] [Succeed] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+		}
+
+		errx = sessionsSvc.Unlock(claims.SessionID, key)
+		if errx != nil {
+			if errx.Kind() == custom_errors.NoRowsAffected {
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "session is no longer valid"), w, lgr)
+				return
+			}
+			errMsg := fmt.Sprintf("[Handlers] [MagicLink] [UnlockSessionHandler] [Unlock] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		auditLog.Record(usr.ID, audit.EventSessionUnlock, audit.OutcomeSuccess, client)
+
+		resp := types.UnlockSessionResponse{
+			Unlocked:  true,
+			KeyBundle: usr.KeyBundle,
+		}
+
+		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+	}
+}
+
+// failSessionCode counts a wrong two-factor code against a restricted session and revokes the session once it has
+// sent too many, reporting whether it was revoked
+func failSessionCode(sessionsSvc service.SessionsService, throttleSvc service.LoginThrottleService, userID types.UserID, sessionID string, lgr *zap.Logger) bool {
+	revoke, errx := throttleSvc.FailSessionCode(sessionID)
+	if errx != nil {
+		errMsg := fmt.Sprintf("[Handlers] [MagicLink] [failSessionCode] [FailSessionCode] %s", errx.Error())
+		utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+		return false
+	}
+
+	if !revoke {
+		return false
+	}
+
+	lgr.Info(fmt.Sprintf("[Handlers] [MagicLink] [failSessionCode] revoking session of user %d after too many wrong codes", userID))
+	if errx = sessionsSvc.Revoke(userID, sessionID); errx != nil && errx.Kind() != custom_errors.NoRowsAffected {
+		errMsg := fmt.Sprintf("[Handlers] [MagicLink] [failSessionCode] [Revoke] %s", errx.Error())
+		utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+	}
+	return true
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"strconv"
 
+	"github.com/sid-sun/arche-api/app/custom_errors"
 	"github.com/sid-sun/arche-api/app/http/resperr"
 	"github.com/sid-sun/arche-api/app/service"
 	"github.com/sid-sun/arche-api/app/types"
@@ -22,7 +23,7 @@ func GetNotesHandler(svc service.NotesService, lgr *zap.Logger) http.HandlerFunc
 		if errx != nil {
 			errMsg := fmt.Sprintf("[Handlers] [GetNotesHandler] [GetAll] %v", errx.String())
 			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
-			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			writeIntegrityFailure(errx, w, lgr)
 			return
 		}
 
@@ -52,7 +53,7 @@ func GetNoteHandler(svc service.NotesService, lgr *zap.Logger) http.HandlerFunc
 		if errx != nil {
 			errMsg := fmt.Sprintf("[Handlers] [GetNoteHandler] [Get] %v", errx.String())
 			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
-			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			writeIntegrityFailure(errx, w, lgr)
 			return
 		}
 
@@ -158,3 +159,27 @@ func DeleteNoteHandler(svc service.NotesService, lgr *zap.Logger) http.HandlerFu
 		utils.WriteSuccessResponse(http.StatusOK, types.DeleteNoteResponse(body), w, lgr)
 	}
 }
+
+// SearchNotesHandler returns the notes containing every word of the q query parameter
+func SearchNotesHandler(svc service.NotesService, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+
+		notes, errx := svc.Search(req.URL.Query().Get("q"), claims)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [SearchNotesHandler] [Search] %v", errx.String())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			switch errx.Kind() {
+			case custom_errors.InvalidSearchQuery:
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "q must contain a word of at least two letters or digits"), w, lgr)
+			case custom_errors.ZeroKnowledgeAccount:
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusConflict, "notes of zero-knowledge accounts can only be searched on the client"), w, lgr)
+			default:
+				writeIntegrityFailure(errx, w, lgr)
+			}
+			return
+		}
+
+		utils.WriteSuccessResponse(http.StatusOK, notes, w, lgr)
+	}
+}
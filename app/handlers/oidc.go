@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/audit"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/http/resperr"
+	"github.com/sid-sun/arche-api/app/service"
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/app/utils"
+	"github.com/sid-sun/arche-api/config"
+	"go.uber.org/zap"
+)
+
+// BeginOIDCHandler starts a sign-in at the OpenID Connect provider for purpose, one of service.OIDCPurposeLogin
+// or service.OIDCPurposeLink, the client sends the user to the returned URL
+func BeginOIDCHandler(svc service.OIDCService, purpose string, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		authURL, state, errx := svc.Begin(purpose)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [OIDC] [BeginOIDCHandler] [Begin] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			writeOIDCFailure(errx.Kind(), errx.String(), w, lgr)
+			return
+		}
+
+		resp := types.BeginOIDCResponse{
+			AuthorizationURL: authURL,
+			State:            state,
+		}
+
+		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+	}
+}
+
+// FinishOIDCLoginHandler logs in the account linked to the identity the provider vouched for
+// The vault passphrase unwraps the data key, without it the session starts restricted
+func FinishOIDCLoginHandler(svc service.OIDCService, usersSvc service.UsersService, sessionsSvc service.SessionsService, auditLog audit.Log, cfg *config.JWTConfig, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		d, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [OIDC] [FinishOIDCLoginHandler] [ReadAll] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "could not read request body"), w, lgr)
+			return
+		}
+
+		var data types.FinishOIDCLoginRequest
+		err = json.Unmarshal(d, &data)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [OIDC] [FinishOIDCLoginHandler] [Unmarshal] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "an error occoured when unmarshaling JSON"), w, lgr)
+			return
+		}
+
+		identity, errx := svc.Finish(service.OIDCPurposeLogin, data.State, data.Code)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [OIDC] [FinishOIDCLoginHandler] [Finish] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			writeOIDCFailure(errx.Kind(), errx.String(), w, lgr)
+			return
+		}
+
+		userID, errx := svc.GetLinkedUser(identity)
+		if errx != nil {
+			if errx.Kind() == custom_errors.NoRowsInResultSet {
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusNotFound, "no account is linked to this identity, log in and link it first"), w, lgr)
+				return
+			}
+			errMsg := fmt.Sprintf("[Handlers] [OIDC] [FinishOIDCLoginHandler] [GetLinkedUser] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		usr, errx := usersSvc.GetUserByID(userID)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [OIDC] [FinishOIDCLoginHandler] [GetUserByID] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		var key []byte
+		if data.VaultPassphrase != "" {
+			var ok bool
+			key, ok, err = unwrapVaultKey(usr, data.VaultPassphrase, lgr)
+			if err != nil {
+				lgr.Debug(fmt.Sprintf("[Handlers] [OIDC] [FinishOIDCLoginHandler] [unwrapVaultKey] %v", err))
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, err.Error()), w, lgr)
+				return
+			}
+
+			if !ok {
+				auditLog.Record(usr.ID, audit.EventOIDCLogin, audit.OutcomeFailure, clientInfo(req, data.DeviceLabel))
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "incorrect vault passphrase"), w, lgr)
+				return
+			}
+		}
+
+		// The provider is trusted with the second factor, its policy applies to this login
+		resp := types.LoginUserResponse{
+			Restricted:    key == nil,
+			ZeroKnowledge: usr.ZeroKnowledge,
+		}
+		if key != nil {
+			resp.KeyBundle = usr.KeyBundle
+		}
+
+		resp.AuthenticationToken, resp.RefreshToken, errx = sessionsSvc.Start(usr.ID, key, clientInfo(req, data.DeviceLabel), cfg)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [OIDC] [FinishOIDCLoginHandler] [Start] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		auditLog.Record(usr.ID, audit.EventOIDCLogin, audit.OutcomeSuccess, clientInfo(req, data.DeviceLabel))
+		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+	}
+}
+
+// LinkOIDCHandler links the identity of a sign-in started with service.OIDCPurposeLink to the logged in account
+// and wraps the session's data key under the vault passphrase chosen for SSO logins
+func LinkOIDCHandler(svc service.OIDCService, kdfCfg *config.KDFConfig, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+
+		d, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [OIDC] [LinkOIDCHandler] [ReadAll] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "could not read request body"), w, lgr)
+			return
+		}
+
+		var data types.LinkOIDCRequest
+		err = json.Unmarshal(d, &data)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [OIDC] [LinkOIDCHandler] [Unmarshal] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "an error occoured when unmarshaling JSON"), w, lgr)
+			return
+		}
+
+		if data.VaultPassphrase == "" {
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "vault passphrase cannot be empty"), w, lgr)
+			return
+		}
+
+		identity, errx := svc.Finish(service.OIDCPurposeLink, data.State, data.Code)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [OIDC] [LinkOIDCHandler] [Finish] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			writeOIDCFailure(errx.Kind(), errx.String(), w, lgr)
+			return
+		}
+
+		vault, err := wrapKeyCopy(claims.EncryptionKey, data.VaultPassphrase, utils.NewKDFParams(kdfCfg), lgr)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [OIDC] [LinkOIDCHandler] [wrapKeyCopy] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, err.Error()), w, lgr)
+			return
+		}
+
+		errx = svc.Link(claims.UserID, identity, vault)
+		if errx != nil {
+			if errx.Kind() == custom_errors.DuplicateRecordInsertion {
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusConflict, "an identity of this provider is already linked"), w, lgr)
+				return
+			}
+			errMsg := fmt.Sprintf("[Handlers] [OIDC] [LinkOIDCHandler] [Link] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		resp := types.LinkOIDCResponse{
+			Linked: true,
+			Email:  identity.Email,
+		}
+
+		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+	}
+}
+
+func ListIdentitiesHandler(svc service.OIDCService, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+
+		linked, errx := svc.List(claims.UserID)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [OIDC] [ListIdentitiesHandler] [List] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		utils.WriteSuccessResponse(http.StatusOK, linked, w, lgr)
+	}
+}
+
+// UnlinkOIDCHandler removes the identity of the configured provider, the vault wrap goes with it
+func UnlinkOIDCHandler(svc service.OIDCService, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+
+		errx := svc.Unlink(claims.UserID)
+		if errx != nil {
+			if errx.Kind() == custom_errors.NoRowsAffected {
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusNotFound, "no identity is linked"), w, lgr)
+				return
+			}
+			errMsg := fmt.Sprintf("[Handlers] [OIDC] [UnlinkOIDCHandler] [Unlink] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			writeOIDCFailure(errx.Kind(), errx.String(), w, lgr)
+			return
+		}
+
+		utils.WriteSuccessResponse(http.StatusOK, types.UnlinkOIDCResponse{Unlinked: true}, w, lgr)
+	}
+}
+
+func writeOIDCFailure(kind erx.Kind, msg string, w http.ResponseWriter, lgr *zap.Logger) {
+	switch kind {
+	case custom_errors.OIDCNotConfigured:
+		utils.WriteFailureResponse(resperr.NewResponseError(http.StatusNotFound, "single sign-on is not configured"), w, lgr)
+	case custom_errors.InvalidOIDCState:
+		utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "sign-in is not valid or has expired, start again"), w, lgr)
+	case custom_errors.OIDCLoginFailed:
+		utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "the identity provider did not confirm the sign-in"), w, lgr)
+	default:
+		utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, msg), w, lgr)
+	}
+}
@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/sid-sun/arche-api/app/audit"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/http/resperr"
+	"github.com/sid-sun/arche-api/app/service"
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/app/utils"
+	"github.com/sid-sun/arche-api/config"
+	"go.uber.org/zap"
+)
+
+// RecoverAccountHandler sets a new password using the recovery code shown at signup, the recovery
+// code is rotated along with it and every session of the user is revoked
+func RecoverAccountHandler(svc service.UsersService, auditLog audit.Log, veCfg *config.VerificationEmailConfig, kdfCfg *config.KDFConfig, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		d, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Recovery] [RecoverAccountHandler] [ReadAll] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "could not read request body"), w, lgr)
+			return
+		}
+
+		var data types.RecoverAccountRequest
+		err = json.Unmarshal(d, &data)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Recovery] [RecoverAccountHandler] [Unmarshal] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "an error occoured when unmarshaling JSON"), w, lgr)
+			return
+		}
+		data.Email = strings.ToLower(data.Email)
+
+		if data.NewPassword == "" {
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "new password cannot be empty"), w, lgr)
+			return
+		}
+
+		// Unknown accounts, accounts without a recovery wrap and wrong codes all look the same to the caller
+		usr, errx := svc.GetUser(data.Email)
+		if errx != nil {
+			if errx.Kind() == custom_errors.NoRowsInResultSet {
+				// Take as long as checking a code would, so timing does not give the address away either
+				burnKDF(data.RecoveryCode, kdfCfg)
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "incorrect email or recovery code"), w, lgr)
+				return
+			}
+			errMsg := fmt.Sprintf("[Handlers] [Recovery] [RecoverAccountHandler] [GetUser] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		// Nor does an account without a recovery wrap answer any sooner
+		if usr.Recovery.Key == "" {
+			burnKDF(data.RecoveryCode, kdfCfg)
+		}
+
+		key, ok, err := unwrapRecoveryKey(usr, data.RecoveryCode, lgr)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Recovery] [RecoverAccountHandler] [unwrapRecoveryKey] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, err.Error()), w, lgr)
+			return
+		}
+
+		if !ok {
+			auditLog.Record(usr.ID, audit.EventAccountRecovery, audit.OutcomeFailure, clientInfo(req, ""))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "incorrect email or recovery code"), w, lgr)
+			return
+		}
+
+		kdfParams := utils.NewKDFParams(kdfCfg)
+		recovery, recoveryCode, err := wrapRecoveryKey(key, kdfParams, lgr)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Recovery] [RecoverAccountHandler] [wrapRecoveryKey] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, err.Error()), w, lgr)
+			return
+		}
+
+		salt, err := wrapUserKey(key, data.NewPassword, kdfParams, lgr)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Recovery] [RecoverAccountHandler] [wrapUserKey] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, err.Error()), w, lgr)
+			return
+		}
+
+		srpVerifier, err := newSRPVerifier(data.NewPassword, kdfParams, lgr)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Recovery] [RecoverAccountHandler] [newSRPVerifier] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, err.Error()), w, lgr)
+			return
+		}
+
+		errx = svc.RecoverAccount(usr.ID, key, salt, kdfParams.String(), recovery, srpVerifier)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [Recovery] [RecoverAccountHandler] [RecoverAccount] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		auditLog.Record(usr.ID, audit.EventAccountRecovery, audit.OutcomeSuccess, clientInfo(req, ""))
+
+		resp := types.RecoverAccountResponse{
+			PasswordChanged: true,
+			RecoveryCode:    recoveryCode,
+		}
+
+		// The password has already changed, a failed notice must not hide the new recovery code
+		errx = svc.SendNoticeEmail(usr.Email, veCfg.GetRecoverySubject(), veCfg.GetRecoveryBody(), veCfg)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [Recovery] [RecoverAccountHandler] [SendNoticeEmail] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+			return
+		}
+		resp.NoticeEmailSent = true
+
+		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+	}
+}
+
+// RegenerateRecoveryCodeHandler replaces the recovery code of the signed in user after re-checking the password,
+// accounts created before recovery codes existed get their first one this way
+func RegenerateRecoveryCodeHandler(svc service.UsersService, auditLog audit.Log, kdfCfg *config.KDFConfig, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+
+		d, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Recovery] [RegenerateRecoveryCodeHandler] [ReadAll] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "could not read request body"), w, lgr)
+			return
+		}
+
+		var data types.RegenerateRecoveryCodeRequest
+		err = json.Unmarshal(d, &data)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Recovery] [RegenerateRecoveryCodeHandler] [Unmarshal] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "an error occoured when unmarshaling JSON"), w, lgr)
+			return
+		}
+
+		usr, errx := svc.GetUserByID(claims.UserID)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [Recovery] [RegenerateRecoveryCodeHandler] [GetUserByID] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		key, ok, err := unwrapUserKey(usr, data.Password, lgr)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Recovery] [RegenerateRecoveryCodeHandler] [unwrapUserKey] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, err.Error()), w, lgr)
+			return
+		}
+
+		if !ok {
+			auditLog.Record(usr.ID, audit.EventRecoveryCodeReset, audit.OutcomeFailure, clientInfo(req, ""))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "incorrect password"), w, lgr)
+			return
+		}
+
+		recovery, recoveryCode, err := wrapRecoveryKey(key, utils.NewKDFParams(kdfCfg), lgr)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Recovery] [RegenerateRecoveryCodeHandler] [wrapRecoveryKey] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, err.Error()), w, lgr)
+			return
+		}
+
+		errx = svc.UpdateRecoveryKey(usr.ID, recovery)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [Recovery] [RegenerateRecoveryCodeHandler] [UpdateRecoveryKey] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		auditLog.Record(usr.ID, audit.EventRecoveryCodeReset, audit.OutcomeSuccess, clientInfo(req, ""))
+
+		resp := types.RegenerateRecoveryCodeResponse{
+			RecoveryCode: recoveryCode,
+		}
+
+		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+	}
+}
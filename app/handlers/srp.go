@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"crypto/aes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/sid-sun/arche-api/app/audit"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/http/resperr"
+	"github.com/sid-sun/arche-api/app/service"
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/app/utils"
+	"github.com/sid-sun/arche-api/config"
+	"go.uber.org/zap"
+)
+
+// SRPInitHandler starts an SRP login, every valid address gets a handshake so the response does not tell
+// which accounts exist
+func SRPInitHandler(svc service.SRPService, kdfCfg *config.KDFConfig, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		d, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [SRP] [SRPInitHandler] [ReadAll] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "could not read request body"), w, lgr)
+			return
+		}
+
+		var data types.SRPInitRequest
+		err = json.Unmarshal(d, &data)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [SRP] [SRPInitHandler] [Unmarshal] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "an error occoured when unmarshaling JSON"), w, lgr)
+			return
+		}
+		data.Email = strings.ToLower(data.Email)
+
+		if errx := validateEmail(data.Email); errx != nil {
+			lgr.Info(fmt.Sprintf("[Handlers] [SRP] [validateEmail] [InvalidEmail] %v", errx.String()))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "email address is not valid"), w, lgr)
+			return
+		}
+
+		resp, errx := svc.Begin(data.Email, kdfCfg)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [SRP] [SRPInitHandler] [Begin] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+	}
+}
+
+// SRPVerifyHandler finishes an SRP login, wrong proofs count towards the throttle like wrong passwords
+// The data key is unwrapped with the wrapping key the client derived, which comes sealed under the session key
+func SRPVerifyHandler(svc service.UsersService, srpSvc service.SRPService, sessionsSvc service.SessionsService, throttleSvc service.LoginThrottleService, auditLog audit.Log, cfg *config.JWTConfig, veCfg *config.VerificationEmailConfig, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		d, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [SRP] [SRPVerifyHandler] [ReadAll] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "could not read request body"), w, lgr)
+			return
+		}
+
+		var data types.SRPVerifyRequest
+		err = json.Unmarshal(d, &data)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [SRP] [SRPVerifyHandler] [Unmarshal] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "an error occoured when unmarshaling JSON"), w, lgr)
+			return
+		}
+		data.Email = strings.ToLower(data.Email)
+
+		if errx := validateEmail(data.Email); errx != nil {
+			lgr.Info(fmt.Sprintf("[Handlers] [SRP] [validateEmail] [InvalidEmail] %v", errx.String()))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "email address is not valid"), w, lgr)
+			return
+		}
+
+		client := clientInfo(req, data.DeviceLabel)
+		decision, errx := throttleSvc.Check(data.Email, client.IPAddress)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [SRP] [SRPVerifyHandler] [Check] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		if !decision.Allowed() {
+			lgr.Info(fmt.Sprintf("[Handlers] [SRP] [SRPVerifyHandler] [Check] throttled for %v, locked: %t", decision.RetryAfter, decision.Locked))
+			auditLog.Record(0, audit.EventSRPLogin, audit.OutcomeThrottled, client)
+			writeThrottled(decision.RetryAfter, w, lgr)
+			return
+		}
+
+		usr, sessionKey, serverProof, errx := srpSvc.Finish(data)
+		if errx != nil {
+			switch errx.Kind() {
+			case custom_errors.InvalidSRPHandshake:
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "login handshake is not valid or has expired"), w, lgr)
+			case custom_errors.SRPProofMismatch:
+				failLogin(svc, throttleSvc, auditLog, decision, usr, data.Email, client, veCfg, w, lgr)
+			default:
+				errMsg := fmt.Sprintf("[Handlers] [SRP] [SRPVerifyHandler] [Finish] %s", errx.Error())
+				utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			}
+			return
+		}
+
+		// The proof shows the client knows the password, a wrapping key which does not open is a client fault
+		key, ok := openSessionWrappingKey(usr, data.WrappingKey, sessionKey, lgr)
+		if !ok {
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "wrapping key does not unlock the data key"), w, lgr)
+			return
+		}
+
+		if errx = throttleSvc.Succeed(decision, data.Email, client.IPAddress); errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [SRP] [SRPVerifyHandler] [Succeed] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+		}
+
+		// Finishing a rotation wraps the new key under the password, which never gets here
+		if usr.KeyRotationPending {
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusConflict, "a key rotation is pending, log in with the password to finish it"), w, lgr)
+			return
+		}
+
+		auditLog.Record(usr.ID, audit.EventSRPLogin, audit.OutcomeSuccess, client)
+
+		resp := types.SRPVerifyResponse{
+			LoginUserResponse: types.LoginUserResponse{
+				VerificationPending: true,
+				ZeroKnowledge:       usr.ZeroKnowledge,
+			},
+			ServerProof: base64.StdEncoding.EncodeToString(serverProof),
+		}
+
+		if !usr.Verified {
+			lgr.Info("[Handlers] [SRP] [SRPVerifyHandler] [VerifiedCheck] User is not verified")
+			utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+			return
+		}
+
+		resp.VerificationPending = false
+		if usr.TOTPEnabled || usr.WebAuthnEnabled {
+			resp.TwoFactorRequired = true
+			if usr.TOTPEnabled {
+				resp.SecondFactors = append(resp.SecondFactors, "totp")
+			}
+			if usr.WebAuthnEnabled {
+				resp.SecondFactors = append(resp.SecondFactors, "webauthn")
+			}
+			resp.ChallengeToken, errx = sessionsSvc.StartChallenge(usr.ID, key, cfg)
+			if errx != nil {
+				errMsg := fmt.Sprintf("[Handlers] [SRP] [SRPVerifyHandler] [StartChallenge] %s", errx.Error())
+				utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+				return
+			}
+			utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+			return
+		}
+
+		resp.AuthenticationToken, resp.RefreshToken, errx = sessionsSvc.Start(usr.ID, key, client, cfg)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [SRP] [SRPVerifyHandler] [Start] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+		resp.KeyBundle = usr.KeyBundle
+
+		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+	}
+}
+
+// openSessionWrappingKey opens the wrapping key the client sealed under the SRP session key and unwraps the user's
+// data key with it, ok is false when either step fails
+func openSessionWrappingKey(usr types.User, sealedKey string, sessionKey []byte, lgr *zap.Logger) ([]byte, bool) {
+	envelope, err := base64.StdEncoding.DecodeString(sealedKey)
+	if err != nil {
+		lgr.Debug(fmt.Sprintf("[Handlers] [SRP] [openSessionWrappingKey] [DecodeString] %v", err))
+		return nil, false
+	}
+
+	blockCipher, err := aes.NewCipher(sessionKey)
+	if err != nil {
+		lgr.Debug(fmt.Sprintf("[Handlers] [SRP] [openSessionWrappingKey] [NewCipher] %v", err))
+		return nil, false
+	}
+
+	wrappingKey, err := utils.GCMDecrypt(envelope, blockCipher)
+	if err != nil {
+		lgr.Debug(fmt.Sprintf("[Handlers] [SRP] [openSessionWrappingKey] [GCMDecrypt] %v", err))
+		return nil, false
+	}
+
+	wrap := types.KeyWrap{Key: usr.EncryptionKey, Salt: usr.KDFSalt, Params: usr.KDFParams}
+	key, ok, err := openKeyWrap(wrap, usr.KeyHash, wrappingKey, lgr)
+	if err != nil {
+		lgr.Debug(fmt.Sprintf("[Handlers] [SRP] [openSessionWrappingKey] [openKeyWrap] %v", err))
+		return nil, false
+	}
+	return key, ok
+}
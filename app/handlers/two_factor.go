@@ -0,0 +1,178 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/audit"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/http/resperr"
+	"github.com/sid-sun/arche-api/app/service"
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/app/utils"
+	"github.com/sid-sun/arche-api/config"
+	"go.uber.org/zap"
+)
+
+func EnrollTOTPHandler(svc service.TwoFactorService, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+
+		resp, errx := svc.EnrollTOTP(claims)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [TwoFactor] [EnrollTOTPHandler] [EnrollTOTP] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			if errx.Kind() == custom_errors.TwoFactorAlreadyEnabled {
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusConflict, "two-factor authentication is already enabled"), w, lgr)
+				return
+			}
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+	}
+}
+
+func ConfirmTOTPHandler(svc service.TwoFactorService, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+
+		d, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [TwoFactor] [ConfirmTOTPHandler] [ReadAll] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "could not read request body"), w, lgr)
+			return
+		}
+
+		var data types.TOTPCodeRequest
+		err = json.Unmarshal(d, &data)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [TwoFactor] [ConfirmTOTPHandler] [Unmarshal] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "an error occoured when unmarshaling JSON"), w, lgr)
+			return
+		}
+
+		backupCodes, errx := svc.ConfirmTOTP(claims, data.Code)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [TwoFactor] [ConfirmTOTPHandler] [ConfirmTOTP] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			writeTwoFactorFailure(errx.Kind(), errx.String(), w, lgr)
+			return
+		}
+
+		utils.WriteSuccessResponse(http.StatusOK, types.ConfirmTOTPResponse{Enabled: true, BackupCodes: backupCodes}, w, lgr)
+	}
+}
+
+func DisableTOTPHandler(svc service.TwoFactorService, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+
+		d, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [TwoFactor] [DisableTOTPHandler] [ReadAll] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "could not read request body"), w, lgr)
+			return
+		}
+
+		var data types.TOTPCodeRequest
+		err = json.Unmarshal(d, &data)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [TwoFactor] [DisableTOTPHandler] [Unmarshal] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "an error occoured when unmarshaling JSON"), w, lgr)
+			return
+		}
+
+		errx := svc.DisableTOTP(claims, data.Code)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [TwoFactor] [DisableTOTPHandler] [DisableTOTP] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			writeTwoFactorFailure(errx.Kind(), errx.String(), w, lgr)
+			return
+		}
+
+		utils.WriteSuccessResponse(http.StatusOK, types.DisableTOTPResponse{Disabled: true}, w, lgr)
+	}
+}
+
+// TwoFactorLoginHandler completes a login started by LoginUserHandler for users with 2FA enabled
+func TwoFactorLoginHandler(svc service.TwoFactorService, usersSvc service.UsersService, sessionsSvc service.SessionsService, auditLog audit.Log, cfg *config.JWTConfig, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		d, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [TwoFactor] [TwoFactorLoginHandler] [ReadAll] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "could not read request body"), w, lgr)
+			return
+		}
+
+		var data types.TwoFactorLoginRequest
+		err = json.Unmarshal(d, &data)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [TwoFactor] [TwoFactorLoginHandler] [Unmarshal] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "an error occoured when unmarshaling JSON"), w, lgr)
+			return
+		}
+
+		userID, key, errx := sessionsSvc.RedeemChallenge(data.ChallengeToken, cfg)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [TwoFactor] [TwoFactorLoginHandler] [RedeemChallenge] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			if errx.Kind() == custom_errors.InvalidChallengeToken {
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "challenge token is invalid or expired, log in again"), w, lgr)
+				return
+			}
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		errx = svc.VerifyCode(userID, key, data.Code)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [TwoFactor] [TwoFactorLoginHandler] [VerifyCode] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			auditLog.Record(userID, audit.EventTwoFactorLogin, audit.OutcomeFailure, clientInfo(req, data.DeviceLabel))
+			writeTwoFactorFailure(errx.Kind(), errx.String(), w, lgr)
+			return
+		}
+
+		usr, errx := usersSvc.GetUserByID(userID)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [TwoFactor] [TwoFactorLoginHandler] [GetUserByID] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		resp := types.LoginUserResponse{
+			ZeroKnowledge: usr.ZeroKnowledge,
+		}
+
+		resp.AuthenticationToken, resp.RefreshToken, errx = sessionsSvc.Start(userID, key, clientInfo(req, data.DeviceLabel), cfg)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [TwoFactor] [TwoFactorLoginHandler] [Start] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+		resp.KeyBundle = usr.KeyBundle
+
+		auditLog.Record(userID, audit.EventTwoFactorLogin, audit.OutcomeSuccess, clientInfo(req, data.DeviceLabel))
+		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+	}
+}
+
+func writeTwoFactorFailure(kind erx.Kind, msg string, w http.ResponseWriter, lgr *zap.Logger) {
+	switch kind {
+	case custom_errors.InvalidTwoFactorCode:
+		utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "two-factor code is not valid"), w, lgr)
+	case custom_errors.TwoFactorAlreadyEnabled:
+		utils.WriteFailureResponse(resperr.NewResponseError(http.StatusConflict, "two-factor authentication is already enabled"), w, lgr)
+	case custom_errors.TwoFactorNotEnabled:
+		utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "two-factor authentication is not enabled"), w, lgr)
+	default:
+		utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, msg), w, lgr)
+	}
+}
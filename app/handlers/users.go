@@ -1,29 +1,28 @@
 package handlers
 
 import (
-	"bytes"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
 
+	"github.com/sid-sun/arche-api/app/audit"
 	"github.com/sid-sun/arche-api/app/custom_errors"
 	"github.com/sid-sun/arche-api/app/http/resperr"
 	"github.com/sid-sun/arche-api/app/service"
+	"github.com/sid-sun/arche-api/app/throttle"
 	"github.com/sid-sun/arche-api/app/types"
 	"github.com/sid-sun/arche-api/app/utils"
 	"github.com/sid-sun/arche-api/config"
 	"go.uber.org/zap"
-	"golang.org/x/crypto/sha3"
 )
 
-func CreateUserHandler(svc service.UsersService, veCfg *config.VerificationEmailConfig, cfg *config.JWTConfig, lgr *zap.Logger) http.HandlerFunc {
+func CreateUserHandler(svc service.UsersService, auditLog audit.Log, veCfg *config.VerificationEmailConfig, kdfCfg *config.KDFConfig, lgr *zap.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		d, err := ioutil.ReadAll(req.Body)
 		if err != nil {
-			lgr.Debug(fmt.Sprintf("[Handlers] [CreateUserHandler] [ReadAll] %v", err))
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [CreateUserHandler] [ReadAll] %v", err))
 			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "could not read request body"), w, lgr)
 			return
 		}
@@ -31,7 +30,7 @@ func CreateUserHandler(svc service.UsersService, veCfg *config.VerificationEmail
 		var data types.CreateUserRequest
 		err = json.Unmarshal(d, &data)
 		if err != nil {
-			lgr.Debug(fmt.Sprintf("[Handlers] [CreateUserHandler] [Unmarshal] %v", err))
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [CreateUserHandler] [Unmarshal] %v", err))
 			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "an error occoured when unmarshaling JSON"), w, lgr)
 			return
 		}
@@ -43,19 +42,49 @@ func CreateUserHandler(svc service.UsersService, veCfg *config.VerificationEmail
 			return
 		}
 
+		if !data.ZeroKnowledge {
+			data.KeyBundle = ""
+		} else if errMsg := validateKeyBundle(data.KeyBundle); errMsg != "" {
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, errMsg), w, lgr)
+			return
+		}
+
 		key, hash, err := utils.GenerateEncryptionKey(lgr)
 		if err != nil {
-			lgr.Debug(fmt.Sprintf("[Handlers] [CreateUserHandler] [GenerateEncryptionKey] %v", err))
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [CreateUserHandler] [GenerateEncryptionKey] %v", err))
 			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, "could not generate encryption keys"), w, lgr)
 			return
 		}
 
 		decryptedKey := make([]byte, len(key))
 		copy(decryptedKey, key)
-		utils.EncryptKey(key, data.Password, lgr)
-		verificationToken := utils.RandString(veCfg.GetTokenLength())
+		kdfParams := utils.NewKDFParams(kdfCfg)
+		salt, err := wrapUserKey(key, data.Password, kdfParams, lgr)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [CreateUserHandler] [wrapUserKey] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, "could not generate encryption keys"), w, lgr)
+			return
+		}
+		recovery, recoveryCode, err := wrapRecoveryKey(decryptedKey, kdfParams, lgr)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [CreateUserHandler] [wrapRecoveryKey] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, "could not generate encryption keys"), w, lgr)
+			return
+		}
+		srpVerifier, err := newSRPVerifier(data.Password, kdfParams, lgr)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [CreateUserHandler] [newSRPVerifier] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, "could not generate encryption keys"), w, lgr)
+			return
+		}
+		verificationToken, err := utils.RandString(veCfg.GetTokenLength())
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [CreateUserHandler] [RandString] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, "could not generate verification token"), w, lgr)
+			return
+		}
 
-		_, errx := svc.CreateUser(data.Email, key, hash, verificationToken)
+		usr, errx := svc.CreateUser(data.Email, key, hash, salt, kdfParams.String(), recovery, srpVerifier, data.KeyBundle, verificationToken)
 		if errx != nil {
 			if errx.Kind() == custom_errors.DuplicateRecordInsertion {
 				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "user already exists"), w, lgr)
@@ -67,28 +96,30 @@ func CreateUserHandler(svc service.UsersService, veCfg *config.VerificationEmail
 			return
 		}
 
+		auditLog.Record(usr.ID, audit.EventSignup, audit.OutcomeSuccess, clientInfo(req, ""))
+
 		resp := types.CreateUserResponse{
 			VerificationEmailSent: false,
 			UserCreated:           true,
+			RecoveryCode:          recoveryCode,
 		}
-		fmt.Printf("here")
 
 		errx = svc.SendVerificationEmail(data.Email, verificationToken, data.VerificationCallbackURL, veCfg)
 		if errx != nil {
-			fmt.Printf(errx.String())
 			errMsg := fmt.Sprintf("[Handlers] [Users] [CreateUserHandler] [SendVerificationEmail] %s", errx.Error())
 			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
 			utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
 			return
 		}
 		resp.VerificationEmailSent = true
-		fmt.Printf("where")
 
 		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
 	}
 }
 
-func LoginUserHandler(svc service.UsersService, cfg *config.JWTConfig, lgr *zap.Logger) http.HandlerFunc {
+// LoginUserHandler logs in with a password, unknown addresses and wrong passwords fail alike and both count
+// towards the throttle, so responses do not tell which accounts exist
+func LoginUserHandler(svc service.UsersService, sessionsSvc service.SessionsService, throttleSvc service.LoginThrottleService, rotationSvc service.KeyRotationService, auditLog audit.Log, cfg *config.JWTConfig, kdfCfg *config.KDFConfig, veCfg *config.VerificationEmailConfig, lgr *zap.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		d, err := ioutil.ReadAll(req.Body)
 		if err != nil {
@@ -112,10 +143,28 @@ func LoginUserHandler(svc service.UsersService, cfg *config.JWTConfig, lgr *zap.
 			return
 		}
 
+		client := clientInfo(req, data.DeviceLabel)
+		decision, errx := throttleSvc.Check(data.Email, client.IPAddress)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [Users] [LoginUserHandler] [Check] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		if !decision.Allowed() {
+			lgr.Info(fmt.Sprintf("[Handlers] [Users] [LoginUserHandler] [Check] throttled for %v, locked: %t", decision.RetryAfter, decision.Locked))
+			auditLog.Record(0, audit.EventLogin, audit.OutcomeThrottled, client)
+			writeThrottled(decision.RetryAfter, w, lgr)
+			return
+		}
+
 		usr, errx := svc.GetUser(data.Email)
 		if errx != nil {
 			if errx.Kind() == custom_errors.NoRowsInResultSet {
-				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "user does not exist"), w, lgr)
+				// Take as long as checking a password would, so timing does not give the address away either
+				burnKDF(data.Password, kdfCfg)
+				failLogin(svc, throttleSvc, auditLog, decision, types.User{}, data.Email, client, veCfg, w, lgr)
 				return
 			}
 			errMsg := fmt.Sprintf("[Handlers] [Users] [LoginUserHandler] [GetUser] %s", errx.Error())
@@ -124,29 +173,61 @@ func LoginUserHandler(svc service.UsersService, cfg *config.JWTConfig, lgr *zap.
 			return
 		}
 
-		key, err := base64.StdEncoding.DecodeString(usr.EncryptionKey)
+		key, ok, err := unwrapUserKey(usr, data.Password, lgr)
 		if err != nil {
-			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [LoginUserHandler] [DecodeString] EncryptionKey %v", err))
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [LoginUserHandler] [unwrapUserKey] %v", err))
 			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, err.Error()), w, lgr)
 			return
 		}
 
-		_ = utils.DecryptKey(key, data.Password, lgr)
-		hash, err := base64.StdEncoding.DecodeString(usr.KeyHash)
-		if err != nil {
-			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [LoginUserHandler] [DecodeString] Hash %v", err))
-			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, err.Error()), w, lgr)
+		if !ok {
+			failLogin(svc, throttleSvc, auditLog, decision, usr, data.Email, client, veCfg, w, lgr)
 			return
 		}
 
-		keyHash := sha3.Sum256(key)
-		if !bytes.Equal(hash, keyHash[:]) {
-			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "incorrect password"), w, lgr)
-			return
+		if errx = throttleSvc.Succeed(decision, data.Email, client.IPAddress); errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [Users] [LoginUserHandler] [Succeed] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
 		}
+		auditLog.Record(usr.ID, audit.EventLogin, audit.OutcomeSuccess, client)
 
 		resp := types.LoginUserResponse{
 			VerificationPending: true,
+			ZeroKnowledge:       usr.ZeroKnowledge,
+		}
+
+		// A pending rotation needs the password to wrap the new key, so it is finished here before any session
+		// gets a key, its password wrap uses the current KDF parameters
+		if usr.KeyRotationPending {
+			key, resp.RecoveryCode, errx = finishKeyRotation(rotationSvc, usr, key, data.Password, kdfCfg, lgr)
+			if errx != nil {
+				errMsg := fmt.Sprintf("[Handlers] [Users] [LoginUserHandler] [finishKeyRotation] %s", errx.Error())
+				utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+				return
+			}
+			auditLog.Record(usr.ID, audit.EventKeyRotation, audit.OutcomeSuccess, client)
+		} else if kdfParams := utils.NewKDFParams(kdfCfg); needsKDFUpgrade(usr, kdfParams) {
+			// The password is known to be correct here, which is the only time a legacy
+			// or weaker key wrap can be replaced, failing to do so must not block the login
+			wrappedKey := make([]byte, len(key))
+			copy(wrappedKey, key)
+			if salt, err := wrapUserKey(wrappedKey, data.Password, kdfParams, lgr); err == nil {
+				if errx := svc.UpgradeKeyWrap(usr.ID, wrappedKey, salt, kdfParams.String()); errx != nil {
+					errMsg := fmt.Sprintf("[Handlers] [Users] [LoginUserHandler] [UpgradeKeyWrap] %s", errx.Error())
+					utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+				}
+			}
+		}
+
+		// Likewise the SRP verifier of accounts from before SRP logins, or with weaker parameters, is made here
+		if kdfParams := utils.NewKDFParams(kdfCfg); needsSRPVerifier(usr, kdfParams) {
+			if srpVerifier, err := newSRPVerifier(data.Password, kdfParams, lgr); err == nil {
+				if errx := svc.SetSRPVerifier(usr.ID, srpVerifier); errx != nil {
+					errMsg := fmt.Sprintf("[Handlers] [Users] [LoginUserHandler] [SetSRPVerifier] %s", errx.Error())
+					utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+				}
+			}
 		}
 
 		if !usr.Verified {
@@ -156,18 +237,105 @@ func LoginUserHandler(svc service.UsersService, cfg *config.JWTConfig, lgr *zap.
 		}
 
 		resp.VerificationPending = false
-		resp.AuthenticationToken, resp.RefreshToken, err = utils.IssueTokens(usr.ID, key, cfg, lgr)
-		if err != nil {
-			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [LoginUserHandler] [IssueTokens] %v", err))
-			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, err.Error()), w, lgr)
+		if usr.TOTPEnabled || usr.WebAuthnEnabled {
+			resp.TwoFactorRequired = true
+			if usr.TOTPEnabled {
+				resp.SecondFactors = append(resp.SecondFactors, "totp")
+			}
+			if usr.WebAuthnEnabled {
+				resp.SecondFactors = append(resp.SecondFactors, "webauthn")
+			}
+			resp.ChallengeToken, errx = sessionsSvc.StartChallenge(usr.ID, key, cfg)
+			if errx != nil {
+				errMsg := fmt.Sprintf("[Handlers] [Users] [LoginUserHandler] [StartChallenge] %s", errx.Error())
+				utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+				return
+			}
+			utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
 			return
 		}
 
+		resp.AuthenticationToken, resp.RefreshToken, errx = sessionsSvc.Start(usr.ID, key, client, cfg)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [Users] [LoginUserHandler] [Start] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+		resp.KeyBundle = usr.KeyBundle
+
 		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
 	}
 }
 
-func ActivateUserHandler(svc service.UsersService, lgr *zap.Logger) http.HandlerFunc {
+// failLogin records a failed login and answers it, the lockout email only goes out to existing accounts and its link
+// points at the configured unlock page, as the failing request may well be the attacker's
+func failLogin(svc service.UsersService, throttleSvc service.LoginThrottleService, auditLog audit.Log, decision throttle.Decision, usr types.User, email string, client types.ClientInfo, veCfg *config.VerificationEmailConfig, w http.ResponseWriter, lgr *zap.Logger) {
+	auditLog.Record(usr.ID, audit.EventLogin, audit.OutcomeFailure, client)
+	countFailedLogin(svc, throttleSvc, decision, usr, email, veCfg, lgr)
+
+	utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "incorrect email or password"), w, lgr)
+}
+
+// countFailedLogin leaves a wrong password or code counted by the throttle and sends the lockout email when it
+// locked the account out
+func countFailedLogin(svc service.UsersService, throttleSvc service.LoginThrottleService, decision throttle.Decision, usr types.User, email string, veCfg *config.VerificationEmailConfig, lgr *zap.Logger) {
+	justLocked, errx := throttleSvc.Fail(decision, email)
+	if errx != nil {
+		errMsg := fmt.Sprintf("[Handlers] [Users] [countFailedLogin] [Fail] %s", errx.Error())
+		utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+	}
+
+	if justLocked && usr.ID != 0 && veCfg.GetUnlockLinkURL() != "" {
+		lgr.Info(fmt.Sprintf("[Handlers] [Users] [countFailedLogin] account %d locked out", usr.ID))
+		token, errx := throttleSvc.StartUnlock(usr.ID)
+		if errx == nil {
+			errx = svc.SendUnlockEmail(usr.Email, token, veCfg)
+		}
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [Users] [countFailedLogin] [SendUnlockEmail] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+		}
+	}
+}
+
+// UnlockLoginHandler lifts a lockout with the token from the unlock email
+func UnlockLoginHandler(throttleSvc service.LoginThrottleService, auditLog audit.Log, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		d, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [UnlockLoginHandler] [ReadAll] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "could not read request body"), w, lgr)
+			return
+		}
+
+		var data types.UnlockLoginRequest
+		err = json.Unmarshal(d, &data)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [UnlockLoginHandler] [Unmarshal] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "an error occoured when unmarshaling JSON"), w, lgr)
+			return
+		}
+
+		userID, errx := throttleSvc.RedeemUnlock(data.Token)
+		if errx != nil {
+			if errx.Kind() == custom_errors.InvalidUnlockToken {
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "unlock link is not valid or has expired"), w, lgr)
+				return
+			}
+			errMsg := fmt.Sprintf("[Handlers] [Users] [UnlockLoginHandler] [RedeemUnlock] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		auditLog.Record(userID, audit.EventLoginUnlocked, audit.OutcomeSuccess, clientInfo(req, ""))
+		utils.WriteSuccessResponse(http.StatusOK, types.UnlockLoginResponse{Unlocked: true}, w, lgr)
+	}
+}
+
+func ActivateUserHandler(svc service.UsersService, auditLog audit.Log, veCfg *config.VerificationEmailConfig, lgr *zap.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		d, err := ioutil.ReadAll(req.Body)
 		if err != nil {
@@ -184,13 +352,23 @@ func ActivateUserHandler(svc service.UsersService, lgr *zap.Logger) http.Handler
 			return
 		}
 
-		errx := svc.ActivateUser(data.VerificationToken)
+		userID, errx := svc.ActivateUser(data.VerificationToken, veCfg)
 		if errx != nil {
-			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [ActivateUserHandler] [ActivateUser] %v", err))
-			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, err.Error()), w, lgr)
+			switch errx.Kind() {
+			case custom_errors.InvalidVerificationToken:
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "verification token is not valid"), w, lgr)
+			case custom_errors.VerificationTokenExpired:
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusGone, "verification token has expired"), w, lgr)
+			default:
+				errMsg := fmt.Sprintf("[Handlers] [Users] [ActivateUserHandler] [ActivateUser] %s", errx.Error())
+				utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			}
 			return
 		}
 
+		auditLog.Record(userID, audit.EventActivation, audit.OutcomeSuccess, clientInfo(req, ""))
+
 		resp := types.ActivateUserResponse{
 			VerificationPending: false,
 		}
@@ -199,7 +377,7 @@ func ActivateUserHandler(svc service.UsersService, lgr *zap.Logger) http.Handler
 	}
 }
 
-func ResendValidationHandler(svc service.UsersService, veCfg *config.VerificationEmailConfig, lgr *zap.Logger) http.HandlerFunc {
+func ResendValidationHandler(svc service.UsersService, auditLog audit.Log, veCfg *config.VerificationEmailConfig, lgr *zap.Logger) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		d, err := ioutil.ReadAll(req.Body)
 		if err != nil {
@@ -217,37 +395,43 @@ func ResendValidationHandler(svc service.UsersService, veCfg *config.Verificatio
 		}
 		data.Email = strings.ToLower(data.Email)
 
-		verified, token, errx := svc.GetVerificationStatus(data.Email)
+		usr, errx := svc.GetUser(data.Email)
 		if errx != nil {
-			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [ActivateUserHandler] [ActivateUser] %v", errx))
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [ActivateUserHandler] [GetUser] %v", errx))
 			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, errx.Error()), w, lgr)
 			return
 		}
 
-		if verified {
+		if usr.Verified {
 			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "user is already verified"), w, lgr)
 			return
 		}
 
-		if token == "" {
-			token = utils.RandString(veCfg.GetTokenLength())
-			errx = svc.UpdateVerificationToken(data.Email, token)
-			if errx != nil {
-				lgr.Debug(fmt.Sprintf("[Handlers] [Users] [ActivateUserHandler] [UpdateVerificationToken] %v", errx))
-				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.Error()), w, lgr)
-				return
-			}
+		// Only a hash of the previous token is stored, so every resend issues a new one and restarts its lifetime
+		token, err := utils.RandString(veCfg.GetTokenLength())
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [ActivateUserHandler] [RandString] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, "could not generate verification token"), w, lgr)
+			return
+		}
+
+		errx = svc.UpdateVerificationToken(data.Email, token)
+		if errx != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [ActivateUserHandler] [UpdateVerificationToken] %v", errx))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.Error()), w, lgr)
+			return
 		}
 
 		errx = svc.SendVerificationEmail(data.Email, token, data.VerificationCallbackURL, veCfg)
 		if errx != nil {
-			fmt.Println(errx.String())
 			errMsg := fmt.Sprintf("[Handlers] [Users] [ActivateUserHandler] [SendVerificationEmail] %s", errx.Error())
 			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
 			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.Error()), w, lgr)
 			return
 		}
 
+		auditLog.Record(usr.ID, audit.EventVerificationResent, audit.OutcomeSuccess, clientInfo(req, ""))
+
 		resp := types.ResendVerificationResponse{
 			VerificationEmailSent: true,
 		}
@@ -255,3 +439,298 @@ func ResendValidationHandler(svc service.UsersService, veCfg *config.Verificatio
 		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
 	}
 }
+
+func ChangePasswordHandler(svc service.UsersService, auditLog audit.Log, kdfCfg *config.KDFConfig, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+
+		d, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [ChangePasswordHandler] [ReadAll] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "could not read request body"), w, lgr)
+			return
+		}
+
+		var data types.ChangePasswordRequest
+		err = json.Unmarshal(d, &data)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [ChangePasswordHandler] [Unmarshal] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "an error occoured when unmarshaling JSON"), w, lgr)
+			return
+		}
+
+		if data.NewPassword == "" {
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "new password cannot be empty"), w, lgr)
+			return
+		}
+
+		usr, errx := svc.GetUserByID(claims.UserID)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [Users] [ChangePasswordHandler] [GetUserByID] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		key, ok, err := unwrapUserKey(usr, data.OldPassword, lgr)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [ChangePasswordHandler] [unwrapUserKey] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, err.Error()), w, lgr)
+			return
+		}
+
+		if !ok {
+			auditLog.Record(usr.ID, audit.EventPasswordChange, audit.OutcomeFailure, clientInfo(req, ""))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "incorrect password"), w, lgr)
+			return
+		}
+
+		kdfParams := utils.NewKDFParams(kdfCfg)
+		salt, err := wrapUserKey(key, data.NewPassword, kdfParams, lgr)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [ChangePasswordHandler] [wrapUserKey] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, err.Error()), w, lgr)
+			return
+		}
+
+		srpVerifier, err := newSRPVerifier(data.NewPassword, kdfParams, lgr)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [ChangePasswordHandler] [newSRPVerifier] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, err.Error()), w, lgr)
+			return
+		}
+
+		errx = svc.ChangePassword(usr.ID, key, salt, kdfParams.String(), srpVerifier)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [Users] [ChangePasswordHandler] [ChangePassword] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		auditLog.Record(usr.ID, audit.EventPasswordChange, audit.OutcomeSuccess, clientInfo(req, ""))
+
+		resp := types.ChangePasswordResponse{
+			PasswordChanged: true,
+		}
+
+		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+	}
+}
+
+// DeleteAccountHandler erases the signed in user and all of their data once the password is re-confirmed
+func DeleteAccountHandler(svc service.UsersService, veCfg *config.VerificationEmailConfig, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+
+		d, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [DeleteAccountHandler] [ReadAll] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "could not read request body"), w, lgr)
+			return
+		}
+
+		var data types.DeleteAccountRequest
+		err = json.Unmarshal(d, &data)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [DeleteAccountHandler] [Unmarshal] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "an error occoured when unmarshaling JSON"), w, lgr)
+			return
+		}
+
+		usr, errx := svc.GetUserByID(claims.UserID)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [Users] [DeleteAccountHandler] [GetUserByID] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		_, ok, err := unwrapUserKey(usr, data.Password, lgr)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [DeleteAccountHandler] [unwrapUserKey] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, err.Error()), w, lgr)
+			return
+		}
+
+		if !ok {
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "incorrect password"), w, lgr)
+			return
+		}
+
+		errx = svc.DeleteAccount(usr.ID)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [Users] [DeleteAccountHandler] [DeleteAccount] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		// The audit log of the account went with it, only the anonymous account_deletions row is left
+		resp := types.DeleteAccountResponse{
+			Deleted: true,
+		}
+
+		// The account is already gone, a failed confirmation must not turn into an error response
+		errx = svc.SendNoticeEmail(usr.Email, veCfg.GetDeletionSubject(), veCfg.GetDeletionBody(), veCfg)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [Users] [DeleteAccountHandler] [SendNoticeEmail] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+			return
+		}
+		resp.NoticeEmailSent = true
+
+		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+	}
+}
+
+// ChangeEmailHandler starts moving the signed in user to a new address, a verification token goes to the new
+// address and a notice to the current one, nothing changes until the token is confirmed
+func ChangeEmailHandler(svc service.UsersService, auditLog audit.Log, veCfg *config.VerificationEmailConfig, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+
+		d, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [ChangeEmailHandler] [ReadAll] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "could not read request body"), w, lgr)
+			return
+		}
+
+		var data types.ChangeEmailRequest
+		err = json.Unmarshal(d, &data)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [ChangeEmailHandler] [Unmarshal] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "an error occoured when unmarshaling JSON"), w, lgr)
+			return
+		}
+		data.NewEmail = strings.ToLower(data.NewEmail)
+
+		if errx := validateEmail(data.NewEmail); errx != nil {
+			lgr.Info(fmt.Sprintf("[Handlers] [Users] [validateEmail] [InvalidEmail] %v", errx.String()))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "email address is not valid"), w, lgr)
+			return
+		}
+
+		usr, errx := svc.GetUserByID(claims.UserID)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [Users] [ChangeEmailHandler] [GetUserByID] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		_, ok, err := unwrapUserKey(usr, data.Password, lgr)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [ChangeEmailHandler] [unwrapUserKey] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, err.Error()), w, lgr)
+			return
+		}
+
+		if !ok {
+			auditLog.Record(usr.ID, audit.EventEmailChange, audit.OutcomeFailure, clientInfo(req, ""))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "incorrect password"), w, lgr)
+			return
+		}
+
+		if data.NewEmail == usr.Email {
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "new email address is the current one"), w, lgr)
+			return
+		}
+
+		// Catches the common case early, the unique index still decides when the change is confirmed
+		if _, errx = svc.GetUser(data.NewEmail); errx == nil {
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusConflict, "email address is already in use"), w, lgr)
+			return
+		} else if errx.Kind() != custom_errors.NoRowsInResultSet {
+			errMsg := fmt.Sprintf("[Handlers] [Users] [ChangeEmailHandler] [GetUser] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		verificationToken, err := utils.RandString(veCfg.GetTokenLength())
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [ChangeEmailHandler] [RandString] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, "could not generate verification token"), w, lgr)
+			return
+		}
+
+		errx = svc.RequestEmailChange(usr.ID, data.NewEmail, verificationToken)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [Users] [ChangeEmailHandler] [RequestEmailChange] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		errx = svc.SendVerificationEmail(data.NewEmail, verificationToken, data.VerificationCallbackURL, veCfg)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [Users] [ChangeEmailHandler] [SendVerificationEmail] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.Error()), w, lgr)
+			return
+		}
+
+		auditLog.Record(usr.ID, audit.EventEmailChange, audit.OutcomeSuccess, clientInfo(req, ""))
+
+		resp := types.ChangeEmailResponse{
+			VerificationEmailSent: true,
+		}
+
+		errx = svc.SendNoticeEmail(usr.Email, veCfg.GetEmailChangeSubject(), veCfg.GetEmailChangeBody(data.NewEmail), veCfg)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [Users] [ChangeEmailHandler] [SendNoticeEmail] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+			return
+		}
+		resp.NoticeEmailSent = true
+
+		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+	}
+}
+
+// ConfirmEmailChangeHandler switches the account to its pending address using the token sent there
+func ConfirmEmailChangeHandler(svc service.UsersService, veCfg *config.VerificationEmailConfig, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		d, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [ConfirmEmailChangeHandler] [ReadAll] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "could not read request body"), w, lgr)
+			return
+		}
+
+		var data types.ConfirmEmailChangeRequest
+		err = json.Unmarshal(d, &data)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Users] [ConfirmEmailChangeHandler] [Unmarshal] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "an error occoured when unmarshaling JSON"), w, lgr)
+			return
+		}
+
+		errx := svc.ConfirmEmailChange(data.VerificationToken, veCfg)
+		if errx != nil {
+			switch errx.Kind() {
+			case custom_errors.InvalidVerificationToken:
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "verification token is not valid"), w, lgr)
+			case custom_errors.VerificationTokenExpired:
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusGone, "verification token has expired"), w, lgr)
+			case custom_errors.DuplicateRecordInsertion:
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusConflict, "email address is already in use"), w, lgr)
+			default:
+				errMsg := fmt.Sprintf("[Handlers] [Users] [ConfirmEmailChangeHandler] [ConfirmEmailChange] %s", errx.Error())
+				utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			}
+			return
+		}
+
+		resp := types.ConfirmEmailChangeResponse{
+			EmailChanged: true,
+		}
+
+		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+	}
+}
@@ -1,11 +1,26 @@
 package handlers
 
 import (
+	"bytes"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
 	"regexp"
+	"strconv"
+	"time"
 
 	"github.com/nsnikhil/erx"
 	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/http/resperr"
+	"github.com/sid-sun/arche-api/app/srp"
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/app/utils"
+	"github.com/sid-sun/arche-api/config"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/sha3"
 )
 
 func validateEmail(email string) *erx.Erx {
@@ -15,3 +30,203 @@ func validateEmail(email string) *erx.Erx {
 	}
 	return nil
 }
+
+// wrapUserKey wraps key in place under password with a fresh salt, returning the salt
+func wrapUserKey(key []byte, password string, params utils.KDFParams, lgr *zap.Logger) ([]byte, error) {
+	salt, err := utils.GenerateKDFSalt()
+	if err != nil {
+		lgr.Debug(fmt.Sprintf("[Handlers] [Utils] [wrapUserKey] [GenerateKDFSalt] %v", err))
+		return nil, err
+	}
+
+	utils.EncryptKey(key, utils.DeriveWrappingKey(password, salt, params), lgr)
+	return salt, nil
+}
+
+// wrapRecoveryKey wraps a copy of key under a fresh recovery code, returning the wrap and the code to show the user
+func wrapRecoveryKey(key []byte, params utils.KDFParams, lgr *zap.Logger) (types.KeyWrap, string, error) {
+	code, err := utils.GenerateRecoveryCode()
+	if err != nil {
+		lgr.Debug(fmt.Sprintf("[Handlers] [Utils] [wrapRecoveryKey] [GenerateRecoveryCode] %v", err))
+		return types.KeyWrap{}, "", err
+	}
+
+	recovery, err := wrapKeyCopy(key, utils.NormalizeRecoveryCode(code), params, lgr)
+	if err != nil {
+		return types.KeyWrap{}, "", err
+	}
+	return recovery, code, nil
+}
+
+// wrapKeyCopy wraps a copy of key under secret, leaving key as it is
+func wrapKeyCopy(key []byte, secret string, params utils.KDFParams, lgr *zap.Logger) (types.KeyWrap, error) {
+	wrappedKey := make([]byte, len(key))
+	copy(wrappedKey, key)
+	salt, err := wrapUserKey(wrappedKey, secret, params, lgr)
+	if err != nil {
+		return types.KeyWrap{}, err
+	}
+
+	return types.KeyWrap{
+		Key:    base64.StdEncoding.EncodeToString(wrappedKey),
+		Salt:   base64.StdEncoding.EncodeToString(salt),
+		Params: params.String(),
+	}, nil
+}
+
+// newSRPVerifier derives the SRP verifier of password under a fresh salt
+func newSRPVerifier(password string, params utils.KDFParams, lgr *zap.Logger) (types.SRPVerifier, error) {
+	salt, err := utils.GenerateKDFSalt()
+	if err != nil {
+		lgr.Debug(fmt.Sprintf("[Handlers] [Utils] [newSRPVerifier] [GenerateKDFSalt] %v", err))
+		return types.SRPVerifier{}, err
+	}
+
+	return types.SRPVerifier{
+		Salt:     base64.StdEncoding.EncodeToString(salt),
+		Verifier: base64.StdEncoding.EncodeToString(srp.Verifier(utils.DeriveSRPKey(password, salt, params))),
+		Params:   params.String(),
+	}, nil
+}
+
+// unwrapUserKey decrypts the user's data key with password and checks it against the stored key hash
+// ok is false when the password is incorrect
+func unwrapUserKey(usr types.User, password string, lgr *zap.Logger) (key []byte, ok bool, err error) {
+	wrap := types.KeyWrap{Key: usr.EncryptionKey, Salt: usr.KDFSalt, Params: usr.KDFParams}
+	return unwrapKey(wrap, usr.KeyHash, password, lgr)
+}
+
+// unwrapRecoveryKey decrypts the user's data key with a recovery code, ok is false when the code is
+// incorrect or the account has no recovery wrap
+func unwrapRecoveryKey(usr types.User, code string, lgr *zap.Logger) (key []byte, ok bool, err error) {
+	if usr.Recovery.Key == "" {
+		return nil, false, nil
+	}
+	return unwrapKey(usr.Recovery, usr.KeyHash, utils.NormalizeRecoveryCode(code), lgr)
+}
+
+// unwrapVaultKey decrypts the user's data key with the vault passphrase of their OpenID Connect login, ok is
+// false when the passphrase is incorrect or no identity is linked
+func unwrapVaultKey(usr types.User, passphrase string, lgr *zap.Logger) (key []byte, ok bool, err error) {
+	if usr.Vault.Key == "" {
+		return nil, false, nil
+	}
+	return unwrapKey(usr.Vault, usr.KeyHash, passphrase, lgr)
+}
+
+// unwrapKey decrypts a wrapped data key with secret and checks it against keyHash, an empty salt marks a legacy SHA3 wrap
+func unwrapKey(wrap types.KeyWrap, keyHash string, secret string, lgr *zap.Logger) (key []byte, ok bool, err error) {
+	salt, err := base64.StdEncoding.DecodeString(wrap.Salt)
+	if err != nil {
+		lgr.Debug(fmt.Sprintf("[Handlers] [Utils] [unwrapKey] [DecodeString] Salt %v", err))
+		return nil, false, err
+	}
+
+	var params utils.KDFParams
+	if len(salt) != 0 {
+		if params, err = utils.ParseKDFParams(wrap.Params); err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [Utils] [unwrapKey] [ParseKDFParams] %v", err))
+			return nil, false, err
+		}
+	}
+
+	return openKeyWrap(wrap, keyHash, utils.DeriveWrappingKey(secret, salt, params), lgr)
+}
+
+// openKeyWrap decrypts a wrapped data key with a wrapping key which has already been derived and checks it against
+// keyHash, ok is false when the wrapping key does not open it
+func openKeyWrap(wrap types.KeyWrap, keyHash string, wrappingKey []byte, lgr *zap.Logger) (key []byte, ok bool, err error) {
+	key, err = base64.StdEncoding.DecodeString(wrap.Key)
+	if err != nil {
+		lgr.Debug(fmt.Sprintf("[Handlers] [Utils] [openKeyWrap] [DecodeString] Key %v", err))
+		return nil, false, err
+	}
+
+	hash, err := base64.StdEncoding.DecodeString(keyHash)
+	if err != nil {
+		lgr.Debug(fmt.Sprintf("[Handlers] [Utils] [openKeyWrap] [DecodeString] Hash %v", err))
+		return nil, false, err
+	}
+
+	// Only a wrapping key of the wrong size fails here, which cannot be the right one
+	if utils.DecryptKey(key, wrappingKey, lgr) != nil {
+		return nil, false, nil
+	}
+
+	sum := sha3.Sum256(key)
+	if !bytes.Equal(hash, sum[:]) {
+		return nil, false, nil
+	}
+
+	return key, true, nil
+}
+
+// clientInfo describes the device behind a request, clipped to what the sessions table stores
+func clientInfo(req *http.Request, deviceLabel string) types.ClientInfo {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+
+	return types.ClientInfo{
+		DeviceLabel: clip(deviceLabel, 255),
+		UserAgent:   clip(req.UserAgent(), 512),
+		IPAddress:   clip(ip, 64),
+	}
+}
+
+// writeIntegrityFailure answers an error reading folders or notes, without the details of a failed integrity check
+func writeIntegrityFailure(errx *erx.Erx, w http.ResponseWriter, lgr *zap.Logger) {
+	if errx.Kind() == custom_errors.IntegrityCheckFailed {
+		utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, "stored data failed integrity check"), w, lgr)
+		return
+	}
+	utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+}
+
+// writeThrottled answers a login which has to wait, the message is the same for locked and slowed down logins
+func writeThrottled(retryAfter time.Duration, w http.ResponseWriter, lgr *zap.Logger) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	utils.WriteFailureResponse(resperr.NewResponseError(http.StatusTooManyRequests, "too many failed login attempts, try again later"), w, lgr)
+}
+
+// dummyKDFSalt stands in for the salt of an account which does not exist
+var dummyKDFSalt = make([]byte, 16)
+
+// burnKDF derives a key nobody uses, taking as long as checking a password with the current parameters
+func burnKDF(password string, kdfCfg *config.KDFConfig) {
+	utils.DeriveWrappingKey(password, dummyKDFSalt, utils.NewKDFParams(kdfCfg))
+}
+
+func clip(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// needsKDFUpgrade reports whether the user's key wrap is legacy SHA3 or uses weaker parameters than params
+func needsKDFUpgrade(usr types.User, params utils.KDFParams) bool {
+	if usr.KDFSalt == "" {
+		return true
+	}
+
+	current, err := utils.ParseKDFParams(usr.KDFParams)
+	if err != nil {
+		return true
+	}
+	return current.WeakerThan(params)
+}
+
+// needsSRPVerifier reports whether the user has no SRP verifier yet or has one derived with weaker parameters than params
+func needsSRPVerifier(usr types.User, params utils.KDFParams) bool {
+	if usr.SRP.Verifier == "" {
+		return true
+	}
+
+	current, err := utils.ParseKDFParams(usr.SRP.Params)
+	if err != nil {
+		return true
+	}
+	return current.WeakerThan(params)
+}
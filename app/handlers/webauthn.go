@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/audit"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/http/resperr"
+	"github.com/sid-sun/arche-api/app/service"
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/app/utils"
+	"github.com/sid-sun/arche-api/config"
+	"go.uber.org/zap"
+)
+
+func BeginWebAuthnRegistrationHandler(svc service.WebAuthnService, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+
+		resp, errx := svc.BeginRegistration(claims)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [WebAuthn] [BeginWebAuthnRegistrationHandler] [BeginRegistration] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+	}
+}
+
+func FinishWebAuthnRegistrationHandler(svc service.WebAuthnService, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+
+		d, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [WebAuthn] [FinishWebAuthnRegistrationHandler] [ReadAll] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "could not read request body"), w, lgr)
+			return
+		}
+
+		var data types.FinishWebAuthnRegistrationRequest
+		err = json.Unmarshal(d, &data)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [WebAuthn] [FinishWebAuthnRegistrationHandler] [Unmarshal] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "an error occoured when unmarshaling JSON"), w, lgr)
+			return
+		}
+
+		data.Name = strings.TrimSpace(data.Name)
+		if data.Name == "" || len(data.Name) > 255 {
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "passkey name must be between 1 and 255 characters"), w, lgr)
+			return
+		}
+
+		credential, errx := svc.FinishRegistration(claims, data)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [WebAuthn] [FinishWebAuthnRegistrationHandler] [FinishRegistration] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			writeWebAuthnFailure(errx.Kind(), errx.String(), w, lgr)
+			return
+		}
+
+		utils.WriteSuccessResponse(http.StatusCreated, credentialInfo(credential), w, lgr)
+	}
+}
+
+func ListWebAuthnCredentialsHandler(svc service.WebAuthnService, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+
+		credentials, errx := svc.ListCredentials(claims.UserID)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [WebAuthn] [ListWebAuthnCredentialsHandler] [ListCredentials] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		resp := make([]types.WebAuthnCredentialInfo, len(credentials))
+		for i, credential := range credentials {
+			resp[i] = credentialInfo(credential)
+		}
+		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+	}
+}
+
+func DeleteWebAuthnCredentialHandler(svc service.WebAuthnService, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		claims := req.Context().Value("claims").(types.AccessTokenClaims)
+		paramsMap := req.Context().Value("url_params").(map[string]string)
+
+		if paramsMap["credentialID"] == "" {
+			lgr.Info("[Handlers] [WebAuthn] [DeleteWebAuthnCredentialHandler] credentialID URL parameter empty")
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "credentialID parameter not specified"), w, lgr)
+			return
+		}
+
+		errx := svc.DeleteCredential(claims.UserID, paramsMap["credentialID"])
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [WebAuthn] [DeleteWebAuthnCredentialHandler] [DeleteCredential] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			if errx.Kind() == custom_errors.NoRowsAffected {
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusNotFound, "passkey does not exist"), w, lgr)
+				return
+			}
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		utils.WriteSuccessResponse(http.StatusOK, types.DeleteWebAuthnCredentialResponse{CredentialID: paramsMap["credentialID"], Deleted: true}, w, lgr)
+	}
+}
+
+func BeginWebAuthnLoginHandler(svc service.WebAuthnService, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		d, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [WebAuthn] [BeginWebAuthnLoginHandler] [ReadAll] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "could not read request body"), w, lgr)
+			return
+		}
+
+		var data types.BeginWebAuthnLoginRequest
+		err = json.Unmarshal(d, &data)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [WebAuthn] [BeginWebAuthnLoginHandler] [Unmarshal] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "an error occoured when unmarshaling JSON"), w, lgr)
+			return
+		}
+		data.Email = strings.ToLower(data.Email)
+
+		if errx := validateEmail(data.Email); errx != nil {
+			lgr.Info(fmt.Sprintf("[Handlers] [WebAuthn] [validateEmail] [InvalidEmail] %v", errx.String()))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "email address is not valid"), w, lgr)
+			return
+		}
+
+		resp, errx := svc.BeginLogin(data.Email)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [WebAuthn] [BeginWebAuthnLoginHandler] [BeginLogin] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+
+		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+	}
+}
+
+// FinishWebAuthnLoginHandler either completes a password login as the second factor, when a challenge token
+// is sent, or logs in with the passkey alone if its prf output unlocks the data key
+func FinishWebAuthnLoginHandler(svc service.WebAuthnService, sessionsSvc service.SessionsService, auditLog audit.Log, cfg *config.JWTConfig, lgr *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		d, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [WebAuthn] [FinishWebAuthnLoginHandler] [ReadAll] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "could not read request body"), w, lgr)
+			return
+		}
+
+		var data types.FinishWebAuthnLoginRequest
+		err = json.Unmarshal(d, &data)
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Handlers] [WebAuthn] [FinishWebAuthnLoginHandler] [Unmarshal] %v", err))
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "an error occoured when unmarshaling JSON"), w, lgr)
+			return
+		}
+
+		usr, key, errx := svc.FinishLogin(data)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [WebAuthn] [FinishWebAuthnLoginHandler] [FinishLogin] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			writeWebAuthnFailure(errx.Kind(), errx.String(), w, lgr)
+			return
+		}
+
+		if data.ChallengeToken != "" {
+			userID, challengeKey, errx := sessionsSvc.RedeemChallenge(data.ChallengeToken, cfg)
+			if errx != nil {
+				errMsg := fmt.Sprintf("[Handlers] [WebAuthn] [FinishWebAuthnLoginHandler] [RedeemChallenge] %s", errx.Error())
+				utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+				if errx.Kind() == custom_errors.InvalidChallengeToken {
+					utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "challenge token is invalid or expired, log in again"), w, lgr)
+					return
+				}
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+				return
+			}
+
+			if userID != usr.ID {
+				lgr.Warn("[Handlers] [WebAuthn] [FinishWebAuthnLoginHandler] passkey and challenge token belong to different users")
+				utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "passkey does not belong to this login"), w, lgr)
+				return
+			}
+			key = challengeKey
+		} else if key == nil {
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "this passkey can not unlock notes, log in with a password"), w, lgr)
+			return
+		}
+
+		resp := types.LoginUserResponse{
+			VerificationPending: true,
+			ZeroKnowledge:       usr.ZeroKnowledge,
+		}
+
+		if !usr.Verified {
+			lgr.Info("[Handlers] [WebAuthn] [FinishWebAuthnLoginHandler] [VerifiedCheck] User is not verified")
+			utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+			return
+		}
+
+		resp.VerificationPending = false
+		resp.AuthenticationToken, resp.RefreshToken, errx = sessionsSvc.Start(usr.ID, key, clientInfo(req, data.DeviceLabel), cfg)
+		if errx != nil {
+			errMsg := fmt.Sprintf("[Handlers] [WebAuthn] [FinishWebAuthnLoginHandler] [Start] %s", errx.Error())
+			utils.LogWithSeverity(errMsg, errx.Severity, lgr)
+			utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, errx.String()), w, lgr)
+			return
+		}
+		resp.KeyBundle = usr.KeyBundle
+
+		auditLog.Record(usr.ID, audit.EventPasskeyLogin, audit.OutcomeSuccess, clientInfo(req, data.DeviceLabel))
+		utils.WriteSuccessResponse(http.StatusOK, resp, w, lgr)
+	}
+}
+
+func credentialInfo(credential types.WebAuthnCredential) types.WebAuthnCredentialInfo {
+	return types.WebAuthnCredentialInfo{
+		CredentialID: credential.CredentialID,
+		Name:         credential.Name,
+		Passwordless: credential.WrappedKey != "",
+		CreatedAt:    credential.CreatedAt,
+		LastUsedAt:   credential.LastUsedAt,
+	}
+}
+
+func writeWebAuthnFailure(kind erx.Kind, msg string, w http.ResponseWriter, lgr *zap.Logger) {
+	switch kind {
+	case custom_errors.InvalidWebAuthnResponse:
+		utils.WriteFailureResponse(resperr.NewResponseError(http.StatusUnauthorized, "passkey response could not be verified"), w, lgr)
+	case custom_errors.WebAuthnCeremonyExpired:
+		utils.WriteFailureResponse(resperr.NewResponseError(http.StatusBadRequest, "passkey ceremony expired, start again"), w, lgr)
+	default:
+		utils.WriteFailureResponse(resperr.NewResponseError(http.StatusInternalServerError, msg), w, lgr)
+	}
+}
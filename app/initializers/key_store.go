@@ -0,0 +1,21 @@
+package initializers
+
+import (
+	"fmt"
+
+	"github.com/sid-sun/arche-api/app/database"
+	"github.com/sid-sun/arche-api/app/keystore"
+	"github.com/sid-sun/arche-api/config"
+	"go.uber.org/zap"
+)
+
+func InitKeyStore(cfg *config.SessionStoreConfig, db *database.DB, lgr *zap.Logger) keystore.KeyStore {
+	switch cfg.GetBackend() {
+	case config.SessionStoreShared:
+		return keystore.NewSharedStore(db.SessionKeys, cfg.GetSecret(), lgr)
+	case config.SessionStoreMemory:
+	default:
+		lgr.Warn(fmt.Sprintf("[Initializers] [InitKeyStore] unknown session store %q, using memory", cfg.GetBackend()))
+	}
+	return keystore.NewMemoryStore()
+}
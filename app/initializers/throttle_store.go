@@ -0,0 +1,21 @@
+package initializers
+
+import (
+	"fmt"
+
+	"github.com/sid-sun/arche-api/app/database"
+	"github.com/sid-sun/arche-api/app/throttle"
+	"github.com/sid-sun/arche-api/config"
+	"go.uber.org/zap"
+)
+
+func InitThrottleStore(cfg *config.ThrottleConfig, db *database.DB, lgr *zap.Logger) throttle.Store {
+	switch cfg.GetBackend() {
+	case config.ThrottleStoreSQL:
+		return throttle.NewSQLStore(db.LoginFailures, lgr)
+	case config.ThrottleStoreMemory:
+	default:
+		lgr.Warn(fmt.Sprintf("[Initializers] [InitThrottleStore] unknown throttle store %q, using memory", cfg.GetBackend()))
+	}
+	return throttle.NewMemoryStore()
+}
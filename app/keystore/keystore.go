@@ -0,0 +1,20 @@
+package keystore
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrKeyNotFound is returned when a session has no key, either because it never existed, expired or was revoked
+var ErrKeyNotFound = errors.New("session key not found")
+
+// KeyStore holds users' data keys server-side, so tokens only need to carry an opaque session id
+type KeyStore interface {
+	Put(sessionID string, key []byte, ttl time.Duration) error
+	Get(sessionID string) ([]byte, error)
+	// Extend pushes back the expiry of a key, returning ErrKeyNotFound rather than re-creating one which is gone
+	Extend(sessionID string, ttl time.Duration) error
+	// Replace swaps the key of a session, returning ErrKeyNotFound rather than re-creating one which is gone
+	Replace(sessionID string, key []byte, ttl time.Duration) error
+	Delete(sessionID string) error
+}
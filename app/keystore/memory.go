@@ -0,0 +1,98 @@
+package keystore
+
+import (
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	key       []byte
+	expiresAt time.Time
+}
+
+type memoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+// NewMemoryStore returns a KeyStore local to this process, sessions do not survive restarts
+// and are not visible to other instances
+func NewMemoryStore() KeyStore {
+	return &memoryStore{
+		entries: make(map[string]memoryEntry),
+	}
+}
+
+func (m *memoryStore) Put(sessionID string, key []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for id, entry := range m.entries {
+		if now.After(entry.expiresAt) {
+			delete(m.entries, id)
+		}
+	}
+
+	m.entries[sessionID] = memoryEntry{
+		key:       append([]byte(nil), key...),
+		expiresAt: now.Add(ttl),
+	}
+	return nil
+}
+
+func (m *memoryStore) Get(sessionID string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.entries[sessionID]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(m.entries, sessionID)
+		return nil, ErrKeyNotFound
+	}
+
+	return append([]byte(nil), entry.key...), nil
+}
+
+func (m *memoryStore) Extend(sessionID string, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.entries[sessionID]
+	if !ok || time.Now().After(entry.expiresAt) {
+		delete(m.entries, sessionID)
+		return ErrKeyNotFound
+	}
+
+	entry.expiresAt = time.Now().Add(ttl)
+	m.entries[sessionID] = entry
+	return nil
+}
+
+func (m *memoryStore) Replace(sessionID string, key []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.entries[sessionID]
+	if !ok || time.Now().After(entry.expiresAt) {
+		delete(m.entries, sessionID)
+		return ErrKeyNotFound
+	}
+
+	m.entries[sessionID] = memoryEntry{
+		key:       append([]byte(nil), key...),
+		expiresAt: time.Now().Add(ttl),
+	}
+	return nil
+}
+
+func (m *memoryStore) Delete(sessionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.entries, sessionID)
+	return nil
+}
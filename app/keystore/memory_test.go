@@ -0,0 +1,50 @@
+package keystore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ks := NewMemoryStore()
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	assert.Nil(t, ks.Put("koala", key, time.Minute))
+
+	got, err := ks.Get("koala")
+	assert.Nil(t, err)
+	assert.Equal(t, key, got)
+
+	assert.Nil(t, ks.Delete("koala"))
+	_, err = ks.Get("koala")
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	assert.Nil(t, ks.Put("squirrel", key, -time.Second))
+	_, err = ks.Get("squirrel")
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// Extending never brings back a key which was deleted or has expired
+	assert.Equal(t, ErrKeyNotFound, ks.Extend("koala", time.Minute))
+	assert.Nil(t, ks.Put("squirrel", key, -time.Second))
+	assert.Equal(t, ErrKeyNotFound, ks.Extend("squirrel", time.Minute))
+
+	assert.Nil(t, ks.Put("wombat", key, time.Minute))
+	assert.Nil(t, ks.Extend("wombat", time.Hour))
+	got, err = ks.Get("wombat")
+	assert.Nil(t, err)
+	assert.Equal(t, key, got)
+
+	// Replacing never brings back a key which was deleted or has expired either
+	unlocked := []byte("fedcba9876543210fedcba9876543210")
+	assert.Equal(t, ErrKeyNotFound, ks.Replace("koala", unlocked, time.Minute))
+	assert.Equal(t, ErrKeyNotFound, ks.Replace("squirrel", unlocked, time.Minute))
+	_, err = ks.Get("koala")
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	assert.Nil(t, ks.Replace("wombat", unlocked, time.Hour))
+	got, err = ks.Get("wombat")
+	assert.Nil(t, err)
+	assert.Equal(t, unlocked, got)
+}
@@ -0,0 +1,109 @@
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/database"
+	"github.com/sid-sun/arche-api/app/utils"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/sha3"
+)
+
+type sharedStore struct {
+	table       database.SessionKeysTable
+	blockCipher cipher.Block
+	lgr         *zap.Logger
+}
+
+// NewSharedStore returns a KeyStore backed by the session_keys table so every instance sees the same sessions
+// Keys are sealed with a server secret before they are written
+func NewSharedStore(table database.SessionKeysTable, secret string, lgr *zap.Logger) KeyStore {
+	sealingKey := sha3.Sum256([]byte(secret))
+	// Error can be safely ignored as SHA3-256 always yields a valid AES key size
+	blockCipher, _ := aes.NewCipher(sealingKey[:])
+
+	return &sharedStore{
+		table:       table,
+		blockCipher: blockCipher,
+		lgr:         lgr,
+	}
+}
+
+func (s *sharedStore) Put(sessionID string, key []byte, ttl time.Duration) error {
+	sealedKey, err := utils.GCMEncrypt(key, s.blockCipher)
+	if err != nil {
+		s.lgr.Debug(fmt.Sprintf("[KeyStore] [Shared] [Put] [GCMEncrypt] %s", err.Error()))
+		return err
+	}
+
+	if errx := s.table.Put(sessionID, base64.StdEncoding.EncodeToString(sealedKey), time.Now().Add(ttl)); errx != nil {
+		s.lgr.Debug(fmt.Sprintf("[KeyStore] [Shared] [Put] [Put] %s", errx.String()))
+		return errx
+	}
+	return nil
+}
+
+func (s *sharedStore) Get(sessionID string) ([]byte, error) {
+	sealedKey, errx := s.table.Get(sessionID)
+	if errx != nil {
+		if errx.Kind() == custom_errors.NoRowsInResultSet {
+			return nil, ErrKeyNotFound
+		}
+		s.lgr.Debug(fmt.Sprintf("[KeyStore] [Shared] [Get] [Get] %s", errx.String()))
+		return nil, errx
+	}
+
+	data, err := base64.StdEncoding.DecodeString(sealedKey)
+	if err != nil {
+		s.lgr.Debug(fmt.Sprintf("[KeyStore] [Shared] [Get] [DecodeString] %s", err.Error()))
+		return nil, err
+	}
+
+	key, err := utils.GCMDecrypt(data, s.blockCipher)
+	if err != nil {
+		s.lgr.Debug(fmt.Sprintf("[KeyStore] [Shared] [Get] [GCMDecrypt] %s", err.Error()))
+		return nil, err
+	}
+	return key, nil
+}
+
+func (s *sharedStore) Extend(sessionID string, ttl time.Duration) error {
+	if errx := s.table.Extend(sessionID, time.Now().Add(ttl)); errx != nil {
+		if errx.Kind() == custom_errors.NoRowsAffected {
+			return ErrKeyNotFound
+		}
+		s.lgr.Debug(fmt.Sprintf("[KeyStore] [Shared] [Extend] [Extend] %s", errx.String()))
+		return errx
+	}
+	return nil
+}
+
+func (s *sharedStore) Replace(sessionID string, key []byte, ttl time.Duration) error {
+	sealedKey, err := utils.GCMEncrypt(key, s.blockCipher)
+	if err != nil {
+		s.lgr.Debug(fmt.Sprintf("[KeyStore] [Shared] [Replace] [GCMEncrypt] %s", err.Error()))
+		return err
+	}
+
+	if errx := s.table.Replace(sessionID, base64.StdEncoding.EncodeToString(sealedKey), time.Now().Add(ttl)); errx != nil {
+		if errx.Kind() == custom_errors.NoRowsAffected {
+			return ErrKeyNotFound
+		}
+		s.lgr.Debug(fmt.Sprintf("[KeyStore] [Shared] [Replace] [Replace] %s", errx.String()))
+		return errx
+	}
+	return nil
+}
+
+func (s *sharedStore) Delete(sessionID string) error {
+	if errx := s.table.Delete(sessionID); errx != nil {
+		s.lgr.Debug(fmt.Sprintf("[KeyStore] [Shared] [Delete] [Delete] %s", errx.String()))
+		return errx
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package middlewares
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/sid-sun/arche-api/config"
+	"go.uber.org/zap"
+)
+
+// AdminAuth admits requests carrying the operator token as a bearer token, without a configured token
+// the routes behind it do not exist
+func AdminAuth(cfg *config.AdminConfig, lgr *zap.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if !cfg.Enabled() {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			token := strings.TrimSpace(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+			if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.GetToken())) != 1 {
+				lgr.Info("[Middlewares] [AdminAuth] rejected operator token")
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, req)
+		})
+	}
+}
@@ -2,6 +2,9 @@ package middlewares
 
 import (
 	"context"
+	"fmt"
+	"github.com/sid-sun/arche-api/app/keystore"
+	"github.com/sid-sun/arche-api/app/service"
 	"github.com/sid-sun/arche-api/app/types"
 	"github.com/sid-sun/arche-api/app/utils"
 	"github.com/sid-sun/arche-api/config"
@@ -10,7 +13,22 @@ import (
 	"strings"
 )
 
-func JWTAuth(jwtCfg *config.JWTConfig, lgr *zap.Logger) func(http.Handler) http.Handler {
+// accessTokenScheme is the Authorization scheme personal access tokens are sent with, "Token <token>"
+const accessTokenScheme = "Token "
+
+// JWTAuth admits requests carrying an access token of a live, unlocked session,
+// or a personal access token sent with the Token scheme
+func JWTAuth(jwtCfg *config.JWTConfig, ks keystore.KeyStore, tokens service.AccessTokensService, lgr *zap.Logger) func(http.Handler) http.Handler {
+	return jwtAuth(jwtCfg, ks, tokens, false, lgr)
+}
+
+// RestrictedJWTAuth also admits restricted sessions, which hold no data key, it is meant for
+// routes that never decrypt anything such as session management and metadata listings
+func RestrictedJWTAuth(jwtCfg *config.JWTConfig, ks keystore.KeyStore, tokens service.AccessTokensService, lgr *zap.Logger) func(http.Handler) http.Handler {
+	return jwtAuth(jwtCfg, ks, tokens, true, lgr)
+}
+
+func jwtAuth(jwtCfg *config.JWTConfig, ks keystore.KeyStore, tokens service.AccessTokensService, allowRestricted bool, lgr *zap.Logger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			token := req.Header.Get("Authorization")
@@ -19,6 +37,19 @@ func JWTAuth(jwtCfg *config.JWTConfig, lgr *zap.Logger) func(http.Handler) http.
 				return
 			}
 
+			if strings.HasPrefix(token, accessTokenScheme) {
+				claims, errx := tokens.Authenticate(strings.TrimSpace(strings.TrimPrefix(token, accessTokenScheme)))
+				if errx != nil {
+					utils.LogWithSeverity(fmt.Sprintf("[Middlewares] [JWTAuth] [Authenticate] %s", errx.String()), errx.Severity, lgr)
+					w.WriteHeader(http.StatusUnauthorized)
+					_, _ = w.Write([]byte("access token is not valid or has expired"))
+					return
+				}
+
+				next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), "claims", claims)))
+				return
+			}
+
 			// Otherwise, extract the actual token
 			hasToken := strings.Split(token, "Bearer")
 			if len(hasToken) != 2 || len(hasToken[1]) <= 1 { // Compensating for a space literal
@@ -29,13 +60,42 @@ func JWTAuth(jwtCfg *config.JWTConfig, lgr *zap.Logger) func(http.Handler) http.
 
 			var claims types.AccessTokenClaims
 			var err error
-			if claims, err = utils.ValidateJWT(token, jwtCfg.GetSecret(), lgr); err != nil {
+			if claims, err = utils.ValidateJWT(token, jwtCfg, lgr); err != nil {
 				// TODO: Add Logging
 				w.WriteHeader(http.StatusUnauthorized)
 				_, _ = w.Write([]byte(err.Error()))
 				return
 			}
 
+			// Refresh tokens are only good for /v1/session/refresh
+			if claims.TokenType != types.TokenTypeAccess {
+				w.WriteHeader(http.StatusUnauthorized)
+				_, _ = w.Write([]byte("not an access token"))
+				return
+			}
+
+			// Tokens issued before scopes existed were session tokens with full access
+			if claims.Scopes == nil {
+				claims.Scopes = types.SessionScopes
+			}
+
+			// Tokens only carry a session id, the data key is resolved from the key store.
+			// Revoking a session drops its key, so tokens of revoked sessions stop here
+			if claims.EncryptionKey, err = ks.Get(claims.SessionID); err != nil {
+				lgr.Debug(fmt.Sprintf("[Middlewares] [JWTAuth] [Get] %s", err.Error()))
+				w.WriteHeader(http.StatusUnauthorized)
+				_, _ = w.Write([]byte("session is no longer valid"))
+				return
+			}
+
+			// Restricted sessions are live but hold an empty key until they are unlocked with the password
+			claims.Restricted = len(claims.EncryptionKey) == 0
+			if claims.Restricted && !allowRestricted {
+				w.WriteHeader(http.StatusForbidden)
+				_, _ = w.Write([]byte("session is restricted, unlock it with the password"))
+				return
+			}
+
 			// just a stub.. some ideas are to look at URL query params for something like
 			// the page number, or the limit, and send a query cursor down the chain
 			next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), "claims", claims)))
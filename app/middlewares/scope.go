@@ -0,0 +1,42 @@
+package middlewares
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/sid-sun/arche-api/app/types"
+	"go.uber.org/zap"
+)
+
+// RequireScope admits requests whose claims carry every one of scopes, it has to run after JWTAuth
+func RequireScope(lgr *zap.Logger, scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			claims, ok := req.Context().Value("claims").(types.AccessTokenClaims)
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			for _, scope := range scopes {
+				if !hasScope(claims.Scopes, scope) {
+					lgr.Info(fmt.Sprintf("[Middlewares] [RequireScope] [%s] missing scope %s", claims.TokenType, scope))
+					w.WriteHeader(http.StatusForbidden)
+					_, _ = w.Write([]byte(fmt.Sprintf("token is missing the %s scope", scope)))
+					return
+				}
+			}
+
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+func hasScope(granted []string, scope string) bool {
+	for _, s := range granted {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
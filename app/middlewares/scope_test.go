@@ -0,0 +1,31 @@
+package middlewares
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestRequireScope(t *testing.T) {
+	handler := RequireScope(zap.NewNop(), types.ScopeNotesWrite)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(scopes []string) int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/notes/create", nil)
+		claims := types.AccessTokenClaims{TokenType: types.TokenTypePersonal, Scopes: scopes}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req.WithContext(context.WithValue(req.Context(), "claims", claims)))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, serve(types.SessionScopes))
+	assert.Equal(t, http.StatusOK, serve([]string{types.ScopeNotesRead, types.ScopeNotesWrite}))
+	assert.Equal(t, http.StatusForbidden, serve([]string{types.ScopeNotesRead}))
+	assert.Equal(t, http.StatusForbidden, serve(nil))
+}
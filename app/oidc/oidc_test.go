@@ -0,0 +1,258 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeProvider is an in-process OpenID Connect provider which signs in whoever it is told to
+type fakeProvider struct {
+	t        *testing.T
+	server   *httptest.Server
+	key      *rsa.PrivateKey
+	clientID string
+	secret   string
+	subject  string
+
+	mu    sync.Mutex
+	codes map[string]authorization
+	// claims lets a test tamper with the next ID token
+	claims func(jwt.MapClaims)
+}
+
+type authorization struct {
+	redirectURI string
+	challenge   string
+	nonce       string
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+
+	f := &fakeProvider{
+		t:        t,
+		key:      key,
+		clientID: "arche",
+		secret:   "client secret",
+		subject:  "248289761001",
+		codes:    make(map[string]authorization),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", f.discovery)
+	mux.HandleFunc("/authorize", f.authorize)
+	mux.HandleFunc("/token", f.token)
+	mux.HandleFunc("/keys", f.keys)
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+
+	return f
+}
+
+func (f *fakeProvider) discovery(w http.ResponseWriter, req *http.Request) {
+	_ = json.NewEncoder(w).Encode(metadata{
+		Issuer:                f.server.URL,
+		AuthorizationEndpoint: f.server.URL + "/authorize",
+		TokenEndpoint:         f.server.URL + "/token",
+		JWKSURI:               f.server.URL + "/keys",
+	})
+}
+
+// authorize signs the user in straight away and redirects back with a code
+func (f *fakeProvider) authorize(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	if query.Get("client_id") != f.clientID || query.Get("code_challenge_method") != "S256" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	code := base64.RawURLEncoding.EncodeToString(big.NewInt(time.Now().UnixNano()).Bytes())
+	f.mu.Lock()
+	f.codes[code] = authorization{
+		redirectURI: query.Get("redirect_uri"),
+		challenge:   query.Get("code_challenge"),
+		nonce:       query.Get("nonce"),
+	}
+	f.mu.Unlock()
+
+	redirect, _ := url.Parse(query.Get("redirect_uri"))
+	redirect.RawQuery = url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	http.Redirect(w, req, redirect.String(), http.StatusFound)
+}
+
+func (f *fakeProvider) token(w http.ResponseWriter, req *http.Request) {
+	id, secret, ok := req.BasicAuth()
+	if !ok || id != f.clientID || secret != url.QueryEscape(f.secret) {
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = json.NewEncoder(w).Encode(tokenResponse{Error: "invalid_client"})
+		return
+	}
+
+	f.mu.Lock()
+	auth, ok := f.codes[req.PostFormValue("code")]
+	delete(f.codes, req.PostFormValue("code"))
+	f.mu.Unlock()
+
+	if !ok || auth.redirectURI != req.PostFormValue("redirect_uri") || auth.challenge != codeChallenge(req.PostFormValue("code_verifier")) {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(tokenResponse{Error: "invalid_grant"})
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss":            f.server.URL,
+		"sub":            f.subject,
+		"aud":            f.clientID,
+		"exp":            time.Now().Add(time.Minute * 5).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          auth.nonce,
+		"email":          "Jane@Example.com",
+		"email_verified": true,
+	}
+	if f.claims != nil {
+		f.claims(claims)
+	}
+
+	tkn := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	tkn.Header["kid"] = "key-1"
+	idToken, err := tkn.SignedString(f.key)
+	assert.Nil(f.t, err)
+
+	_ = json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+}
+
+func (f *fakeProvider) keys(w http.ResponseWriter, req *http.Request) {
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []jsonWebKey{{
+			KeyType: "RSA",
+			KeyID:   "key-1",
+			Use:     "sig",
+			N:       base64.RawURLEncoding.EncodeToString(f.key.N.Bytes()),
+			E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(f.key.E)).Bytes()),
+		}},
+	})
+}
+
+// signIn runs the browser part of the flow, returning the code the provider redirected back with
+func signIn(t *testing.T, p *Provider, state string, nonce string, challenge string) string {
+	authURL, err := p.AuthCodeURL(state, nonce, challenge)
+	assert.Nil(t, err)
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	assert.Nil(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+
+	redirect, err := url.Parse(resp.Header.Get("Location"))
+	assert.Nil(t, err)
+	assert.Equal(t, state, redirect.Query().Get("state"))
+	return redirect.Query().Get("code")
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	fake := newFakeProvider(t)
+	p := NewProvider(fake.server.URL+"/", fake.clientID, fake.secret, "https://notes.example.com/sso")
+
+	verifier, challenge, err := NewPKCE()
+	assert.Nil(t, err)
+
+	code := signIn(t, p, "state", "nonce", challenge)
+	idToken, err := p.Exchange(code, verifier)
+	assert.Nil(t, err)
+
+	identity, err := p.VerifyIDToken(idToken, "nonce")
+	assert.Nil(t, err)
+	assert.Equal(t, Identity{Issuer: fake.server.URL, Subject: fake.subject, Email: "jane@example.com", EmailVerified: true}, identity)
+
+	// Codes are single use
+	_, err = p.Exchange(code, verifier)
+	assert.True(t, errors.Is(err, ErrExchange))
+
+	_, err = p.VerifyIDToken(idToken, "other nonce")
+	assert.Equal(t, ErrNonceMismatch, err)
+}
+
+func TestExchangeRequiresVerifier(t *testing.T) {
+	fake := newFakeProvider(t)
+	p := NewProvider(fake.server.URL, fake.clientID, fake.secret, "https://notes.example.com/sso")
+
+	_, challenge, err := NewPKCE()
+	assert.Nil(t, err)
+	otherVerifier, _, err := NewPKCE()
+	assert.Nil(t, err)
+
+	code := signIn(t, p, "state", "nonce", challenge)
+	_, err = p.Exchange(code, otherVerifier)
+	assert.True(t, errors.Is(err, ErrExchange))
+
+	p = NewProvider(fake.server.URL, fake.clientID, "wrong secret", "https://notes.example.com/sso")
+	verifier, challenge, err := NewPKCE()
+	assert.Nil(t, err)
+	code = signIn(t, p, "state", "nonce", challenge)
+	_, err = p.Exchange(code, verifier)
+	assert.True(t, errors.Is(err, ErrExchange))
+}
+
+func TestVerifyIDTokenRejectsTamperedClaims(t *testing.T) {
+	fake := newFakeProvider(t)
+	p := NewProvider(fake.server.URL, fake.clientID, fake.secret, "https://notes.example.com/sso")
+
+	cases := map[string]func(jwt.MapClaims){
+		"audience": func(c jwt.MapClaims) { c["aud"] = "someone else" },
+		"issuer":   func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" },
+		"expired":  func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"azp":      func(c jwt.MapClaims) { c["aud"] = []string{fake.clientID, "someone else"} },
+	}
+
+	for name, tamper := range cases {
+		fake.claims = tamper
+		verifier, challenge, err := NewPKCE()
+		assert.Nil(t, err)
+
+		idToken, err := p.Exchange(signIn(t, p, "state", "nonce", challenge), verifier)
+		assert.Nil(t, err, name)
+
+		_, err = p.VerifyIDToken(idToken, "nonce")
+		assert.True(t, errors.Is(err, ErrInvalidIDToken), name)
+	}
+
+	// A token signed with some other key under the provider's key id
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	tkn := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss": fake.server.URL, "sub": fake.subject, "aud": fake.clientID, "nonce": "nonce",
+		"exp": time.Now().Add(time.Minute).Unix(), "iat": time.Now().Unix(),
+	})
+	tkn.Header["kid"] = "key-1"
+	forged, err := tkn.SignedString(otherKey)
+	assert.Nil(t, err)
+	_, err = p.VerifyIDToken(forged, "nonce")
+	assert.True(t, errors.Is(err, ErrInvalidIDToken))
+
+	// HMAC signed with the client secret is never accepted
+	tkn = jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss": fake.server.URL, "sub": fake.subject, "aud": fake.clientID, "nonce": "nonce",
+		"exp": time.Now().Add(time.Minute).Unix(), "iat": time.Now().Unix(),
+	})
+	forged, err = tkn.SignedString([]byte(fake.secret))
+	assert.Nil(t, err)
+	_, err = p.VerifyIDToken(forged, "nonce")
+	assert.True(t, errors.Is(err, ErrInvalidIDToken))
+}
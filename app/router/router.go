@@ -4,50 +4,146 @@ import (
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/sid-sun/arche-api/app/handlers"
+	"github.com/sid-sun/arche-api/app/keystore"
 	"github.com/sid-sun/arche-api/app/middlewares"
 	"github.com/sid-sun/arche-api/app/service"
+	"github.com/sid-sun/arche-api/app/types"
 	"github.com/sid-sun/arche-api/config"
 	"go.uber.org/zap"
 )
 
-func NewRouter(svc *service.Service, jwtCfg *config.JWTConfig, veCfg *config.VerificationEmailConfig, lgr *zap.Logger) *chi.Mux {
+func NewRouter(svc *service.Service, ks keystore.KeyStore, jwtCfg *config.JWTConfig, kdfCfg *config.KDFConfig, veCfg *config.VerificationEmailConfig, adminCfg *config.AdminConfig, lgr *zap.Logger) *chi.Mux {
 	rtr := chi.NewRouter()
 
 	rtr.Use(middleware.Recoverer)
 	rtr.Use(middlewares.WithContentJSON)
 	rtr.Use(middlewares.WithCors())
 
+	jwtAuth := middlewares.JWTAuth(jwtCfg, ks, svc.AccessTokens, lgr)
+	restrictedJWTAuth := middlewares.RestrictedJWTAuth(jwtCfg, ks, svc.AccessTokens, lgr)
+	requireAccount := middlewares.RequireScope(lgr, types.ScopeAccount)
+
+	rtr.Get("/.well-known/jwks.json", handlers.JWKSHandler(jwtCfg, lgr))
+
 	rtr.Route("/v1/users", func(r chi.Router) {
-		r.Post("/signup", handlers.CreateUserHandler(svc.Users, veCfg, jwtCfg, lgr))
-		r.Post("/login", handlers.LoginUserHandler(svc.Users, jwtCfg, lgr))
-		r.Post("/activate", handlers.ActivateUserHandler(svc.Users, lgr))
-		r.Post("/resendVerification", handlers.ResendValidationHandler(svc.Users, veCfg, lgr))
+		r.Post("/signup", handlers.CreateUserHandler(svc.Users, svc.Audit, veCfg, kdfCfg, lgr))
+		r.Post("/login", handlers.LoginUserHandler(svc.Users, svc.Sessions, svc.Throttle, svc.KeyRotation, svc.Audit, jwtCfg, kdfCfg, veCfg, lgr))
+		r.Post("/login/unlock", handlers.UnlockLoginHandler(svc.Throttle, svc.Audit, lgr))
+		r.Post("/login/srp/init", handlers.SRPInitHandler(svc.SRP, kdfCfg, lgr))
+		r.Post("/login/srp/verify", handlers.SRPVerifyHandler(svc.Users, svc.SRP, svc.Sessions, svc.Throttle, svc.Audit, jwtCfg, veCfg, lgr))
+		r.Post("/activate", handlers.ActivateUserHandler(svc.Users, svc.Audit, veCfg, lgr))
+		r.Post("/resendVerification", handlers.ResendValidationHandler(svc.Users, svc.Audit, veCfg, lgr))
+		r.Post("/login/2fa", handlers.TwoFactorLoginHandler(svc.TwoFactor, svc.Users, svc.Sessions, svc.Audit, jwtCfg, lgr))
+		r.Post("/login/magic", handlers.RequestMagicLinkHandler(svc.Users, svc.Sessions, veCfg, lgr))
+		r.Post("/login/magic/redeem", handlers.RedeemMagicLinkHandler(svc.Users, svc.Sessions, svc.Audit, jwtCfg, lgr))
+		r.Post("/login/oidc", handlers.BeginOIDCHandler(svc.OIDC, service.OIDCPurposeLogin, lgr))
+		r.Post("/login/oidc/finish", handlers.FinishOIDCLoginHandler(svc.OIDC, svc.Users, svc.Sessions, svc.Audit, jwtCfg, lgr))
+		r.With(jwtAuth, requireAccount).Post("/password", handlers.ChangePasswordHandler(svc.Users, svc.Audit, kdfCfg, lgr))
+		r.Post("/recover", handlers.RecoverAccountHandler(svc.Users, svc.Audit, veCfg, kdfCfg, lgr))
+		r.With(jwtAuth, requireAccount).Post("/recovery-code", handlers.RegenerateRecoveryCodeHandler(svc.Users, svc.Audit, kdfCfg, lgr))
+		r.With(restrictedJWTAuth, requireAccount).Post("/rotate-key", handlers.RotateKeyHandler(svc.Users, svc.KeyRotation, svc.Audit, kdfCfg, lgr))
+		r.With(restrictedJWTAuth, requireAccount).Get("/me/security-events", handlers.SecurityEventsHandler(svc.Audit, lgr))
+		r.With(jwtAuth, middlewares.RequireScope(lgr, types.ScopeNotesRead)).Get("/key-bundle", handlers.GetKeyBundleHandler(svc.Users, lgr))
+		r.With(jwtAuth, requireAccount).Put("/key-bundle", handlers.UpdateKeyBundleHandler(svc.Users, lgr))
+		r.With(jwtAuth, requireAccount).Delete("/me", handlers.DeleteAccountHandler(svc.Users, veCfg, lgr))
+		r.With(jwtAuth, requireAccount).Post("/email", handlers.ChangeEmailHandler(svc.Users, svc.Audit, veCfg, lgr))
+		r.Post("/email/confirm", handlers.ConfirmEmailChangeHandler(svc.Users, veCfg, lgr))
+		r.With(jwtAuth, requireAccount).Post("/2fa/totp/enroll", handlers.EnrollTOTPHandler(svc.TwoFactor, lgr))
+		r.With(jwtAuth, requireAccount).Post("/2fa/totp/confirm", handlers.ConfirmTOTPHandler(svc.TwoFactor, lgr))
+		r.With(jwtAuth, requireAccount).Post("/2fa/totp/disable", handlers.DisableTOTPHandler(svc.TwoFactor, lgr))
+
+		r.Route("/oidc", func(r chi.Router) {
+			r.Use(jwtAuth, requireAccount)
+
+			r.Get("/", handlers.ListIdentitiesHandler(svc.OIDC, lgr))
+			r.Post("/link/begin", handlers.BeginOIDCHandler(svc.OIDC, service.OIDCPurposeLink, lgr))
+			r.Post("/link", handlers.LinkOIDCHandler(svc.OIDC, kdfCfg, lgr))
+			r.Delete("/", handlers.UnlinkOIDCHandler(svc.OIDC, lgr))
+		})
+
+		r.Route("/webauthn", func(r chi.Router) {
+			r.Post("/login/begin", handlers.BeginWebAuthnLoginHandler(svc.WebAuthn, lgr))
+			r.Post("/login/finish", handlers.FinishWebAuthnLoginHandler(svc.WebAuthn, svc.Sessions, svc.Audit, jwtCfg, lgr))
+
+			r.Group(func(r chi.Router) {
+				r.Use(jwtAuth, requireAccount)
+
+				r.Post("/register/begin", handlers.BeginWebAuthnRegistrationHandler(svc.WebAuthn, lgr))
+				r.Post("/register/finish", handlers.FinishWebAuthnRegistrationHandler(svc.WebAuthn, lgr))
+				r.Get("/credentials", handlers.ListWebAuthnCredentialsHandler(svc.WebAuthn, lgr))
+				r.With(middlewares.ContextURLParams(lgr, "credentialID")).Delete("/credentials/{credentialID}",
+					handlers.DeleteWebAuthnCredentialHandler(svc.WebAuthn, lgr))
+			})
+		})
 	})
 
 	rtr.Route("/v1/session", func(r chi.Router) {
-		r.With(middlewares.JWTAuth(jwtCfg, lgr)).Get("/validate", handlers.ValidateTokenHandler(lgr))
-		r.Post("/refresh", handlers.RefreshTokenHandler(jwtCfg, lgr))
+		r.Post("/refresh", handlers.RefreshTokenHandler(svc.Sessions, svc.Audit, jwtCfg, lgr))
+
+		// Session management never touches the data key, so restricted sessions are let in
+		r.Group(func(r chi.Router) {
+			r.Use(restrictedJWTAuth, requireAccount)
+
+			r.Get("/validate", handlers.ValidateTokenHandler(lgr))
+			r.Post("/unlock", handlers.UnlockSessionHandler(svc.Users, svc.TwoFactor, svc.Sessions, svc.Throttle, svc.Audit, veCfg, lgr))
+			r.Post("/logout", handlers.LogoutHandler(svc.Sessions, svc.Audit, lgr))
+			r.Post("/logout-all", handlers.LogoutAllHandler(svc.Sessions, svc.Audit, lgr))
+			r.Get("/list", handlers.ListSessionsHandler(svc.Sessions, lgr))
+			r.With(middlewares.ContextURLParams(lgr, "sessionID")).Delete("/{sessionID}",
+				handlers.RevokeSessionHandler(svc.Sessions, svc.Audit, lgr))
+		})
+	})
+
+	rtr.Route("/v1/tokens", func(r chi.Router) {
+		r.Use(jwtAuth, requireAccount)
+
+		r.Post("/", handlers.CreateAccessTokenHandler(svc.AccessTokens, lgr))
+		r.Get("/", handlers.ListAccessTokensHandler(svc.AccessTokens, lgr))
+		r.With(middlewares.ContextURLParams(lgr, "tokenID")).Delete("/{tokenID}",
+			handlers.RevokeAccessTokenHandler(svc.AccessTokens, lgr))
 	})
 
 	rtr.Route("/v1/folders", func(r chi.Router) {
-		r.Use(middlewares.JWTAuth(jwtCfg, lgr))
+		r.With(restrictedJWTAuth, middlewares.RequireScope(lgr, types.ScopeNotesRead)).Get("/get",
+			handlers.GetFoldersHandler(svc.Folders, lgr))
 
-		r.Post("/create", handlers.CreateFolderHandler(svc.Folders, lgr))
-		r.Get("/get", handlers.GetFoldersHandler(svc.Folders, lgr))
-		r.With(middlewares.ContextURLParams(lgr, "folderID")).Get("/get/{folderID}",
-			handlers.GetFolderHandler(svc.Folders, lgr))
-		r.Delete("/delete", handlers.DeleteFolderHandler(svc.Folders, lgr))
+		r.Group(func(r chi.Router) {
+			r.Use(jwtAuth)
+
+			r.With(middlewares.RequireScope(lgr, types.ScopeFoldersWrite)).Post("/create",
+				handlers.CreateFolderHandler(svc.Folders, lgr))
+			r.With(middlewares.RequireScope(lgr, types.ScopeNotesRead), middlewares.ContextURLParams(lgr, "folderID")).Get("/get/{folderID}",
+				handlers.GetFolderHandler(svc.Folders, lgr))
+			r.With(middlewares.RequireScope(lgr, types.ScopeFoldersWrite)).Delete("/delete",
+				handlers.DeleteFolderHandler(svc.Folders, lgr))
+		})
 	})
 
 	rtr.Route("/v1/notes", func(r chi.Router) {
-		r.Use(middlewares.JWTAuth(jwtCfg, lgr))
-
-		r.Post("/create", handlers.CreateNoteHandler(svc.Notes, lgr))
-		r.Put("/update", handlers.UpdateNoteHandler(svc.Notes, lgr))
-		r.Get("/getall", handlers.GetNotesHandler(svc.Notes, lgr))
-		r.With(middlewares.ContextURLParams(lgr, "noteID")).Get("/get/{noteID}",
-			handlers.GetNoteHandler(svc.Notes, lgr))
-		r.Delete("/delete", handlers.DeleteNoteHandler(svc.Notes, lgr))
+		r.With(restrictedJWTAuth, middlewares.RequireScope(lgr, types.ScopeNotesRead)).Get("/getall",
+			handlers.GetNotesHandler(svc.Notes, lgr))
+
+		r.Group(func(r chi.Router) {
+			r.Use(jwtAuth)
+
+			r.With(middlewares.RequireScope(lgr, types.ScopeNotesWrite)).Post("/create",
+				handlers.CreateNoteHandler(svc.Notes, lgr))
+			r.With(middlewares.RequireScope(lgr, types.ScopeNotesWrite)).Put("/update",
+				handlers.UpdateNoteHandler(svc.Notes, lgr))
+			r.With(middlewares.RequireScope(lgr, types.ScopeNotesRead), middlewares.ContextURLParams(lgr, "noteID")).Get("/get/{noteID}",
+				handlers.GetNoteHandler(svc.Notes, lgr))
+			r.With(middlewares.RequireScope(lgr, types.ScopeNotesRead)).Get("/search",
+				handlers.SearchNotesHandler(svc.Notes, lgr))
+			r.With(middlewares.RequireScope(lgr, types.ScopeNotesWrite)).Delete("/delete",
+				handlers.DeleteNoteHandler(svc.Notes, lgr))
+		})
+	})
+
+	rtr.Route("/v1/admin", func(r chi.Router) {
+		r.Use(middlewares.AdminAuth(adminCfg, lgr))
+
+		r.With(middlewares.ContextURLParams(lgr, "userID")).Post("/users/{userID}/rotate-key",
+			handlers.RequestKeyRotationHandler(svc.Users, svc.KeyRotation, svc.Audit, lgr))
 	})
 
 	return rtr
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"crypto/aes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/database"
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/app/utils"
+	"go.uber.org/zap"
+)
+
+// AccessTokensService manages personal access tokens, each token holds its own copy of the data key
+// wrapped under a key derived from the token's secret, so it can decrypt without the password
+type AccessTokensService interface {
+	Create(claims types.AccessTokenClaims, name string, scopes []string, expiresAt time.Time) (types.AccessToken, string, *erx.Erx)
+	List(userID types.UserID) ([]types.AccessToken, *erx.Erx)
+	Revoke(userID types.UserID, tokenID string) *erx.Erx
+	Authenticate(token string) (types.AccessTokenClaims, *erx.Erx)
+}
+
+type accessTokens struct {
+	db  *database.DB
+	lgr *zap.Logger
+}
+
+// Create issues a new token, the returned token string is the only time its secret is available
+func (a *accessTokens) Create(claims types.AccessTokenClaims, name string, scopes []string, expiresAt time.Time) (types.AccessToken, string, *erx.Erx) {
+	tokenID, secret, token, err := utils.NewAccessToken()
+	if err != nil {
+		a.lgr.Debug(fmt.Sprintf("[Service] [AccessTokens] [Create] [NewAccessToken] %s", err.Error()))
+		return types.AccessToken{}, "", erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	blockCipher, err := aes.NewCipher(utils.AccessTokenWrappingKey(secret))
+	if err != nil {
+		a.lgr.Debug(fmt.Sprintf("[Service] [AccessTokens] [Create] [NewCipher] %s", err.Error()))
+		return types.AccessToken{}, "", erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	wrappedKey, err := utils.GCMEncrypt(claims.EncryptionKey, blockCipher)
+	if err != nil {
+		a.lgr.Debug(fmt.Sprintf("[Service] [AccessTokens] [Create] [GCMEncrypt] %s", err.Error()))
+		return types.AccessToken{}, "", erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	accessToken := types.AccessToken{
+		TokenID:    tokenID,
+		UserID:     claims.UserID,
+		Name:       name,
+		SecretHash: utils.HashAccessTokenSecret(secret),
+		Scopes:     scopes,
+		WrappedKey: base64.StdEncoding.EncodeToString(wrappedKey),
+		CreatedAt:  time.Now(),
+		ExpiresAt:  expiresAt,
+	}
+
+	errx := a.db.AccessTokens.Create(accessToken)
+	if errx != nil {
+		a.lgr.Debug(fmt.Sprintf("[Service] [AccessTokens] [Create] [Create] %s", errx.String()))
+		return types.AccessToken{}, "", errx
+	}
+
+	return accessToken, token, nil
+}
+
+func (a *accessTokens) List(userID types.UserID) ([]types.AccessToken, *erx.Erx) {
+	tokens, errx := a.db.AccessTokens.List(userID)
+	if errx != nil {
+		a.lgr.Debug(fmt.Sprintf("[Service] [AccessTokens] [List] [List] %s", errx.String()))
+		return nil, errx
+	}
+
+	return tokens, nil
+}
+
+func (a *accessTokens) Revoke(userID types.UserID, tokenID string) *erx.Erx {
+	errx := a.db.AccessTokens.Delete(userID, tokenID)
+	if errx != nil {
+		a.lgr.Debug(fmt.Sprintf("[Service] [AccessTokens] [Revoke] [Delete] %s", errx.String()))
+		return errx
+	}
+
+	return nil
+}
+
+// Authenticate resolves a token into claims carrying its scopes and the unwrapped data key
+// Unknown, mismatched and expired tokens are all reported as InvalidAccessToken
+func (a *accessTokens) Authenticate(token string) (types.AccessTokenClaims, *erx.Erx) {
+	invalid := erx.WithArgs(errors.New("access token is not valid or has expired"), erx.SeverityInfo, custom_errors.InvalidAccessToken)
+
+	tokenID, secret, ok := utils.ParseAccessToken(token)
+	if !ok {
+		return types.AccessTokenClaims{}, invalid
+	}
+
+	accessToken, errx := a.db.AccessTokens.Get(tokenID)
+	if errx != nil {
+		if errx.Kind() == custom_errors.NoRowsInResultSet {
+			return types.AccessTokenClaims{}, invalid
+		}
+		a.lgr.Debug(fmt.Sprintf("[Service] [AccessTokens] [Authenticate] [Get] %s", errx.String()))
+		return types.AccessTokenClaims{}, errx
+	}
+
+	if subtle.ConstantTimeCompare([]byte(accessToken.SecretHash), []byte(utils.HashAccessTokenSecret(secret))) != 1 {
+		return types.AccessTokenClaims{}, invalid
+	}
+
+	now := time.Now()
+	if !now.Before(accessToken.ExpiresAt) {
+		return types.AccessTokenClaims{}, invalid
+	}
+
+	wrappedKey, err := base64.StdEncoding.DecodeString(accessToken.WrappedKey)
+	if err != nil {
+		a.lgr.Debug(fmt.Sprintf("[Service] [AccessTokens] [Authenticate] [DecodeString] %s", err.Error()))
+		return types.AccessTokenClaims{}, erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	blockCipher, err := aes.NewCipher(utils.AccessTokenWrappingKey(secret))
+	if err != nil {
+		a.lgr.Debug(fmt.Sprintf("[Service] [AccessTokens] [Authenticate] [NewCipher] %s", err.Error()))
+		return types.AccessTokenClaims{}, erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	key, err := utils.GCMDecrypt(wrappedKey, blockCipher)
+	if err != nil {
+		if errors.Is(err, utils.ErrCiphertextIntegrity) {
+			return types.AccessTokenClaims{}, erx.WithArgs(err, erx.SeverityWarn, custom_errors.IntegrityCheckFailed)
+		}
+		a.lgr.Debug(fmt.Sprintf("[Service] [AccessTokens] [Authenticate] [GCMDecrypt] %s", err.Error()))
+		return types.AccessTokenClaims{}, erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	// Last use is informational, failing to record it must not fail the request
+	if errx = a.db.AccessTokens.Touch(tokenID, now); errx != nil {
+		a.lgr.Debug(fmt.Sprintf("[Service] [AccessTokens] [Authenticate] [Touch] %s", errx.String()))
+	}
+
+	claims := types.AccessTokenClaims{
+		UserID:        accessToken.UserID,
+		TokenType:     types.TokenTypePersonal,
+		EncryptionKey: key,
+		Scopes:        accessToken.Scopes,
+		ZeroKnowledge: accessToken.ZeroKnowledge,
+	}
+	claims.Id = tokenID
+	claims.ExpiresAt = accessToken.ExpiresAt.Unix()
+
+	return claims, nil
+}
@@ -2,7 +2,6 @@ package service
 
 import (
 	"crypto/aes"
-	"encoding/base64"
 	"errors"
 	"fmt"
 
@@ -10,7 +9,6 @@ import (
 	"github.com/sid-sun/arche-api/app/custom_errors"
 	"github.com/sid-sun/arche-api/app/database"
 	"github.com/sid-sun/arche-api/app/types"
-	"github.com/sid-sun/arche-api/app/utils"
 	"go.uber.org/zap"
 )
 
@@ -27,6 +25,16 @@ type folders struct {
 }
 
 func (f folders) Create(name string, userClaims types.AccessTokenClaims) (types.FolderID, *erx.Erx) {
+	// Names sealed by a zero-knowledge client cannot be compared, telling duplicates apart is left to the client
+	if userClaims.ZeroKnowledge {
+		folderID, errx := f.db.Folders.Create(name, userClaims.UserID)
+		if errx != nil {
+			f.lgr.Debug(fmt.Sprintf("[Service] [Folders] [Create] [Create] %s", errx.String()))
+			return 0, errx
+		}
+		return folderID, nil
+	}
+
 	fldrs, errx := f.GetAll(userClaims)
 	if errx != nil {
 		return 0, errx
@@ -43,13 +51,13 @@ func (f folders) Create(name string, userClaims types.AccessTokenClaims) (types.
 		return 0, erx.WithArgs(err, erx.SeverityDebug)
 	}
 
-	encryptedName, err := utils.CFBEncrypt([]byte(name), blockCipher)
+	encryptedName, err := encryptField(name, blockCipher)
 	if err != nil {
-		f.lgr.Debug(fmt.Sprintf("[Service] [Folders] [Create] [CFBEncrypt] [Name] %s", err.Error()))
+		f.lgr.Debug(fmt.Sprintf("[Service] [Folders] [Create] [encryptField] [Name] %s", err.Error()))
 		return 0, erx.WithArgs(err, erx.SeverityDebug)
 	}
 
-	folderID, errx := f.db.Folders.Create(base64.StdEncoding.EncodeToString(encryptedName), userClaims.UserID)
+	folderID, errx := f.db.Folders.Create(encryptedName, userClaims.UserID)
 	if errx != nil {
 		f.lgr.Debug(fmt.Sprintf("[Service] [Folders] [Create] [Create] %s", errx.String()))
 		return 0, errx
@@ -65,6 +73,10 @@ func (f folders) Get(folderID types.FolderID, userClaims types.AccessTokenClaims
 		return nil, errx
 	}
 
+	if userClaims.ZeroKnowledge {
+		return contents, nil
+	}
+
 	blockCipher, err := aes.NewCipher(userClaims.EncryptionKey)
 	if err != nil {
 		f.lgr.Debug(fmt.Sprintf("[Service] [Folders] [Get] [NewCipher] %s", err.Error()))
@@ -72,13 +84,19 @@ func (f folders) Get(folderID types.FolderID, userClaims types.AccessTokenClaims
 	}
 
 	for index, content := range contents {
-		name, err := base64.StdEncoding.DecodeString(content.Name)
-		if err != nil {
-			f.lgr.Debug(fmt.Sprintf("[Service] [Folders] [Get] [DecodeString] %s", err.Error()))
-			return nil, erx.WithArgs(err, erx.SeverityDebug)
+		contentCipher, errx := noteCipher(content.WrappedKey, blockCipher, f.lgr)
+		if errx != nil {
+			f.lgr.Debug(fmt.Sprintf("[Service] [Folders] [Get] [noteCipher] %s", errx.String()))
+			return nil, errx
+		}
+
+		name, errx := decryptField(content.Name, contentCipher)
+		if errx != nil {
+			f.lgr.Debug(fmt.Sprintf("[Service] [Folders] [Get] [decryptField] %s", errx.String()))
+			return nil, errx
 		}
 
-		content.Name = string(utils.CFBDecrypt(name, blockCipher))
+		content.Name = name
 		contents[index] = content
 	}
 
@@ -92,6 +110,18 @@ func (f folders) GetAll(userClaims types.AccessTokenClaims) ([]types.Folder, *er
 		return []types.Folder{}, errx
 	}
 
+	// Restricted sessions only get to see which folders exist
+	if userClaims.Restricted {
+		for index, folder := range fldrs {
+			fldrs[index] = types.Folder{FolderID: folder.FolderID, UserID: folder.UserID, Locked: true}
+		}
+		return fldrs, nil
+	}
+
+	if userClaims.ZeroKnowledge {
+		return fldrs, nil
+	}
+
 	blockCipher, err := aes.NewCipher(userClaims.EncryptionKey)
 	if err != nil {
 		f.lgr.Debug(fmt.Sprintf("[Service] [Folders] [GetAll] [NewCipher] %s", err.Error()))
@@ -99,13 +129,13 @@ func (f folders) GetAll(userClaims types.AccessTokenClaims) ([]types.Folder, *er
 	}
 
 	for index, folder := range fldrs {
-		name, err := base64.StdEncoding.DecodeString(folder.Name)
-		if err != nil {
-			f.lgr.Debug(fmt.Sprintf("[Service] [Folders] [GetAll] [DecodeString] %s", err.Error()))
-			return []types.Folder{}, erx.WithArgs(err, erx.SeverityDebug)
+		name, errx := decryptField(folder.Name, blockCipher)
+		if errx != nil {
+			f.lgr.Debug(fmt.Sprintf("[Service] [Folders] [GetAll] [decryptField] %s", errx.String()))
+			return []types.Folder{}, errx
 		}
 
-		folder.Name = string(utils.CFBDecrypt(name, blockCipher))
+		folder.Name = name
 		fldrs[index] = folder
 	}
 
@@ -0,0 +1,249 @@
+package service
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/database"
+	"github.com/sid-sun/arche-api/app/keystore"
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/app/utils"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/sha3"
+)
+
+// keyRotationBatchSize is how many folders or notes are re-encrypted in one transaction
+const keyRotationBatchSize = 100
+
+// KeyRotationService replaces a user's data key and re-encrypts everything sealed under it
+//
+// A rotation is requested first, which signs the user out everywhere and drops the copies of the key no one can
+// re-wrap. The new key is then stored sealed under the current one, so an interrupted rotation picks up the same
+// key, and folders and notes move over in batches which each commit together with their cursor. The current key
+// stays in place until the last step swaps the new one in, so a crash at any point leaves everything readable
+type KeyRotationService interface {
+	Request(userID types.UserID) *erx.Erx
+	Prepare(userID types.UserID, key []byte) ([]byte, *erx.Erx)
+	Complete(userID types.UserID, key []byte, newKey []byte, password types.KeyWrap, recovery types.KeyWrap) *erx.Erx
+}
+
+type keyRotation struct {
+	db  *database.DB
+	ks  keystore.KeyStore
+	lgr *zap.Logger
+}
+
+// Request starts a rotation of the user's key, requesting it again while one is pending changes nothing
+// but signing the user out again
+func (k *keyRotation) Request(userID types.UserID) *erx.Erx {
+	sessionIDs, errx := k.db.KeyRotations.Request(userID)
+	if errx != nil {
+		k.lgr.Debug(fmt.Sprintf("[Service] [KeyRotation] [Request] [Request] %s", errx.String()))
+		return errx
+	}
+	return dropSessionKeys(sessionIDs, k.ks, k.lgr)
+}
+
+// Prepare returns the new key of the user's pending rotation given the current key, generating it on the first run
+func (k *keyRotation) Prepare(userID types.UserID, key []byte) ([]byte, *erx.Erx) {
+	rotation, errx := k.db.KeyRotations.Get(userID)
+	if errx != nil {
+		k.lgr.Debug(fmt.Sprintf("[Service] [KeyRotation] [Prepare] [Get] %s", errx.String()))
+		return nil, errx
+	}
+
+	blockCipher, err := aes.NewCipher(key)
+	if err != nil {
+		k.lgr.Debug(fmt.Sprintf("[Service] [KeyRotation] [Prepare] [NewCipher] %s", err.Error()))
+		return nil, erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	if rotation.PendingKey != "" {
+		return k.openPendingKey(rotation.PendingKey, blockCipher)
+	}
+
+	newKey, _, err := utils.GenerateEncryptionKey(k.lgr)
+	if err != nil {
+		k.lgr.Debug(fmt.Sprintf("[Service] [KeyRotation] [Prepare] [GenerateEncryptionKey] %s", err.Error()))
+		return nil, erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	pendingKey, err := encryptField(string(newKey), blockCipher)
+	if err != nil {
+		k.lgr.Debug(fmt.Sprintf("[Service] [KeyRotation] [Prepare] [encryptField] %s", err.Error()))
+		return nil, erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	errx = k.db.KeyRotations.SetPendingKey(userID, pendingKey)
+	if errx != nil {
+		if errx.Kind() != custom_errors.NoRowsAffected {
+			k.lgr.Debug(fmt.Sprintf("[Service] [KeyRotation] [Prepare] [SetPendingKey] %s", errx.String()))
+			return nil, errx
+		}
+
+		// Another login got there first, its key is the one to carry on with
+		if rotation, errx = k.db.KeyRotations.Get(userID); errx != nil {
+			k.lgr.Debug(fmt.Sprintf("[Service] [KeyRotation] [Prepare] [Get] %s", errx.String()))
+			return nil, errx
+		}
+		return k.openPendingKey(rotation.PendingKey, blockCipher)
+	}
+
+	return newKey, nil
+}
+
+// Complete re-encrypts the folders and notes which are not under newKey yet and then swaps newKey in along with
+// its password and recovery wraps, the TOTP secret is re-sealed on the way
+func (k *keyRotation) Complete(userID types.UserID, key []byte, newKey []byte, password types.KeyWrap, recovery types.KeyWrap) *erx.Erx {
+	rotation, errx := k.db.KeyRotations.Get(userID)
+	if errx != nil {
+		k.lgr.Debug(fmt.Sprintf("[Service] [KeyRotation] [Complete] [Get] %s", errx.String()))
+		return errx
+	}
+
+	oldCipher, err := aes.NewCipher(key)
+	if err != nil {
+		k.lgr.Debug(fmt.Sprintf("[Service] [KeyRotation] [Complete] [NewCipher] %s", err.Error()))
+		return erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	newCipher, err := aes.NewCipher(newKey)
+	if err != nil {
+		k.lgr.Debug(fmt.Sprintf("[Service] [KeyRotation] [Complete] [NewCipher] %s", err.Error()))
+		return erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	usr, errx := k.db.Users.GetByID(userID)
+	if errx != nil {
+		k.lgr.Debug(fmt.Sprintf("[Service] [KeyRotation] [Complete] [GetByID] %s", errx.String()))
+		return errx
+	}
+
+	// Folders and notes of zero-knowledge accounts are sealed by the client and are not under this key
+	if !usr.ZeroKnowledge {
+		if errx = k.rotateFolders(rotation, oldCipher, newCipher); errx != nil {
+			return errx
+		}
+
+		if errx = k.rotateNotes(rotation, oldCipher, newCipher, newKey); errx != nil {
+			return errx
+		}
+	}
+
+	totp, errx := k.db.TwoFactor.GetTOTP(userID)
+	if errx != nil {
+		k.lgr.Debug(fmt.Sprintf("[Service] [KeyRotation] [Complete] [GetTOTP] %s", errx.String()))
+		return errx
+	}
+
+	var totpSecret string
+	if totp.Secret != "" {
+		secret, errx := decryptField(totp.Secret, oldCipher)
+		if errx != nil {
+			k.lgr.Debug(fmt.Sprintf("[Service] [KeyRotation] [Complete] [decryptField] [TOTP] %s", errx.String()))
+			return errx
+		}
+
+		if totpSecret, err = encryptField(secret, newCipher); err != nil {
+			k.lgr.Debug(fmt.Sprintf("[Service] [KeyRotation] [Complete] [encryptField] [TOTP] %s", err.Error()))
+			return erx.WithArgs(err, erx.SeverityDebug)
+		}
+	}
+
+	keyHash := sha3.Sum256(newKey)
+	errx = k.db.KeyRotations.Finish(userID, base64.StdEncoding.EncodeToString(keyHash[:]), password, recovery, totpSecret)
+	if errx != nil {
+		k.lgr.Debug(fmt.Sprintf("[Service] [KeyRotation] [Complete] [Finish] %s", errx.String()))
+		return errx
+	}
+
+	return nil
+}
+
+func (k *keyRotation) rotateFolders(rotation types.KeyRotation, oldCipher cipher.Block, newCipher cipher.Block) *erx.Erx {
+	cursor := rotation.FolderCursor
+	for {
+		batch, errx := k.db.KeyRotations.FolderBatch(rotation.UserID, cursor, keyRotationBatchSize)
+		if errx != nil {
+			k.lgr.Debug(fmt.Sprintf("[Service] [KeyRotation] [rotateFolders] [FolderBatch] %s", errx.String()))
+			return errx
+		}
+
+		if len(batch) == 0 {
+			return nil
+		}
+
+		for index, folder := range batch {
+			name, errx := decryptField(folder.Name, oldCipher)
+			if errx != nil {
+				k.lgr.Debug(fmt.Sprintf("[Service] [KeyRotation] [rotateFolders] [decryptField] %s", errx.String()))
+				return errx
+			}
+
+			var err error
+			if folder.Name, err = encryptField(name, newCipher); err != nil {
+				k.lgr.Debug(fmt.Sprintf("[Service] [KeyRotation] [rotateFolders] [encryptField] %s", err.Error()))
+				return erx.WithArgs(err, erx.SeverityDebug)
+			}
+			batch[index] = folder
+		}
+
+		if errx = k.db.KeyRotations.StoreFolders(rotation.UserID, batch); errx != nil {
+			k.lgr.Debug(fmt.Sprintf("[Service] [KeyRotation] [rotateFolders] [StoreFolders] %s", errx.String()))
+			return errx
+		}
+		cursor = batch[len(batch)-1].FolderID
+	}
+}
+
+// rotateNotes gives every note a new data key under the new user key, rather than re-wrapping the old data key
+// which may have leaked along with the user key. The search tokens are recomputed under the new key alongside
+func (k *keyRotation) rotateNotes(rotation types.KeyRotation, oldCipher cipher.Block, newCipher cipher.Block, newKey []byte) *erx.Erx {
+	cursor := rotation.NoteCursor
+	for {
+		batch, errx := k.db.KeyRotations.NoteBatch(rotation.UserID, cursor, keyRotationBatchSize)
+		if errx != nil {
+			k.lgr.Debug(fmt.Sprintf("[Service] [KeyRotation] [rotateNotes] [NoteBatch] %s", errx.String()))
+			return errx
+		}
+
+		if len(batch) == 0 {
+			return nil
+		}
+
+		tokens := make(map[types.NoteID][]string, len(batch))
+		for index, note := range batch {
+			note, errx := decryptNote(note, oldCipher, k.lgr)
+			if errx != nil {
+				k.lgr.Debug(fmt.Sprintf("[Service] [KeyRotation] [rotateNotes] [decryptNote] %s", errx.String()))
+				return errx
+			}
+			tokens[note.NoteID] = noteSearchTokens(newKey, note.Name, note.Data)
+
+			note.WrappedKey = ""
+			if batch[index], errx = encryptNote(note, newCipher, k.lgr); errx != nil {
+				k.lgr.Debug(fmt.Sprintf("[Service] [KeyRotation] [rotateNotes] [encryptNote] %s", errx.String()))
+				return errx
+			}
+		}
+
+		if errx = k.db.KeyRotations.StoreNotes(rotation.UserID, batch, tokens); errx != nil {
+			k.lgr.Debug(fmt.Sprintf("[Service] [KeyRotation] [rotateNotes] [StoreNotes] %s", errx.String()))
+			return errx
+		}
+		cursor = batch[len(batch)-1].NoteID
+	}
+}
+
+func (k *keyRotation) openPendingKey(pendingKey string, blockCipher cipher.Block) ([]byte, *erx.Erx) {
+	newKey, errx := decryptField(pendingKey, blockCipher)
+	if errx != nil {
+		k.lgr.Debug(fmt.Sprintf("[Service] [KeyRotation] [openPendingKey] [decryptField] %s", errx.String()))
+		return nil, errx
+	}
+	return []byte(newKey), nil
+}
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"crypto/aes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/database"
+	"github.com/sid-sun/arche-api/app/keystore"
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/app/utils"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/sha3"
+)
+
+// fakeKeyRotations holds one user's rotation, folders and notes in id order
+// crashAfter is how many StoreNotes batches commit before the next one fails, a negative value never fails
+type fakeKeyRotations struct {
+	database.KeyRotationsTable
+	rotation   *types.KeyRotation
+	folders    []types.Folder
+	notes      []types.Note
+	stored     map[types.NoteID]int
+	crashAfter int
+	keyHash    string
+	totpSecret string
+}
+
+func (f *fakeKeyRotations) Get(userID types.UserID) (types.KeyRotation, *erx.Erx) {
+	if f.rotation == nil {
+		return types.KeyRotation{}, erx.WithArgs(custom_errors.NoRowsInResultSet, erx.SeverityInfo)
+	}
+	return *f.rotation, nil
+}
+
+func (f *fakeKeyRotations) SetPendingKey(userID types.UserID, pendingKey string) *erx.Erx {
+	if f.rotation == nil || f.rotation.PendingKey != "" {
+		return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+	}
+	f.rotation.PendingKey = pendingKey
+	return nil
+}
+
+func (f *fakeKeyRotations) FolderBatch(userID types.UserID, after types.FolderID, limit int) ([]types.Folder, *erx.Erx) {
+	var batch []types.Folder
+	for _, folder := range f.folders {
+		if folder.FolderID > after && len(batch) < limit {
+			batch = append(batch, folder)
+		}
+	}
+	return batch, nil
+}
+
+func (f *fakeKeyRotations) NoteBatch(userID types.UserID, after types.NoteID, limit int) ([]types.Note, *erx.Erx) {
+	var batch []types.Note
+	for _, note := range f.notes {
+		if note.NoteID > after && len(batch) < limit {
+			batch = append(batch, note)
+		}
+	}
+	return batch, nil
+}
+
+func (f *fakeKeyRotations) StoreFolders(userID types.UserID, folders []types.Folder) *erx.Erx {
+	for _, folder := range folders {
+		f.folders[folder.FolderID-1] = folder
+	}
+	f.rotation.FolderCursor = folders[len(folders)-1].FolderID
+	return nil
+}
+
+func (f *fakeKeyRotations) StoreNotes(userID types.UserID, notes []types.Note, tokens map[types.NoteID][]string) *erx.Erx {
+	if f.crashAfter == 0 {
+		return erx.WithArgs(errors.New("connection reset"), erx.SeverityError)
+	}
+	f.crashAfter--
+
+	for _, note := range notes {
+		f.notes[note.NoteID-1] = note
+		f.stored[note.NoteID]++
+	}
+	f.rotation.NoteCursor = notes[len(notes)-1].NoteID
+	return nil
+}
+
+func (f *fakeKeyRotations) Finish(userID types.UserID, keyHash string, password types.KeyWrap, recovery types.KeyWrap, totpSecret string) *erx.Erx {
+	f.keyHash = keyHash
+	f.totpSecret = totpSecret
+	f.rotation = nil
+	return nil
+}
+
+type fakeTwoFactor struct {
+	database.TwoFactorTable
+	totp types.TOTP
+}
+
+func (f *fakeTwoFactor) GetTOTP(userID types.UserID) (types.TOTP, *erx.Erx) {
+	return f.totp, nil
+}
+
+func newKeyRotation(t *testing.T, key []byte, folderCount int, noteCount int) (*keyRotation, *fakeKeyRotations) {
+	lgr := zap.NewNop()
+	blockCipher, err := aes.NewCipher(key)
+	assert.Nil(t, err)
+
+	rotations := &fakeKeyRotations{
+		rotation:   &types.KeyRotation{UserID: 1},
+		stored:     map[types.NoteID]int{},
+		crashAfter: -1,
+	}
+
+	for id := 1; id <= folderCount; id++ {
+		name, err := encryptField(fmt.Sprintf("folder %d", id), blockCipher)
+		assert.Nil(t, err)
+		rotations.folders = append(rotations.folders, types.Folder{FolderID: types.FolderID(id), UserID: 1, Name: name})
+	}
+
+	for id := 1; id <= noteCount; id++ {
+		note, errx := encryptNote(types.Note{NoteID: types.NoteID(id), Name: fmt.Sprintf("note %d", id), Data: "I am a butterfly"}, blockCipher, lgr)
+		assert.Nil(t, errx)
+		rotations.notes = append(rotations.notes, note)
+	}
+
+	secret, err := encryptField("JBSWY3DPEHPK3PXP", blockCipher)
+	assert.Nil(t, err)
+
+	db := &database.DB{
+		Users:        &fakeUsers{},
+		TwoFactor:    &fakeTwoFactor{totp: types.TOTP{Secret: secret, Enabled: true}},
+		KeyRotations: rotations,
+	}
+	return &keyRotation{db: db, ks: keystore.NewMemoryStore(), lgr: lgr}, rotations
+}
+
+func TestKeyRotationPrepare(t *testing.T) {
+	key, _, err := utils.GenerateEncryptionKey(nil)
+	assert.Nil(t, err)
+	svc, rotations := newKeyRotation(t, key, 0, 0)
+
+	newKey, errx := svc.Prepare(1, key)
+	assert.Nil(t, errx)
+	assert.NotEqual(t, key, newKey)
+	assert.NotEmpty(t, rotations.rotation.PendingKey)
+
+	// A login after a crash which lost newKey picks the same key back up
+	resumed, errx := svc.Prepare(1, key)
+	assert.Nil(t, errx)
+	assert.Equal(t, newKey, resumed)
+}
+
+func TestKeyRotationResume(t *testing.T) {
+	lgr := zap.NewNop()
+	key, _, err := utils.GenerateEncryptionKey(nil)
+	assert.Nil(t, err)
+
+	noteCount := keyRotationBatchSize*2 + keyRotationBatchSize/2
+	svc, rotations := newKeyRotation(t, key, 3, noteCount)
+
+	newKey, errx := svc.Prepare(1, key)
+	assert.Nil(t, errx)
+
+	// The second batch of notes fails to commit, the first one stays under the new key
+	rotations.crashAfter = 1
+	errx = svc.Complete(1, key, newKey, types.KeyWrap{}, types.KeyWrap{})
+	assert.NotNil(t, errx)
+	assert.NotNil(t, rotations.rotation)
+	assert.Equal(t, types.FolderID(3), rotations.rotation.FolderCursor)
+	assert.Equal(t, types.NoteID(keyRotationBatchSize), rotations.rotation.NoteCursor)
+	assert.Empty(t, rotations.keyHash)
+
+	// The next login prepares the same key and carries on from the cursors
+	rotations.crashAfter = -1
+	resumed, errx := svc.Prepare(1, key)
+	assert.Nil(t, errx)
+	assert.Equal(t, newKey, resumed)
+
+	errx = svc.Complete(1, key, resumed, types.KeyWrap{}, types.KeyWrap{})
+	assert.Nil(t, errx)
+	assert.Nil(t, rotations.rotation)
+
+	keyHash := sha3.Sum256(newKey)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(keyHash[:]), rotations.keyHash)
+
+	newCipher, err := aes.NewCipher(newKey)
+	assert.Nil(t, err)
+
+	for _, folder := range rotations.folders {
+		name, errx := decryptField(folder.Name, newCipher)
+		assert.Nil(t, errx)
+		assert.Equal(t, fmt.Sprintf("folder %d", folder.FolderID), name)
+	}
+
+	// Every note was re-encrypted exactly once and opens under the new key
+	assert.Len(t, rotations.stored, noteCount)
+	for _, note := range rotations.notes {
+		assert.Equal(t, 1, rotations.stored[note.NoteID])
+		opened, errx := decryptNote(note, newCipher, lgr)
+		assert.Nil(t, errx)
+		assert.Equal(t, fmt.Sprintf("note %d", note.NoteID), opened.Name)
+		assert.Equal(t, "I am a butterfly", opened.Data)
+	}
+
+	secret, errx := decryptField(rotations.totpSecret, newCipher)
+	assert.Nil(t, errx)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", secret)
+}
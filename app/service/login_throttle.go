@@ -0,0 +1,180 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/database"
+	"github.com/sid-sun/arche-api/app/keystore"
+	"github.com/sid-sun/arche-api/app/throttle"
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/app/utils"
+	"github.com/sid-sun/arche-api/config"
+	"go.uber.org/zap"
+)
+
+// LoginThrottleService slows down password guessing, failures are counted per email address and per client IP
+// whether or not the address belongs to an account
+//
+// Check counts the attempt it lets through as a failure straight away, Succeed takes it back
+type LoginThrottleService interface {
+	Check(email string, ip string) (throttle.Decision, *erx.Erx)
+	Fail(decision throttle.Decision, email string) (bool, *erx.Erx)
+	Succeed(decision throttle.Decision, email string, ip string) *erx.Erx
+	StartUnlock(userID types.UserID) (string, *erx.Erx)
+	RedeemUnlock(token string) (types.UserID, *erx.Erx)
+	FailSessionCode(sessionID string) (bool, *erx.Erx)
+}
+
+// unlockPrefix keeps unlock token entries apart from session keys in the key store
+const unlockPrefix = "unlock:"
+
+// maxSessionCodeFailures is how many wrong two-factor codes a restricted session may send before it is revoked
+const maxSessionCodeFailures = 5
+
+type loginThrottle struct {
+	db      *database.DB
+	ks      keystore.KeyStore
+	store   throttle.Store
+	limiter *throttle.Limiter
+	lockout time.Duration
+	lgr     *zap.Logger
+}
+
+func newLoginThrottle(db *database.DB, ks keystore.KeyStore, store throttle.Store, cfg *config.ThrottleConfig, lgr *zap.Logger) *loginThrottle {
+	account := throttle.Policy{
+		Window:       time.Minute * 15,
+		FreeAttempts: 3,
+		BaseDelay:    time.Second,
+		MaxDelay:     time.Second * 30,
+		LockoutAfter: cfg.GetMaxFailures(),
+		LockoutFor:   cfg.GetLockoutDuration(),
+	}
+
+	// A client may be behind a shared address, so it gets more room before being slowed down
+	client := throttle.Policy{
+		Window:       time.Minute * 15,
+		FreeAttempts: 10,
+		BaseDelay:    time.Second,
+		MaxDelay:     time.Second * 30,
+		LockoutAfter: cfg.GetMaxFailures() * 5,
+		LockoutFor:   cfg.GetLockoutDuration(),
+	}
+
+	return &loginThrottle{
+		db:      db,
+		ks:      ks,
+		store:   store,
+		limiter: throttle.NewLimiter(store, account, client),
+		lockout: cfg.GetLockoutDuration(),
+		lgr:     lgr,
+	}
+}
+
+func (l *loginThrottle) Check(email string, ip string) (throttle.Decision, *erx.Erx) {
+	decision, err := l.limiter.Check(email, ip)
+	if err != nil {
+		l.lgr.Debug(fmt.Sprintf("[Service] [LoginThrottle] [Check] [Check] %s", err.Error()))
+		return throttle.Decision{}, erx.WithArgs(err, erx.SeverityError)
+	}
+	return decision, nil
+}
+
+// Fail leaves a failed login counted, the returned bool is set by the failure which locked the account out
+func (l *loginThrottle) Fail(decision throttle.Decision, email string) (bool, *erx.Erx) {
+	justLocked, err := l.limiter.Fail(decision, email)
+	if err != nil {
+		l.lgr.Debug(fmt.Sprintf("[Service] [LoginThrottle] [Fail] [Fail] %s", err.Error()))
+		return false, erx.WithArgs(err, erx.SeverityError)
+	}
+	return justLocked, nil
+}
+
+func (l *loginThrottle) Succeed(decision throttle.Decision, email string, ip string) *erx.Erx {
+	if err := l.limiter.Succeed(decision, email, ip); err != nil {
+		l.lgr.Debug(fmt.Sprintf("[Service] [LoginThrottle] [Succeed] [Succeed] %s", err.Error()))
+		return erx.WithArgs(err, erx.SeverityError)
+	}
+	return nil
+}
+
+// StartUnlock returns a single use token lifting the lockout of userID, it lasts as long as the lockout itself
+// The user ID is kept rather than the address, entries have to fit the shared key store
+func (l *loginThrottle) StartUnlock(userID types.UserID) (string, *erx.Erx) {
+	token, err := utils.RandToken(32)
+	if err != nil {
+		l.lgr.Debug(fmt.Sprintf("[Service] [LoginThrottle] [StartUnlock] [RandToken] %s", err.Error()))
+		return "", erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	userIDBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(userIDBytes, uint64(userID))
+	if err = l.ks.Put(unlockPrefix+utils.HashVerificationToken(token), userIDBytes, l.lockout); err != nil {
+		l.lgr.Debug(fmt.Sprintf("[Service] [LoginThrottle] [StartUnlock] [Put] %s", err.Error()))
+		return "", erx.WithArgs(err, erx.SeverityError)
+	}
+
+	return token, nil
+}
+
+// RedeemUnlock lifts the lockout of the account an unlock token was issued to, a token can only be redeemed once
+func (l *loginThrottle) RedeemUnlock(token string) (types.UserID, *erx.Erx) {
+	entryID := unlockPrefix + utils.HashVerificationToken(token)
+
+	userIDBytes, err := l.ks.Get(entryID)
+	if err != nil {
+		if errors.Is(err, keystore.ErrKeyNotFound) {
+			return 0, erx.WithArgs(err, erx.SeverityInfo, custom_errors.InvalidUnlockToken)
+		}
+		l.lgr.Debug(fmt.Sprintf("[Service] [LoginThrottle] [RedeemUnlock] [Get] %s", err.Error()))
+		return 0, erx.WithArgs(err, erx.SeverityError)
+	}
+
+	if err = l.ks.Delete(entryID); err != nil {
+		l.lgr.Debug(fmt.Sprintf("[Service] [LoginThrottle] [RedeemUnlock] [Delete] %s", err.Error()))
+		return 0, erx.WithArgs(err, erx.SeverityError)
+	}
+
+	if len(userIDBytes) != 8 {
+		return 0, erx.WithArgs(errors.New("malformed unlock entry"), erx.SeverityError)
+	}
+
+	usr, errx := l.db.Users.GetByID(types.UserID(binary.BigEndian.Uint64(userIDBytes)))
+	if errx != nil {
+		if errx.Kind() == custom_errors.NoRowsInResultSet {
+			return 0, erx.WithArgs(errors.New("account no longer exists"), erx.SeverityInfo, custom_errors.InvalidUnlockToken)
+		}
+		l.lgr.Debug(fmt.Sprintf("[Service] [LoginThrottle] [RedeemUnlock] [GetByID] %s", errx.String()))
+		return 0, errx
+	}
+
+	if err = l.limiter.Unlock(usr.Email); err != nil {
+		l.lgr.Debug(fmt.Sprintf("[Service] [LoginThrottle] [RedeemUnlock] [Unlock] %s", err.Error()))
+		return 0, erx.WithArgs(err, erx.SeverityError)
+	}
+	return usr.ID, nil
+}
+
+// FailSessionCode records a wrong two-factor code sent to unlock a restricted session, the returned bool is set
+// once the session has used up its attempts and has to be revoked
+// Unlike a login, unlocking does not cost a challenge token per code, so this caps the guesses of one session
+func (l *loginThrottle) FailSessionCode(sessionID string) (bool, *erx.Erx) {
+	key := "session:" + sessionID
+	now := time.Now()
+
+	if err := l.store.RecordFailure(key, now, utils.RefreshTokenTTL); err != nil {
+		l.lgr.Debug(fmt.Sprintf("[Service] [LoginThrottle] [FailSessionCode] [RecordFailure] %s", err.Error()))
+		return false, erx.WithArgs(err, erx.SeverityError)
+	}
+
+	failures, err := l.store.Failures(key, now.Add(-utils.RefreshTokenTTL))
+	if err != nil {
+		l.lgr.Debug(fmt.Sprintf("[Service] [LoginThrottle] [FailSessionCode] [Failures] %s", err.Error()))
+		return false, erx.WithArgs(err, erx.SeverityError)
+	}
+	return len(failures) >= maxSessionCodeFailures, nil
+}
@@ -2,20 +2,31 @@ package service
 
 import (
 	"crypto/aes"
+	"crypto/cipher"
+	"errors"
 	"fmt"
 
 	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/custom_errors"
 	"github.com/sid-sun/arche-api/app/database"
 	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/app/utils"
 	"go.uber.org/zap"
 )
 
+// maxQueryWords caps the words of a search query, every one of them has to be in a note for it to match
+const maxQueryWords = 16
+
+// noteIndexBatchSize is how many notes written before search are indexed in one transaction
+const noteIndexBatchSize = 100
+
 type NotesService interface {
 	Get(noteID types.NoteID, claims types.AccessTokenClaims) (types.Note, *erx.Erx)
 	GetAll(claims types.AccessTokenClaims) ([]types.Note, *erx.Erx)
 	Create(name string, data string, folderID types.FolderID, claims types.AccessTokenClaims) (types.NoteID, *erx.Erx)
 	Update(name string, data string, folderID types.FolderID, noteID types.NoteID, claims types.AccessTokenClaims) *erx.Erx
 	Delete(noteID types.NoteID, claims types.AccessTokenClaims) *erx.Erx
+	Search(query string, claims types.AccessTokenClaims) ([]types.Note, *erx.Erx)
 }
 
 type notes struct {
@@ -30,6 +41,11 @@ func (n *notes) Get(noteID types.NoteID, claims types.AccessTokenClaims) (types.
 		return types.Note{}, errx
 	}
 
+	// Notes of zero-knowledge accounts are stored as the client sealed them
+	if claims.ZeroKnowledge {
+		return note, nil
+	}
+
 	blockCipher, err := aes.NewCipher(claims.EncryptionKey)
 	if err != nil {
 		n.lgr.Debug(fmt.Sprintf("[Service] [Notes] [Get] [NewCipher] %s", err.Error()))
@@ -52,6 +68,18 @@ func (n *notes) GetAll(claims types.AccessTokenClaims) ([]types.Note, *erx.Erx)
 		return nil, errx
 	}
 
+	// Restricted sessions only get to see which notes exist
+	if claims.Restricted {
+		for ind, note := range notesList {
+			notesList[ind] = types.Note{NoteID: note.NoteID, FolderID: note.FolderID, Locked: true}
+		}
+		return notesList, nil
+	}
+
+	if claims.ZeroKnowledge {
+		return notesList, nil
+	}
+
 	blockCipher, err := aes.NewCipher(claims.EncryptionKey)
 	if err != nil {
 		n.lgr.Debug(fmt.Sprintf("[Service] [Notes] [GetAll] [NewCipher] %s", err.Error()))
@@ -71,6 +99,16 @@ func (n *notes) GetAll(claims types.AccessTokenClaims) ([]types.Note, *erx.Erx)
 }
 
 func (n *notes) Create(name string, data string, folderID types.FolderID, claims types.AccessTokenClaims) (types.NoteID, *erx.Erx) {
+	// The server can neither encrypt nor index notes of zero-knowledge accounts
+	if claims.ZeroKnowledge {
+		noteID, errx := n.db.Notes.Create(name, data, "", nil, folderID, claims.UserID)
+		if errx != nil {
+			n.lgr.Debug(fmt.Sprintf("[Service] [Notes] [Create] [Create] %s", errx.String()))
+			return 0, errx
+		}
+		return noteID, nil
+	}
+
 	blockCipher, err := aes.NewCipher(claims.EncryptionKey)
 	if err != nil {
 		n.lgr.Debug(fmt.Sprintf("[Service] [Notes] [Create] [NewCipher] %s", err.Error()))
@@ -91,7 +129,8 @@ func (n *notes) Create(name string, data string, folderID types.FolderID, claims
 		return 0, errx
 	}
 
-	noteID, errx := n.db.Notes.Create(note.Name, note.Data, folderID, claims.UserID)
+	tokens := noteSearchTokens(claims.EncryptionKey, name, data)
+	noteID, errx := n.db.Notes.Create(note.Name, note.Data, note.WrappedKey, tokens, folderID, claims.UserID)
 	if errx != nil {
 		n.lgr.Debug(fmt.Sprintf("[Service] [Notes] [Create] [Create] %s", errx.String()))
 		return 0, errx
@@ -101,6 +140,22 @@ func (n *notes) Create(name string, data string, folderID types.FolderID, claims
 }
 
 func (n *notes) Update(name string, data string, folderID types.FolderID, noteID types.NoteID, claims types.AccessTokenClaims) *erx.Erx {
+	if claims.ZeroKnowledge {
+		note := types.Note{FolderID: folderID, NoteID: noteID, Name: name, Data: data}
+		if errx := n.db.Notes.Update(note, nil, claims.UserID); errx != nil {
+			n.lgr.Debug(fmt.Sprintf("[Service] [Notes] [Update] [Update] %s", errx.String()))
+			return errx
+		}
+		return nil
+	}
+
+	// The note keeps its data key across edits, notes written before per-note keys get one now
+	existing, errx := n.db.Notes.Get(noteID, claims.UserID)
+	if errx != nil {
+		n.lgr.Debug(fmt.Sprintf("[Service] [Notes] [Update] [Get] %s", errx.String()))
+		return errx
+	}
+
 	blockCipher, err := aes.NewCipher(claims.EncryptionKey)
 	if err != nil {
 		n.lgr.Debug(fmt.Sprintf("[Service] [Notes] [Update] [NewCipher] %s", err.Error()))
@@ -110,18 +165,19 @@ func (n *notes) Update(name string, data string, folderID types.FolderID, noteID
 	// Create note with zero NoteID as encryptNote needs note
 	// It does not operate on NoteID
 	note := types.Note{
-		FolderID: folderID,
-		NoteID:   noteID,
-		Name:     name,
-		Data:     data,
+		FolderID:   folderID,
+		NoteID:     noteID,
+		Name:       name,
+		Data:       data,
+		WrappedKey: existing.WrappedKey,
 	}
-	note, errx := encryptNote(note, blockCipher, n.lgr)
+	note, errx = encryptNote(note, blockCipher, n.lgr)
 	if errx != nil {
 		n.lgr.Debug(fmt.Sprintf("[Service] [Notes] [Update] [encryptNote] %s", errx.String()))
 		return errx
 	}
 
-	errx = n.db.Notes.Update(note, claims.UserID)
+	errx = n.db.Notes.Update(note, noteSearchTokens(claims.EncryptionKey, name, data), claims.UserID)
 	if errx != nil {
 		n.lgr.Debug(fmt.Sprintf("[Service] [Notes] [Update] [Uodate] %s", errx.String()))
 		return errx
@@ -138,3 +194,85 @@ func (n *notes) Delete(noteID types.NoteID, claims types.AccessTokenClaims) *erx
 	}
 	return nil
 }
+
+// Search returns the notes holding every word of query, matched by their blind index so the query never
+// reaches the database in the clear
+func (n *notes) Search(query string, claims types.AccessTokenClaims) ([]types.Note, *erx.Erx) {
+	if claims.ZeroKnowledge {
+		return nil, erx.WithArgs(errors.New("notes of zero-knowledge accounts are not indexed"), erx.SeverityInfo, custom_errors.ZeroKnowledgeAccount)
+	}
+
+	words := utils.SearchWords(query, maxQueryWords)
+	if len(words) == 0 {
+		return nil, erx.WithArgs(errors.New("search query has no words to look for"), erx.SeverityInfo, custom_errors.InvalidSearchQuery)
+	}
+
+	blockCipher, err := aes.NewCipher(claims.EncryptionKey)
+	if err != nil {
+		n.lgr.Debug(fmt.Sprintf("[Service] [Notes] [Search] [NewCipher] %s", err.Error()))
+		return nil, erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	if errx := n.indexNotes(claims, blockCipher); errx != nil {
+		n.lgr.Debug(fmt.Sprintf("[Service] [Notes] [Search] [indexNotes] %s", errx.String()))
+		return nil, errx
+	}
+
+	indexKey := utils.SearchIndexKey(claims.EncryptionKey)
+	tokens := make([]string, len(words))
+	for i, word := range words {
+		tokens[i] = utils.SearchToken(indexKey, word)
+	}
+
+	notesList, errx := n.db.Notes.Search(claims.UserID, tokens)
+	if errx != nil {
+		n.lgr.Debug(fmt.Sprintf("[Service] [Notes] [Search] [Search] %s", errx.String()))
+		return nil, errx
+	}
+
+	for ind, note := range notesList {
+		note, errx := decryptNote(note, blockCipher, n.lgr)
+		if errx != nil {
+			n.lgr.Debug(fmt.Sprintf("[Service] [Notes] [Search] [decryptNote] %s", errx.String()))
+			return nil, errx
+		}
+		notesList[ind] = note
+	}
+
+	return notesList, nil
+}
+
+// indexNotes adds the user's notes written before search existed to the index, which takes the user's key
+// so it happens on their first search rather than in the background
+func (n *notes) indexNotes(claims types.AccessTokenClaims, blockCipher cipher.Block) *erx.Erx {
+	for {
+		batch, errx := n.db.Notes.Unindexed(claims.UserID, noteIndexBatchSize)
+		if errx != nil {
+			n.lgr.Debug(fmt.Sprintf("[Service] [Notes] [indexNotes] [Unindexed] %s", errx.String()))
+			return errx
+		}
+
+		if len(batch) == 0 {
+			return nil
+		}
+
+		tokens := make(map[types.NoteID][]string, len(batch))
+		for _, note := range batch {
+			note, errx := decryptNote(note, blockCipher, n.lgr)
+			if errx != nil {
+				n.lgr.Debug(fmt.Sprintf("[Service] [Notes] [indexNotes] [decryptNote] %s", errx.String()))
+				return errx
+			}
+			tokens[note.NoteID] = noteSearchTokens(claims.EncryptionKey, note.Name, note.Data)
+		}
+
+		if errx = n.db.Notes.Index(claims.UserID, tokens); errx != nil {
+			n.lgr.Debug(fmt.Sprintf("[Service] [Notes] [indexNotes] [Index] %s", errx.String()))
+			return errx
+		}
+
+		if len(batch) < noteIndexBatchSize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/database"
+	"github.com/sid-sun/arche-api/app/keystore"
+	"github.com/sid-sun/arche-api/app/oidc"
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/app/utils"
+	"go.uber.org/zap"
+)
+
+// Purposes an OpenID Connect sign-in is started for, a state issued for one cannot finish the other
+const (
+	OIDCPurposeLogin = "login"
+	OIDCPurposeLink  = "link"
+)
+
+// oidcStatePrefix keeps pending sign-ins apart from session keys in the key store
+const oidcStatePrefix = "oidc:"
+
+// oidcStateTTL is how long the user has to sign in at the provider
+const oidcStateTTL = time.Minute * 10
+
+// OIDCService signs users in through the configured OpenID Connect provider, accounts are linked
+// to the provider's subject identifier while logged in and found by it afterwards
+type OIDCService interface {
+	Begin(purpose string) (string, string, *erx.Erx)
+	Finish(purpose string, state string, code string) (oidc.Identity, *erx.Erx)
+	GetLinkedUser(identity oidc.Identity) (types.UserID, *erx.Erx)
+	List(userID types.UserID) ([]types.Identity, *erx.Erx)
+	Link(userID types.UserID, identity oidc.Identity, vault types.KeyWrap) *erx.Erx
+	Unlink(userID types.UserID) *erx.Erx
+}
+
+type openIDConnect struct {
+	db       *database.DB
+	ks       keystore.KeyStore
+	provider *oidc.Provider
+	lgr      *zap.Logger
+}
+
+func (o *openIDConnect) notConfigured() *erx.Erx {
+	return erx.WithArgs(errors.New("openid connect is not configured"), erx.SeverityInfo, custom_errors.OIDCNotConfigured)
+}
+
+// Begin returns the provider's authorization URL and the state it will come back with
+// The PKCE verifier stays in the key store, the nonce is derived from it
+func (o *openIDConnect) Begin(purpose string) (string, string, *erx.Erx) {
+	if o.provider == nil {
+		return "", "", o.notConfigured()
+	}
+
+	state, err := utils.RandToken(32)
+	if err != nil {
+		o.lgr.Debug(fmt.Sprintf("[Service] [OIDC] [Begin] [RandToken] %s", err.Error()))
+		return "", "", erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	verifier, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		o.lgr.Debug(fmt.Sprintf("[Service] [OIDC] [Begin] [NewPKCE] %s", err.Error()))
+		return "", "", erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	authURL, err := o.provider.AuthCodeURL(state, oidcNonce(verifier), challenge)
+	if err != nil {
+		o.lgr.Error(fmt.Sprintf("[Service] [OIDC] [Begin] [AuthCodeURL] %s", err.Error()))
+		return "", "", erx.WithArgs(err, erx.SeverityError)
+	}
+
+	if err = o.ks.Put(oidcStatePrefix+state, []byte(purpose+":"+verifier), oidcStateTTL); err != nil {
+		o.lgr.Debug(fmt.Sprintf("[Service] [OIDC] [Begin] [Put] %s", err.Error()))
+		return "", "", erx.WithArgs(err, erx.SeverityError)
+	}
+
+	return authURL, state, nil
+}
+
+// Finish exchanges the code the provider redirected back with and verifies the ID token, a state can be used once
+func (o *openIDConnect) Finish(purpose string, state string, code string) (oidc.Identity, *erx.Erx) {
+	if o.provider == nil {
+		return oidc.Identity{}, o.notConfigured()
+	}
+
+	entry, err := o.ks.Get(oidcStatePrefix + state)
+	if err != nil {
+		if errors.Is(err, keystore.ErrKeyNotFound) {
+			return oidc.Identity{}, erx.WithArgs(err, erx.SeverityInfo, custom_errors.InvalidOIDCState)
+		}
+		o.lgr.Debug(fmt.Sprintf("[Service] [OIDC] [Finish] [Get] %s", err.Error()))
+		return oidc.Identity{}, erx.WithArgs(err, erx.SeverityError)
+	}
+
+	if err = o.ks.Delete(oidcStatePrefix + state); err != nil {
+		o.lgr.Debug(fmt.Sprintf("[Service] [OIDC] [Finish] [Delete] %s", err.Error()))
+		return oidc.Identity{}, erx.WithArgs(err, erx.SeverityError)
+	}
+
+	parts := strings.SplitN(string(entry), ":", 2)
+	if len(parts) != 2 || parts[0] != purpose {
+		return oidc.Identity{}, erx.WithArgs(errors.New("state was issued for another purpose"), erx.SeverityInfo, custom_errors.InvalidOIDCState)
+	}
+	verifier := parts[1]
+
+	idToken, err := o.provider.Exchange(code, verifier)
+	if err != nil {
+		o.lgr.Info(fmt.Sprintf("[Service] [OIDC] [Finish] [Exchange] %s", err.Error()))
+		return oidc.Identity{}, erx.WithArgs(err, erx.SeverityInfo, custom_errors.OIDCLoginFailed)
+	}
+
+	identity, err := o.provider.VerifyIDToken(idToken, oidcNonce(verifier))
+	if err != nil {
+		o.lgr.Warn(fmt.Sprintf("[Service] [OIDC] [Finish] [VerifyIDToken] %s", err.Error()))
+		return oidc.Identity{}, erx.WithArgs(err, erx.SeverityWarn, custom_errors.OIDCLoginFailed)
+	}
+
+	return identity, nil
+}
+
+func (o *openIDConnect) GetLinkedUser(identity oidc.Identity) (types.UserID, *erx.Erx) {
+	userID, errx := o.db.Identities.GetUserID(identity.Issuer, identity.Subject)
+	if errx != nil {
+		o.lgr.Debug(fmt.Sprintf("[Service] [OIDC] [GetLinkedUser] [GetUserID] %s", errx.String()))
+		return 0, errx
+	}
+
+	return userID, nil
+}
+
+func (o *openIDConnect) List(userID types.UserID) ([]types.Identity, *erx.Erx) {
+	linked, errx := o.db.Identities.List(userID)
+	if errx != nil {
+		o.lgr.Debug(fmt.Sprintf("[Service] [OIDC] [List] [List] %s", errx.String()))
+		return nil, errx
+	}
+
+	return linked, nil
+}
+
+// Link ties identity to the user and stores the data key wrapped under their vault passphrase
+func (o *openIDConnect) Link(userID types.UserID, identity oidc.Identity, vault types.KeyWrap) *erx.Erx {
+	errx := o.db.Identities.Link(types.Identity{
+		Issuer:    identity.Issuer,
+		Subject:   identity.Subject,
+		UserID:    userID,
+		Email:     identity.Email,
+		CreatedAt: time.Now(),
+	}, vault)
+	if errx != nil {
+		o.lgr.Debug(fmt.Sprintf("[Service] [OIDC] [Link] [Link] %s", errx.String()))
+		return errx
+	}
+
+	return nil
+}
+
+// Unlink removes the user's identity at the configured provider
+func (o *openIDConnect) Unlink(userID types.UserID) *erx.Erx {
+	if o.provider == nil {
+		return o.notConfigured()
+	}
+
+	errx := o.db.Identities.Unlink(userID, o.provider.Issuer)
+	if errx != nil {
+		o.lgr.Debug(fmt.Sprintf("[Service] [OIDC] [Unlink] [Unlink] %s", errx.String()))
+		return errx
+	}
+
+	return nil
+}
+
+// oidcNonce binds the ID token to the pending sign-in without storing a second secret
+func oidcNonce(verifier string) string {
+	return utils.HashVerificationToken("oidc nonce:" + verifier)
+}
@@ -1,24 +1,61 @@
 package service
 
 import (
+	"github.com/sid-sun/arche-api/app/audit"
 	"github.com/sid-sun/arche-api/app/database"
 	"github.com/sid-sun/arche-api/app/initializers"
+	"github.com/sid-sun/arche-api/app/keystore"
+	"github.com/sid-sun/arche-api/app/oidc"
+	"github.com/sid-sun/arche-api/app/throttle"
+	"github.com/sid-sun/arche-api/config"
 	"go.uber.org/zap"
 )
 
 type Service struct {
-	Users   UsersService
-	Folders FoldersService
-	Notes   NotesService
+	Users     UsersService
+	Sessions  SessionsService
+	TwoFactor TwoFactorService
+	WebAuthn  WebAuthnService
+	Folders   FoldersService
+	Notes     NotesService
+	// AccessTokens is named after the personal access tokens it manages, not the JWT access tokens of sessions
+	AccessTokens AccessTokensService
+	OIDC         OIDCService
+	Throttle     LoginThrottleService
+	KeyRotation  KeyRotationService
+	SRP          SRPService
+	Audit        audit.Log
 }
 
-func NewService(db *database.DB, mc initializers.MailClient, lgr *zap.Logger) *Service {
+func NewService(db *database.DB, mc initializers.MailClient, ks keystore.KeyStore, ts throttle.Store, webAuthnCfg *config.WebAuthnConfig, oidcCfg *config.OIDCConfig, throttleCfg *config.ThrottleConfig, decoyCfg *config.DecoyConfig, lgr *zap.Logger) *Service {
+	var provider *oidc.Provider
+	if oidcCfg.Enabled() {
+		provider = oidc.NewProvider(oidcCfg.GetIssuer(), oidcCfg.GetClientID(), oidcCfg.GetClientSecret(), oidcCfg.GetRedirectURL())
+	}
+
 	return &Service{
 		Users: &users{
 			db:         db,
+			ks:         ks,
 			lgr:        lgr,
 			mailClient: mc,
 		},
+		Sessions: &sessions{
+			db:  db,
+			ks:  ks,
+			lgr: lgr,
+		},
+		TwoFactor: &twoFactor{
+			db:  db,
+			lgr: lgr,
+		},
+		WebAuthn: &webAuthn{
+			db:       db,
+			ks:       ks,
+			cfg:      webAuthnCfg,
+			decoyKey: decoyCfg.GetKey(),
+			lgr:      lgr,
+		},
 		Folders: &folders{
 			db:  db,
 			lgr: lgr,
@@ -27,5 +64,23 @@ func NewService(db *database.DB, mc initializers.MailClient, lgr *zap.Logger) *S
 			db:  db,
 			lgr: lgr,
 		},
+		AccessTokens: &accessTokens{
+			db:  db,
+			lgr: lgr,
+		},
+		OIDC: &openIDConnect{
+			db:       db,
+			ks:       ks,
+			provider: provider,
+			lgr:      lgr,
+		},
+		Throttle: newLoginThrottle(db, ks, ts, throttleCfg, lgr),
+		KeyRotation: &keyRotation{
+			db:  db,
+			ks:  ks,
+			lgr: lgr,
+		},
+		SRP:   newSRPLogin(db, ks, decoyCfg, lgr),
+		Audit: audit.NewLog(db.AuditEvents, lgr),
 	}
 }
@@ -0,0 +1,310 @@
+package service
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/database"
+	"github.com/sid-sun/arche-api/app/keystore"
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/app/utils"
+	"github.com/sid-sun/arche-api/config"
+	"go.uber.org/zap"
+)
+
+// SessionsService manages login sessions, a session id doubles as the family id of its refresh tokens
+type SessionsService interface {
+	Start(userID types.UserID, key []byte, client types.ClientInfo, jwtCfg *config.JWTConfig) (string, string, *erx.Erx)
+	Refresh(claims types.AccessTokenClaims, client types.ClientInfo, jwtCfg *config.JWTConfig) (string, string, *erx.Erx)
+	List(userID types.UserID) ([]types.Session, *erx.Erx)
+	Revoke(userID types.UserID, sessionID string) *erx.Erx
+	RevokeAll(userID types.UserID) *erx.Erx
+	StartChallenge(userID types.UserID, key []byte, jwtCfg *config.JWTConfig) (string, *erx.Erx)
+	RedeemChallenge(challengeToken string, jwtCfg *config.JWTConfig) (types.UserID, []byte, *erx.Erx)
+	StartMagicLink(userID types.UserID) (string, *erx.Erx)
+	RedeemMagicLink(token string) (types.UserID, *erx.Erx)
+	Unlock(sessionID string, key []byte) *erx.Erx
+}
+
+// magicLinkPrefix keeps login link entries apart from session keys in the key store
+const magicLinkPrefix = "magic:"
+
+type sessions struct {
+	db  *database.DB
+	ks  keystore.KeyStore
+	lgr *zap.Logger
+}
+
+// Start stores the data key server-side under a new session and issues its first pair of tokens
+// A nil key starts a restricted session, which stays usable for metadata until Unlock gives it the key
+func (s *sessions) Start(userID types.UserID, key []byte, client types.ClientInfo, jwtCfg *config.JWTConfig) (string, string, *erx.Erx) {
+	sessionID, err := utils.RandToken(32)
+	if err != nil {
+		s.lgr.Debug(fmt.Sprintf("[Service] [Sessions] [Start] [RandToken] %s", err.Error()))
+		return "", "", erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	if err = s.ks.Put(sessionID, key, utils.RefreshTokenTTL); err != nil {
+		s.lgr.Debug(fmt.Sprintf("[Service] [Sessions] [Start] [Put] %s", err.Error()))
+		return "", "", erx.WithArgs(err, erx.SeverityError)
+	}
+
+	errx := s.db.Sessions.Create(types.Session{
+		SessionID:   sessionID,
+		UserID:      userID,
+		DeviceLabel: client.DeviceLabel,
+		UserAgent:   client.UserAgent,
+		IPAddress:   client.IPAddress,
+		CreatedAt:   time.Now(),
+	})
+	if errx != nil {
+		s.lgr.Debug(fmt.Sprintf("[Service] [Sessions] [Start] [Create] %s", errx.String()))
+		return "", "", errx
+	}
+
+	return s.issue(userID, sessionID, jwtCfg)
+}
+
+// Refresh rotates a refresh token, presenting a token which was already rotated revokes its whole family
+func (s *sessions) Refresh(claims types.AccessTokenClaims, client types.ClientInfo, jwtCfg *config.JWTConfig) (string, string, *erx.Erx) {
+	if claims.TokenType != types.TokenTypeRefresh || claims.Id == "" {
+		return "", "", erx.WithArgs(errors.New("not a refresh token"), erx.SeverityInfo, custom_errors.InvalidRefreshToken)
+	}
+
+	token, errx := s.db.RefreshTokens.Use(claims.Id)
+	if errx != nil {
+		if errx.Kind() == custom_errors.NoRowsInResultSet {
+			return "", "", erx.WithArgs(errx, erx.SeverityInfo, custom_errors.InvalidRefreshToken)
+		}
+		s.lgr.Debug(fmt.Sprintf("[Service] [Sessions] [Refresh] [Use] %s", errx.String()))
+		return "", "", errx
+	}
+
+	if token.UserID != claims.UserID || token.FamilyID != claims.SessionID {
+		return "", "", erx.WithArgs(errors.New("refresh token does not match its record"), erx.SeverityWarn, custom_errors.InvalidRefreshToken)
+	}
+
+	if token.Revoked || time.Now().After(token.ExpiresAt) {
+		return "", "", erx.WithArgs(errors.New("refresh token is revoked or expired"), erx.SeverityInfo, custom_errors.InvalidRefreshToken)
+	}
+
+	if token.Used {
+		s.lgr.Warn(fmt.Sprintf("[Service] [Sessions] [Refresh] refresh token reuse detected for user %d, revoking session", token.UserID))
+		if errx := s.Revoke(token.UserID, token.FamilyID); errx != nil && errx.Kind() != custom_errors.NoRowsAffected {
+			return "", "", errx
+		}
+		return "", "", erx.WithArgs(errors.New("refresh token reuse detected"), erx.SeverityWarn, custom_errors.RefreshTokenReused)
+	}
+
+	// Revoked sessions are not touched, so this also catches tokens of a session revoked from another device
+	errx = s.db.Sessions.Touch(token.FamilyID, client.IPAddress, client.UserAgent, time.Now())
+	if errx != nil {
+		if errx.Kind() == custom_errors.NoRowsAffected {
+			return "", "", erx.WithArgs(errx, erx.SeverityInfo, custom_errors.InvalidRefreshToken)
+		}
+		s.lgr.Debug(fmt.Sprintf("[Service] [Sessions] [Refresh] [Touch] %s", errx.String()))
+		return "", "", errx
+	}
+
+	// The key lives as long as the newest refresh token of its session, extending it cannot write back the key
+	// of a session revoked since it was touched
+	if err := s.ks.Extend(token.FamilyID, utils.RefreshTokenTTL); err != nil {
+		if errors.Is(err, keystore.ErrKeyNotFound) {
+			return "", "", erx.WithArgs(err, erx.SeverityInfo, custom_errors.InvalidRefreshToken)
+		}
+		s.lgr.Debug(fmt.Sprintf("[Service] [Sessions] [Refresh] [Extend] %s", err.Error()))
+		return "", "", erx.WithArgs(err, erx.SeverityError)
+	}
+
+	return s.issue(token.UserID, token.FamilyID, jwtCfg)
+}
+
+func (s *sessions) List(userID types.UserID) ([]types.Session, *erx.Erx) {
+	sessionList, errx := s.db.Sessions.List(userID)
+	if errx != nil {
+		s.lgr.Debug(fmt.Sprintf("[Service] [Sessions] [List] [List] %s", errx.String()))
+		return nil, errx
+	}
+	return sessionList, nil
+}
+
+// Revoke ends a session of the user, dropping its key makes its access tokens fail in JWTAuth right away
+func (s *sessions) Revoke(userID types.UserID, sessionID string) *erx.Erx {
+	errx := s.db.Sessions.Revoke(sessionID, userID)
+	if errx != nil {
+		s.lgr.Debug(fmt.Sprintf("[Service] [Sessions] [Revoke] [Revoke] %s", errx.String()))
+		return errx
+	}
+
+	return dropSessionKeys([]string{sessionID}, s.ks, s.lgr)
+}
+
+func (s *sessions) RevokeAll(userID types.UserID) *erx.Erx {
+	sessionIDs, errx := s.db.Sessions.RevokeAll(userID)
+	if errx != nil {
+		s.lgr.Debug(fmt.Sprintf("[Service] [Sessions] [RevokeAll] [RevokeAll] %s", errx.String()))
+		return errx
+	}
+
+	return dropSessionKeys(sessionIDs, s.ks, s.lgr)
+}
+
+// StartChallenge parks the data key of a half finished login and returns a short-lived token referencing it
+func (s *sessions) StartChallenge(userID types.UserID, key []byte, jwtCfg *config.JWTConfig) (string, *erx.Erx) {
+	challengeID, err := utils.RandToken(32)
+	if err != nil {
+		s.lgr.Debug(fmt.Sprintf("[Service] [Sessions] [StartChallenge] [RandToken] %s", err.Error()))
+		return "", erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	if err = s.ks.Put(challengeID, key, utils.ChallengeTokenTTL); err != nil {
+		s.lgr.Debug(fmt.Sprintf("[Service] [Sessions] [StartChallenge] [Put] %s", err.Error()))
+		return "", erx.WithArgs(err, erx.SeverityError)
+	}
+
+	claims := types.AccessTokenClaims{
+		UserID:    userID,
+		SessionID: challengeID,
+		TokenType: types.TokenTypeChallenge,
+		StandardClaims: jwt.StandardClaims{
+			NotBefore: time.Now().Unix(),
+			ExpiresAt: time.Now().Add(utils.ChallengeTokenTTL).Unix(),
+		},
+	}
+
+	challengeToken, err := utils.IssueJWT(claims, jwtCfg, s.lgr)
+	if err != nil {
+		s.lgr.Debug(fmt.Sprintf("[Service] [Sessions] [StartChallenge] [IssueJWT] %s", err.Error()))
+		return "", erx.WithArgs(err, erx.SeverityDebug)
+	}
+	return challengeToken, nil
+}
+
+// RedeemChallenge returns the data key parked by StartChallenge, a challenge can only be redeemed once
+// whatever the outcome of the second factor, so every guess costs a password entry
+func (s *sessions) RedeemChallenge(challengeToken string, jwtCfg *config.JWTConfig) (types.UserID, []byte, *erx.Erx) {
+	claims, err := utils.ValidateJWT(challengeToken, jwtCfg, s.lgr)
+	if err != nil {
+		return 0, nil, erx.WithArgs(err, erx.SeverityInfo, custom_errors.InvalidChallengeToken)
+	}
+
+	if claims.TokenType != types.TokenTypeChallenge {
+		return 0, nil, erx.WithArgs(errors.New("not a challenge token"), erx.SeverityInfo, custom_errors.InvalidChallengeToken)
+	}
+
+	key, err := s.ks.Get(claims.SessionID)
+	if err != nil {
+		if errors.Is(err, keystore.ErrKeyNotFound) {
+			return 0, nil, erx.WithArgs(err, erx.SeverityInfo, custom_errors.InvalidChallengeToken)
+		}
+		s.lgr.Debug(fmt.Sprintf("[Service] [Sessions] [RedeemChallenge] [Get] %s", err.Error()))
+		return 0, nil, erx.WithArgs(err, erx.SeverityError)
+	}
+
+	if err = s.ks.Delete(claims.SessionID); err != nil {
+		s.lgr.Debug(fmt.Sprintf("[Service] [Sessions] [RedeemChallenge] [Delete] %s", err.Error()))
+		return 0, nil, erx.WithArgs(err, erx.SeverityError)
+	}
+
+	return claims.UserID, key, nil
+}
+
+// StartMagicLink returns a single use login token for userID, only its hash is kept in the key store
+func (s *sessions) StartMagicLink(userID types.UserID) (string, *erx.Erx) {
+	token, err := utils.RandToken(32)
+	if err != nil {
+		s.lgr.Debug(fmt.Sprintf("[Service] [Sessions] [StartMagicLink] [RandToken] %s", err.Error()))
+		return "", erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	userIDBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(userIDBytes, uint64(userID))
+	if err = s.ks.Put(magicLinkPrefix+utils.HashVerificationToken(token), userIDBytes, utils.MagicLinkTTL); err != nil {
+		s.lgr.Debug(fmt.Sprintf("[Service] [Sessions] [StartMagicLink] [Put] %s", err.Error()))
+		return "", erx.WithArgs(err, erx.SeverityError)
+	}
+
+	return token, nil
+}
+
+// RedeemMagicLink returns the user a login token was issued to, a token can only be redeemed once
+func (s *sessions) RedeemMagicLink(token string) (types.UserID, *erx.Erx) {
+	entryID := magicLinkPrefix + utils.HashVerificationToken(token)
+
+	userIDBytes, err := s.ks.Get(entryID)
+	if err != nil {
+		if errors.Is(err, keystore.ErrKeyNotFound) {
+			return 0, erx.WithArgs(err, erx.SeverityInfo, custom_errors.InvalidMagicLink)
+		}
+		s.lgr.Debug(fmt.Sprintf("[Service] [Sessions] [RedeemMagicLink] [Get] %s", err.Error()))
+		return 0, erx.WithArgs(err, erx.SeverityError)
+	}
+
+	if err = s.ks.Delete(entryID); err != nil {
+		s.lgr.Debug(fmt.Sprintf("[Service] [Sessions] [RedeemMagicLink] [Delete] %s", err.Error()))
+		return 0, erx.WithArgs(err, erx.SeverityError)
+	}
+
+	if len(userIDBytes) != 8 {
+		return 0, erx.WithArgs(errors.New("malformed login link entry"), erx.SeverityError)
+	}
+	return types.UserID(binary.BigEndian.Uint64(userIDBytes)), nil
+}
+
+// Unlock hands a restricted session the data key, its existing tokens then work everywhere
+func (s *sessions) Unlock(sessionID string, key []byte) *erx.Erx {
+	// Replacing cannot write back the key of a session revoked since the request was authenticated
+	if err := s.ks.Replace(sessionID, key, utils.RefreshTokenTTL); err != nil {
+		if errors.Is(err, keystore.ErrKeyNotFound) {
+			return erx.WithArgs(err, erx.SeverityInfo, custom_errors.NoRowsAffected)
+		}
+		s.lgr.Debug(fmt.Sprintf("[Service] [Sessions] [Unlock] [Replace] %s", err.Error()))
+		return erx.WithArgs(err, erx.SeverityError)
+	}
+	return nil
+}
+
+func (s *sessions) issue(userID types.UserID, sessionID string, jwtCfg *config.JWTConfig) (string, string, *erx.Erx) {
+	tokenID, err := utils.RandToken(32)
+	if err != nil {
+		s.lgr.Debug(fmt.Sprintf("[Service] [Sessions] [issue] [RandToken] %s", err.Error()))
+		return "", "", erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	// The mode is looked up on every issue rather than trusted from the previous token
+	usr, errx := s.db.Users.GetByID(userID)
+	if errx != nil {
+		s.lgr.Debug(fmt.Sprintf("[Service] [Sessions] [issue] [GetByID] %s", errx.String()))
+		return "", "", errx
+	}
+
+	errx = s.db.RefreshTokens.Create(tokenID, sessionID, userID, time.Now().Add(utils.RefreshTokenTTL))
+	if errx != nil {
+		s.lgr.Debug(fmt.Sprintf("[Service] [Sessions] [issue] [Create] %s", errx.String()))
+		return "", "", errx
+	}
+
+	accessToken, refreshToken, err := utils.IssueTokens(userID, sessionID, tokenID, usr.ZeroKnowledge, jwtCfg, s.lgr)
+	if err != nil {
+		s.lgr.Debug(fmt.Sprintf("[Service] [Sessions] [issue] [IssueTokens] %s", err.Error()))
+		return "", "", erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	return accessToken, refreshToken, nil
+}
+
+// dropSessionKeys removes the keys of revoked sessions so their access tokens stop working right away
+func dropSessionKeys(sessionIDs []string, ks keystore.KeyStore, lgr *zap.Logger) *erx.Erx {
+	for _, sessionID := range sessionIDs {
+		if err := ks.Delete(sessionID); err != nil {
+			lgr.Debug(fmt.Sprintf("[Service] [Sessions] [dropSessionKeys] [Delete] %s", err.Error()))
+			return erx.WithArgs(err, erx.SeverityError)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/database"
+	"github.com/sid-sun/arche-api/app/keystore"
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/config"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// fakeRefreshTokens keeps the refresh_tokens rows of fakeSessions, Use returns a row as it was before marking it used
+type fakeRefreshTokens struct {
+	database.RefreshTokensTable
+	tokens map[string]types.RefreshToken
+	latest string
+}
+
+func (f *fakeRefreshTokens) Create(tokenID string, familyID string, userID types.UserID, expiresAt time.Time) *erx.Erx {
+	f.tokens[tokenID] = types.RefreshToken{TokenID: tokenID, FamilyID: familyID, UserID: userID, ExpiresAt: expiresAt}
+	f.latest = tokenID
+	return nil
+}
+
+func (f *fakeRefreshTokens) Use(tokenID string) (types.RefreshToken, *erx.Erx) {
+	token, ok := f.tokens[tokenID]
+	if !ok {
+		return types.RefreshToken{}, erx.WithArgs(custom_errors.NoRowsInResultSet, erx.SeverityInfo)
+	}
+	used := token
+	used.Used = true
+	f.tokens[tokenID] = used
+	return token, nil
+}
+
+// fakeSessions revokes the refresh tokens of a session along with it, like the sessions table does
+type fakeSessions struct {
+	database.SessionsTable
+	tokens  *fakeRefreshTokens
+	revoked map[string]bool
+	live    map[string]types.UserID
+}
+
+func (f *fakeSessions) Create(session types.Session) *erx.Erx {
+	f.live[session.SessionID] = session.UserID
+	return nil
+}
+
+func (f *fakeSessions) Touch(sessionID string, ipAddress string, userAgent string, lastSeenAt time.Time) *erx.Erx {
+	if _, ok := f.live[sessionID]; !ok || f.revoked[sessionID] {
+		return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+	}
+	return nil
+}
+
+func (f *fakeSessions) Revoke(sessionID string, userID types.UserID) *erx.Erx {
+	if f.live[sessionID] != userID || f.revoked[sessionID] {
+		return erx.WithArgs(custom_errors.NoRowsAffected, erx.SeverityInfo)
+	}
+	f.revoked[sessionID] = true
+	for tokenID, token := range f.tokens.tokens {
+		if token.FamilyID == sessionID {
+			token.Revoked = true
+			f.tokens.tokens[tokenID] = token
+		}
+	}
+	return nil
+}
+
+type fakeUsers struct {
+	database.UsersTable
+}
+
+func (f *fakeUsers) GetByID(userID types.UserID) (types.User, *erx.Erx) {
+	return types.User{ID: userID}, nil
+}
+
+func refreshClaims(userID types.UserID, sessionID string, tokenID string) types.AccessTokenClaims {
+	claims := types.AccessTokenClaims{UserID: userID, SessionID: sessionID, TokenType: types.TokenTypeRefresh}
+	claims.Id = tokenID
+	return claims
+}
+
+func TestRefreshTokenReuse(t *testing.T) {
+	tokens := &fakeRefreshTokens{tokens: map[string]types.RefreshToken{}}
+	db := &database.DB{
+		Users:         &fakeUsers{},
+		RefreshTokens: tokens,
+		Sessions:      &fakeSessions{tokens: tokens, revoked: map[string]bool{}, live: map[string]types.UserID{}},
+	}
+	ks := keystore.NewMemoryStore()
+	svc := &sessions{db: db, ks: ks, lgr: zap.NewNop()}
+	jwtCfg := &config.JWTConfig{}
+	userID := types.UserID(1)
+
+	_, _, errx := svc.Start(userID, []byte("data key"), types.ClientInfo{}, jwtCfg)
+	assert.Nil(t, errx)
+	first := tokens.tokens[tokens.latest]
+
+	// Each refresh rotates the token within the same family
+	_, _, errx = svc.Refresh(refreshClaims(userID, first.FamilyID, first.TokenID), types.ClientInfo{}, jwtCfg)
+	assert.Nil(t, errx)
+	second := tokens.tokens[tokens.latest]
+	assert.NotEqual(t, first.TokenID, second.TokenID)
+	assert.Equal(t, first.FamilyID, second.FamilyID)
+
+	// Presenting the rotated token again revokes the whole family
+	_, _, errx = svc.Refresh(refreshClaims(userID, first.FamilyID, first.TokenID), types.ClientInfo{}, jwtCfg)
+	assert.NotNil(t, errx)
+	assert.Equal(t, custom_errors.RefreshTokenReused, errx.Kind())
+
+	_, err := ks.Get(first.FamilyID)
+	assert.Equal(t, keystore.ErrKeyNotFound, err)
+
+	// Including the newest token, which was never presented
+	_, _, errx = svc.Refresh(refreshClaims(userID, second.FamilyID, second.TokenID), types.ClientInfo{}, jwtCfg)
+	assert.NotNil(t, errx)
+	assert.Equal(t, custom_errors.InvalidRefreshToken, errx.Kind())
+
+	// Claims which do not match the record of a token never revoke its family
+	_, _, errx = svc.Start(userID, []byte("data key"), types.ClientInfo{}, jwtCfg)
+	assert.Nil(t, errx)
+	third := tokens.tokens[tokens.latest]
+	_, _, errx = svc.Refresh(refreshClaims(userID+1, third.FamilyID, third.TokenID), types.ClientInfo{}, jwtCfg)
+	assert.NotNil(t, errx)
+	assert.Equal(t, custom_errors.InvalidRefreshToken, errx.Kind())
+	_, err = ks.Get(third.FamilyID)
+	assert.Nil(t, err)
+}
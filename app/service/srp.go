@@ -0,0 +1,169 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/database"
+	"github.com/sid-sun/arche-api/app/keystore"
+	"github.com/sid-sun/arche-api/app/srp"
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/app/utils"
+	"github.com/sid-sun/arche-api/config"
+	"go.uber.org/zap"
+)
+
+// srpHandshakePrefix keeps pending handshakes apart from session keys in the key store
+const srpHandshakePrefix = "srp:"
+
+// srpHandshakeTTL is how long a client has to answer the server's public value
+const srpHandshakeTTL = time.Minute * 5
+
+// SRPService runs the server side of an SRP-6a login, the password never reaches the server
+//
+// Addresses without an account, or accounts without a verifier yet, get a handshake which looks like any other
+// and always fails, its salts are derived from the address so repeating the request does not give it away
+type SRPService interface {
+	Begin(emailID string, kdfCfg *config.KDFConfig) (types.SRPInitResponse, *erx.Erx)
+	Finish(req types.SRPVerifyRequest) (types.User, []byte, []byte, *erx.Erx)
+}
+
+type srpLogin struct {
+	db *database.DB
+	ks keystore.KeyStore
+	// decoyKey derives the salts of handshakes for addresses without a verifier
+	decoyKey []byte
+	lgr      *zap.Logger
+}
+
+func newSRPLogin(db *database.DB, ks keystore.KeyStore, cfg *config.DecoyConfig, lgr *zap.Logger) *srpLogin {
+	return &srpLogin{
+		db:       db,
+		ks:       ks,
+		decoyKey: cfg.GetKey(),
+		lgr:      lgr,
+	}
+}
+
+// Begin starts a handshake for emailID and returns the salts and parameters the client derives its keys with
+func (s *srpLogin) Begin(emailID string, kdfCfg *config.KDFConfig) (types.SRPInitResponse, *erx.Erx) {
+	usr, errx := s.db.Users.Get(emailID)
+	if errx != nil && errx.Kind() != custom_errors.NoRowsInResultSet {
+		s.lgr.Debug(fmt.Sprintf("[Service] [SRP] [Begin] [Get] %s", errx.String()))
+		return types.SRPInitResponse{}, errx
+	}
+
+	var verifier []byte
+	if errx == nil && usr.SRP.Verifier != "" {
+		var err error
+		if verifier, err = base64.StdEncoding.DecodeString(usr.SRP.Verifier); err != nil {
+			s.lgr.Debug(fmt.Sprintf("[Service] [SRP] [Begin] [DecodeString] %s", err.Error()))
+			return types.SRPInitResponse{}, erx.WithArgs(err, erx.SeverityDebug)
+		}
+	} else {
+		params := utils.NewKDFParams(kdfCfg).String()
+		usr = types.User{
+			SRP: types.SRPVerifier{
+				Salt:   base64.StdEncoding.EncodeToString(s.decoy("salt", emailID)[:16]),
+				Params: params,
+			},
+			KDFSalt:   base64.StdEncoding.EncodeToString(s.decoy("kdf", emailID)[:16]),
+			KDFParams: params,
+		}
+		verifier = srp.Verifier(s.decoy("verifier", emailID))
+	}
+
+	b, err := srp.NewEphemeral()
+	if err != nil {
+		s.lgr.Debug(fmt.Sprintf("[Service] [SRP] [Begin] [NewEphemeral] %s", err.Error()))
+		return types.SRPInitResponse{}, erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	handshakeID, err := utils.RandToken(32)
+	if err != nil {
+		s.lgr.Debug(fmt.Sprintf("[Service] [SRP] [Begin] [RandToken] %s", err.Error()))
+		return types.SRPInitResponse{}, erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	// user id (8) | b (32) | email, the user id of a decoy is 0
+	state := make([]byte, 8, 8+srp.EphemeralSize+len(emailID))
+	binary.BigEndian.PutUint64(state, uint64(usr.ID))
+	state = append(state, b...)
+	state = append(state, emailID...)
+
+	if err = s.ks.Put(srpHandshakePrefix+handshakeID, state, srpHandshakeTTL); err != nil {
+		s.lgr.Debug(fmt.Sprintf("[Service] [SRP] [Begin] [Put] %s", err.Error()))
+		return types.SRPInitResponse{}, erx.WithArgs(err, erx.SeverityError)
+	}
+
+	return types.SRPInitResponse{
+		HandshakeID:  handshakeID,
+		Salt:         usr.SRP.Salt,
+		Params:       usr.SRP.Params,
+		ServerPublic: base64.StdEncoding.EncodeToString(srp.ServerPublic(verifier, b)),
+		KDFSalt:      usr.KDFSalt,
+		KDFParams:    usr.KDFParams,
+	}, nil
+}
+
+// Finish checks the client's proof and returns the user along with the session key and the server's proof
+// A handshake can be answered once, on a wrong proof the user is still returned so the failure can be counted
+func (s *srpLogin) Finish(req types.SRPVerifyRequest) (types.User, []byte, []byte, *erx.Erx) {
+	if req.HandshakeID == "" {
+		return types.User{}, nil, nil, erx.WithArgs(errors.New("handshake id was not sent"), erx.SeverityInfo, custom_errors.InvalidSRPHandshake)
+	}
+
+	state, err := s.ks.Get(srpHandshakePrefix + req.HandshakeID)
+	if err != nil {
+		if errors.Is(err, keystore.ErrKeyNotFound) {
+			return types.User{}, nil, nil, erx.WithArgs(err, erx.SeverityInfo, custom_errors.InvalidSRPHandshake)
+		}
+		s.lgr.Debug(fmt.Sprintf("[Service] [SRP] [Finish] [Get] %s", err.Error()))
+		return types.User{}, nil, nil, erx.WithArgs(err, erx.SeverityError)
+	}
+
+	if err = s.ks.Delete(srpHandshakePrefix + req.HandshakeID); err != nil {
+		s.lgr.Debug(fmt.Sprintf("[Service] [SRP] [Finish] [Delete] %s", err.Error()))
+		return types.User{}, nil, nil, erx.WithArgs(err, erx.SeverityError)
+	}
+
+	if len(state) < 8+srp.EphemeralSize || string(state[8+srp.EphemeralSize:]) != req.Email {
+		return types.User{}, nil, nil, erx.WithArgs(errors.New("handshake was started for another address"), erx.SeverityInfo, custom_errors.InvalidSRPHandshake)
+	}
+
+	userID := types.UserID(binary.BigEndian.Uint64(state[:8]))
+	if userID == 0 {
+		return types.User{}, nil, nil, erx.WithArgs(srp.ErrProofMismatch, erx.SeverityInfo, custom_errors.SRPProofMismatch)
+	}
+
+	usr, errx := s.db.Users.GetByID(userID)
+	if errx != nil {
+		s.lgr.Debug(fmt.Sprintf("[Service] [SRP] [Finish] [GetByID] %s", errx.String()))
+		return types.User{}, nil, nil, errx
+	}
+
+	values := make([][]byte, 4)
+	for i, value := range []string{usr.SRP.Salt, usr.SRP.Verifier, req.ClientPublic, req.ClientProof} {
+		if values[i], err = base64.StdEncoding.DecodeString(value); err != nil {
+			return usr, nil, nil, erx.WithArgs(err, erx.SeverityInfo, custom_errors.SRPProofMismatch)
+		}
+	}
+
+	// The verifier may have changed since Begin, in which case the proof cannot match
+	sessionKey, serverProof, err := srp.Verify(values[1], state[8:8+srp.EphemeralSize], values[0], values[2], values[3])
+	if err != nil {
+		return usr, nil, nil, erx.WithArgs(err, erx.SeverityInfo, custom_errors.SRPProofMismatch)
+	}
+
+	return usr, sessionKey, serverProof, nil
+}
+
+// decoy derives a value for handshakes of addresses without a verifier which stays the same across restarts and instances
+func (s *srpLogin) decoy(label string, emailID string) []byte {
+	return decoyValue(s.decoyKey, "srp-"+label, emailID)
+}
@@ -0,0 +1,205 @@
+package service
+
+import (
+	"crypto/aes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/database"
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/app/utils"
+	"go.uber.org/zap"
+)
+
+// totpIssuer is shown next to the account in authenticator apps
+const totpIssuer = "Arche"
+
+const backupCodeCount = 10
+
+type TwoFactorService interface {
+	EnrollTOTP(claims types.AccessTokenClaims) (types.EnrollTOTPResponse, *erx.Erx)
+	ConfirmTOTP(claims types.AccessTokenClaims, code string) ([]string, *erx.Erx)
+	DisableTOTP(claims types.AccessTokenClaims, code string) *erx.Erx
+	VerifyCode(userID types.UserID, key []byte, code string) *erx.Erx
+}
+
+type twoFactor struct {
+	db  *database.DB
+	lgr *zap.Logger
+}
+
+// EnrollTOTP stores a new secret sealed under the data key, it is not used for login until confirmed
+func (t *twoFactor) EnrollTOTP(claims types.AccessTokenClaims) (types.EnrollTOTPResponse, *erx.Erx) {
+	usr, errx := t.db.Users.GetByID(claims.UserID)
+	if errx != nil {
+		t.lgr.Debug(fmt.Sprintf("[Service] [TwoFactor] [EnrollTOTP] [GetByID] %s", errx.String()))
+		return types.EnrollTOTPResponse{}, errx
+	}
+
+	if usr.TOTPEnabled {
+		return types.EnrollTOTPResponse{}, erx.WithArgs(errors.New("totp is already enabled"), erx.SeverityInfo, custom_errors.TwoFactorAlreadyEnabled)
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		t.lgr.Debug(fmt.Sprintf("[Service] [TwoFactor] [EnrollTOTP] [GenerateTOTPSecret] %s", err.Error()))
+		return types.EnrollTOTPResponse{}, erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	blockCipher, err := aes.NewCipher(claims.EncryptionKey)
+	if err != nil {
+		t.lgr.Debug(fmt.Sprintf("[Service] [TwoFactor] [EnrollTOTP] [NewCipher] %s", err.Error()))
+		return types.EnrollTOTPResponse{}, erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	sealedSecret, err := encryptField(utils.EncodeTOTPSecret(secret), blockCipher)
+	if err != nil {
+		t.lgr.Debug(fmt.Sprintf("[Service] [TwoFactor] [EnrollTOTP] [encryptField] %s", err.Error()))
+		return types.EnrollTOTPResponse{}, erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	errx = t.db.TwoFactor.SetTOTPSecret(claims.UserID, sealedSecret)
+	if errx != nil {
+		if errx.Kind() == custom_errors.NoRowsAffected {
+			return types.EnrollTOTPResponse{}, erx.WithArgs(errx, erx.SeverityInfo, custom_errors.TwoFactorAlreadyEnabled)
+		}
+		t.lgr.Debug(fmt.Sprintf("[Service] [TwoFactor] [EnrollTOTP] [SetTOTPSecret] %s", errx.String()))
+		return types.EnrollTOTPResponse{}, errx
+	}
+
+	return types.EnrollTOTPResponse{
+		Secret: utils.EncodeTOTPSecret(secret),
+		URI:    utils.TOTPURI(totpIssuer, usr.Email, secret),
+	}, nil
+}
+
+// ConfirmTOTP enables 2FA once the user proves their authenticator works, returning backup codes to be shown once
+func (t *twoFactor) ConfirmTOTP(claims types.AccessTokenClaims, code string) ([]string, *erx.Erx) {
+	totp, errx := t.db.TwoFactor.GetTOTP(claims.UserID)
+	if errx != nil {
+		t.lgr.Debug(fmt.Sprintf("[Service] [TwoFactor] [ConfirmTOTP] [GetTOTP] %s", errx.String()))
+		return nil, errx
+	}
+
+	if totp.Enabled {
+		return nil, erx.WithArgs(errors.New("totp is already enabled"), erx.SeverityInfo, custom_errors.TwoFactorAlreadyEnabled)
+	}
+	if totp.Secret == "" {
+		return nil, erx.WithArgs(errors.New("totp enrolment was not started"), erx.SeverityInfo, custom_errors.TwoFactorNotEnabled)
+	}
+
+	secret, errx := openTOTPSecret(totp.Secret, claims.EncryptionKey)
+	if errx != nil {
+		t.lgr.Debug(fmt.Sprintf("[Service] [TwoFactor] [ConfirmTOTP] [openTOTPSecret] %s", errx.String()))
+		return nil, errx
+	}
+
+	step, ok := utils.VerifyTOTP(secret, code, time.Now())
+	if !ok {
+		return nil, erx.WithArgs(errors.New("totp code does not match"), erx.SeverityInfo, custom_errors.InvalidTwoFactorCode)
+	}
+
+	backupCodes, err := utils.GenerateBackupCodes(backupCodeCount)
+	if err != nil {
+		t.lgr.Debug(fmt.Sprintf("[Service] [TwoFactor] [ConfirmTOTP] [GenerateBackupCodes] %s", err.Error()))
+		return nil, erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	hashes := make([]string, len(backupCodes))
+	for i, backupCode := range backupCodes {
+		hashes[i] = utils.HashBackupCode(backupCode)
+	}
+
+	errx = t.db.TwoFactor.EnableTOTP(claims.UserID, step, hashes)
+	if errx != nil {
+		if errx.Kind() == custom_errors.NoRowsAffected {
+			return nil, erx.WithArgs(errx, erx.SeverityInfo, custom_errors.TwoFactorAlreadyEnabled)
+		}
+		t.lgr.Debug(fmt.Sprintf("[Service] [TwoFactor] [ConfirmTOTP] [EnableTOTP] %s", errx.String()))
+		return nil, errx
+	}
+
+	return backupCodes, nil
+}
+
+func (t *twoFactor) DisableTOTP(claims types.AccessTokenClaims, code string) *erx.Erx {
+	if errx := t.VerifyCode(claims.UserID, claims.EncryptionKey, code); errx != nil {
+		return errx
+	}
+
+	errx := t.db.TwoFactor.DisableTOTP(claims.UserID)
+	if errx != nil {
+		t.lgr.Debug(fmt.Sprintf("[Service] [TwoFactor] [DisableTOTP] [DisableTOTP] %s", errx.String()))
+		return errx
+	}
+	return nil
+}
+
+// VerifyCode accepts either a current TOTP code or an unused backup code, both can only be used once
+func (t *twoFactor) VerifyCode(userID types.UserID, key []byte, code string) *erx.Erx {
+	totp, errx := t.db.TwoFactor.GetTOTP(userID)
+	if errx != nil {
+		t.lgr.Debug(fmt.Sprintf("[Service] [TwoFactor] [VerifyCode] [GetTOTP] %s", errx.String()))
+		return errx
+	}
+
+	if !totp.Enabled {
+		return erx.WithArgs(errors.New("totp is not enabled"), erx.SeverityInfo, custom_errors.TwoFactorNotEnabled)
+	}
+
+	code = strings.TrimSpace(code)
+	if len(code) != utils.TOTPDigits {
+		errx = t.db.TwoFactor.UseBackupCode(userID, utils.HashBackupCode(code))
+		if errx != nil {
+			if errx.Kind() == custom_errors.NoRowsAffected {
+				return erx.WithArgs(errx, erx.SeverityInfo, custom_errors.InvalidTwoFactorCode)
+			}
+			t.lgr.Debug(fmt.Sprintf("[Service] [TwoFactor] [VerifyCode] [UseBackupCode] %s", errx.String()))
+			return errx
+		}
+		return nil
+	}
+
+	secret, errx := openTOTPSecret(totp.Secret, key)
+	if errx != nil {
+		t.lgr.Debug(fmt.Sprintf("[Service] [TwoFactor] [VerifyCode] [openTOTPSecret] %s", errx.String()))
+		return errx
+	}
+
+	step, ok := utils.VerifyTOTP(secret, code, time.Now())
+	if !ok {
+		return erx.WithArgs(errors.New("totp code does not match"), erx.SeverityInfo, custom_errors.InvalidTwoFactorCode)
+	}
+
+	errx = t.db.TwoFactor.UseTOTPStep(userID, step)
+	if errx != nil {
+		if errx.Kind() == custom_errors.NoRowsAffected {
+			return erx.WithArgs(errx, erx.SeverityInfo, custom_errors.InvalidTwoFactorCode)
+		}
+		t.lgr.Debug(fmt.Sprintf("[Service] [TwoFactor] [VerifyCode] [UseTOTPStep] %s", errx.String()))
+		return errx
+	}
+	return nil
+}
+
+func openTOTPSecret(sealedSecret string, key []byte) ([]byte, *erx.Erx) {
+	blockCipher, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	encodedSecret, errx := decryptField(sealedSecret, blockCipher)
+	if errx != nil {
+		return nil, errx
+	}
+
+	secret, err := utils.DecodeTOTPSecret(encodedSecret)
+	if err != nil {
+		return nil, erx.WithArgs(err, erx.SeverityDebug)
+	}
+	return secret, nil
+}
@@ -9,22 +9,38 @@ import (
 	"github.com/nsnikhil/erx"
 	"github.com/sid-sun/arche-api/app/database"
 	"github.com/sid-sun/arche-api/app/initializers"
+	"github.com/sid-sun/arche-api/app/keystore"
 	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/app/utils"
 	"github.com/sid-sun/arche-api/config"
 	"go.uber.org/zap"
 )
 
 type UsersService interface {
 	SendVerificationEmail(emailID string, verificationString string, callbackURL string, veCfg *config.VerificationEmailConfig) *erx.Erx
-	CreateUser(emailID string, encryptionKey []byte, keyHash [32]byte, vetkn string) (types.User, *erx.Erx)
-	ActivateUser(verificationString string) *erx.Erx
-	GetVerificationStatus(emailID string) (bool, string, *erx.Erx)
+	SendNoticeEmail(emailID string, subject string, body string, veCfg *config.VerificationEmailConfig) *erx.Erx
+	SendMagicLinkEmail(emailID string, token string, veCfg *config.VerificationEmailConfig) *erx.Erx
+	SendUnlockEmail(emailID string, token string, veCfg *config.VerificationEmailConfig) *erx.Erx
+	CreateUser(emailID string, encryptionKey []byte, keyHash [32]byte, kdfSalt []byte, kdfParams string, recovery types.KeyWrap, srp types.SRPVerifier, keyBundle string, vetkn string) (types.User, *erx.Erx)
+	ActivateUser(verificationString string, veCfg *config.VerificationEmailConfig) (types.UserID, *erx.Erx)
+	GetVerificationStatus(emailID string) (bool, *erx.Erx)
 	UpdateVerificationToken(email string, token string) *erx.Erx
 	GetUser(emailID string) (types.User, *erx.Erx)
+	GetUserByID(userID types.UserID) (types.User, *erx.Erx)
+	ChangePassword(userID types.UserID, encryptionKey []byte, kdfSalt []byte, kdfParams string, srp types.SRPVerifier) *erx.Erx
+	UpgradeKeyWrap(userID types.UserID, encryptionKey []byte, kdfSalt []byte, kdfParams string) *erx.Erx
+	RecoverAccount(userID types.UserID, encryptionKey []byte, kdfSalt []byte, kdfParams string, recovery types.KeyWrap, srp types.SRPVerifier) *erx.Erx
+	SetSRPVerifier(userID types.UserID, srp types.SRPVerifier) *erx.Erx
+	UpdateRecoveryKey(userID types.UserID, recovery types.KeyWrap) *erx.Erx
+	UpdateKeyBundle(userID types.UserID, keyBundle string) *erx.Erx
+	DeleteAccount(userID types.UserID) *erx.Erx
+	RequestEmailChange(userID types.UserID, emailID string, vetkn string) *erx.Erx
+	ConfirmEmailChange(vetkn string, veCfg *config.VerificationEmailConfig) *erx.Erx
 }
 
 type users struct {
 	db         *database.DB
+	ks         keystore.KeyStore
 	lgr        *zap.Logger
 	mailClient initializers.MailClient
 }
@@ -39,11 +55,117 @@ func (u *users) GetUser(emailID string) (types.User, *erx.Erx) {
 	return usr, nil
 }
 
-func (u *users) CreateUser(emailID string, encryptionKey []byte, keyHash [32]byte, vetkn string) (types.User, *erx.Erx) {
+func (u *users) GetUserByID(userID types.UserID) (types.User, *erx.Erx) {
+	usr, errx := u.db.Users.GetByID(userID)
+	if errx != nil {
+		(*u).lgr.Debug(fmt.Sprintf("[Service] [Users] [GetUserByID] [GetByID] %s", errx.Error()))
+		return types.User{}, errx
+	}
+
+	return usr, nil
+}
+
+// ChangePassword stores the data key re-wrapped under a new password and the new password's SRP verifier,
+// revoking every session of the user
+func (u *users) ChangePassword(userID types.UserID, encryptionKey []byte, kdfSalt []byte, kdfParams string, srp types.SRPVerifier) *erx.Erx {
+	sessionIDs, errx := u.db.Users.UpdateEncryptionKey(userID, base64.StdEncoding.EncodeToString(encryptionKey),
+		base64.StdEncoding.EncodeToString(kdfSalt), kdfParams, srp)
+	if errx != nil {
+		(*u).lgr.Debug(fmt.Sprintf("[Service] [Users] [ChangePassword] [UpdateEncryptionKey] %s", errx.Error()))
+		return errx
+	}
+	return dropSessionKeys(sessionIDs, u.ks, u.lgr)
+}
+
+// UpgradeKeyWrap stores the data key re-wrapped under the same password with the current KDF parameters
+func (u *users) UpgradeKeyWrap(userID types.UserID, encryptionKey []byte, kdfSalt []byte, kdfParams string) *erx.Erx {
+	errx := u.db.Users.UpgradeEncryptionKey(userID, base64.StdEncoding.EncodeToString(encryptionKey),
+		base64.StdEncoding.EncodeToString(kdfSalt), kdfParams)
+	if errx != nil {
+		(*u).lgr.Debug(fmt.Sprintf("[Service] [Users] [UpgradeKeyWrap] [UpgradeEncryptionKey] %s", errx.Error()))
+		return errx
+	}
+	return nil
+}
+
+// RecoverAccount stores the data key re-wrapped under a new password and a new recovery code, revoking every session of the user
+func (u *users) RecoverAccount(userID types.UserID, encryptionKey []byte, kdfSalt []byte, kdfParams string, recovery types.KeyWrap, srp types.SRPVerifier) *erx.Erx {
+	sessionIDs, errx := u.db.Users.RecoverAccount(userID, base64.StdEncoding.EncodeToString(encryptionKey),
+		base64.StdEncoding.EncodeToString(kdfSalt), kdfParams, recovery, srp)
+	if errx != nil {
+		(*u).lgr.Debug(fmt.Sprintf("[Service] [Users] [RecoverAccount] [RecoverAccount] %s", errx.Error()))
+		return errx
+	}
+	return dropSessionKeys(sessionIDs, u.ks, u.lgr)
+}
+
+// SetSRPVerifier stores the SRP verifier of the user's current password
+func (u *users) SetSRPVerifier(userID types.UserID, srp types.SRPVerifier) *erx.Erx {
+	errx := u.db.Users.SetSRPVerifier(userID, srp)
+	if errx != nil {
+		(*u).lgr.Debug(fmt.Sprintf("[Service] [Users] [SetSRPVerifier] [SetSRPVerifier] %s", errx.Error()))
+		return errx
+	}
+	return nil
+}
+
+// UpdateRecoveryKey replaces the recovery wrap of the data key, invalidating the previous recovery code
+func (u *users) UpdateRecoveryKey(userID types.UserID, recovery types.KeyWrap) *erx.Erx {
+	errx := u.db.Users.UpdateRecoveryKey(userID, recovery)
+	if errx != nil {
+		(*u).lgr.Debug(fmt.Sprintf("[Service] [Users] [UpdateRecoveryKey] [UpdateRecoveryKey] %s", errx.Error()))
+		return errx
+	}
+	return nil
+}
+
+// UpdateKeyBundle stores the key bundle a zero-knowledge client re-wrapped, other accounts get NoRowsAffected
+func (u *users) UpdateKeyBundle(userID types.UserID, keyBundle string) *erx.Erx {
+	errx := u.db.Users.UpdateKeyBundle(userID, keyBundle)
+	if errx != nil {
+		(*u).lgr.Debug(fmt.Sprintf("[Service] [Users] [UpdateKeyBundle] [UpdateKeyBundle] %s", errx.Error()))
+		return errx
+	}
+	return nil
+}
+
+// DeleteAccount erases the user and everything they own, dropping the keys of their live sessions
+func (u *users) DeleteAccount(userID types.UserID) *erx.Erx {
+	sessionIDs, errx := u.db.Users.Delete(userID)
+	if errx != nil {
+		(*u).lgr.Debug(fmt.Sprintf("[Service] [Users] [DeleteAccount] [Delete] %s", errx.Error()))
+		return errx
+	}
+	return dropSessionKeys(sessionIDs, u.ks, u.lgr)
+}
+
+// RequestEmailChange stores emailID as the user's pending address until vetkn is confirmed
+func (u *users) RequestEmailChange(userID types.UserID, emailID string, vetkn string) *erx.Erx {
+	errx := u.db.Users.SetPendingEmail(userID, emailID, utils.HashVerificationToken(vetkn))
+	if errx != nil {
+		(*u).lgr.Debug(fmt.Sprintf("[Service] [Users] [RequestEmailChange] [SetPendingEmail] %s", errx.Error()))
+		return errx
+	}
+	return nil
+}
+
+func (u *users) ConfirmEmailChange(vetkn string, veCfg *config.VerificationEmailConfig) *erx.Erx {
+	notBefore := time.Now().Add(-veCfg.GetTokenTTL())
+	errx := u.db.Users.ConfirmEmailChange(utils.HashVerificationToken(vetkn), notBefore)
+	if errx != nil {
+		(*u).lgr.Debug(fmt.Sprintf("[Service] [Users] [ConfirmEmailChange] [ConfirmEmailChange] %s", errx.Error()))
+		return errx
+	}
+	return nil
+}
+
+// CreateUser stores a new account, a non-empty keyBundle makes it a zero-knowledge account
+func (u *users) CreateUser(emailID string, encryptionKey []byte, keyHash [32]byte, kdfSalt []byte, kdfParams string, recovery types.KeyWrap, srp types.SRPVerifier, keyBundle string, vetkn string) (types.User, *erx.Erx) {
 	encryptionKeyStr := base64.StdEncoding.EncodeToString(encryptionKey)
 	hashStr := base64.StdEncoding.EncodeToString(keyHash[:])
+	kdfSaltStr := base64.StdEncoding.EncodeToString(kdfSalt)
 
-	userID, errx := u.db.Users.Create(emailID, encryptionKeyStr, hashStr, vetkn)
+	userID, errx := u.db.Users.Create(emailID, encryptionKeyStr, hashStr, kdfSaltStr, kdfParams, recovery, srp, keyBundle, utils.HashVerificationToken(vetkn))
 	if errx != nil {
 		(*u).lgr.Debug(fmt.Sprintf("[Service] [Users] [CreateUser] [Create] %s", errx.Error()))
 		return types.User{}, errx
@@ -54,26 +176,51 @@ func (u *users) CreateUser(emailID string, encryptionKey []byte, keyHash [32]byt
 		Email:         emailID,
 		KeyHash:       hashStr,
 		EncryptionKey: encryptionKeyStr,
+		KDFSalt:       kdfSaltStr,
+		KDFParams:     kdfParams,
+		Recovery:      recovery,
+		SRP:           srp,
+		ZeroKnowledge: keyBundle != "",
+		KeyBundle:     keyBundle,
 	}, nil
 }
 
-func (u *users) ActivateUser(verificationString string) *erx.Erx {
-	errx := u.db.Users.VerifyUser(verificationString)
+// ActivateUser verifies the user the token was emailed to, tokens older than the configured TTL are rejected
+func (u *users) ActivateUser(verificationString string, veCfg *config.VerificationEmailConfig) (types.UserID, *erx.Erx) {
+	notBefore := time.Now().Add(-veCfg.GetTokenTTL())
+	userID, errx := u.db.Users.VerifyUser(utils.HashVerificationToken(verificationString), notBefore)
 	if errx != nil {
-		(*u).lgr.Debug(fmt.Sprintf("[Service] [Users] [GetUser] [Get] %s", errx.Error()))
-		return errx
+		(*u).lgr.Debug(fmt.Sprintf("[Service] [Users] [ActivateUser] [VerifyUser] %s", errx.Error()))
+		return 0, errx
 	}
-	return nil
+	return userID, nil
 }
 
-func (u *users) GetVerificationStatus(emailID string) (bool, string, *erx.Erx) {
+func (u *users) GetVerificationStatus(emailID string) (bool, *erx.Erx) {
 	return u.db.Users.GetVerificationStatus(emailID)
 }
 
 func (u *users) SendVerificationEmail(emailID string, verificationString string, callbackURL string, veCfg *config.VerificationEmailConfig) *erx.Erx {
 	callbackURL = fmt.Sprintf("%s?verificationToken=%s", callbackURL, verificationString)
+	return u.SendNoticeEmail(emailID, veCfg.GetSubject(), veCfg.GetBody(callbackURL), veCfg)
+}
+
+// SendMagicLinkEmail mails a login link to the configured login page, a link built from a request could hand
+// the token to whoever made the request
+func (u *users) SendMagicLinkEmail(emailID string, token string, veCfg *config.VerificationEmailConfig) *erx.Erx {
+	callbackURL := fmt.Sprintf("%s?loginToken=%s", veCfg.GetLoginLinkURL(), token)
+	return u.SendNoticeEmail(emailID, veCfg.GetMagicLinkSubject(), veCfg.GetMagicLinkBody(callbackURL), veCfg)
+}
+
+// SendUnlockEmail mails a link lifting a login lockout to the configured unlock page
+func (u *users) SendUnlockEmail(emailID string, token string, veCfg *config.VerificationEmailConfig) *erx.Erx {
+	callbackURL := fmt.Sprintf("%s?unlockToken=%s", veCfg.GetUnlockLinkURL(), token)
+	return u.SendNoticeEmail(emailID, veCfg.GetUnlockSubject(), veCfg.GetUnlockBody(callbackURL), veCfg)
+}
 
-	msg := u.mailClient.NewMessage(veCfg.GetSenderEmail(u.mailClient.Domain()), veCfg.GetSubject(), veCfg.GetBody(callbackURL), emailID)
+// SendNoticeEmail sends an informational email, such as a security notice, from the verification sender
+func (u *users) SendNoticeEmail(emailID string, subject string, body string, veCfg *config.VerificationEmailConfig) *erx.Erx {
+	msg := u.mailClient.NewMessage(veCfg.GetSenderEmail(u.mailClient.Domain()), subject, body, emailID)
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
 
@@ -86,5 +233,5 @@ func (u *users) SendVerificationEmail(emailID string, verificationString string,
 }
 
 func (u *users) UpdateVerificationToken(email string, token string) *erx.Erx {
-	return u.db.Users.UpdateVerificationToken(email, token)
+	return u.db.Users.UpdateVerificationToken(email, utils.HashVerificationToken(token))
 }
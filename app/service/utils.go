@@ -1,48 +1,174 @@
 package service
 
 import (
+	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/custom_errors"
 	"github.com/sid-sun/arche-api/app/types"
 	"github.com/sid-sun/arche-api/app/utils"
 	"go.uber.org/zap"
 )
 
-func decryptNote(note types.Note, blockCipher cipher.Block, lgr *zap.Logger) (types.Note, *erx.Erx) {
-	name, err := base64.StdEncoding.DecodeString(note.Name)
+// envelopePrefix marks stored values sealed with utils.GCMEncrypt
+// It is not part of the base64 alphabet, so legacy CFB values can never be mistaken for an envelope
+const envelopePrefix = "$"
+
+// encryptField seals plaintext into a base64 encoded envelope ready to be stored
+func encryptField(plaintext string, blockCipher cipher.Block) (string, error) {
+	envelope, err := utils.GCMEncrypt([]byte(plaintext), blockCipher)
 	if err != nil {
-		lgr.Debug(fmt.Sprintf("[Service] [Utils] [decryptNote] [DecodeString] [Name] %s", err.Error()))
-		return types.Note{}, erx.WithArgs(err, erx.SeverityDebug)
+		return "", err
 	}
-	note.Name = string(utils.CFBDecrypt(name, blockCipher))
+	return envelopePrefix + base64.StdEncoding.EncodeToString(envelope), nil
+}
 
-	data, err := base64.StdEncoding.DecodeString(note.Data)
+// decryptField opens a stored value, falling back to legacy CFB for values written before envelopes
+// Legacy values are upgraded the next time they are written through encryptField
+func decryptField(stored string, blockCipher cipher.Block) (string, *erx.Erx) {
+	legacy := !strings.HasPrefix(stored, envelopePrefix)
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, envelopePrefix))
 	if err != nil {
-		lgr.Debug(fmt.Sprintf("[Service] [Utils] [decryptNote] [DecodeString] [Data] %s", err.Error()))
-		return types.Note{}, erx.WithArgs(err, erx.SeverityDebug)
+		return "", erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	var plaintext []byte
+	if legacy {
+		plaintext, err = utils.CFBDecrypt(data, blockCipher)
+	} else {
+		plaintext, err = utils.GCMDecrypt(data, blockCipher)
+	}
+	if err != nil {
+		if errors.Is(err, utils.ErrCiphertextIntegrity) {
+			return "", erx.WithArgs(err, erx.SeverityWarn, custom_errors.IntegrityCheckFailed)
+		}
+		return "", erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	return string(plaintext), nil
+}
+
+// newNoteKey generates a data key for a note and seals it under the user's key
+func newNoteKey(userCipher cipher.Block, lgr *zap.Logger) (string, *erx.Erx) {
+	key, _, err := utils.GenerateEncryptionKey(lgr)
+	if err != nil {
+		lgr.Debug(fmt.Sprintf("[Service] [Utils] [newNoteKey] [GenerateEncryptionKey] %s", err.Error()))
+		return "", erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	wrappedKey, err := encryptField(string(key), userCipher)
+	if err != nil {
+		lgr.Debug(fmt.Sprintf("[Service] [Utils] [newNoteKey] [encryptField] %s", err.Error()))
+		return "", erx.WithArgs(err, erx.SeverityDebug)
 	}
-	note.Data = string(utils.CFBDecrypt(data, blockCipher))
+
+	return wrappedKey, nil
+}
+
+// noteCipher opens the note's data key with the user's key
+// Notes without one were sealed under the user's key directly, which is what they get back
+func noteCipher(wrappedKey string, userCipher cipher.Block, lgr *zap.Logger) (cipher.Block, *erx.Erx) {
+	if wrappedKey == "" {
+		return userCipher, nil
+	}
+
+	key, errx := decryptField(wrappedKey, userCipher)
+	if errx != nil {
+		lgr.Debug(fmt.Sprintf("[Service] [Utils] [noteCipher] [decryptField] %s", errx.String()))
+		return nil, errx
+	}
+
+	blockCipher, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		lgr.Debug(fmt.Sprintf("[Service] [Utils] [noteCipher] [NewCipher] %s", err.Error()))
+		return nil, erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	return blockCipher, nil
+}
+
+// decryptNote opens a note with its data key, userCipher being the user's key
+func decryptNote(note types.Note, userCipher cipher.Block, lgr *zap.Logger) (types.Note, *erx.Erx) {
+	blockCipher, errx := noteCipher(note.WrappedKey, userCipher, lgr)
+	if errx != nil {
+		lgr.Debug(fmt.Sprintf("[Service] [Utils] [decryptNote] [noteCipher] %s", errx.String()))
+		return types.Note{}, errx
+	}
+
+	name, errx := decryptField(note.Name, blockCipher)
+	if errx != nil {
+		lgr.Debug(fmt.Sprintf("[Service] [Utils] [decryptNote] [decryptField] [Name] %s", errx.String()))
+		return types.Note{}, errx
+	}
+	note.Name = name
+
+	data, errx := decryptField(note.Data, blockCipher)
+	if errx != nil {
+		lgr.Debug(fmt.Sprintf("[Service] [Utils] [decryptNote] [decryptField] [Data] %s", errx.String()))
+		return types.Note{}, errx
+	}
+	note.Data = data
 
 	return note, nil
 }
 
-func encryptNote(note types.Note, blockCipher cipher.Block, lgr *zap.Logger) (types.Note, *erx.Erx) {
-	encryptedName, err := utils.CFBEncrypt([]byte(note.Name), blockCipher)
+// encryptNote seals a note under its data key, generating one for notes which do not have a key yet
+func encryptNote(note types.Note, userCipher cipher.Block, lgr *zap.Logger) (types.Note, *erx.Erx) {
+	if note.WrappedKey == "" {
+		wrappedKey, errx := newNoteKey(userCipher, lgr)
+		if errx != nil {
+			lgr.Debug(fmt.Sprintf("[Service] [Utils] [encryptNote] [newNoteKey] %s", errx.String()))
+			return types.Note{}, errx
+		}
+		note.WrappedKey = wrappedKey
+	}
+
+	blockCipher, errx := noteCipher(note.WrappedKey, userCipher, lgr)
+	if errx != nil {
+		lgr.Debug(fmt.Sprintf("[Service] [Utils] [encryptNote] [noteCipher] %s", errx.String()))
+		return types.Note{}, errx
+	}
+
+	encryptedName, err := encryptField(note.Name, blockCipher)
 	if err != nil {
-		lgr.Debug(fmt.Sprintf("[Service] [Utils] [encryptNote] [DecodeString] [Data] %s", err.Error()))
+		lgr.Debug(fmt.Sprintf("[Service] [Utils] [encryptNote] [encryptField] [Name] %s", err.Error()))
 		return types.Note{}, erx.WithArgs(err, erx.SeverityDebug)
 	}
-	note.Name = base64.StdEncoding.EncodeToString(encryptedName)
+	note.Name = encryptedName
 
-	encryptedData, err := utils.CFBEncrypt([]byte(note.Data), blockCipher)
+	encryptedData, err := encryptField(note.Data, blockCipher)
 	if err != nil {
-		lgr.Debug(fmt.Sprintf("[Service] [Utils] [encryptNote] [DecodeString] [Data] %s", err.Error()))
+		lgr.Debug(fmt.Sprintf("[Service] [Utils] [encryptNote] [encryptField] [Data] %s", err.Error()))
 		return types.Note{}, erx.WithArgs(err, erx.SeverityDebug)
 	}
-	note.Data = base64.StdEncoding.EncodeToString(encryptedData)
+	note.Data = encryptedData
 
 	return note, nil
 }
+
+// noteSearchTokens is the blind index of a note's name and contents under the user's key
+func noteSearchTokens(userKey []byte, name string, data string) []string {
+	indexKey := utils.SearchIndexKey(userKey)
+	words := utils.SearchWords(name+"\n"+data, utils.MaxSearchWords)
+	tokens := make([]string, len(words))
+	for i, word := range words {
+		tokens[i] = utils.SearchToken(indexKey, word)
+	}
+	return tokens
+}
+
+// decoyValue derives a value standing in for one of an address without an account, the same key, label and address
+// always give the same value so repeated requests do not give the address away
+func decoyValue(key []byte, label string, emailID string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label + ":" + emailID))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,88 @@
+package service
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/app/utils"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func newUserCipher(t *testing.T) cipher.Block {
+	key, _, err := utils.GenerateEncryptionKey(nil)
+	assert.Nil(t, err)
+	blockCipher, err := aes.NewCipher(key)
+	assert.Nil(t, err)
+	return blockCipher
+}
+
+func TestNoteEnvelope(t *testing.T) {
+	lgr := zap.NewNop()
+	userCipher := newUserCipher(t)
+
+	note := types.Note{NoteID: 7, Name: "Groceries", Data: "I am a butterfly"}
+	sealed, errx := encryptNote(note, userCipher, lgr)
+	assert.Nil(t, errx)
+	assert.NotEmpty(t, sealed.WrappedKey)
+	assert.NotEqual(t, note.Name, sealed.Name)
+	assert.NotEqual(t, note.Data, sealed.Data)
+
+	// The note's name and data are not under the user's key but under the note's own
+	_, errx = decryptField(sealed.Data, userCipher)
+	assert.NotNil(t, errx)
+
+	opened, errx := decryptNote(sealed, userCipher, lgr)
+	assert.Nil(t, errx)
+	assert.Equal(t, note.Name, opened.Name)
+	assert.Equal(t, note.Data, opened.Data)
+
+	// Editing a note keeps its data key
+	opened.Data = "I am a squirrel"
+	edited, errx := encryptNote(opened, userCipher, lgr)
+	assert.Nil(t, errx)
+	assert.Equal(t, sealed.WrappedKey, edited.WrappedKey)
+
+	opened, errx = decryptNote(edited, userCipher, lgr)
+	assert.Nil(t, errx)
+	assert.Equal(t, "I am a squirrel", opened.Data)
+}
+
+func TestNoteEnvelopeLegacy(t *testing.T) {
+	lgr := zap.NewNop()
+	userCipher := newUserCipher(t)
+
+	// Notes written before per-note keys are sealed under the user's key directly
+	name, err := encryptField("Groceries", userCipher)
+	assert.Nil(t, err)
+	data, err := encryptField("I am a butterfly", userCipher)
+	assert.Nil(t, err)
+
+	opened, errx := decryptNote(types.Note{Name: name, Data: data}, userCipher, lgr)
+	assert.Nil(t, errx)
+	assert.Equal(t, "Groceries", opened.Name)
+	assert.Equal(t, "I am a butterfly", opened.Data)
+	assert.Empty(t, opened.WrappedKey)
+}
+
+func TestNoteEnvelopeTamperedKey(t *testing.T) {
+	lgr := zap.NewNop()
+	userCipher := newUserCipher(t)
+
+	sealed, errx := encryptNote(types.Note{Name: "Groceries", Data: "I am a butterfly"}, userCipher, lgr)
+	assert.Nil(t, errx)
+
+	envelope, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed.WrappedKey, envelopePrefix))
+	assert.Nil(t, err)
+	envelope[len(envelope)-1] ^= 0xff
+	sealed.WrappedKey = envelopePrefix + base64.StdEncoding.EncodeToString(envelope)
+
+	_, errx = decryptNote(sealed, userCipher, lgr)
+	assert.NotNil(t, errx)
+	assert.Equal(t, custom_errors.IntegrityCheckFailed, errx.Kind())
+}
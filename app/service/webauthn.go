@@ -0,0 +1,456 @@
+package service
+
+import (
+	"crypto/aes"
+	crand "crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/nsnikhil/erx"
+	"github.com/sid-sun/arche-api/app/custom_errors"
+	"github.com/sid-sun/arche-api/app/database"
+	"github.com/sid-sun/arche-api/app/keystore"
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/app/utils"
+	"github.com/sid-sun/arche-api/app/webauthn"
+	"github.com/sid-sun/arche-api/config"
+	"go.uber.org/zap"
+)
+
+const (
+	ceremonyRegistration byte = 1
+	ceremonyLogin        byte = 2
+)
+
+// ceremonyTTL bounds how long a browser prompt can stay open
+const ceremonyTTL = time.Minute * 5
+
+// WebAuthnService manages passkeys and logs in with them
+//
+// Addresses without an account, or accounts without passkeys, get a login ceremony which looks like any other
+// and always fails, its credential ids are derived from the address so repeating the request does not give it away
+type WebAuthnService interface {
+	BeginRegistration(claims types.AccessTokenClaims) (types.BeginWebAuthnRegistrationResponse, *erx.Erx)
+	FinishRegistration(claims types.AccessTokenClaims, req types.FinishWebAuthnRegistrationRequest) (types.WebAuthnCredential, *erx.Erx)
+	ListCredentials(userID types.UserID) ([]types.WebAuthnCredential, *erx.Erx)
+	DeleteCredential(userID types.UserID, credentialID string) *erx.Erx
+	BeginLogin(emailID string) (types.BeginWebAuthnLoginResponse, *erx.Erx)
+	FinishLogin(req types.FinishWebAuthnLoginRequest) (types.User, []byte, *erx.Erx)
+}
+
+type webAuthn struct {
+	db  *database.DB
+	ks  keystore.KeyStore
+	cfg *config.WebAuthnConfig
+	// decoyKey derives the credentials of ceremonies for addresses without passkeys
+	decoyKey []byte
+	lgr      *zap.Logger
+}
+
+// ceremony is what is kept server-side between begin and finish, in the key store under the ceremony id
+type ceremony struct {
+	kind      byte
+	userID    types.UserID
+	challenge []byte
+	prfSalt   []byte
+}
+
+func (w *webAuthn) rp() webauthn.RelyingParty {
+	return webauthn.RelyingParty{ID: w.cfg.GetRPID(), Origin: w.cfg.GetOrigin()}
+}
+
+func (w *webAuthn) BeginRegistration(claims types.AccessTokenClaims) (types.BeginWebAuthnRegistrationResponse, *erx.Erx) {
+	usr, errx := w.db.Users.GetByID(claims.UserID)
+	if errx != nil {
+		w.lgr.Debug(fmt.Sprintf("[Service] [WebAuthn] [BeginRegistration] [GetByID] %s", errx.String()))
+		return types.BeginWebAuthnRegistrationResponse{}, errx
+	}
+
+	credentials, errx := w.db.WebAuthn.List(claims.UserID)
+	if errx != nil {
+		w.lgr.Debug(fmt.Sprintf("[Service] [WebAuthn] [BeginRegistration] [List] %s", errx.String()))
+		return types.BeginWebAuthnRegistrationResponse{}, errx
+	}
+
+	prfSalt := make([]byte, 32)
+	if _, err := io.ReadFull(crand.Reader, prfSalt); err != nil {
+		w.lgr.Debug(fmt.Sprintf("[Service] [WebAuthn] [BeginRegistration] [ReadFull] %s", err.Error()))
+		return types.BeginWebAuthnRegistrationResponse{}, erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	ceremonyID, c, errx := w.startCeremony(ceremonyRegistration, claims.UserID, prfSalt)
+	if errx != nil {
+		w.lgr.Debug(fmt.Sprintf("[Service] [WebAuthn] [BeginRegistration] [startCeremony] %s", errx.String()))
+		return types.BeginWebAuthnRegistrationResponse{}, errx
+	}
+
+	exclude := make([]types.WebAuthnCredentialDescriptor, len(credentials))
+	for i, credential := range credentials {
+		exclude[i] = types.WebAuthnCredentialDescriptor{Type: "public-key", ID: credential.CredentialID}
+	}
+
+	return types.BeginWebAuthnRegistrationResponse{
+		CeremonyID: ceremonyID,
+		PublicKey: types.WebAuthnCreationOptions{
+			Challenge: base64.RawURLEncoding.EncodeToString(c.challenge),
+			RP:        types.WebAuthnRelyingParty{ID: w.cfg.GetRPID(), Name: w.cfg.GetRPName()},
+			User: types.WebAuthnUser{
+				ID:          base64.RawURLEncoding.EncodeToString(userHandle(claims.UserID)),
+				Name:        usr.Email,
+				DisplayName: usr.Email,
+			},
+			PubKeyCredParams: []types.WebAuthnCredentialParameter{
+				{Type: "public-key", Alg: webauthn.AlgEdDSA},
+				{Type: "public-key", Alg: webauthn.AlgES256},
+				{Type: "public-key", Alg: webauthn.AlgRS256},
+			},
+			ExcludeCredentials: exclude,
+			Timeout:            int(ceremonyTTL / time.Millisecond),
+			Attestation:        "none",
+			Extensions: types.WebAuthnExtensions{PRF: types.WebAuthnPRFInputs{
+				Eval: &types.WebAuthnPRFValues{First: base64.RawURLEncoding.EncodeToString(prfSalt)},
+			}},
+		},
+	}, nil
+}
+
+// FinishRegistration stores a new passkey, with a prf output it also gets a wrap of the data key so it can log in alone
+func (w *webAuthn) FinishRegistration(claims types.AccessTokenClaims, req types.FinishWebAuthnRegistrationRequest) (types.WebAuthnCredential, *erx.Erx) {
+	c, errx := w.redeemCeremony(req.CeremonyID, ceremonyRegistration)
+	if errx != nil {
+		return types.WebAuthnCredential{}, errx
+	}
+
+	if c.userID != claims.UserID {
+		return types.WebAuthnCredential{}, erx.WithArgs(errors.New("ceremony belongs to another user"), erx.SeverityWarn, custom_errors.InvalidWebAuthnResponse)
+	}
+
+	fields, err := decodeB64URL(req.CredentialID, req.ClientDataJSON, req.AuthenticatorData, req.PublicKey)
+	if err != nil {
+		return types.WebAuthnCredential{}, erx.WithArgs(err, erx.SeverityInfo, custom_errors.InvalidWebAuthnResponse)
+	}
+	credentialID, clientDataJSON, authenticatorData, publicKey := fields[0], fields[1], fields[2], fields[3]
+
+	authData, err := webauthn.VerifyRegistration(w.rp(), c.challenge, clientDataJSON, authenticatorData, credentialID,
+		publicKey, req.PublicKeyAlgorithm, false)
+	if err != nil {
+		return types.WebAuthnCredential{}, erx.WithArgs(err, erx.SeverityInfo, custom_errors.InvalidWebAuthnResponse)
+	}
+
+	credential := types.WebAuthnCredential{
+		UserID:       claims.UserID,
+		CredentialID: base64.RawURLEncoding.EncodeToString(credentialID),
+		Name:         req.Name,
+		PublicKey:    base64.StdEncoding.EncodeToString(publicKey),
+		Algorithm:    req.PublicKeyAlgorithm,
+		SignCount:    authData.SignCount,
+		PRFSalt:      base64.StdEncoding.EncodeToString(c.prfSalt),
+		CreatedAt:    time.Now(),
+	}
+
+	if req.PRFOutput != "" {
+		prfOutput, err := decodeB64URL(req.PRFOutput)
+		if err != nil {
+			return types.WebAuthnCredential{}, erx.WithArgs(err, erx.SeverityInfo, custom_errors.InvalidWebAuthnResponse)
+		}
+
+		if credential.WrappedKey, errx = wrapWithPRF(claims.EncryptionKey, prfOutput[0], c.prfSalt); errx != nil {
+			w.lgr.Debug(fmt.Sprintf("[Service] [WebAuthn] [FinishRegistration] [wrapWithPRF] %s", errx.String()))
+			return types.WebAuthnCredential{}, errx
+		}
+	}
+
+	if errx = w.db.WebAuthn.Create(credential); errx != nil {
+		w.lgr.Debug(fmt.Sprintf("[Service] [WebAuthn] [FinishRegistration] [Create] %s", errx.String()))
+		return types.WebAuthnCredential{}, errx
+	}
+
+	return credential, nil
+}
+
+func (w *webAuthn) ListCredentials(userID types.UserID) ([]types.WebAuthnCredential, *erx.Erx) {
+	credentials, errx := w.db.WebAuthn.List(userID)
+	if errx != nil {
+		w.lgr.Debug(fmt.Sprintf("[Service] [WebAuthn] [ListCredentials] [List] %s", errx.String()))
+		return nil, errx
+	}
+	return credentials, nil
+}
+
+func (w *webAuthn) DeleteCredential(userID types.UserID, credentialID string) *erx.Erx {
+	errx := w.db.WebAuthn.Delete(userID, credentialID)
+	if errx != nil {
+		w.lgr.Debug(fmt.Sprintf("[Service] [WebAuthn] [DeleteCredential] [Delete] %s", errx.String()))
+		return errx
+	}
+	return nil
+}
+
+// BeginLogin starts a login ceremony for emailID, the user id of a decoy ceremony is 0
+func (w *webAuthn) BeginLogin(emailID string) (types.BeginWebAuthnLoginResponse, *erx.Erx) {
+	usr, errx := w.db.Users.Get(emailID)
+	if errx != nil && errx.Kind() != custom_errors.NoRowsInResultSet {
+		w.lgr.Debug(fmt.Sprintf("[Service] [WebAuthn] [BeginLogin] [Get] %s", errx.String()))
+		return types.BeginWebAuthnLoginResponse{}, errx
+	}
+
+	var credentials []types.WebAuthnCredential
+	if errx == nil {
+		if credentials, errx = w.db.WebAuthn.List(usr.ID); errx != nil {
+			w.lgr.Debug(fmt.Sprintf("[Service] [WebAuthn] [BeginLogin] [List] %s", errx.String()))
+			return types.BeginWebAuthnLoginResponse{}, errx
+		}
+	}
+
+	// A decoy offers a prf input, as passkeys which log in on their own do
+	if len(credentials) == 0 {
+		usr = types.User{}
+		credentials = []types.WebAuthnCredential{{
+			CredentialID: base64.RawURLEncoding.EncodeToString(w.decoy("credential", emailID)),
+			PRFSalt:      base64.StdEncoding.EncodeToString(w.decoy("prf", emailID)),
+			WrappedKey:   "decoy",
+		}}
+	}
+
+	ceremonyID, c, errx := w.startCeremony(ceremonyLogin, usr.ID, nil)
+	if errx != nil {
+		w.lgr.Debug(fmt.Sprintf("[Service] [WebAuthn] [BeginLogin] [startCeremony] %s", errx.String()))
+		return types.BeginWebAuthnLoginResponse{}, errx
+	}
+
+	allow := make([]types.WebAuthnCredentialDescriptor, len(credentials))
+	prfInputs := make(map[string]types.WebAuthnPRFValues)
+	for i, credential := range credentials {
+		allow[i] = types.WebAuthnCredentialDescriptor{Type: "public-key", ID: credential.CredentialID}
+
+		if credential.WrappedKey != "" {
+			prfSalt, err := base64.StdEncoding.DecodeString(credential.PRFSalt)
+			if err != nil {
+				w.lgr.Debug(fmt.Sprintf("[Service] [WebAuthn] [BeginLogin] [DecodeString] %s", err.Error()))
+				return types.BeginWebAuthnLoginResponse{}, erx.WithArgs(err, erx.SeverityDebug)
+			}
+			prfInputs[credential.CredentialID] = types.WebAuthnPRFValues{First: base64.RawURLEncoding.EncodeToString(prfSalt)}
+		}
+	}
+
+	return types.BeginWebAuthnLoginResponse{
+		CeremonyID: ceremonyID,
+		PublicKey: types.WebAuthnRequestOptions{
+			Challenge:        base64.RawURLEncoding.EncodeToString(c.challenge),
+			RPID:             w.cfg.GetRPID(),
+			AllowCredentials: allow,
+			Timeout:          int(ceremonyTTL / time.Millisecond),
+			UserVerification: "preferred",
+			Extensions:       types.WebAuthnExtensions{PRF: types.WebAuthnPRFInputs{EvalByCredential: prfInputs}},
+		},
+	}, nil
+}
+
+// FinishLogin verifies an assertion and returns its user, along with the data key when the prf output unlocks it.
+// Without a challenge token the login is passwordless and user verification is required
+func (w *webAuthn) FinishLogin(req types.FinishWebAuthnLoginRequest) (types.User, []byte, *erx.Erx) {
+	c, errx := w.redeemCeremony(req.CeremonyID, ceremonyLogin)
+	if errx != nil {
+		return types.User{}, nil, errx
+	}
+
+	if c.userID == 0 {
+		return types.User{}, nil, erx.WithArgs(errors.New("ceremony has no passkeys"), erx.SeverityInfo, custom_errors.InvalidWebAuthnResponse)
+	}
+
+	fields, err := decodeB64URL(req.CredentialID, req.ClientDataJSON, req.AuthenticatorData, req.Signature)
+	if err != nil {
+		return types.User{}, nil, erx.WithArgs(err, erx.SeverityInfo, custom_errors.InvalidWebAuthnResponse)
+	}
+	clientDataJSON, authenticatorData, signature := fields[1], fields[2], fields[3]
+
+	credentialID := base64.RawURLEncoding.EncodeToString(fields[0])
+	credential, errx := w.db.WebAuthn.Get(c.userID, credentialID)
+	if errx != nil {
+		if errx.Kind() == custom_errors.NoRowsInResultSet {
+			return types.User{}, nil, erx.WithArgs(errx, erx.SeverityInfo, custom_errors.InvalidWebAuthnResponse)
+		}
+		w.lgr.Debug(fmt.Sprintf("[Service] [WebAuthn] [FinishLogin] [Get] %s", errx.String()))
+		return types.User{}, nil, errx
+	}
+
+	publicKey, err := base64.StdEncoding.DecodeString(credential.PublicKey)
+	if err != nil {
+		w.lgr.Debug(fmt.Sprintf("[Service] [WebAuthn] [FinishLogin] [DecodeString] %s", err.Error()))
+		return types.User{}, nil, erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	authData, err := webauthn.VerifyAssertion(w.rp(), c.challenge, clientDataJSON, authenticatorData, signature,
+		publicKey, credential.Algorithm, req.ChallengeToken == "")
+	if err == nil {
+		err = webauthn.CheckSignCount(credential.SignCount, authData.SignCount)
+	}
+	if err != nil {
+		return types.User{}, nil, erx.WithArgs(err, erx.SeverityInfo, custom_errors.InvalidWebAuthnResponse)
+	}
+
+	errx = w.db.WebAuthn.UpdateSignCount(c.userID, credentialID, authData.SignCount, time.Now())
+	if errx != nil {
+		if errx.Kind() == custom_errors.NoRowsAffected {
+			return types.User{}, nil, erx.WithArgs(webauthn.ErrSignCount, erx.SeverityWarn, custom_errors.InvalidWebAuthnResponse)
+		}
+		w.lgr.Debug(fmt.Sprintf("[Service] [WebAuthn] [FinishLogin] [UpdateSignCount] %s", errx.String()))
+		return types.User{}, nil, errx
+	}
+
+	usr, errx := w.db.Users.GetByID(c.userID)
+	if errx != nil {
+		w.lgr.Debug(fmt.Sprintf("[Service] [WebAuthn] [FinishLogin] [GetByID] %s", errx.String()))
+		return types.User{}, nil, errx
+	}
+
+	if req.PRFOutput == "" || credential.WrappedKey == "" {
+		return usr, nil, nil
+	}
+
+	prfOutput, err := decodeB64URL(req.PRFOutput)
+	if err != nil {
+		return types.User{}, nil, erx.WithArgs(err, erx.SeverityInfo, custom_errors.InvalidWebAuthnResponse)
+	}
+
+	key, errx := unwrapWithPRF(credential.WrappedKey, prfOutput[0], credential.PRFSalt)
+	if errx != nil {
+		w.lgr.Debug(fmt.Sprintf("[Service] [WebAuthn] [FinishLogin] [unwrapWithPRF] %s", errx.String()))
+		return types.User{}, nil, errx
+	}
+
+	return usr, key, nil
+}
+
+func (w *webAuthn) startCeremony(kind byte, userID types.UserID, prfSalt []byte) (string, ceremony, *erx.Erx) {
+	c := ceremony{kind: kind, userID: userID, challenge: make([]byte, 32), prfSalt: prfSalt}
+	if _, err := io.ReadFull(crand.Reader, c.challenge); err != nil {
+		return "", ceremony{}, erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	ceremonyID, err := utils.RandToken(32)
+	if err != nil {
+		return "", ceremony{}, erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	// kind (1) | user id (8) | challenge (32) | prf salt
+	state := []byte{kind}
+	state = append(state, userHandle(userID)...)
+	state = append(state, c.challenge...)
+	state = append(state, prfSalt...)
+
+	if err = w.ks.Put(ceremonyID, state, ceremonyTTL); err != nil {
+		return "", ceremony{}, erx.WithArgs(err, erx.SeverityError)
+	}
+	return ceremonyID, c, nil
+}
+
+// redeemCeremony loads and removes the state of a ceremony, each challenge can only be answered once
+func (w *webAuthn) redeemCeremony(ceremonyID string, kind byte) (ceremony, *erx.Erx) {
+	if ceremonyID == "" {
+		return ceremony{}, erx.WithArgs(errors.New("ceremony id was not sent"), erx.SeverityInfo, custom_errors.WebAuthnCeremonyExpired)
+	}
+
+	state, err := w.ks.Get(ceremonyID)
+	if err != nil {
+		if errors.Is(err, keystore.ErrKeyNotFound) {
+			return ceremony{}, erx.WithArgs(err, erx.SeverityInfo, custom_errors.WebAuthnCeremonyExpired)
+		}
+		w.lgr.Debug(fmt.Sprintf("[Service] [WebAuthn] [redeemCeremony] [Get] %s", err.Error()))
+		return ceremony{}, erx.WithArgs(err, erx.SeverityError)
+	}
+
+	if err = w.ks.Delete(ceremonyID); err != nil {
+		w.lgr.Debug(fmt.Sprintf("[Service] [WebAuthn] [redeemCeremony] [Delete] %s", err.Error()))
+		return ceremony{}, erx.WithArgs(err, erx.SeverityError)
+	}
+
+	if len(state) < 41 || state[0] != kind {
+		return ceremony{}, erx.WithArgs(errors.New("ceremony is of another kind"), erx.SeverityInfo, custom_errors.WebAuthnCeremonyExpired)
+	}
+
+	return ceremony{
+		kind:      state[0],
+		userID:    types.UserID(binary.BigEndian.Uint64(state[1:9])),
+		challenge: state[9:41],
+		prfSalt:   state[41:],
+	}, nil
+}
+
+// decoy derives a value for ceremonies of addresses without passkeys which stays the same across restarts and instances
+func (w *webAuthn) decoy(label string, emailID string) []byte {
+	return decoyValue(w.decoyKey, "webauthn-"+label, emailID)
+}
+
+// userHandle is the opaque user id given to authenticators, it must not contain personal data
+func userHandle(userID types.UserID) []byte {
+	handle := make([]byte, 8)
+	binary.BigEndian.PutUint64(handle, uint64(userID))
+	return handle
+}
+
+func decodeB64URL(values ...string) ([][]byte, error) {
+	decoded := make([][]byte, len(values))
+	for i, value := range values {
+		var err error
+		if decoded[i], err = base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "=")); err != nil {
+			return nil, err
+		}
+	}
+	return decoded, nil
+}
+
+func wrapWithPRF(key []byte, prfOutput []byte, prfSalt []byte) (string, *erx.Erx) {
+	wrappingKey, err := webauthn.PRFWrappingKey(prfOutput, prfSalt)
+	if err != nil {
+		return "", erx.WithArgs(err, erx.SeverityInfo, custom_errors.InvalidWebAuthnResponse)
+	}
+
+	blockCipher, err := aes.NewCipher(wrappingKey)
+	if err != nil {
+		return "", erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	wrappedKey, err := utils.GCMEncrypt(key, blockCipher)
+	if err != nil {
+		return "", erx.WithArgs(err, erx.SeverityDebug)
+	}
+	return base64.StdEncoding.EncodeToString(wrappedKey), nil
+}
+
+func unwrapWithPRF(wrappedKey string, prfOutput []byte, encodedSalt string) ([]byte, *erx.Erx) {
+	prfSalt, err := base64.StdEncoding.DecodeString(encodedSalt)
+	if err != nil {
+		return nil, erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	wrappingKey, err := webauthn.PRFWrappingKey(prfOutput, prfSalt)
+	if err != nil {
+		return nil, erx.WithArgs(err, erx.SeverityInfo, custom_errors.InvalidWebAuthnResponse)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(wrappedKey)
+	if err != nil {
+		return nil, erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	blockCipher, err := aes.NewCipher(wrappingKey)
+	if err != nil {
+		return nil, erx.WithArgs(err, erx.SeverityDebug)
+	}
+
+	key, err := utils.GCMDecrypt(sealed, blockCipher)
+	if err != nil {
+		if errors.Is(err, utils.ErrCiphertextIntegrity) {
+			// A wrong prf output fails authentication, which is the expected way for this to fail
+			return nil, erx.WithArgs(err, erx.SeverityInfo, custom_errors.InvalidWebAuthnResponse)
+		}
+		return nil, erx.WithArgs(err, erx.SeverityDebug)
+	}
+	return key, nil
+}
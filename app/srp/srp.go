@@ -0,0 +1,119 @@
+// Package srp implements the server side of SRP-6a (RFC 5054) over the 2048-bit group with SHA-256.
+//
+// Every value which goes into a hash is the big-endian encoding of the number, left padded with zeroes to the
+// length of N, and the identity is left empty so a change of email address keeps the verifier valid:
+//
+//	k  = H(N | g)
+//	v  = g^x mod N
+//	u  = H(A | B)
+//	S  = (A * v^u)^b mod N
+//	K  = H(S)
+//	M1 = H(H(N) xor H(g) | H("") | salt | A | B | K)
+//	M2 = H(A | M1 | K)
+//
+// How x is derived from the password is up to the caller.
+package srp
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"math/big"
+)
+
+// EphemeralSize is the length of the server's secret ephemeral value b
+const EphemeralSize = 32
+
+var (
+	ErrInvalidPublicKey = errors.New("srp: client public value is not valid")
+	ErrProofMismatch    = errors.New("srp: client proof does not match")
+)
+
+// nHex is the 2048-bit group of RFC 5054 appendix A, with generator 2
+const nHex = "AC6BDB41324A9A9BF166DE5E1389582FAF72B6651987EE07FC3192943DB56050A37329CBB4A099ED8193E0757767A13DD52312AB4B03310D" +
+	"CD7F48A9DA04FD50E8083969EDB767B0CF6095179A163AB3661A05FBD5FAAAE82918A9962F0B93B855F97993EC975EEAA80D740ADBF4FF747359D041D5C33EA71D281E" +
+	"446B14773BCA97B43A23FB801676BD207A436C6481F1D2B9078717461A5B9D32E688F87748544523B524B0D57D5EA77A2775D2ECFA032CFBDBF52FB3786160279004E5" +
+	"7AE6AF874E7303CE53299CCC041C7BC308D82A5698F3A8D0C38271AE35F8E9DBFBB694B5C803D89F7AE435DE236D525F54759B65E372FCD68EF20FA7111F9E4AFF73"
+
+var (
+	groupN, _ = new(big.Int).SetString(nHex, 16)
+	groupG    = big.NewInt(2)
+	groupSize = len(groupN.Bytes())
+	// multiplier is k = H(N | g)
+	multiplier = new(big.Int).SetBytes(hash(pad(groupN), pad(groupG)))
+)
+
+func hash(parts ...[]byte) []byte {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// pad encodes n big-endian at the length of N
+func pad(n *big.Int) []byte {
+	padded := make([]byte, groupSize)
+	return n.FillBytes(padded)
+}
+
+// Verifier returns v = g^x mod N for the private key x
+func Verifier(x []byte) []byte {
+	return pad(new(big.Int).Exp(groupG, new(big.Int).SetBytes(x), groupN))
+}
+
+// NewEphemeral returns a random secret ephemeral value b
+func NewEphemeral() ([]byte, error) {
+	b := make([]byte, EphemeralSize)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ServerPublic returns B = k*v + g^b mod N
+func ServerPublic(verifier []byte, b []byte) []byte {
+	v := new(big.Int).SetBytes(verifier)
+	kv := new(big.Int).Mul(multiplier, v)
+	gb := new(big.Int).Exp(groupG, new(big.Int).SetBytes(b), groupN)
+	return pad(kv.Add(kv, gb).Mod(kv, groupN))
+}
+
+// Verify checks the client's proof M1 and returns the shared session key K along with the server's proof M2
+func Verify(verifier []byte, b []byte, salt []byte, clientPublic []byte, clientProof []byte) (sessionKey []byte, serverProof []byte, err error) {
+	A := new(big.Int).SetBytes(clientPublic)
+	if len(clientPublic) > groupSize || new(big.Int).Mod(A, groupN).Sign() == 0 {
+		return nil, nil, ErrInvalidPublicKey
+	}
+
+	paddedA := pad(A)
+	paddedB := ServerPublic(verifier, b)
+	u := new(big.Int).SetBytes(hash(paddedA, paddedB))
+	if u.Sign() == 0 {
+		return nil, nil, ErrInvalidPublicKey
+	}
+
+	v := new(big.Int).SetBytes(verifier)
+	S := new(big.Int).Exp(v, u, groupN)
+	S.Mul(S, A).Mod(S, groupN)
+	S.Exp(S, new(big.Int).SetBytes(b), groupN)
+	sessionKey = hash(pad(S))
+
+	expected := clientProofFor(salt, paddedA, paddedB, sessionKey)
+	if subtle.ConstantTimeCompare(expected, clientProof) != 1 {
+		return nil, nil, ErrProofMismatch
+	}
+
+	return sessionKey, hash(paddedA, expected, sessionKey), nil
+}
+
+// clientProofFor computes M1 = H(H(N) xor H(g) | H("") | salt | A | B | K)
+func clientProofFor(salt []byte, paddedA []byte, paddedB []byte, sessionKey []byte) []byte {
+	hN, hG := hash(pad(groupN)), hash(pad(groupG))
+	for i := range hN {
+		hN[i] ^= hG[i]
+	}
+	return hash(hN, hash(), salt, paddedA, paddedB, sessionKey)
+}
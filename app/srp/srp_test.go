@@ -0,0 +1,95 @@
+package srp
+
+import (
+	"crypto/rand"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// client runs the client side of the handshake the way clients are expected to
+type client struct {
+	x, a []byte
+}
+
+func (c client) public() []byte {
+	return pad(new(big.Int).Exp(groupG, new(big.Int).SetBytes(c.a), groupN))
+}
+
+// finish returns K and M1 for the server's B
+func (c client) finish(salt []byte, serverPublic []byte) ([]byte, []byte) {
+	paddedA := c.public()
+	B := new(big.Int).SetBytes(serverPublic)
+	u := new(big.Int).SetBytes(hash(paddedA, pad(B)))
+	x := new(big.Int).SetBytes(c.x)
+
+	// S = (B - k * g^x) ^ (a + u * x) mod N
+	base := new(big.Int).Exp(groupG, x, groupN)
+	base.Mul(base, multiplier).Sub(B, base).Mod(base, groupN)
+	exp := new(big.Int).Mul(u, x)
+	exp.Add(exp, new(big.Int).SetBytes(c.a))
+	S := new(big.Int).Exp(base, exp, groupN)
+
+	sessionKey := hash(pad(S))
+	return sessionKey, clientProofFor(salt, paddedA, pad(B), sessionKey)
+}
+
+func newClient(t *testing.T, x []byte) client {
+	a := make([]byte, 32)
+	_, err := rand.Read(a)
+	assert.Nil(t, err)
+	return client{x: x, a: a}
+}
+
+func TestGroup(t *testing.T) {
+	assert.Equal(t, 2048, groupN.BitLen())
+	assert.True(t, groupN.ProbablyPrime(20))
+}
+
+func TestHandshake(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	x := hash(salt, []byte("correct horse battery staple"))
+	verifier := Verifier(x)
+
+	b, err := NewEphemeral()
+	assert.Nil(t, err)
+	B := ServerPublic(verifier, b)
+
+	c := newClient(t, x)
+	clientKey, M1 := c.finish(salt, B)
+
+	serverKey, M2, err := Verify(verifier, b, salt, c.public(), M1)
+	assert.Nil(t, err)
+	assert.Equal(t, clientKey, serverKey)
+	assert.Equal(t, hash(c.public(), M1, clientKey), M2)
+}
+
+func TestVerifyRejectsWrongPassword(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	verifier := Verifier(hash(salt, []byte("correct horse battery staple")))
+
+	b, err := NewEphemeral()
+	assert.Nil(t, err)
+
+	c := newClient(t, hash(salt, []byte("Tr0ub4dor&3")))
+	_, M1 := c.finish(salt, ServerPublic(verifier, b))
+
+	_, _, err = Verify(verifier, b, salt, c.public(), M1)
+	assert.Equal(t, ErrProofMismatch, err)
+}
+
+func TestVerifyRejectsDegeneratePublicValues(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	verifier := Verifier(hash(salt, []byte("correct horse battery staple")))
+
+	b, err := NewEphemeral()
+	assert.Nil(t, err)
+
+	// A of 0 or a multiple of N forces S to 0 whatever the password
+	for _, A := range []*big.Int{big.NewInt(0), groupN, new(big.Int).Mul(groupN, big.NewInt(2))} {
+		forged := hash(salt, make([]byte, 32))
+		_, _, err = Verify(verifier, b, salt, A.Bytes(), forged)
+		assert.Equal(t, ErrInvalidPublicKey, err)
+	}
+}
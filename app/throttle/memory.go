@@ -0,0 +1,110 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+type memoryStore struct {
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	keepFor  map[string]time.Duration
+	swept    time.Time
+}
+
+// sweepEvery is how often keys whose failures have all aged out are dropped
+const sweepEvery = time.Minute
+
+// NewMemoryStore returns a Store local to this process, every instance throttles on its own
+func NewMemoryStore() Store {
+	return &memoryStore{
+		failures: make(map[string][]time.Time),
+		keepFor:  make(map[string]time.Duration),
+	}
+}
+
+func (m *memoryStore) RecordFailure(key string, t time.Time, keep time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.record(key, t, keep)
+	return nil
+}
+
+func (m *memoryStore) Reserve(key string, t time.Time, keep time.Duration, allow func(failures []time.Time) bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var failures []time.Time
+	for _, failedAt := range m.failures[key] {
+		if !failedAt.Before(t.Add(-keep)) {
+			failures = append(failures, failedAt)
+		}
+	}
+
+	if allow(failures) {
+		m.record(key, t, keep)
+	}
+	return nil
+}
+
+func (m *memoryStore) Refund(key string, t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	failures := m.failures[key]
+	for i, failedAt := range failures {
+		if failedAt.Equal(t) {
+			m.failures[key] = append(failures[:i:i], failures[i+1:]...)
+			break
+		}
+	}
+	if len(m.failures[key]) == 0 {
+		delete(m.failures, key)
+		delete(m.keepFor, key)
+	}
+	return nil
+}
+
+// record adds a failure, the caller holds the lock
+func (m *memoryStore) record(key string, t time.Time, keep time.Duration) {
+	// Drop keys whose failures have all aged out, so the map does not grow with every address ever tried
+	if t.Sub(m.swept) > sweepEvery {
+		for k, failures := range m.failures {
+			if last := failures[len(failures)-1]; t.Sub(last) > m.keepFor[k] {
+				delete(m.failures, k)
+				delete(m.keepFor, k)
+			}
+		}
+		m.swept = t
+	}
+
+	failures := m.failures[key]
+	for len(failures) > 0 && t.Sub(failures[0]) > keep {
+		failures = failures[1:]
+	}
+	m.failures[key] = append(failures, t)
+	m.keepFor[key] = keep
+}
+
+func (m *memoryStore) Failures(key string, since time.Time) ([]time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var failures []time.Time
+	for _, t := range m.failures[key] {
+		if !t.Before(since) {
+			failures = append(failures, t)
+		}
+	}
+	return failures, nil
+}
+
+func (m *memoryStore) Reset(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.failures, key)
+	delete(m.keepFor, key)
+	return nil
+}
@@ -0,0 +1,63 @@
+package throttle
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sid-sun/arche-api/app/database"
+	"go.uber.org/zap"
+)
+
+type sqlStore struct {
+	table database.LoginFailuresTable
+	lgr   *zap.Logger
+}
+
+// NewSQLStore returns a Store backed by the login_failures table so every instance counts the same failures
+func NewSQLStore(table database.LoginFailuresTable, lgr *zap.Logger) Store {
+	return &sqlStore{
+		table: table,
+		lgr:   lgr,
+	}
+}
+
+func (s *sqlStore) RecordFailure(key string, t time.Time, keep time.Duration) error {
+	if errx := s.table.Record(key, t, t.Add(-keep)); errx != nil {
+		s.lgr.Debug(fmt.Sprintf("[Throttle] [SQL] [RecordFailure] [Record] %s", errx.String()))
+		return errx
+	}
+	return nil
+}
+
+func (s *sqlStore) Reserve(key string, t time.Time, keep time.Duration, allow func(failures []time.Time) bool) error {
+	if errx := s.table.Reserve(key, t, t.Add(-keep), allow); errx != nil {
+		s.lgr.Debug(fmt.Sprintf("[Throttle] [SQL] [Reserve] [Reserve] %s", errx.String()))
+		return errx
+	}
+	return nil
+}
+
+func (s *sqlStore) Refund(key string, t time.Time) error {
+	if errx := s.table.Refund(key, t); errx != nil {
+		s.lgr.Debug(fmt.Sprintf("[Throttle] [SQL] [Refund] [Refund] %s", errx.String()))
+		return errx
+	}
+	return nil
+}
+
+func (s *sqlStore) Failures(key string, since time.Time) ([]time.Time, error) {
+	failures, errx := s.table.Since(key, since)
+	if errx != nil {
+		s.lgr.Debug(fmt.Sprintf("[Throttle] [SQL] [Failures] [Since] %s", errx.String()))
+		return nil, errx
+	}
+	return failures, nil
+}
+
+func (s *sqlStore) Reset(key string) error {
+	if errx := s.table.Delete(key); errx != nil {
+		s.lgr.Debug(fmt.Sprintf("[Throttle] [SQL] [Reset] [Delete] %s", errx.String()))
+		return errx
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+// Package throttle slows down and locks out repeated failed logins.
+//
+// Failures are kept per key, such as an email address or a client IP, in a sliding window. Once a key has
+// used up its free attempts every further attempt has to wait twice as long as the one before, and a key
+// that keeps failing is locked out for a while. Attempts count as failures from the moment they are let
+// through until they succeed, so a burst of concurrent attempts cannot all get past the limits.
+package throttle
+
+import (
+	"time"
+)
+
+// Store keeps the times of failed attempts, it is shared by every instance when they have to agree on limits
+type Store interface {
+	// RecordFailure adds a failure for key at t, failures older than keep may be forgotten
+	RecordFailure(key string, t time.Time, keep time.Duration) error
+	// Reserve records a failure for key at t if allow accepts the failures of key kept at t, in one step so
+	// concurrent calls for a key each see the failures recorded by the ones before them
+	Reserve(key string, t time.Time, keep time.Duration, allow func(failures []time.Time) bool) error
+	// Refund forgets the failure of key recorded at t
+	Refund(key string, t time.Time) error
+	// Failures returns the failures of key since since, oldest first
+	Failures(key string, since time.Time) ([]time.Time, error)
+	// Reset forgets every failure of key
+	Reset(key string) error
+}
+
+// Policy is how a kind of key is throttled
+type Policy struct {
+	// Window is how far back failures are counted
+	Window time.Duration
+	// FreeAttempts is how many failures in the window go without a delay
+	FreeAttempts int
+	// BaseDelay is the delay after the first failure past the free attempts, it doubles with every failure after that
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockoutAfter failures in the window lock the key for LockoutFor since the last of them, 0 never locks
+	LockoutAfter int
+	LockoutFor   time.Duration
+}
+
+// Decision is whether an attempt may go ahead
+type Decision struct {
+	// RetryAfter is how long the caller has to wait, zero when the attempt may go ahead
+	RetryAfter time.Duration
+	// Locked is set when the account, rather than only the client, is locked out
+	Locked bool
+	// at is when the attempt let through was counted, it identifies the attempt to Fail and Succeed
+	at time.Time
+}
+
+// Allowed reports whether the attempt may go ahead
+func (d Decision) Allowed() bool {
+	return d.RetryAfter <= 0
+}
+
+func (d Decision) merge(other Decision) Decision {
+	if other.RetryAfter > d.RetryAfter {
+		d.RetryAfter = other.RetryAfter
+	}
+	d.Locked = d.Locked || other.Locked
+	return d
+}
+
+// Limiter throttles logins per account and per client IP
+type Limiter struct {
+	store   Store
+	account Policy
+	client  Policy
+	now     func() time.Time
+}
+
+func NewLimiter(store Store, account Policy, client Policy) *Limiter {
+	return &Limiter{
+		store:   store,
+		account: account,
+		client:  client,
+		now:     time.Now,
+	}
+}
+
+func accountKey(email string) string {
+	return "email:" + email
+}
+
+func clientKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Check decides whether a login for email from ip may be attempted now. An attempt which may go ahead is counted
+// as a failure of the account and of the client right away, Succeed takes it back and anything else leaves it counted
+func (l *Limiter) Check(email string, ip string) (Decision, error) {
+	// Failure times are kept to the microsecond, which every store holds exactly, so Succeed can find the attempt again
+	now := l.now().Truncate(time.Microsecond)
+
+	account, err := l.reserve(accountKey(email), l.account, now)
+	if err != nil || !account.Allowed() {
+		return account, err
+	}
+
+	client, err := l.reserve(clientKey(ip), l.client, now)
+	if err != nil || !client.Allowed() {
+		// The account's attempt is taken back as the client may not make it
+		if refundErr := l.store.Refund(accountKey(email), now); err == nil {
+			err = refundErr
+		}
+		// Only the account can be unlocked by email, a locked out client just has to wait
+		client.Locked = false
+		return client, err
+	}
+
+	return Decision{at: now}, nil
+}
+
+// Fail leaves an attempt let through by Check counted, justLocked is set by the attempt which locked the account
+func (l *Limiter) Fail(d Decision, email string) (justLocked bool, err error) {
+	if l.account.LockoutAfter <= 0 {
+		return false, nil
+	}
+
+	failures, err := l.store.Failures(accountKey(email), d.at.Add(-l.account.Window))
+	if err != nil {
+		return false, err
+	}
+
+	// The attempts after this one are still running or came later, they have no say in whether this one locked
+	count := 0
+	for _, t := range failures {
+		if !t.After(d.at) {
+			count++
+		}
+	}
+	return count == l.account.LockoutAfter, nil
+}
+
+// Succeed takes back an attempt let through by Check once the password was entered correctly, forgetting every
+// failure of the account, the earlier failures of the client stay
+func (l *Limiter) Succeed(d Decision, email string, ip string) error {
+	if err := l.store.Reset(accountKey(email)); err != nil {
+		return err
+	}
+	return l.store.Refund(clientKey(ip), d.at)
+}
+
+// Unlock lifts the lockout of an account, as done through the unlock email
+func (l *Limiter) Unlock(email string) error {
+	return l.store.Reset(accountKey(email))
+}
+
+// keep is how long failures of a policy are of any use
+func (p Policy) keep() time.Duration {
+	return p.Window + p.LockoutFor
+}
+
+// reserve counts an attempt for key at now if p lets it go ahead, returning the decision either way
+func (l *Limiter) reserve(key string, p Policy, now time.Time) (Decision, error) {
+	var d Decision
+	err := l.store.Reserve(key, now, p.keep(), func(failures []time.Time) bool {
+		d = p.decide(failures, now)
+		return d.Allowed()
+	})
+	return d, err
+}
+
+// decide applies p to the failures kept at now, oldest first
+func (p Policy) decide(failures []time.Time, now time.Time) Decision {
+	if len(failures) == 0 {
+		return Decision{}
+	}
+
+	last := failures[len(failures)-1]
+
+	// The lockout runs from the failure which reached the limit, counted over the window before it
+	if p.LockoutAfter > 0 {
+		inWindow := countSince(failures, last.Add(-p.Window))
+		if lockedUntil := last.Add(p.LockoutFor); inWindow >= p.LockoutAfter && now.Before(lockedUntil) {
+			return Decision{RetryAfter: lockedUntil.Sub(now), Locked: true}
+		}
+	}
+
+	count := countSince(failures, now.Add(-p.Window))
+	if count <= p.FreeAttempts {
+		return Decision{}
+	}
+
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < count && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	if next := last.Add(delay); now.Before(next) {
+		return Decision{RetryAfter: next.Sub(now)}
+	}
+	return Decision{}
+}
+
+func countSince(failures []time.Time, since time.Time) int {
+	count := 0
+	for _, t := range failures {
+		if !t.Before(since) {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,180 @@
+package throttle
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLimiter(now *time.Time) *Limiter {
+	l := NewLimiter(NewMemoryStore(), Policy{
+		Window:       time.Minute * 15,
+		FreeAttempts: 3,
+		BaseDelay:    time.Second,
+		MaxDelay:     time.Second * 8,
+		LockoutAfter: 6,
+		LockoutFor:   time.Minute * 30,
+	}, Policy{
+		Window:       time.Minute * 15,
+		FreeAttempts: 10,
+		BaseDelay:    time.Second,
+		MaxDelay:     time.Second * 8,
+		LockoutAfter: 20,
+		LockoutFor:   time.Minute * 30,
+	})
+	l.now = func() time.Time { return *now }
+	return l
+}
+
+func TestProgressiveDelay(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	l := newTestLimiter(&now)
+
+	for i := 0; i < 3; i++ {
+		d, err := l.Check("jane@example.com", "10.0.0.1")
+		assert.Nil(t, err)
+		assert.True(t, d.Allowed())
+		_, err = l.Fail(d, "jane@example.com")
+		assert.Nil(t, err)
+	}
+
+	// Past the free attempts every failure doubles the wait
+	for _, want := range []time.Duration{time.Second, time.Second * 2} {
+		d, err := l.Check("jane@example.com", "10.0.0.1")
+		assert.Nil(t, err)
+		assert.True(t, d.Allowed())
+		_, err = l.Fail(d, "jane@example.com")
+		assert.Nil(t, err)
+
+		d, err = l.Check("jane@example.com", "10.0.0.1")
+		assert.Nil(t, err)
+		assert.Equal(t, want, d.RetryAfter)
+		assert.False(t, d.Locked)
+
+		// Another client is held back just the same, the delay belongs to the account
+		d, err = l.Check("jane@example.com", "10.0.0.2")
+		assert.Nil(t, err)
+		assert.Equal(t, want, d.RetryAfter)
+
+		now = now.Add(want)
+	}
+
+	// Failures age out of the window
+	now = now.Add(time.Minute * 15)
+	d, err := l.Check("jane@example.com", "10.0.0.1")
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed())
+}
+
+func TestConcurrentAttempts(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	l := newTestLimiter(&now)
+
+	// Attempts count from the moment they are let through, so a burst gets no further than attempts one by one
+	decisions := make(chan Decision, 20)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d, err := l.Check("jane@example.com", "10.0.0.1")
+			assert.Nil(t, err)
+			decisions <- d
+		}()
+	}
+	wg.Wait()
+	close(decisions)
+
+	var allowed []Decision
+	for d := range decisions {
+		if d.Allowed() {
+			allowed = append(allowed, d)
+		}
+	}
+	assert.Len(t, allowed, 4)
+
+	// A correct password takes its attempt back and forgets the failures of the account
+	assert.Nil(t, l.Succeed(allowed[0], "jane@example.com", "10.0.0.1"))
+	failures, err := l.store.Failures(clientKey("10.0.0.1"), now.Add(-time.Hour))
+	assert.Nil(t, err)
+	assert.Len(t, failures, 3)
+
+	d, err := l.Check("jane@example.com", "10.0.0.1")
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed())
+}
+
+func TestLockoutAndUnlock(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	l := newTestLimiter(&now)
+
+	var locks int
+	for i := 0; i < 6; i++ {
+		d, err := l.Check("jane@example.com", "10.0.0.1")
+		assert.Nil(t, err)
+		assert.True(t, d.Allowed())
+
+		justLocked, err := l.Fail(d, "jane@example.com")
+		assert.Nil(t, err)
+		if justLocked {
+			locks++
+			assert.Equal(t, 5, i)
+		}
+		now = now.Add(time.Second * 10)
+	}
+	// Only the failure reaching the limit reports the lockout, so only one unlock email goes out
+	assert.Equal(t, 1, locks)
+
+	d, err := l.Check("jane@example.com", "10.0.0.1")
+	assert.Nil(t, err)
+	assert.True(t, d.Locked)
+	assert.Equal(t, time.Minute*30-time.Second*10, d.RetryAfter)
+
+	// Other accounts are not affected by the lock
+	d, err = l.Check("john@example.com", "10.0.0.2")
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed())
+
+	assert.Nil(t, l.Unlock("jane@example.com"))
+	d, err = l.Check("jane@example.com", "10.0.0.2")
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed())
+}
+
+func TestClientThrottledAcrossAccounts(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	l := newTestLimiter(&now)
+
+	// Spraying one password over many addresses never trips an account, but it does trip the client
+	for i := 0; i < 20; i++ {
+		email := string(rune('a'+i)) + "@example.com"
+		d, err := l.Check(email, "10.0.0.1")
+		assert.Nil(t, err)
+		assert.True(t, d.Allowed())
+		_, err = l.Fail(d, email)
+		assert.Nil(t, err)
+		now = now.Add(time.Second * 10)
+	}
+
+	d, err := l.Check("jane@example.com", "10.0.0.1")
+	assert.Nil(t, err)
+	assert.False(t, d.Allowed())
+	assert.False(t, d.Locked)
+
+	// The account's attempt was not counted as the client could not make it
+	failures, err := l.store.Failures(accountKey("jane@example.com"), now.Add(-time.Hour))
+	assert.Nil(t, err)
+	assert.Empty(t, failures)
+
+	d, err = l.Check("jane@example.com", "10.0.0.2")
+	assert.Nil(t, err)
+	assert.True(t, d.Allowed())
+
+	// A correct password resets the account, not the client
+	assert.Nil(t, l.Succeed(d, "a@example.com", "10.0.0.2"))
+	d, err = l.Check("a@example.com", "10.0.0.1")
+	assert.Nil(t, err)
+	assert.False(t, d.Allowed())
+}
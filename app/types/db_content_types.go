@@ -3,4 +3,6 @@ package types
 type FolderContent struct {
 	NoteID NoteID
 	Name   string
+	// WrappedKey is the note's data key, see Note
+	WrappedKey string `json:"-"`
 }
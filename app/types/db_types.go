@@ -1,22 +1,63 @@
 package types
 
+import "time"
+
 type UserID int
 type FolderID int
 type NoteID int
 
 type User struct {
-	ID              UserID `json:"user_id"`
-	Email           string `json:"email"`
-	KeyHash         string `json:"key_hash"`
-	EncryptionKey   string `json:"encryption_key"`
-	VerificationKey string `json:"verification_key"`
-	Verified        bool   `json:"verified"`
+	ID            UserID `json:"user_id"`
+	Email         string `json:"email"`
+	KeyHash       string `json:"key_hash"`
+	EncryptionKey string `json:"encryption_key"`
+	KDFSalt       string `json:"kdf_salt"`
+	KDFParams     string `json:"kdf_params"`
+	// Recovery is the data key wrapped under the recovery code, empty for accounts created without one
+	Recovery KeyWrap `json:"recovery"`
+	// Vault is the data key wrapped under the vault passphrase, empty unless an OpenID Connect identity is linked
+	Vault KeyWrap `json:"vault"`
+	// SRP is empty for accounts which have not logged in with their password since SRP was added
+	SRP             SRPVerifier `json:"srp"`
+	VerificationKey string      `json:"verification_key"`
+	Verified        bool        `json:"verified"`
+	TOTPEnabled     bool        `json:"totp_enabled"`
+	WebAuthnEnabled bool        `json:"webauthn_enabled"`
+	// KeyRotationPending is set while a rotation of the data key is requested or interrupted
+	KeyRotationPending bool `json:"key_rotation_pending"`
+	// ZeroKnowledge accounts encrypt folders and notes on the client, the server stores them as they come
+	ZeroKnowledge bool `json:"zero_knowledge"`
+	// KeyBundle is the client wrapped key of a zero-knowledge account, the server cannot open it
+	KeyBundle string `json:"key_bundle"`
+}
+
+// TOTP is a user's second factor, Secret is sealed under the user's data key
+type TOTP struct {
+	Secret   string `json:"secret"`
+	Enabled  bool   `json:"enabled"`
+	LastStep int64  `json:"last_step"`
+}
+
+// SRPVerifier lets a user log in without sending the password, Salt and Verifier are base64
+type SRPVerifier struct {
+	Salt     string `json:"salt"`
+	Verifier string `json:"verifier"`
+	Params   string `json:"params"`
+}
+
+// KeyWrap is a data key wrapped under a secret through the password KDF, all fields base64 except Params
+type KeyWrap struct {
+	Key    string `json:"key"`
+	Salt   string `json:"salt"`
+	Params string `json:"params"`
 }
 
 type Folder struct {
 	FolderID FolderID `json:"folder_id"`
 	UserID   UserID   `json:"user_id"`
 	Name     string   `json:"name"`
+	// Locked folders are listed to restricted sessions, which cannot decrypt the name
+	Locked bool `json:"locked,omitempty"`
 }
 
 type Note struct {
@@ -24,4 +65,87 @@ type Note struct {
 	FolderID FolderID `json:"folder_id"`
 	Data     string   `json:"data"`
 	Name     string   `json:"name"`
+	// WrappedKey is the note's own data key sealed under the user's key, empty for notes
+	// written before per-note keys, whose name and data are sealed under the user's key directly
+	WrappedKey string `json:"-"`
+	// Locked notes are listed to restricted sessions, which cannot decrypt the name or data
+	Locked bool `json:"locked,omitempty"`
+}
+
+type Session struct {
+	SessionID   string    `json:"session_id"`
+	UserID      UserID    `json:"user_id"`
+	DeviceLabel string    `json:"device_label"`
+	UserAgent   string    `json:"user_agent"`
+	IPAddress   string    `json:"ip_address"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+}
+
+// KeyRotation is a rotation of a user's data key which has not finished yet
+// PendingKey is the new key sealed under the current one, empty until a password login picks the rotation up
+type KeyRotation struct {
+	UserID       UserID
+	PendingKey   string
+	FolderCursor FolderID
+	NoteCursor   NoteID
+	RequestedAt  time.Time
+}
+
+// AuditEvent is an entry of the security audit log, UserID is 0 for attempts which matched no account
+type AuditEvent struct {
+	EventID   int64     `json:"event_id"`
+	UserID    UserID    `json:"-"`
+	Type      string    `json:"type"`
+	Outcome   string    `json:"outcome"`
+	IPAddress string    `json:"ip_address"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebAuthnCredential is a registered passkey, WrappedKey is the data key sealed under its PRF output when set
+type WebAuthnCredential struct {
+	UserID       UserID    `json:"user_id"`
+	CredentialID string    `json:"credential_id"`
+	Name         string    `json:"name"`
+	PublicKey    string    `json:"public_key"`
+	Algorithm    int       `json:"algorithm"`
+	SignCount    uint32    `json:"sign_count"`
+	PRFSalt      string    `json:"prf_salt"`
+	WrappedKey   string    `json:"wrapped_key"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastUsedAt   time.Time `json:"last_used_at"`
+}
+
+// AccessToken is a personal access token, WrappedKey is the data key sealed under a key derived from the token's secret
+type AccessToken struct {
+	TokenID    string   `json:"token_id"`
+	UserID     UserID   `json:"user_id"`
+	Name       string   `json:"name"`
+	SecretHash string   `json:"-"`
+	Scopes     []string `json:"scopes"`
+	WrappedKey string   `json:"-"`
+	// ZeroKnowledge is the mode of the account the token belongs to
+	ZeroKnowledge bool      `json:"-"`
+	CreatedAt     time.Time `json:"created_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	LastUsedAt    time.Time `json:"last_used_at"`
+}
+
+type RefreshToken struct {
+	TokenID   string    `json:"token_id"`
+	FamilyID  string    `json:"family_id"`
+	UserID    UserID    `json:"user_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Used      bool      `json:"used"`
+	Revoked   bool      `json:"revoked"`
+}
+
+// Identity links an account to the subject of an OpenID Connect provider
+type Identity struct {
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	UserID    UserID    `json:"user_id"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
 }
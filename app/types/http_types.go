@@ -1,27 +1,56 @@
 package types
 
-import "github.com/dgrijalva/jwt-go"
+import (
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
 
 type CreateUserRequest struct {
 	Email                   string `json:"email"`
 	Password                string `json:"password"`
 	VerificationCallbackURL string `json:"verification_callback_url"`
+	// ZeroKnowledge accounts encrypt folders and notes on the client, KeyBundle is then required
+	ZeroKnowledge bool   `json:"zero_knowledge"`
+	KeyBundle     string `json:"key_bundle"`
 }
 
 type CreateUserResponse struct {
 	UserCreated           bool `json:"user_created"`
 	VerificationEmailSent bool `json:"verification_email_sent"`
+	// RecoveryCode is shown only once, it is the only way back in after a forgotten password
+	RecoveryCode string `json:"recovery_code,omitempty"`
 }
 
 type LoginUserRequest struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email       string `json:"email"`
+	Password    string `json:"password"`
+	DeviceLabel string `json:"device_label"`
 }
 
 type LoginUserResponse struct {
 	AuthenticationToken string `json:"authentication_token,omitempty"`
 	RefreshToken        string `json:"refresh_token,omitempty"`
 	VerificationPending bool   `json:"verification_pending"`
+	// TwoFactorRequired means no tokens were issued, ChallengeToken has to be completed at /v1/users/login/2fa
+	TwoFactorRequired bool   `json:"two_factor_required,omitempty"`
+	ChallengeToken    string `json:"challenge_token,omitempty"`
+	// SecondFactors lists what can complete the challenge, "totp" and "webauthn"
+	SecondFactors []string `json:"second_factors,omitempty"`
+	// Restricted sessions can only manage sessions and list metadata until unlocked with the password
+	Restricted bool `json:"restricted,omitempty"`
+	// RecoveryCode is set when the login finished a pending rotation of the data key, it replaces the previous code
+	RecoveryCode string `json:"recovery_code,omitempty"`
+	// ZeroKnowledge tells the client to encrypt and decrypt folders and notes itself
+	ZeroKnowledge bool `json:"zero_knowledge"`
+	// KeyBundle is handed out along with unrestricted tokens of zero-knowledge accounts
+	KeyBundle string `json:"key_bundle,omitempty"`
+}
+
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+	DeviceLabel    string `json:"device_label"`
 }
 
 type ActivateUserRequest struct {
@@ -41,9 +70,362 @@ type ResendVerificationResponse struct {
 	VerificationEmailSent bool `json:"verification_email_sent"`
 }
 
+type MagicLinkRequest struct {
+	Email string `json:"email"`
+}
+
+type MagicLinkResponse struct {
+	Requested bool `json:"requested"`
+}
+
+type UnlockLoginRequest struct {
+	Token string `json:"token"`
+}
+
+type UnlockLoginResponse struct {
+	Unlocked bool `json:"unlocked"`
+}
+
+type RedeemMagicLinkRequest struct {
+	Token       string `json:"token"`
+	DeviceLabel string `json:"device_label"`
+}
+
+type UnlockSessionRequest struct {
+	Password string `json:"password"`
+	// Code is a TOTP or backup code, required when two-factor authentication is enabled
+	Code string `json:"code"`
+}
+
+type UnlockSessionResponse struct {
+	Unlocked  bool   `json:"unlocked"`
+	KeyBundle string `json:"key_bundle,omitempty"`
+}
+
+type KeyBundleResponse struct {
+	ZeroKnowledge bool   `json:"zero_knowledge"`
+	KeyBundle     string `json:"key_bundle,omitempty"`
+}
+
+type UpdateKeyBundleRequest struct {
+	KeyBundle string `json:"key_bundle"`
+}
+
+type UpdateKeyBundleResponse struct {
+	Updated bool `json:"updated"`
+}
+
+type CreateAccessTokenRequest struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"`
+}
+
+type CreateAccessTokenResponse struct {
+	AccessToken
+	// Token is shown only once, only a hash of its secret is kept
+	Token string `json:"token"`
+}
+
+type RevokeAccessTokenResponse struct {
+	TokenID string `json:"token_id"`
+	Revoked bool   `json:"revoked"`
+}
+
+type ChangePasswordRequest struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
+
+type LogoutResponse struct {
+	LoggedOut bool `json:"logged_out"`
+}
+
+// ClientInfo describes the device a session is used from
+type ClientInfo struct {
+	DeviceLabel string
+	UserAgent   string
+	IPAddress   string
+}
+
+type SessionInfo struct {
+	SessionID   string    `json:"session_id"`
+	DeviceLabel string    `json:"device_label"`
+	UserAgent   string    `json:"user_agent"`
+	IPAddress   string    `json:"ip_address"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+	Current     bool      `json:"current"`
+}
+
+type RevokeSessionResponse struct {
+	SessionID string `json:"session_id"`
+	Revoked   bool   `json:"revoked"`
+}
+
+type ChangePasswordResponse struct {
+	PasswordChanged bool `json:"password_changed"`
+}
+
+type RotateKeyRequest struct {
+	Password string `json:"password"`
+}
+
+// RotateKeyResponse carries the recovery code of the new key, the previous code no longer works
+type RotateKeyResponse struct {
+	Rotated      bool   `json:"rotated"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type RequestKeyRotationResponse struct {
+	UserID    UserID `json:"user_id"`
+	Requested bool   `json:"requested"`
+}
+
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+type DeleteAccountResponse struct {
+	Deleted         bool `json:"deleted"`
+	NoticeEmailSent bool `json:"notice_email_sent"`
+}
+
+type ChangeEmailRequest struct {
+	NewEmail                string `json:"new_email"`
+	Password                string `json:"password"`
+	VerificationCallbackURL string `json:"verification_callback_url"`
+}
+
+type ChangeEmailResponse struct {
+	VerificationEmailSent bool `json:"verification_email_sent"`
+	NoticeEmailSent       bool `json:"notice_email_sent"`
+}
+
+type ConfirmEmailChangeRequest struct {
+	VerificationToken string `json:"verification_token"`
+}
+
+type ConfirmEmailChangeResponse struct {
+	EmailChanged bool `json:"email_changed"`
+}
+
+type RecoverAccountRequest struct {
+	Email        string `json:"email"`
+	RecoveryCode string `json:"recovery_code"`
+	NewPassword  string `json:"new_password"`
+}
+
+type RecoverAccountResponse struct {
+	PasswordChanged bool `json:"password_changed"`
+	NoticeEmailSent bool `json:"notice_email_sent"`
+	// RecoveryCode replaces the code used for recovery, which stops working
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type RegenerateRecoveryCodeRequest struct {
+	Password string `json:"password"`
+}
+
+type RegenerateRecoveryCodeResponse struct {
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type EnrollTOTPResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type ConfirmTOTPResponse struct {
+	Enabled     bool     `json:"enabled"`
+	BackupCodes []string `json:"backup_codes"`
+}
+
+type DisableTOTPResponse struct {
+	Disabled bool `json:"disabled"`
+}
+
+// WebAuthn binary values are base64url encoded without padding, as in the WebAuthn JSON serialisation
+
+type WebAuthnRelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type WebAuthnUser struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName"`
+}
+
+type WebAuthnCredentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type WebAuthnCredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type WebAuthnPRFValues struct {
+	First string `json:"first"`
+}
+
+type WebAuthnPRFInputs struct {
+	Eval             *WebAuthnPRFValues           `json:"eval,omitempty"`
+	EvalByCredential map[string]WebAuthnPRFValues `json:"evalByCredential,omitempty"`
+}
+
+type WebAuthnExtensions struct {
+	PRF WebAuthnPRFInputs `json:"prf"`
+}
+
+// WebAuthnCreationOptions is passed as publicKey to navigator.credentials.create()
+type WebAuthnCreationOptions struct {
+	Challenge          string                         `json:"challenge"`
+	RP                 WebAuthnRelyingParty           `json:"rp"`
+	User               WebAuthnUser                   `json:"user"`
+	PubKeyCredParams   []WebAuthnCredentialParameter  `json:"pubKeyCredParams"`
+	ExcludeCredentials []WebAuthnCredentialDescriptor `json:"excludeCredentials"`
+	Timeout            int                            `json:"timeout"`
+	Attestation        string                         `json:"attestation"`
+	Extensions         WebAuthnExtensions             `json:"extensions"`
+}
+
+// WebAuthnRequestOptions is passed as publicKey to navigator.credentials.get()
+type WebAuthnRequestOptions struct {
+	Challenge        string                         `json:"challenge"`
+	RPID             string                         `json:"rpId"`
+	AllowCredentials []WebAuthnCredentialDescriptor `json:"allowCredentials"`
+	Timeout          int                            `json:"timeout"`
+	UserVerification string                         `json:"userVerification"`
+	Extensions       WebAuthnExtensions             `json:"extensions"`
+}
+
+type BeginWebAuthnRegistrationResponse struct {
+	CeremonyID string                  `json:"ceremony_id"`
+	PublicKey  WebAuthnCreationOptions `json:"publicKey"`
+}
+
+type FinishWebAuthnRegistrationRequest struct {
+	CeremonyID         string `json:"ceremony_id"`
+	Name               string `json:"name"`
+	CredentialID       string `json:"credential_id"`
+	ClientDataJSON     string `json:"client_data_json"`
+	AuthenticatorData  string `json:"authenticator_data"`
+	PublicKey          string `json:"public_key"`
+	PublicKeyAlgorithm int    `json:"public_key_algorithm"`
+	// PRFOutput is the prf extension result for the salt in the options, without it the passkey can't unlock notes
+	PRFOutput string `json:"prf_output"`
+}
+
+type WebAuthnCredentialInfo struct {
+	CredentialID string    `json:"credential_id"`
+	Name         string    `json:"name"`
+	Passwordless bool      `json:"passwordless"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastUsedAt   time.Time `json:"last_used_at"`
+}
+
+type BeginWebAuthnLoginRequest struct {
+	Email string `json:"email"`
+}
+
+type BeginWebAuthnLoginResponse struct {
+	CeremonyID string                 `json:"ceremony_id"`
+	PublicKey  WebAuthnRequestOptions `json:"publicKey"`
+}
+
+type FinishWebAuthnLoginRequest struct {
+	CeremonyID        string `json:"ceremony_id"`
+	CredentialID      string `json:"credential_id"`
+	ClientDataJSON    string `json:"client_data_json"`
+	AuthenticatorData string `json:"authenticator_data"`
+	Signature         string `json:"signature"`
+	PRFOutput         string `json:"prf_output"`
+	// ChallengeToken completes a password login as the second factor, without it the login is passwordless
+	ChallengeToken string `json:"challenge_token"`
+	DeviceLabel    string `json:"device_label"`
+}
+
+type SRPInitRequest struct {
+	Email string `json:"email"`
+}
+
+// SRPInitResponse carries the server's half of the handshake, the binary values are base64
+type SRPInitResponse struct {
+	HandshakeID string `json:"handshake_id"`
+	// Salt and Params derive the SRP private key x from the password
+	Salt         string `json:"srp_salt"`
+	Params       string `json:"srp_params"`
+	ServerPublic string `json:"server_public"`
+	// KDFSalt and KDFParams derive the key wrapping the data key, an empty salt means SHA3-256 of the password
+	KDFSalt   string `json:"kdf_salt"`
+	KDFParams string `json:"kdf_params"`
+}
+
+type SRPVerifyRequest struct {
+	Email        string `json:"email"`
+	HandshakeID  string `json:"handshake_id"`
+	ClientPublic string `json:"client_public"`
+	ClientProof  string `json:"client_proof"`
+	// WrappingKey is the key derived with kdf_salt and kdf_params, sealed with AES-256-GCM under the session key
+	WrappingKey string `json:"wrapping_key"`
+	DeviceLabel string `json:"device_label"`
+}
+
+// SRPVerifyResponse is a login response along with the server's proof, which the client checks before trusting it
+type SRPVerifyResponse struct {
+	LoginUserResponse
+	ServerProof string `json:"server_proof"`
+}
+
+type DeleteWebAuthnCredentialResponse struct {
+	CredentialID string `json:"credential_id"`
+	Deleted      bool   `json:"deleted"`
+}
+
+const (
+	TokenTypeAccess  = "access"
+	TokenTypeRefresh = "refresh"
+	// TokenTypeChallenge is handed out in place of tokens when a login still needs a second factor
+	TokenTypeChallenge = "challenge"
+	// TokenTypePersonal marks claims resolved from a personal access token rather than a JWT
+	TokenTypePersonal = "pat"
+)
+
+const (
+	ScopeNotesRead    = "notes:read"
+	ScopeNotesWrite   = "notes:write"
+	ScopeFoldersWrite = "folders:write"
+	// ScopeAccount covers account, session and token management, it is never granted to personal access tokens
+	ScopeAccount = "account"
+)
+
+// AccessTokenScopes are the scopes a personal access token can be granted
+var AccessTokenScopes = []string{ScopeNotesRead, ScopeNotesWrite, ScopeFoldersWrite}
+
+// SessionScopes are granted to the access tokens of login sessions
+var SessionScopes = []string{ScopeNotesRead, ScopeNotesWrite, ScopeFoldersWrite, ScopeAccount}
+
+// AccessTokenClaims are shared by access and refresh tokens, refresh tokens also carry a token id (jti)
 type AccessTokenClaims struct {
-	UserID        UserID `json:"user_id"`
-	EncryptionKey []byte `json:"encryption_key"`
+	UserID    UserID `json:"user_id"`
+	SessionID string `json:"sid"`
+	TokenType string `json:"typ"`
+	// EncryptionKey is never serialized into tokens, JWTAuth resolves it from the session key store
+	EncryptionKey []byte `json:"-"`
+	// Restricted is set by JWTAuth for sessions which were started without the password and hold no data key
+	Restricted bool `json:"-"`
+	// Scopes are checked by middlewares.RequireScope, whatever kind of token the claims came from
+	Scopes []string `json:"scp,omitempty"`
+	// ZeroKnowledge is set for accounts whose folders and notes arrive encrypted by the client
+	ZeroKnowledge bool `json:"zk,omitempty"`
 	jwt.StandardClaims
 }
 
@@ -83,3 +465,54 @@ type UpdateNoteRequest struct {
 	NoteID   NoteID   `json:"note_id"`
 	FolderID FolderID `json:"folder_id"`
 }
+
+// JSONWebKey is a public key as published in the JWKS (RFC 7517)
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+type BeginOIDCResponse struct {
+	AuthorizationURL string `json:"authorization_url"`
+	State            string `json:"state"`
+}
+
+// FinishOIDCLoginRequest carries what the provider redirected back with, without the vault passphrase
+// the session is restricted until it is unlocked
+type FinishOIDCLoginRequest struct {
+	State           string `json:"state"`
+	Code            string `json:"code"`
+	VaultPassphrase string `json:"vault_passphrase"`
+	DeviceLabel     string `json:"device_label"`
+}
+
+type LinkOIDCRequest struct {
+	State           string `json:"state"`
+	Code            string `json:"code"`
+	VaultPassphrase string `json:"vault_passphrase"`
+}
+
+type LinkOIDCResponse struct {
+	Linked bool   `json:"linked"`
+	Email  string `json:"email"`
+}
+
+type UnlinkOIDCResponse struct {
+	Unlinked bool `json:"unlinked"`
+}
+
+type SecurityEventsResponse struct {
+	Events []AuditEvent `json:"events"`
+	// NextBefore is the before parameter of the next page, it is left out on the last page
+	NextBefore int64 `json:"next_before,omitempty"`
+}
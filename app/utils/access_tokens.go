@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// AccessTokenPrefix marks personal access tokens, so they are easy to spot in leaked configs and logs
+const AccessTokenPrefix = "arche_pat_"
+
+// NewAccessToken returns the public id and the secret of a new personal access token along with
+// the token handed to the user, which joins both
+func NewAccessToken() (tokenID string, secret string, token string, err error) {
+	if tokenID, err = RandToken(16); err != nil {
+		return "", "", "", err
+	}
+	if secret, err = RandToken(32); err != nil {
+		return "", "", "", err
+	}
+	return tokenID, secret, AccessTokenPrefix + tokenID + "." + secret, nil
+}
+
+// ParseAccessToken splits a personal access token into its id and secret
+func ParseAccessToken(token string) (tokenID string, secret string, ok bool) {
+	if !strings.HasPrefix(token, AccessTokenPrefix) {
+		return "", "", false
+	}
+
+	parts := strings.Split(strings.TrimPrefix(token, AccessTokenPrefix), ".")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// HashAccessTokenSecret is what gets stored to check a token's secret
+func HashAccessTokenSecret(secret string) string {
+	sum := sha3.Sum256([]byte("arche-api access token hash:" + secret))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// AccessTokenWrappingKey derives the key a token's copy of the data key is wrapped under, the secret
+// carries 256 random bits so it needs no password KDF, and is domain separated from the stored hash
+func AccessTokenWrappingKey(secret string) []byte {
+	sum := sha3.Sum256([]byte("arche-api access token key wrap:" + secret))
+	return sum[:]
+}
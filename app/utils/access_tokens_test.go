@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAccessToken(t *testing.T) {
+	tokenID, secret, token, err := NewAccessToken()
+	assert.Nil(t, err)
+
+	parsedID, parsedSecret, ok := ParseAccessToken(token)
+	assert.True(t, ok)
+	assert.Equal(t, tokenID, parsedID)
+	assert.Equal(t, secret, parsedSecret)
+
+	for _, malformed := range []string{"", tokenID + "." + secret, AccessTokenPrefix + tokenID, AccessTokenPrefix + "." + secret} {
+		_, _, ok = ParseAccessToken(malformed)
+		assert.False(t, ok, malformed)
+	}
+}
+
+func TestAccessTokenDerivationsDiffer(t *testing.T) {
+	_, secret, _, err := NewAccessToken()
+	assert.Nil(t, err)
+
+	assert.Len(t, AccessTokenWrappingKey(secret), 32)
+	assert.NotEqual(t, HashAccessTokenSecret(secret), HashVerificationToken(secret))
+}
@@ -4,11 +4,24 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/sha3"
 	"io"
 )
 
+const (
+	// EnvelopeVersion1 is the first (and current) version of the ciphertext envelope
+	EnvelopeVersion1 byte = 0x01
+	// EnvelopeAlgAES256GCM identifies AES-256 in Galois/Counter Mode
+	EnvelopeAlgAES256GCM byte = 0x01
+
+	envelopeHeaderSize = 2
+)
+
+// ErrCiphertextIntegrity is returned when an envelope is malformed or fails authentication
+var ErrCiphertextIntegrity = errors.New("ciphertext failed integrity check")
+
 func GenerateEncryptionKey(lgr *zap.Logger) ([]byte, [32]byte, error) {
 	key := make([]byte, 32)
 	if _, err := io.ReadFull(rand.Reader, key); err != nil {
@@ -19,18 +32,18 @@ func GenerateEncryptionKey(lgr *zap.Logger) ([]byte, [32]byte, error) {
 	return key, sha3.Sum256(key), nil
 }
 
-func EncryptKey(key []byte, password string, lgr *zap.Logger) {
-	encryptionKey := sha3.Sum256([]byte(password))
+// EncryptKey wraps key in place with wrappingKey, see DeriveWrappingKey
+func EncryptKey(key []byte, wrappingKey []byte, lgr *zap.Logger) {
 	// Error can be safely ignored as it is only thrown if keysize if invalid
-	// Which won't happen as we use SHA to generate the encryption key
-	blockCipher, _ := aes.NewCipher(encryptionKey[:])
+	// Which won't happen as DeriveWrappingKey always generates 32 byte keys
+	blockCipher, _ := aes.NewCipher(wrappingKey)
 	blockCipher.Encrypt(key[:aes.BlockSize], key[:aes.BlockSize])
 	blockCipher.Encrypt(key[aes.BlockSize:], key[aes.BlockSize:])
 }
 
-func DecryptKey(key []byte, password string, lgr *zap.Logger) error {
-	encryptionKey := sha3.Sum256([]byte(password))
-	blockCipher, err := aes.NewCipher(encryptionKey[:])
+// DecryptKey unwraps key in place with wrappingKey, see DeriveWrappingKey
+func DecryptKey(key []byte, wrappingKey []byte, lgr *zap.Logger) error {
+	blockCipher, err := aes.NewCipher(wrappingKey)
 	if err != nil {
 		// TODO: Add Logging
 		return err
@@ -42,6 +55,48 @@ func DecryptKey(key []byte, password string, lgr *zap.Logger) error {
 	return nil
 }
 
+// GCMEncrypt seals data into a versioned envelope laid out as
+// version (1 byte) | algorithm id (1 byte) | nonce | ciphertext | AEAD tag
+// The header bytes are authenticated as additional data
+func GCMEncrypt(data []byte, blockCipher cipher.Block) ([]byte, error) {
+	gcm, err := cipher.NewGCM(blockCipher)
+	if err != nil {
+		return nil, err
+	}
+
+	dst := make([]byte, envelopeHeaderSize+gcm.NonceSize(), envelopeHeaderSize+gcm.NonceSize()+len(data)+gcm.Overhead())
+	dst[0], dst[1] = EnvelopeVersion1, EnvelopeAlgAES256GCM
+	if _, err := io.ReadFull(rand.Reader, dst[envelopeHeaderSize:]); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(dst, dst[envelopeHeaderSize:], data, dst[:envelopeHeaderSize]), nil
+}
+
+// GCMDecrypt opens an envelope created by GCMEncrypt, returning ErrCiphertextIntegrity
+// if the envelope has an unknown header or has been tampered with
+func GCMDecrypt(envelope []byte, blockCipher cipher.Block) ([]byte, error) {
+	gcm, err := cipher.NewGCM(blockCipher)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(envelope) < envelopeHeaderSize+gcm.NonceSize()+gcm.Overhead() {
+		return nil, ErrCiphertextIntegrity
+	}
+	if envelope[0] != EnvelopeVersion1 || envelope[1] != EnvelopeAlgAES256GCM {
+		return nil, ErrCiphertextIntegrity
+	}
+
+	nonce := envelope[envelopeHeaderSize : envelopeHeaderSize+gcm.NonceSize()]
+	data, err := gcm.Open(nil, nonce, envelope[envelopeHeaderSize+gcm.NonceSize():], envelope[:envelopeHeaderSize])
+	if err != nil {
+		return nil, ErrCiphertextIntegrity
+	}
+	return data, nil
+}
+
+// CFBEncrypt is kept to produce legacy ciphertext, new data must use GCMEncrypt
 func CFBEncrypt(data []byte, blockCipher cipher.Block) ([]byte, error) {
 	// Create dst with length of cipher blocksize + data length
 	// And initialize first BlockSize bytes pseudorandom for IV
@@ -56,12 +111,16 @@ func CFBEncrypt(data []byte, blockCipher cipher.Block) ([]byte, error) {
 	return dst, nil
 }
 
-func CFBDecrypt(data []byte, blockCipher cipher.Block) []byte {
+// CFBDecrypt reads legacy (unauthenticated) ciphertext written before envelopes were introduced
+func CFBDecrypt(data []byte, blockCipher cipher.Block) ([]byte, error) {
+	if len(data) < blockCipher.BlockSize() {
+		return nil, ErrCiphertextIntegrity
+	}
 	// Create CFB Decrypter with cipher, instantiating with IV (first blockSize blocks of data)
 	cfb := cipher.NewCFBDecrypter(blockCipher, data[:blockCipher.BlockSize()])
 	// Create variable for storing decrypted note of shorter length taking into account IV
 	decrypted := make([]byte, len(data)-blockCipher.BlockSize())
 	// Decrypt data starting from blockSize to decrypted
 	cfb.XORKeyStream(decrypted, data[blockCipher.BlockSize():])
-	return decrypted
+	return decrypted, nil
 }
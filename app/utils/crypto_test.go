@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"crypto/aes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGCMEnvelope(t *testing.T) {
+	key, _, err := GenerateEncryptionKey(nil)
+	assert.Nil(t, err)
+	blockCipher, err := aes.NewCipher(key)
+	assert.Nil(t, err)
+
+	envelope, err := GCMEncrypt([]byte("I am a butterfly"), blockCipher)
+	assert.Nil(t, err)
+	assert.Equal(t, EnvelopeVersion1, envelope[0])
+	assert.Equal(t, EnvelopeAlgAES256GCM, envelope[1])
+
+	data, err := GCMDecrypt(envelope, blockCipher)
+	assert.Nil(t, err)
+	assert.Equal(t, "I am a butterfly", string(data))
+
+	envelope[len(envelope)-1] ^= 0xff
+	_, err = GCMDecrypt(envelope, blockCipher)
+	assert.Equal(t, ErrCiphertextIntegrity, err)
+
+	_, err = GCMDecrypt(envelope[:8], blockCipher)
+	assert.Equal(t, ErrCiphertextIntegrity, err)
+}
+
+func TestCFBLegacy(t *testing.T) {
+	key, _, err := GenerateEncryptionKey(nil)
+	assert.Nil(t, err)
+	blockCipher, err := aes.NewCipher(key)
+	assert.Nil(t, err)
+
+	ciphertext, err := CFBEncrypt([]byte("I am a squirrel"), blockCipher)
+	assert.Nil(t, err)
+
+	data, err := CFBDecrypt(ciphertext, blockCipher)
+	assert.Nil(t, err)
+	assert.Equal(t, "I am a squirrel", string(data))
+
+	_, err = CFBDecrypt(ciphertext[:4], blockCipher)
+	assert.Equal(t, ErrCiphertextIntegrity, err)
+}
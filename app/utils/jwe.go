@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+)
+
+type jweHeader struct {
+	Alg string `json:"alg"`
+	Enc string `json:"enc"`
+	Cty string `json:"cty,omitempty"`
+}
+
+var errMalformedJWE = errors.New("malformed JWE token")
+
+// isJWE reports whether tkn is in JWE compact serialization, which has five parts instead of the three of a JWS
+func isJWE(tkn string) bool {
+	return strings.Count(tkn, ".") == 4
+}
+
+// encryptJWE wraps a signed token in a compact JWE using direct encryption with A256GCM
+func encryptJWE(payload []byte, key []byte) (string, error) {
+	header, err := json.Marshal(jweHeader{Alg: "dir", Enc: "A256GCM", Cty: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	encodedHeader := base64.RawURLEncoding.EncodeToString(header)
+
+	gcm, err := newJWECipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return "", err
+	}
+
+	// The encoded protected header is the additional authenticated data, RFC 7516 section 5.1
+	sealed := gcm.Seal(nil, iv, payload, []byte(encodedHeader))
+	ciphertext, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+
+	// The encrypted key part is empty for direct encryption
+	return strings.Join([]string{
+		encodedHeader,
+		"",
+		base64.RawURLEncoding.EncodeToString(iv),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, "."), nil
+}
+
+// decryptJWE returns the payload of a compact JWE created by encryptJWE
+func decryptJWE(tkn string, key []byte) ([]byte, error) {
+	parts := strings.Split(tkn, ".")
+	if len(parts) != 5 || parts[1] != "" {
+		return nil, errMalformedJWE
+	}
+
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errMalformedJWE
+	}
+	var header jweHeader
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, errMalformedJWE
+	}
+	if header.Alg != "dir" || header.Enc != "A256GCM" {
+		return nil, errors.New("unexpected JWE algorithm")
+	}
+
+	gcm, err := newJWECipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	iv, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(iv) != gcm.NonceSize() {
+		return nil, errMalformedJWE
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return nil, errMalformedJWE
+	}
+	tag, err := base64.RawURLEncoding.DecodeString(parts[4])
+	if err != nil || len(tag) != gcm.Overhead() {
+		return nil, errMalformedJWE
+	}
+
+	payload, err := gcm.Open(nil, iv, append(ciphertext, tag...), []byte(parts[0]))
+	if err != nil {
+		return nil, ErrCiphertextIntegrity
+	}
+	return payload, nil
+}
+
+func newJWECipher(key []byte) (cipher.AEAD, error) {
+	blockCipher, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(blockCipher)
+}
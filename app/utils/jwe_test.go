@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJWE(t *testing.T) {
+	key, _, err := GenerateEncryptionKey(nil)
+	assert.Nil(t, err)
+
+	tkn, err := encryptJWE([]byte("header.payload.signature"), key)
+	assert.Nil(t, err)
+	assert.True(t, isJWE(tkn))
+	assert.False(t, isJWE("header.payload.signature"))
+
+	payload, err := decryptJWE(tkn, key)
+	assert.Nil(t, err)
+	assert.Equal(t, "header.payload.signature", string(payload))
+
+	otherKey, _, err := GenerateEncryptionKey(nil)
+	assert.Nil(t, err)
+	_, err = decryptJWE(tkn, otherKey)
+	assert.Equal(t, ErrCiphertextIntegrity, err)
+
+	parts := strings.Split(tkn, ".")
+	parts[0] = "eyJhbGciOiJkaXIiLCJlbmMiOiJBMTI4R0NNIn0"
+	_, err = decryptJWE(strings.Join(parts, "."), key)
+	assert.NotNil(t, err)
+
+	_, err = decryptJWE("a.b.c.d", key)
+	assert.Equal(t, errMalformedJWE, err)
+}
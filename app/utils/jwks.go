@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+
+	"github.com/sid-sun/arche-api/app/types"
+	"github.com/sid-sun/arche-api/config"
+)
+
+// JWKS lists the public verification keys so other services can check tokens without the signing key
+// HS256 tokens are never published, they can only be checked with the secret
+func JWKS(cfg *config.JWTConfig) types.JSONWebKeySet {
+	set := types.JSONWebKeySet{Keys: []types.JSONWebKey{}}
+	for _, key := range cfg.GetVerificationKeys() {
+		jwk := types.JSONWebKey{
+			KeyID:     key.GetID(),
+			Algorithm: key.GetAlgorithm(),
+			Use:       "sig",
+		}
+
+		switch publicKey := key.GetPublicKey().(type) {
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(publicKey)
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+		default:
+			continue
+		}
+
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
@@ -10,25 +10,66 @@ import (
 	"time"
 )
 
-func IssueJWT(claims types.AccessTokenClaims, secret string, lgr *zap.Logger) (string, error) {
-	tkn := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	token, err := tkn.SignedString([]byte(secret))
+// IssueJWT signs claims and, when the configured format is JWE, encrypts the signed token
+// Tokens are signed with the configured asymmetric key and carry its kid, or with HS256 when there is none
+func IssueJWT(claims types.AccessTokenClaims, cfg *config.JWTConfig, lgr *zap.Logger) (string, error) {
+	var token string
+	var err error
+	if signingKey := cfg.GetSigningKey(); signingKey != nil {
+		tkn := jwt.NewWithClaims(jwt.GetSigningMethod(signingKey.GetAlgorithm()), claims)
+		tkn.Header["kid"] = signingKey.GetID()
+		token, err = tkn.SignedString(signingKey.GetPrivateKey())
+	} else {
+		token, err = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(cfg.GetSecret()))
+	}
 	if err != nil {
 		// TODO: Add logging
 		return "", err
 	}
+
+	if cfg.GetFormat() == config.TokenFormatJWE {
+		if token, err = encryptJWE([]byte(token), cfg.GetEncryptionKey()); err != nil {
+			lgr.Debug(fmt.Sprintf("[Utils] [IssueJWT] [encryptJWE] %s", err.Error()))
+			return "", err
+		}
+	}
 	return token, nil
 }
 
-func ValidateJWT(tkn string, secret string, lgr *zap.Logger) (types.AccessTokenClaims, error) {
+// ValidateJWT accepts both JWE and plain JWS tokens so either format can be rolled out without logging everyone out
+// Plain JWS tokens are refused once the format is JWE and the rollover window is closed
+func ValidateJWT(tkn string, cfg *config.JWTConfig, lgr *zap.Logger) (types.AccessTokenClaims, error) {
+	if isJWE(tkn) {
+		payload, err := decryptJWE(tkn, cfg.GetEncryptionKey())
+		if err != nil {
+			lgr.Debug(fmt.Sprintf("[Utils] [ValidateJWT] [decryptJWE] %s", err.Error()))
+			return types.AccessTokenClaims{}, err
+		}
+		tkn = string(payload)
+	} else if !cfg.AcceptsJWS() {
+		return types.AccessTokenClaims{}, errors.New("unencrypted tokens are no longer accepted")
+	}
+
 	token, err := jwt.ParseWithClaims(tkn, &types.AccessTokenClaims{}, func(token *jwt.Token) (interface{}, error) {
-		// Don't forget to validate the alg is what you expect:
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		// HS256 tokens stay valid while JWT_SECRET is set, so switching to an asymmetric key logs nobody out
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+			if cfg.GetSecret() == "" {
+				return nil, errors.New("HMAC signed tokens are not accepted")
+			}
+			return []byte(cfg.GetSecret()), nil
 		}
 
-		// hmacSampleSecret is a []byte containing your secret, e.g. []byte("my_secret_key")
-		return []byte(secret), nil
+		kid, _ := token.Header["kid"].(string)
+		key, ok := cfg.GetVerificationKey(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown key id: %q", kid)
+		}
+
+		// The algorithm is pinned by the key, not by the token header
+		if token.Method.Alg() != key.GetAlgorithm() {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return key.GetPublicKey(), nil
 	})
 
 	if err != nil {
@@ -43,32 +84,49 @@ func ValidateJWT(tkn string, secret string, lgr *zap.Logger) (types.AccessTokenC
 	return types.AccessTokenClaims{}, errors.New("token not okay or invalid or incorrect token claim")
 }
 
-func IssueTokens(userID types.UserID, key []byte, cfg *config.JWTConfig, lgr *zap.Logger) (accessToken string, refreshToken string, err error) {
+// ChallengeTokenTTL is how long a login waits for its second factor
+const ChallengeTokenTTL = time.Minute * 5
+
+// MagicLinkTTL is how long an emailed login link can be redeemed
+const MagicLinkTTL = time.Minute * 15
+
+// RefreshTokenTTL is how long a refresh token, and the session key behind it, stays valid
+const RefreshTokenTTL = time.Hour * 24 * 30
+
+// IssueTokens issues an access token and a refresh token with id refreshTokenID for a session
+// zeroKnowledge is the mode of the user's account, carried in both tokens
+func IssueTokens(userID types.UserID, sessionID string, refreshTokenID string, zeroKnowledge bool, cfg *config.JWTConfig, lgr *zap.Logger) (accessToken string, refreshToken string, err error) {
 	refreshClaims := types.AccessTokenClaims{
 		UserID:        userID,
-		EncryptionKey: key,
+		SessionID:     sessionID,
+		TokenType:     types.TokenTypeRefresh,
+		ZeroKnowledge: zeroKnowledge,
 		StandardClaims: jwt.StandardClaims{
+			Id:        refreshTokenID,
 			NotBefore: time.Now().Unix(),
-			ExpiresAt: time.Now().Add(time.Hour * 24 * 30).Unix(),
+			ExpiresAt: time.Now().Add(RefreshTokenTTL).Unix(),
 		},
 	}
 
 	accessClaims := types.AccessTokenClaims{
 		UserID:        userID,
-		EncryptionKey: key,
+		SessionID:     sessionID,
+		TokenType:     types.TokenTypeAccess,
+		Scopes:        types.SessionScopes,
+		ZeroKnowledge: zeroKnowledge,
 		StandardClaims: jwt.StandardClaims{
 			NotBefore: time.Now().Unix(),
 			ExpiresAt: time.Now().Add(time.Minute * time.Duration(cfg.GetTTL())).Unix(),
 		},
 	}
 
-	refreshToken, err = IssueJWT(refreshClaims, cfg.GetSecret(), lgr)
+	refreshToken, err = IssueJWT(refreshClaims, cfg, lgr)
 	if err != nil {
 		// TODO: Add Logging
 		return "", "", err
 	}
 
-	accessToken, err = IssueJWT(accessClaims, cfg.GetSecret(), lgr)
+	accessToken, err = IssueJWT(accessClaims, cfg, lgr)
 	if err != nil {
 		// TODO: Add Logging
 		return "", "", err
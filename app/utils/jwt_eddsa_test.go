@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSigningMethodEdDSA(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	tkn := jwt.NewWithClaims(SigningMethodEdDSA, jwt.StandardClaims{Subject: "1"})
+	token, err := tkn.SignedString(privateKey)
+	assert.Nil(t, err)
+
+	parsed, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+		return publicKey, nil
+	})
+	assert.Nil(t, err)
+	assert.True(t, parsed.Valid)
+	assert.Equal(t, "EdDSA", parsed.Header["alg"])
+
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	_, err = jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+		return otherKey, nil
+	})
+	assert.NotNil(t, err)
+
+	_, err = tkn.SignedString([]byte("secret"))
+	assert.Equal(t, jwt.ErrInvalidKeyType, err)
+}
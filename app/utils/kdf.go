@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"github.com/sid-sun/arche-api/config"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/sha3"
+)
+
+const kdfSaltSize = 16
+
+// KDFParams are the Argon2id cost parameters a password wrap was derived with
+type KDFParams struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+func NewKDFParams(cfg *config.KDFConfig) KDFParams {
+	return KDFParams{
+		Time:    uint32(cfg.GetTime()),
+		Memory:  uint32(cfg.GetMemory()),
+		Threads: uint8(cfg.GetThreads()),
+	}
+}
+
+func ParseKDFParams(params string) (KDFParams, error) {
+	var p KDFParams
+	if _, err := fmt.Sscanf(params, "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return KDFParams{}, err
+	}
+	return p, nil
+}
+
+func (p KDFParams) String() string {
+	return fmt.Sprintf("m=%d,t=%d,p=%d", p.Memory, p.Time, p.Threads)
+}
+
+// WeakerThan reports whether any cost parameter is lower than in target
+func (p KDFParams) WeakerThan(target KDFParams) bool {
+	return p.Time < target.Time || p.Memory < target.Memory || p.Threads < target.Threads
+}
+
+func GenerateKDFSalt() ([]byte, error) {
+	salt := make([]byte, kdfSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// DeriveWrappingKey derives the key used to wrap a data key from a password
+// Wraps created before Argon2id have no salt and use an unsalted SHA3 hash of the password
+func DeriveWrappingKey(password string, salt []byte, params KDFParams) []byte {
+	if len(salt) == 0 {
+		legacyKey := sha3.Sum256([]byte(password))
+		return legacyKey[:]
+	}
+	return argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, 32)
+}
+
+// DeriveSRPKey derives the SRP private key x = SHA-256(salt | Argon2id(password, salt)) which the verifier is made from
+func DeriveSRPKey(password string, salt []byte, params KDFParams) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write(argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, 32))
+	return h.Sum(nil)
+}
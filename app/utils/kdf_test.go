@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/sha3"
+)
+
+func TestKDFParams(t *testing.T) {
+	params := KDFParams{Time: 3, Memory: 64 * 1024, Threads: 2}
+	assert.Equal(t, "m=65536,t=3,p=2", params.String())
+
+	parsed, err := ParseKDFParams(params.String())
+	assert.Nil(t, err)
+	assert.Equal(t, params, parsed)
+
+	_, err = ParseKDFParams("potato")
+	assert.NotNil(t, err)
+
+	assert.False(t, params.WeakerThan(params))
+	assert.True(t, KDFParams{Time: 1, Memory: 64 * 1024, Threads: 2}.WeakerThan(params))
+}
+
+func TestDeriveWrappingKey(t *testing.T) {
+	legacyKey := sha3.Sum256([]byte("&now:we@pluto"))
+	assert.Equal(t, legacyKey[:], DeriveWrappingKey("&now:we@pluto", nil, KDFParams{}))
+
+	params := KDFParams{Time: 1, Memory: 1024, Threads: 1}
+	salt, err := GenerateKDFSalt()
+	assert.Nil(t, err)
+
+	wrappingKey := DeriveWrappingKey("&now:we@pluto", salt, params)
+	assert.Len(t, wrappingKey, 32)
+	assert.Equal(t, wrappingKey, DeriveWrappingKey("&now:we@pluto", salt, params))
+
+	otherSalt, err := GenerateKDFSalt()
+	assert.Nil(t, err)
+	assert.False(t, bytes.Equal(wrappingKey, DeriveWrappingKey("&now:we@pluto", otherSalt, params)))
+}
+
+func TestDeriveSRPKey(t *testing.T) {
+	params := KDFParams{Time: 1, Memory: 1024, Threads: 1}
+	salt, err := GenerateKDFSalt()
+	assert.Nil(t, err)
+
+	x := DeriveSRPKey("&now:we@pluto", salt, params)
+	assert.Len(t, x, 32)
+	assert.Equal(t, x, DeriveSRPKey("&now:we@pluto", salt, params))
+	assert.False(t, bytes.Equal(x, DeriveWrappingKey("&now:we@pluto", salt, params)))
+}
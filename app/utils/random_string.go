@@ -1,18 +1,41 @@
 package utils
 
 import (
-	"math/rand"
-	"time"
+	crand "crypto/rand"
+	"encoding/base64"
+	"io"
+	"math/big"
+
+	"golang.org/x/crypto/sha3"
 )
 
 var characters = []rune("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
-// RandString generates a random string of n letters long
-func RandString(n int) string {
-	rand.Seed(time.Now().UnixNano())
+// RandString generates a random string of n letters long from crypto/rand
+func RandString(n int) (string, error) {
+	max := big.NewInt(int64(len(characters)))
 	b := make([]rune, n)
 	for i := range b {
-		b[i] = characters[rand.Intn(len(characters))]
+		idx, err := crand.Int(crand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = characters[idx.Int64()]
+	}
+	return string(b), nil
+}
+
+// RandToken generates a url-safe string from n bytes read from crypto/rand
+func RandToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(crand.Reader, b); err != nil {
+		return "", err
 	}
-	return string(b)
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashVerificationToken is what gets stored for an emailed token, the token itself only ever exists in the email
+func HashVerificationToken(token string) string {
+	sum := sha3.Sum256([]byte(token))
+	return base64.StdEncoding.EncodeToString(sum[:])
 }
@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRandString(t *testing.T) {
+	s, err := RandString(12)
+	assert.Nil(t, err)
+	assert.Len(t, s, 12)
+	assert.Regexp(t, "^[0-9a-zA-Z]+$", s)
+
+	other, err := RandString(12)
+	assert.Nil(t, err)
+	assert.NotEqual(t, s, other)
+}
+
+func TestHashVerificationToken(t *testing.T) {
+	assert.Equal(t, HashVerificationToken("abc"), HashVerificationToken("abc"))
+	assert.NotEqual(t, HashVerificationToken("abc"), HashVerificationToken("abd"))
+	assert.NotContains(t, HashVerificationToken("abc"), "abc")
+}
@@ -0,0 +1,36 @@
+package utils
+
+import (
+	crand "crypto/rand"
+	"encoding/base32"
+	"io"
+	"strings"
+)
+
+const (
+	// RecoveryCodeBytes is the entropy of a recovery code, it is the only secret guarding the data key
+	RecoveryCodeBytes = 20
+	recoveryGroupSize = 4
+)
+
+// GenerateRecoveryCode returns a random base32 recovery code split into dash separated groups
+func GenerateRecoveryCode() (string, error) {
+	buf := make([]byte, RecoveryCodeBytes)
+	if _, err := io.ReadFull(crand.Reader, buf); err != nil {
+		return "", err
+	}
+
+	code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf)
+	groups := make([]string, 0, len(code)/recoveryGroupSize+1)
+	for len(code) > recoveryGroupSize {
+		groups = append(groups, code[:recoveryGroupSize])
+		code = code[recoveryGroupSize:]
+	}
+	return strings.Join(append(groups, code), "-"), nil
+}
+
+// NormalizeRecoveryCode strips separators and case so a code can be typed loosely, the result is what keys get wrapped under
+func NormalizeRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code))
+}
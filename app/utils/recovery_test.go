@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateRecoveryCode(t *testing.T) {
+	code, err := GenerateRecoveryCode()
+	assert.Nil(t, err)
+	assert.Len(t, code, 39)
+
+	other, err := GenerateRecoveryCode()
+	assert.Nil(t, err)
+	assert.NotEqual(t, code, other)
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	code, err := GenerateRecoveryCode()
+	assert.Nil(t, err)
+
+	normalized := NormalizeRecoveryCode(code)
+	assert.Len(t, normalized, 32)
+	assert.Equal(t, normalized, NormalizeRecoveryCode(" "+strings.ToLower(code)+" "))
+}
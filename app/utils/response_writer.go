@@ -38,3 +38,15 @@ func WriteSuccessResponse(statusCode int, data interface{}, resp http.ResponseWr
 func WriteFailureResponse(gr resperr.ResponseError, resp http.ResponseWriter, lgr *zap.Logger) {
 	writeAPIResponse(gr.StatusCode(), contract.NewFailureResponse(gr.Description()), resp, lgr)
 }
+
+// WriteJSONResponse writes data as is, without the API envelope, for documents read by standard clients
+func WriteJSONResponse(statusCode int, data interface{}, resp http.ResponseWriter, lgr *zap.Logger) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		lgr.Error(fmt.Sprintf("[Utils] [ResponseWriter] [WriteJSONResponse] [Marshal] %s", err.Error()))
+		writeResponse(http.StatusInternalServerError, []byte("internal server error"), resp, lgr)
+		return
+	}
+
+	writeResponse(statusCode, b, resp, lgr)
+}
@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	// MaxSearchWords caps the distinct words indexed per note
+	MaxSearchWords = 1000
+	// minSearchWordLength leaves out single characters, which would match nearly every note
+	minSearchWordLength = 2
+	searchTokenBytes    = 16
+)
+
+// SearchIndexKey derives the key search tokens are computed with from a user's data key, so the tokens mean
+// nothing without the data key and change when it is rotated
+func SearchIndexKey(key []byte) []byte {
+	mac := hmac.New(sha3.New256, key)
+	mac.Write([]byte("arche:note-search"))
+	return mac.Sum(nil)
+}
+
+// SearchWords splits text into its distinct lower case words of letters and digits in order of first appearance,
+// returning at most limit of them
+func SearchWords(text string, limit int) []string {
+	seen := make(map[string]bool)
+	words := make([]string, 0)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(words) == limit {
+			break
+		}
+		if utf8.RuneCountInString(word) < minSearchWordLength || seen[word] {
+			continue
+		}
+		seen[word] = true
+		words = append(words, word)
+	}
+	return words
+}
+
+// SearchToken is the blind index entry of a word, a truncated HMAC under the index key
+func SearchToken(indexKey []byte, word string) string {
+	mac := hmac.New(sha3.New256, indexKey)
+	mac.Write([]byte(word))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:searchTokenBytes])
+}
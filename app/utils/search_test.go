@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearchWords(t *testing.T) {
+	words := SearchWords("Squirrels, squirrels & more SQUIRRELS: a café-list (2nd draft)", MaxSearchWords)
+	assert.Equal(t, []string{"squirrels", "more", "café", "list", "2nd", "draft"}, words)
+
+	assert.Equal(t, []string{"squirrels", "more"}, SearchWords("squirrels more café", 2))
+	assert.Empty(t, SearchWords(" a - b ", MaxSearchWords))
+}
+
+func TestSearchToken(t *testing.T) {
+	key, _, err := GenerateEncryptionKey(nil)
+	assert.Nil(t, err)
+	otherKey, _, err := GenerateEncryptionKey(nil)
+	assert.Nil(t, err)
+
+	indexKey := SearchIndexKey(key)
+	token := SearchToken(indexKey, "squirrel")
+	assert.Len(t, token, 22)
+	assert.Equal(t, token, SearchToken(SearchIndexKey(key), "squirrel"))
+	assert.NotEqual(t, token, SearchToken(indexKey, "squirrels"))
+	assert.NotEqual(t, token, SearchToken(SearchIndexKey(otherKey), "squirrel"))
+}
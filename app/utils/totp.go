@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// RFC 6238 parameters, these are the defaults every authenticator app understands
+const (
+	TOTPPeriod = 30
+	TOTPDigits = 6
+	// TOTPSkew is how many periods either side of now a code is still accepted for
+	TOTPSkew = 1
+)
+
+const backupCodeAlphabet = "abcdefghijkmnpqrstuvwxyz23456789"
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a 160 bit secret, the size RFC 4226 recommends for HMAC-SHA1
+func GenerateTOTPSecret() ([]byte, error) {
+	secret := make([]byte, 20)
+	if _, err := io.ReadFull(crand.Reader, secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// EncodeTOTPSecret is the base32 form authenticator apps expect
+func EncodeTOTPSecret(secret []byte) string {
+	return totpEncoding.EncodeToString(secret)
+}
+
+func DecodeTOTPSecret(encoded string) ([]byte, error) {
+	return totpEncoding.DecodeString(encoded)
+}
+
+// TOTPURI builds the otpauth:// URI usually shown as a QR code
+func TOTPURI(issuer string, account string, secret []byte) string {
+	params := url.Values{}
+	params.Set("secret", EncodeTOTPSecret(secret))
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(TOTPDigits))
+	params.Set("period", fmt.Sprint(TOTPPeriod))
+
+	return fmt.Sprintf("otpauth://totp/%s?%s", url.PathEscape(issuer+":"+account), params.Encode())
+}
+
+// TOTPStep is the RFC 6238 time step t falls in
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / TOTPPeriod
+}
+
+// TOTPCode computes the HOTP value (RFC 4226) of secret for a time step
+func TOTPCode(secret []byte, step int64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// VerifyTOTP checks code against the steps around t and returns the step it matched
+func VerifyTOTP(secret []byte, code string, t time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != TOTPDigits {
+		return 0, false
+	}
+
+	now := TOTPStep(t)
+	for step := now - TOTPSkew; step <= now+TOTPSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(TOTPCode(secret, step, TOTPDigits)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// GenerateBackupCodes returns n single-use codes of ten characters, avoiding look-alike characters
+func GenerateBackupCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	buf := make([]byte, 10)
+	for i := range codes {
+		if _, err := io.ReadFull(crand.Reader, buf); err != nil {
+			return nil, err
+		}
+		for j, b := range buf {
+			buf[j] = backupCodeAlphabet[int(b)%len(backupCodeAlphabet)]
+		}
+		codes[i] = string(buf)
+	}
+	return codes, nil
+}
+
+// HashBackupCode is what gets stored for a backup code, codes are normalised so they can be typed loosely
+func HashBackupCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha3.Sum256([]byte(code))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
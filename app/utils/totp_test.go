@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// SHA1 test vectors from RFC 6238 Appendix B
+	secret := []byte("12345678901234567890")
+
+	assert.Equal(t, "94287082", TOTPCode(secret, TOTPStep(time.Unix(59, 0)), 8))
+	assert.Equal(t, "07081804", TOTPCode(secret, TOTPStep(time.Unix(1111111109, 0)), 8))
+	assert.Equal(t, "14050471", TOTPCode(secret, TOTPStep(time.Unix(1111111111, 0)), 8))
+	assert.Equal(t, "89005924", TOTPCode(secret, TOTPStep(time.Unix(1234567890, 0)), 8))
+	assert.Equal(t, "69279037", TOTPCode(secret, TOTPStep(time.Unix(2000000000, 0)), 8))
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	assert.Nil(t, err)
+
+	now := time.Now()
+	code := TOTPCode(secret, TOTPStep(now), TOTPDigits)
+
+	step, ok := VerifyTOTP(secret, code, now)
+	assert.True(t, ok)
+	assert.Equal(t, TOTPStep(now), step)
+
+	_, ok = VerifyTOTP(secret, code, now.Add(TOTPPeriod*time.Second))
+	assert.True(t, ok)
+
+	_, ok = VerifyTOTP(secret, code, now.Add(3*TOTPPeriod*time.Second))
+	assert.False(t, ok)
+
+	_, ok = VerifyTOTP(secret, "12345", now)
+	assert.False(t, ok)
+}
+
+func TestBackupCodes(t *testing.T) {
+	codes, err := GenerateBackupCodes(10)
+	assert.Nil(t, err)
+	assert.Len(t, codes, 10)
+
+	for _, code := range codes {
+		assert.Len(t, code, 10)
+	}
+	assert.Equal(t, HashBackupCode(codes[0]), HashBackupCode(" "+codes[0][:5]+"-"+codes[0][5:]+" "))
+	assert.NotEqual(t, HashBackupCode(codes[0]), HashBackupCode(codes[1]))
+}
@@ -0,0 +1,259 @@
+// Package webauthn verifies WebAuthn registration and assertion responses.
+//
+// Clients send the credential public key as SubjectPublicKeyInfo DER, which browsers expose through
+// AuthenticatorAttestationResponse.getPublicKey(), so no CBOR has to be parsed. Attestation statements
+// are not verified, the same as requesting attestation "none".
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// COSE algorithm identifiers of the supported credential keys
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+const (
+	TypeCreate = "webauthn.create"
+	TypeGet    = "webauthn.get"
+)
+
+const (
+	flagUserPresent            = 0x01
+	flagUserVerified           = 0x04
+	flagAttestedCredentialData = 0x40
+)
+
+var (
+	ErrMalformed            = errors.New("webauthn: malformed response")
+	ErrTypeMismatch         = errors.New("webauthn: unexpected ceremony type")
+	ErrChallengeMismatch    = errors.New("webauthn: challenge does not match")
+	ErrOriginMismatch       = errors.New("webauthn: origin does not match")
+	ErrRPIDMismatch         = errors.New("webauthn: relying party id does not match")
+	ErrUserNotPresent       = errors.New("webauthn: user presence flag not set")
+	ErrUserNotVerified      = errors.New("webauthn: user verification flag not set")
+	ErrCredentialMismatch   = errors.New("webauthn: credential id does not match")
+	ErrUnsupportedAlgorithm = errors.New("webauthn: unsupported public key algorithm")
+	ErrInvalidSignature     = errors.New("webauthn: invalid signature")
+	ErrSignCount            = errors.New("webauthn: signature counter did not increase, authenticator may be cloned")
+)
+
+// RelyingParty is this server as seen by authenticators
+type RelyingParty struct {
+	ID     string
+	Origin string
+}
+
+// AuthenticatorData is the parsed authenticatorData structure, CredentialID is only set during registration
+type AuthenticatorData struct {
+	RPIDHash     []byte
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+}
+
+func (a AuthenticatorData) UserVerified() bool {
+	return a.Flags&flagUserVerified != 0
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// ParseAuthenticatorData reads the fixed header and, when present, the credential id of the attested credential data
+func ParseAuthenticatorData(data []byte) (AuthenticatorData, error) {
+	if len(data) < 37 {
+		return AuthenticatorData{}, ErrMalformed
+	}
+
+	authData := AuthenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	if authData.Flags&flagAttestedCredentialData != 0 {
+		// aaguid (16) | credential id length (2) | credential id | credential public key
+		if len(data) < 55 {
+			return AuthenticatorData{}, ErrMalformed
+		}
+		idLen := int(binary.BigEndian.Uint16(data[53:55]))
+		if len(data) < 55+idLen {
+			return AuthenticatorData{}, ErrMalformed
+		}
+		authData.CredentialID = data[55 : 55+idLen]
+	}
+
+	return authData, nil
+}
+
+// ParsePublicKey parses a SubjectPublicKeyInfo and checks it is of the kind alg says
+func ParsePublicKey(der []byte, alg int) (crypto.PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, ErrMalformed
+	}
+
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if alg == AlgES256 && k.Curve.Params().BitSize == 256 {
+			return k, nil
+		}
+	case ed25519.PublicKey:
+		if alg == AlgEdDSA {
+			return k, nil
+		}
+	case *rsa.PublicKey:
+		if alg == AlgRS256 && k.N.BitLen() >= 2048 {
+			return k, nil
+		}
+	}
+	return nil, ErrUnsupportedAlgorithm
+}
+
+// VerifyRegistration checks a navigator.credentials.create() response against the challenge it was issued for
+func VerifyRegistration(rp RelyingParty, challenge []byte, clientDataJSON []byte, authenticatorData []byte,
+	credentialID []byte, publicKey []byte, alg int, requireUV bool) (AuthenticatorData, error) {
+	if err := verifyClientData(rp, TypeCreate, challenge, clientDataJSON); err != nil {
+		return AuthenticatorData{}, err
+	}
+
+	authData, err := verifyAuthenticatorData(rp, authenticatorData, requireUV)
+	if err != nil {
+		return AuthenticatorData{}, err
+	}
+
+	if subtle.ConstantTimeCompare(authData.CredentialID, credentialID) != 1 {
+		return AuthenticatorData{}, ErrCredentialMismatch
+	}
+
+	if _, err = ParsePublicKey(publicKey, alg); err != nil {
+		return AuthenticatorData{}, err
+	}
+
+	return authData, nil
+}
+
+// VerifyAssertion checks a navigator.credentials.get() response against the challenge and the stored credential.
+// Callers have to compare the returned sign count with the stored one, see CheckSignCount
+func VerifyAssertion(rp RelyingParty, challenge []byte, clientDataJSON []byte, authenticatorData []byte,
+	signature []byte, publicKey []byte, alg int, requireUV bool) (AuthenticatorData, error) {
+	if err := verifyClientData(rp, TypeGet, challenge, clientDataJSON); err != nil {
+		return AuthenticatorData{}, err
+	}
+
+	authData, err := verifyAuthenticatorData(rp, authenticatorData, requireUV)
+	if err != nil {
+		return AuthenticatorData{}, err
+	}
+
+	key, err := ParsePublicKey(publicKey, alg)
+	if err != nil {
+		return AuthenticatorData{}, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authenticatorData...), clientDataHash[:]...)
+
+	if !verifySignature(key, signed, signature) {
+		return AuthenticatorData{}, ErrInvalidSignature
+	}
+
+	return authData, nil
+}
+
+// CheckSignCount rejects counters which did not move forward, authenticators which don't count always report zero
+func CheckSignCount(stored uint32, received uint32) error {
+	if (stored != 0 || received != 0) && received <= stored {
+		return ErrSignCount
+	}
+	return nil
+}
+
+func verifyClientData(rp RelyingParty, ceremonyType string, challenge []byte, clientDataJSON []byte) error {
+	var cd clientData
+	if err := json.Unmarshal(clientDataJSON, &cd); err != nil {
+		return ErrMalformed
+	}
+
+	if cd.Type != ceremonyType {
+		return ErrTypeMismatch
+	}
+
+	received, err := base64.RawURLEncoding.DecodeString(cd.Challenge)
+	if err != nil || subtle.ConstantTimeCompare(received, challenge) != 1 {
+		return ErrChallengeMismatch
+	}
+
+	if cd.Origin != rp.Origin {
+		return ErrOriginMismatch
+	}
+	return nil
+}
+
+func verifyAuthenticatorData(rp RelyingParty, authenticatorData []byte, requireUV bool) (AuthenticatorData, error) {
+	authData, err := ParseAuthenticatorData(authenticatorData)
+	if err != nil {
+		return AuthenticatorData{}, err
+	}
+
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if subtle.ConstantTimeCompare(authData.RPIDHash, rpIDHash[:]) != 1 {
+		return AuthenticatorData{}, ErrRPIDMismatch
+	}
+
+	if authData.Flags&flagUserPresent == 0 {
+		return AuthenticatorData{}, ErrUserNotPresent
+	}
+	if requireUV && !authData.UserVerified() {
+		return AuthenticatorData{}, ErrUserNotVerified
+	}
+
+	return authData, nil
+}
+
+func verifySignature(key crypto.PublicKey, signed []byte, signature []byte) bool {
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		return ecdsa.VerifyASN1(k, digest[:], signature)
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, signed, signature)
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature) == nil
+	}
+	return false
+}
+
+// PRFWrappingKey derives the key which wraps the data key from a prf extension output.
+// The output never leaves the authenticator without user presence, so the wrap can only be opened with the passkey
+func PRFWrappingKey(prfOutput []byte, prfSalt []byte) ([]byte, error) {
+	if len(prfOutput) != 32 {
+		return nil, ErrMalformed
+	}
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, prfOutput, prfSalt, []byte("arche-api webauthn prf key wrap")), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,104 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testRP = RelyingParty{ID: "example.com", Origin: "https://example.com"}
+
+func clientDataFor(t *testing.T, ceremonyType string, challenge []byte, origin string) []byte {
+	data, err := json.Marshal(clientData{
+		Type:      ceremonyType,
+		Challenge: base64.RawURLEncoding.EncodeToString(challenge),
+		Origin:    origin,
+	})
+	assert.Nil(t, err)
+	return data
+}
+
+func authenticatorDataFor(rpID string, flags byte, signCount uint32, credentialID []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags)
+	data = append(data, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], signCount)
+
+	if credentialID != nil {
+		data = append(data, make([]byte, 16)...)
+		data = append(data, byte(len(credentialID)>>8), byte(len(credentialID)))
+		data = append(data, credentialID...)
+	}
+	return data
+}
+
+func TestRegistrationAndAssertion(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.Nil(t, err)
+
+	challenge := []byte("registration challenge of 32 b..")
+	credentialID := []byte("credential-1")
+
+	clientDataJSON := clientDataFor(t, TypeCreate, challenge, testRP.Origin)
+	authData := authenticatorDataFor(testRP.ID, flagUserPresent|flagUserVerified|flagAttestedCredentialData, 0, credentialID)
+
+	_, err = VerifyRegistration(testRP, challenge, clientDataJSON, authData, credentialID, publicKey, AlgES256, true)
+	assert.Nil(t, err)
+
+	_, err = VerifyRegistration(testRP, challenge, clientDataJSON, authData, []byte("other"), publicKey, AlgES256, true)
+	assert.Equal(t, ErrCredentialMismatch, err)
+
+	_, err = VerifyRegistration(testRP, challenge, clientDataJSON, authData, credentialID, publicKey, AlgRS256, true)
+	assert.Equal(t, ErrUnsupportedAlgorithm, err)
+
+	challenge = []byte("assertion challenge of 32 bytes.")
+	clientDataJSON = clientDataFor(t, TypeGet, challenge, testRP.Origin)
+	authData = authenticatorDataFor(testRP.ID, flagUserPresent, 7, nil)
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	assert.Nil(t, err)
+
+	got, err := VerifyAssertion(testRP, challenge, clientDataJSON, authData, signature, publicKey, AlgES256, false)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(7), got.SignCount)
+	assert.Nil(t, CheckSignCount(6, got.SignCount))
+	assert.Equal(t, ErrSignCount, CheckSignCount(7, got.SignCount))
+
+	_, err = VerifyAssertion(testRP, challenge, clientDataJSON, authData, signature, publicKey, AlgES256, true)
+	assert.Equal(t, ErrUserNotVerified, err)
+
+	signature[len(signature)-1] ^= 1
+	_, err = VerifyAssertion(testRP, challenge, clientDataJSON, authData, signature, publicKey, AlgES256, false)
+	assert.Equal(t, ErrInvalidSignature, err)
+}
+
+func TestClientDataChecks(t *testing.T) {
+	challenge := []byte("challenge")
+	authData := authenticatorDataFor(testRP.ID, flagUserPresent, 0, nil)
+
+	_, err := VerifyAssertion(testRP, challenge, clientDataFor(t, TypeCreate, challenge, testRP.Origin), authData, nil, nil, AlgES256, false)
+	assert.Equal(t, ErrTypeMismatch, err)
+
+	_, err = VerifyAssertion(testRP, challenge, clientDataFor(t, TypeGet, []byte("other"), testRP.Origin), authData, nil, nil, AlgES256, false)
+	assert.Equal(t, ErrChallengeMismatch, err)
+
+	_, err = VerifyAssertion(testRP, challenge, clientDataFor(t, TypeGet, challenge, "https://evil.example"), authData, nil, nil, AlgES256, false)
+	assert.Equal(t, ErrOriginMismatch, err)
+
+	otherRP := authenticatorDataFor("evil.example", flagUserPresent, 0, nil)
+	_, err = VerifyAssertion(testRP, challenge, clientDataFor(t, TypeGet, challenge, testRP.Origin), otherRP, nil, nil, AlgES256, false)
+	assert.Equal(t, ErrRPIDMismatch, err)
+}
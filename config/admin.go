@@ -0,0 +1,15 @@
+package config
+
+// AdminConfig guards the operator endpoints, they are disabled without a token
+type AdminConfig struct {
+	token string
+}
+
+func (a *AdminConfig) Enabled() bool {
+	return a.token != ""
+}
+
+// GetToken is the bearer token operators authenticate with
+func (a *AdminConfig) GetToken() string {
+	return a.token
+}
@@ -1,7 +1,13 @@
 package config
 
 import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
 	"github.com/spf13/viper"
+	"golang.org/x/crypto/sha3"
 )
 
 type Config struct {
@@ -9,6 +15,13 @@ type Config struct {
 	HTTP        HTTPServerConfig
 	DBConfig    *DBConfig
 	JWT         *JWTConfig
+	KDF         *KDFConfig
+	Sessions    *SessionStoreConfig
+	WebAuthn    *WebAuthnConfig
+	OIDC        *OIDCConfig
+	Throttle    *ThrottleConfig
+	Decoy       *DecoyConfig
+	Admin       *AdminConfig
 	EmailConfig *EmailConfig
 	VECfg       *VerificationEmailConfig
 }
@@ -22,6 +35,9 @@ func Load() (*Config, error) {
 	viper.AddConfigPath(".")
 	viper.SetConfigType("toml")
 	viper.AutomaticEnv()
+	viper.SetDefault("JWT_FORMAT", TokenFormatJWS)
+	viper.SetDefault("JWT_ACCEPT_JWS", true)
+	viper.SetDefault("WEBAUTHN_RP_NAME", "Arche")
 
 	if err := viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
@@ -34,6 +50,56 @@ func Load() (*Config, error) {
 		ttl = 15
 	}
 
+	jwtFormat := viper.GetString("JWT_FORMAT")
+	if jwtFormat != TokenFormatJWS && jwtFormat != TokenFormatJWE {
+		return nil, fmt.Errorf("unknown JWT_FORMAT %q", jwtFormat)
+	}
+
+	// Without an explicit key the JWE key is derived from the signing secret
+	jweKey := sha3.Sum256([]byte("jwe:" + viper.GetString("JWT_SECRET")))
+	jwtEncryptionKey := jweKey[:]
+	if encoded := viper.GetString("JWT_ENCRYPTION_KEY"); encoded != "" {
+		var err error
+		if jwtEncryptionKey, err = base64.StdEncoding.DecodeString(encoded); err != nil || len(jwtEncryptionKey) != 32 {
+			return nil, errors.New("JWT_ENCRYPTION_KEY must be 32 bytes encoded in base64")
+		}
+	}
+
+	// Keys of earlier rotations stay listed in JWT_VERIFICATION_KEY_FILES until their tokens have expired
+	var verificationKeyFiles []string
+	for _, file := range strings.Split(viper.GetString("JWT_VERIFICATION_KEY_FILES"), ",") {
+		if file = strings.TrimSpace(file); file != "" {
+			verificationKeyFiles = append(verificationKeyFiles, file)
+		}
+	}
+
+	jwtSigningKey, jwtVerificationKeys, err := loadJWTKeys(viper.GetString("JWT_SIGNING_KEY_FILE"), verificationKeyFiles)
+	if err != nil {
+		return nil, fmt.Errorf("could not load JWT keys: %w", err)
+	}
+
+	if viper.GetString("OIDC_ISSUER") != "" && (viper.GetString("OIDC_CLIENT_ID") == "" || viper.GetString("OIDC_REDIRECT_URL") == "") {
+		return nil, errors.New("OIDC_CLIENT_ID and OIDC_REDIRECT_URL are required when OIDC_ISSUER is set")
+	}
+
+	sessionStore := viper.GetString("SESSION_STORE")
+	if sessionStore == "" {
+		sessionStore = SessionStoreMemory
+	}
+	if sessionStore == SessionStoreShared && viper.GetString("SESSION_STORE_SECRET") == "" {
+		return nil, errors.New("SESSION_STORE_SECRET is required for the shared session store")
+	}
+
+	// Without an explicit secret the decoy key is derived from the signing secret
+	decoySecret := viper.GetString("DECOY_SECRET")
+	if decoySecret == "" {
+		decoySecret = viper.GetString("JWT_SECRET")
+	}
+	if decoySecret == "" {
+		return nil, errors.New("DECOY_SECRET is required when JWT_SECRET is not set")
+	}
+	decoyKey := sha3.Sum256([]byte("decoy:" + decoySecret))
+
 	return &Config{
 		env: viper.GetString("APP_ENV"),
 		HTTP: HTTPServerConfig{
@@ -48,13 +114,41 @@ func Load() (*Config, error) {
 			database: viper.GetString("DB_DATABASE"),
 		},
 		JWT: &JWTConfig{
-			secret: viper.GetString("JWT_SECRET"),
-			ttl:    ttl,
+			secret:           viper.GetString("JWT_SECRET"),
+			ttl:              ttl,
+			format:           jwtFormat,
+			encryptionKey:    jwtEncryptionKey,
+			acceptJWS:        viper.GetBool("JWT_ACCEPT_JWS"),
+			signingKey:       jwtSigningKey,
+			verificationKeys: jwtVerificationKeys,
+		},
+		KDF: newKDFConfig(viper.GetInt("KDF_TIME"), viper.GetInt("KDF_MEMORY"), viper.GetInt("KDF_THREADS")),
+		Sessions: &SessionStoreConfig{
+			backend: sessionStore,
+			secret:  viper.GetString("SESSION_STORE_SECRET"),
+		},
+		WebAuthn: &WebAuthnConfig{
+			rpID:   viper.GetString("WEBAUTHN_RP_ID"),
+			rpName: viper.GetString("WEBAUTHN_RP_NAME"),
+			origin: viper.GetString("WEBAUTHN_ORIGIN"),
+		},
+		OIDC: &OIDCConfig{
+			issuer:       viper.GetString("OIDC_ISSUER"),
+			clientID:     viper.GetString("OIDC_CLIENT_ID"),
+			clientSecret: viper.GetString("OIDC_CLIENT_SECRET"),
+			redirectURL:  viper.GetString("OIDC_REDIRECT_URL"),
+		},
+		Throttle: newThrottleConfig(viper.GetString("THROTTLE_STORE"), viper.GetInt("LOGIN_MAX_FAILURES"), viper.GetInt("LOGIN_LOCKOUT_MINUTES")),
+		Decoy: &DecoyConfig{
+			key: decoyKey[:],
+		},
+		Admin: &AdminConfig{
+			token: viper.GetString("ADMIN_API_TOKEN"),
 		},
 		EmailConfig: &EmailConfig{
 			domain: viper.GetString("MG_DOMAIN"),
 			apiKey: viper.GetString("MG_API_KEY"),
 		},
-		VECfg: newDefaultVEConfig(),
+		VECfg: newDefaultVEConfig(viper.GetInt("VERIFICATION_TOKEN_TTL"), viper.GetString("LOGIN_LINK_URL"), viper.GetString("UNLOCK_LINK_URL")),
 	}, nil
 }
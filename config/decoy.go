@@ -0,0 +1,12 @@
+package config
+
+// DecoyConfig holds the key the answers for addresses without an account are derived from, such as SRP salts and
+// passkey ids, it has to be the same across restarts and instances or those answers would tell such addresses apart
+type DecoyConfig struct {
+	key []byte
+}
+
+// GetKey is the key the answers for addresses without an account are derived from
+func (d *DecoyConfig) GetKey() []byte {
+	return d.key
+}
@@ -1,8 +1,32 @@
 package config
 
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	TokenFormatJWS = "jws"
+	TokenFormatJWE = "jwe"
+)
+
 type JWTConfig struct {
-	secret string
-	ttl    int
+	secret        string
+	ttl           int
+	format        string
+	encryptionKey []byte
+	acceptJWS     bool
+	// signingKey and verificationKeys are only set when tokens are signed with an asymmetric key
+	signingKey       *JWTKey
+	verificationKeys []*JWTKey
 }
 
 func (j JWTConfig) GetSecret() string {
@@ -12,3 +36,178 @@ func (j JWTConfig) GetSecret() string {
 func (j JWTConfig) GetTTL() int {
 	return j.ttl
 }
+
+// GetFormat is the format new tokens are issued in, either TokenFormatJWS or TokenFormatJWE
+func (j JWTConfig) GetFormat() string {
+	return j.format
+}
+
+// GetEncryptionKey is the 256-bit content encryption key for JWE tokens
+func (j JWTConfig) GetEncryptionKey() []byte {
+	return j.encryptionKey
+}
+
+// AcceptsJWS reports whether plain signed tokens are still accepted
+// JWE tokens are always accepted so the format can be rolled over in either direction
+func (j JWTConfig) AcceptsJWS() bool {
+	return j.format != TokenFormatJWE || j.acceptJWS
+}
+
+const (
+	JWTAlgEdDSA = "EdDSA"
+	JWTAlgRS256 = "RS256"
+)
+
+// JWTKey is an asymmetric key tokens are signed or verified with
+type JWTKey struct {
+	id         string
+	algorithm  string
+	privateKey crypto.PrivateKey
+	publicKey  crypto.PublicKey
+}
+
+// GetID is the kid put in the header of tokens signed with the key, it is derived from the public key
+func (k *JWTKey) GetID() string {
+	return k.id
+}
+
+// GetAlgorithm is either JWTAlgEdDSA or JWTAlgRS256
+func (k *JWTKey) GetAlgorithm() string {
+	return k.algorithm
+}
+
+// GetPrivateKey is nil for keys only kept to verify tokens
+func (k *JWTKey) GetPrivateKey() crypto.PrivateKey {
+	return k.privateKey
+}
+
+// GetPublicKey is either an ed25519.PublicKey or an *rsa.PublicKey
+func (k *JWTKey) GetPublicKey() crypto.PublicKey {
+	return k.publicKey
+}
+
+// GetSigningKey is the key new tokens are signed with, tokens are signed with HS256
+// and the secret when it is nil
+func (j JWTConfig) GetSigningKey() *JWTKey {
+	return j.signingKey
+}
+
+// GetVerificationKey looks up a key by the kid of a token, the signing key is always one of them
+func (j JWTConfig) GetVerificationKey(id string) (*JWTKey, bool) {
+	return findJWTKey(j.verificationKeys, id)
+}
+
+// GetVerificationKeys are the public keys tokens are accepted from, they are published as the JWKS
+func (j JWTConfig) GetVerificationKeys() []*JWTKey {
+	return j.verificationKeys
+}
+
+// loadJWTKeys reads the PEM encoded signing key and any keys only kept to verify tokens signed before a rotation
+func loadJWTKeys(signingKeyFile string, verificationKeyFiles []string) (*JWTKey, []*JWTKey, error) {
+	var signingKey *JWTKey
+	var verificationKeys []*JWTKey
+
+	if signingKeyFile != "" {
+		block, err := readPEM(signingKeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		privateKey, err := parsePrivateKey(block)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", signingKeyFile, err)
+		}
+
+		signer, ok := privateKey.(crypto.Signer)
+		if !ok {
+			return nil, nil, fmt.Errorf("%s: key cannot sign", signingKeyFile)
+		}
+
+		if signingKey, err = newJWTKey(privateKey, signer.Public()); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", signingKeyFile, err)
+		}
+		verificationKeys = append(verificationKeys, signingKey)
+	}
+
+	for _, file := range verificationKeyFiles {
+		block, err := readPEM(file)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", file, err)
+		}
+
+		key, err := newJWTKey(nil, publicKey)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", file, err)
+		}
+
+		// The signing key may be listed again, it is already known
+		if _, ok := findJWTKey(verificationKeys, key.id); !ok {
+			verificationKeys = append(verificationKeys, key)
+		}
+	}
+
+	return signingKey, verificationKeys, nil
+}
+
+func findJWTKey(keys []*JWTKey, id string) (*JWTKey, bool) {
+	for _, key := range keys {
+		if key.id == id {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+func readPEM(file string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", file)
+	}
+	return block, nil
+}
+
+// parsePrivateKey accepts PKCS #8 keys, as written by openssl genpkey, and PKCS #1 RSA keys
+func parsePrivateKey(block *pem.Block) (crypto.PrivateKey, error) {
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+func newJWTKey(privateKey crypto.PrivateKey, publicKey crypto.PublicKey) (*JWTKey, error) {
+	var algorithm string
+	switch key := publicKey.(type) {
+	case ed25519.PublicKey:
+		algorithm = JWTAlgEdDSA
+	case *rsa.PublicKey:
+		if key.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		algorithm = JWTAlgRS256
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, use Ed25519 or RSA", publicKey)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+
+	return &JWTKey{
+		id:         base64.RawURLEncoding.EncodeToString(sum[:12]),
+		algorithm:  algorithm,
+		privateKey: privateKey,
+		publicKey:  publicKey,
+	}, nil
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writePEM(t *testing.T, dir string, name string, blockType string, der []byte) string {
+	file := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+	return file
+}
+
+func TestLoadJWTKeys(t *testing.T) {
+	dir := t.TempDir()
+
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(edPrivate)
+	assert.Nil(t, err)
+	signingFile := writePEM(t, dir, "signing.pem", "PRIVATE KEY", der)
+	der, err = x509.MarshalPKIXPublicKey(edPublic)
+	assert.Nil(t, err)
+	signingPublicFile := writePEM(t, dir, "signing.pub.pem", "PUBLIC KEY", der)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	der, err = x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	assert.Nil(t, err)
+	previousFile := writePEM(t, dir, "previous.pub.pem", "PUBLIC KEY", der)
+
+	signingKey, verificationKeys, err := loadJWTKeys(signingFile, []string{previousFile, signingPublicFile})
+	assert.Nil(t, err)
+	assert.Equal(t, JWTAlgEdDSA, signingKey.GetAlgorithm())
+	assert.NotNil(t, signingKey.GetPrivateKey())
+
+	// The signing key listed again as a verification key is not duplicated
+	assert.Len(t, verificationKeys, 2)
+	assert.Equal(t, signingKey.GetID(), verificationKeys[0].GetID())
+	assert.Equal(t, JWTAlgRS256, verificationKeys[1].GetAlgorithm())
+	assert.Nil(t, verificationKeys[1].GetPrivateKey())
+
+	smallKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.Nil(t, err)
+	smallFile := writePEM(t, dir, "small.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(smallKey))
+	_, _, err = loadJWTKeys(smallFile, nil)
+	assert.NotNil(t, err)
+
+	signingKey, verificationKeys, err = loadJWTKeys("", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, signingKey)
+	assert.Empty(t, verificationKeys)
+}
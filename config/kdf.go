@@ -0,0 +1,39 @@
+package config
+
+type KDFConfig struct {
+	time    int
+	memory  int
+	threads int
+}
+
+func newKDFConfig(time, memory, threads int) *KDFConfig {
+	if time == 0 {
+		time = 3
+	}
+	if memory == 0 {
+		memory = 64 * 1024
+	}
+	if threads == 0 {
+		threads = 2
+	}
+
+	return &KDFConfig{
+		time:    time,
+		memory:  memory,
+		threads: threads,
+	}
+}
+
+// GetTime is the number of Argon2id passes over memory
+func (k *KDFConfig) GetTime() int {
+	return k.time
+}
+
+// GetMemory is the Argon2id memory cost in KiB
+func (k *KDFConfig) GetMemory() int {
+	return k.memory
+}
+
+func (k *KDFConfig) GetThreads() int {
+	return k.threads
+}
@@ -0,0 +1,32 @@
+package config
+
+// OIDCConfig is the OpenID Connect provider users can sign in with, it is disabled without an issuer
+type OIDCConfig struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+}
+
+func (o *OIDCConfig) Enabled() bool {
+	return o.issuer != ""
+}
+
+// GetIssuer is the provider's issuer identifier, its metadata is discovered from there
+func (o *OIDCConfig) GetIssuer() string {
+	return o.issuer
+}
+
+func (o *OIDCConfig) GetClientID() string {
+	return o.clientID
+}
+
+// GetClientSecret may be empty for public clients, which rely on PKCE alone
+func (o *OIDCConfig) GetClientSecret() string {
+	return o.clientSecret
+}
+
+// GetRedirectURL is the page of the web app the provider sends the user back to with the code
+func (o *OIDCConfig) GetRedirectURL() string {
+	return o.redirectURL
+}
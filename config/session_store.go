@@ -0,0 +1,20 @@
+package config
+
+const (
+	SessionStoreMemory = "memory"
+	SessionStoreShared = "shared"
+)
+
+type SessionStoreConfig struct {
+	backend string
+	secret  string
+}
+
+func (s *SessionStoreConfig) GetBackend() string {
+	return s.backend
+}
+
+// GetSecret is used to seal keys written to the shared session store
+func (s *SessionStoreConfig) GetSecret() string {
+	return s.secret
+}
@@ -0,0 +1,46 @@
+package config
+
+import "time"
+
+const (
+	ThrottleStoreMemory = "memory"
+	ThrottleStoreSQL    = "sql"
+)
+
+type ThrottleConfig struct {
+	backend     string
+	maxFailures int
+	lockout     time.Duration
+}
+
+func newThrottleConfig(backend string, maxFailures int, lockoutMinutes int) *ThrottleConfig {
+	if backend == "" {
+		backend = ThrottleStoreMemory
+	}
+	if maxFailures == 0 {
+		maxFailures = 10
+	}
+	if lockoutMinutes == 0 {
+		lockoutMinutes = 30
+	}
+
+	return &ThrottleConfig{
+		backend:     backend,
+		maxFailures: maxFailures,
+		lockout:     time.Duration(lockoutMinutes) * time.Minute,
+	}
+}
+
+// GetBackend is where failed logins are counted, the SQL store is needed once there is more than one instance
+func (t *ThrottleConfig) GetBackend() string {
+	return t.backend
+}
+
+// GetMaxFailures is how many failed logins of an account lock it out
+func (t *ThrottleConfig) GetMaxFailures() int {
+	return t.maxFailures
+}
+
+func (t *ThrottleConfig) GetLockoutDuration() time.Duration {
+	return t.lockout
+}
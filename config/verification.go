@@ -1,6 +1,9 @@
 package config
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 type VerificationEmailConfig struct {
 	senderName     string
@@ -8,10 +11,33 @@ type VerificationEmailConfig struct {
 	emailSubject   string
 	emailBody      string
 	tokenLength    int
+	tokenTTL       time.Duration
+	// loginLinkURL is where login links point, it is never taken from a request
+	loginLinkURL string
+	// unlockLinkURL is where lockout emails point, never the failing request's callback which an attacker controls
+	unlockLinkURL string
+
+	recoverySubject    string
+	recoveryBody       string
+	deletionSubject    string
+	deletionBody       string
+	emailChangeSubject string
+	emailChangeBody    string
+	magicLinkSubject   string
+	magicLinkBody      string
+	unlockSubject      string
+	unlockBody         string
 }
 
-func newDefaultVEConfig() *VerificationEmailConfig {
+func newDefaultVEConfig(tokenTTL int, loginLinkURL string, unlockLinkURL string) *VerificationEmailConfig {
+	if tokenTTL == 0 {
+		tokenTTL = 24 * 60
+	}
+
 	return &VerificationEmailConfig{
+		tokenTTL:       time.Duration(tokenTTL) * time.Minute,
+		loginLinkURL:   loginLinkURL,
+		unlockLinkURL:  unlockLinkURL,
 		senderName:     "OnlyNotes",
 		senderUsername: "no-reply",
 		emailSubject:   "Verify your sign-up and get started!",
@@ -25,6 +51,55 @@ func newDefaultVEConfig() *VerificationEmailConfig {
 		%s
 
 		That's all for now, Cheers!
+	`,
+		recoverySubject: "Your OnlyNotes password was reset",
+		recoveryBody: `
+		Hey!
+
+		The password of your OnlyNotes account was just reset with your recovery code.
+		Every device has been signed out and your previous recovery code no longer works.
+
+		If this wasn't you, please get in touch with us right away.
+	`,
+		deletionSubject: "Your OnlyNotes account was deleted",
+		deletionBody: `
+		Hey!
+
+		Your OnlyNotes account has been deleted along with all of your notes and folders.
+		None of it can be restored, and this address will not hear from us again.
+
+		Sorry to see you go, Cheers!
+	`,
+		emailChangeSubject: "Your OnlyNotes email address is being changed",
+		emailChangeBody: `
+		Hey!
+
+		Someone signed in to your OnlyNotes account asked to move it to %s.
+		The change only happens once that address is confirmed, until then this address stays in use.
+
+		If this wasn't you, please change your password right away.
+	`,
+		magicLinkSubject: "Your OnlyNotes login link",
+		magicLinkBody: `
+		Hey!
+
+		Click the link below to log in to OnlyNotes, it works once and expires in 15 minutes.
+		You will still need your password to open your notes.
+
+		%s
+
+		If you didn't ask for this, you can safely ignore this email.
+	`,
+		unlockSubject: "Your OnlyNotes account was locked",
+		unlockBody: `
+		Hey!
+
+		There were too many failed attempts to log in to your OnlyNotes account, so logins are paused for a while.
+		If it was you, click the link below to log in again right away.
+
+		%s
+
+		If it wasn't you, someone may be guessing your password, consider changing it once you're back in.
 	`,
 	}
 }
@@ -41,6 +116,61 @@ func (v *VerificationEmailConfig) GetBody(callbackURL string) string {
 	return fmt.Sprintf(v.emailBody, callbackURL)
 }
 
+func (v *VerificationEmailConfig) GetRecoverySubject() string {
+	return v.recoverySubject
+}
+
+func (v *VerificationEmailConfig) GetRecoveryBody() string {
+	return v.recoveryBody
+}
+
+func (v *VerificationEmailConfig) GetDeletionSubject() string {
+	return v.deletionSubject
+}
+
+func (v *VerificationEmailConfig) GetDeletionBody() string {
+	return v.deletionBody
+}
+
+func (v *VerificationEmailConfig) GetEmailChangeSubject() string {
+	return v.emailChangeSubject
+}
+
+func (v *VerificationEmailConfig) GetEmailChangeBody(newEmail string) string {
+	return fmt.Sprintf(v.emailChangeBody, newEmail)
+}
+
+func (v *VerificationEmailConfig) GetMagicLinkSubject() string {
+	return v.magicLinkSubject
+}
+
+func (v *VerificationEmailConfig) GetMagicLinkBody(callbackURL string) string {
+	return fmt.Sprintf(v.magicLinkBody, callbackURL)
+}
+
+// GetLoginLinkURL is the page login links open, login links are off when it is empty
+func (v *VerificationEmailConfig) GetLoginLinkURL() string {
+	return v.loginLinkURL
+}
+
+// GetUnlockLinkURL is the page unlock links open, no unlock email is sent when it is empty
+func (v *VerificationEmailConfig) GetUnlockLinkURL() string {
+	return v.unlockLinkURL
+}
+
+func (v *VerificationEmailConfig) GetUnlockSubject() string {
+	return v.unlockSubject
+}
+
+func (v *VerificationEmailConfig) GetUnlockBody(callbackURL string) string {
+	return fmt.Sprintf(v.unlockBody, callbackURL)
+}
+
 func (v *VerificationEmailConfig) GetTokenLength() int {
 	return v.tokenLength
 }
+
+// GetTokenTTL is how long an emailed verification token stays valid after it is issued
+func (v *VerificationEmailConfig) GetTokenTTL() time.Duration {
+	return v.tokenTTL
+}
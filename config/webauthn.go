@@ -0,0 +1,21 @@
+package config
+
+type WebAuthnConfig struct {
+	rpID   string
+	rpName string
+	origin string
+}
+
+// GetRPID is the relying party id, the registrable domain credentials are scoped to
+func (w *WebAuthnConfig) GetRPID() string {
+	return w.rpID
+}
+
+func (w *WebAuthnConfig) GetRPName() string {
+	return w.rpName
+}
+
+// GetOrigin is the origin of the web app running the ceremonies, e.g. https://notes.example.com
+func (w *WebAuthnConfig) GetOrigin() string {
+	return w.origin
+}
@@ -9,10 +9,127 @@ create TABLE dbo.Users
             unique,
     encryption_key   varchar(255) not null,
     key_hash         varchar(255) not null,
-    verification_key varchar(255) not null,
-    verified         bit          not null default 0
+    -- NULL salt and params mark a legacy SHA3 password wrap
+    kdf_salt         varchar(64),
+    kdf_params       varchar(64),
+    -- Data key wrapped under the recovery code the user was shown at signup
+    recovery_key        varchar(255),
+    recovery_kdf_salt   varchar(64),
+    recovery_kdf_params varchar(64),
+    -- Data key wrapped under the vault passphrase of users who log in through OpenID Connect
+    vault_key        varchar(255),
+    vault_kdf_salt   varchar(64),
+    vault_kdf_params varchar(64),
+    -- Verification tokens are stored as SHA3 hashes and cleared once used
+    verification_key       varchar(255),
+    verification_issued_at datetime2,
+    verified         bit          not null default 0,
+    -- Address the user asked to move to, only applied once email_change_key comes back from it
+    pending_email          varchar(255),
+    email_change_key       varchar(255),
+    email_change_issued_at datetime2,
+    -- TOTP secret sealed under the data key, set on enrolment and only trusted once totp_enabled
+    totp_secret      varchar(255),
+    totp_enabled     bit          not null default 0,
+    totp_last_step   bigint       not null default 0,
+    -- SRP-6a verifier of the password, x is derived through Argon2id under its own salt and parameters
+    srp_salt         varchar(64),
+    srp_verifier     varchar(512),
+    srp_kdf_params   varchar(64),
+    -- Set for zero-knowledge accounts only: the client's own keys wrapped by the client, opaque to the server
+    key_bundle       varchar(max)
 )
 
+-- Table structure for table `Session_Keys`, only used by the shared session store
+create table dbo.Session_Keys
+(
+    session_id varchar(64)  not null
+        constraint Session_Keys_pk
+            primary key,
+    sealed_key varchar(255) not null,
+    expires_at datetime2    not null
+)
+
+-- Table structure for table `Refresh_Tokens`, a family holds every token rotated from one login
+create table dbo.Refresh_Tokens
+(
+    token_id   varchar(64) not null
+        constraint Refresh_Tokens_pk
+            primary key,
+    family_id  varchar(64) not null,
+    user_id    int         not null,
+    expires_at datetime2   not null,
+    used       bit         not null default 0,
+    revoked    bit         not null default 0
+)
+
+create index Refresh_Tokens_family_index on dbo.Refresh_Tokens (family_id)
+create index Refresh_Tokens_user_index on dbo.Refresh_Tokens (user_id)
+
+-- Table structure for table `Sessions`, session_id is also the family id of the session's refresh tokens
+create table dbo.Sessions
+(
+    session_id   varchar(64)  not null
+        constraint Sessions_pk
+            primary key,
+    user_id      int          not null,
+    device_label varchar(255) not null default '',
+    user_agent   varchar(512) not null default '',
+    ip_address   varchar(64)  not null default '',
+    created_at   datetime2    not null,
+    last_seen_at datetime2    not null,
+    revoked      bit          not null default 0
+)
+
+create index Sessions_user_index on dbo.Sessions (user_id)
+
+-- Table structure for table `Totp_Backup_Codes`, only hashes of the codes are stored
+create table dbo.Totp_Backup_Codes
+(
+    user_id   int         not null,
+    code_hash varchar(64) not null,
+    constraint Totp_Backup_Codes_pk
+        primary key (user_id, code_hash)
+)
+
+-- Table structure for table `WebAuthn_Credentials`, wrapped_key is the data key sealed under the passkey's PRF output
+create table dbo.WebAuthn_Credentials
+(
+    credential_pk int identity not null
+        constraint WebAuthn_Credentials_pk
+            primary key,
+    user_id       int           not null,
+    credential_id varchar(1400) not null,
+    name          varchar(255)  not null,
+    public_key    varchar(max)  not null,
+    algorithm     int           not null,
+    sign_count    bigint        not null default 0,
+    prf_salt      varchar(64)   not null,
+    wrapped_key   varchar(255),
+    created_at    datetime2     not null,
+    last_used_at  datetime2
+)
+
+create index WebAuthn_Credentials_user_index on dbo.WebAuthn_Credentials (user_id)
+
+-- Table structure for table `Access_Tokens`, only a hash of the secret is stored and wrapped_key can only be opened with it
+create table dbo.Access_Tokens
+(
+    token_id     varchar(64)  not null
+        constraint Access_Tokens_pk
+            primary key,
+    user_id      int          not null,
+    name         varchar(255) not null,
+    secret_hash  varchar(64)  not null,
+    scopes       varchar(255) not null,
+    wrapped_key  varchar(255) not null,
+    created_at   datetime2    not null,
+    expires_at   datetime2    not null,
+    last_used_at datetime2
+)
+
+create index Access_Tokens_user_index on dbo.Access_Tokens (user_id)
+
 -- Table structure for table `Folders`
 create table dbo.Folders
 (
@@ -20,7 +137,7 @@ create table dbo.Folders
         constraint Folders_pk
             primary key,
     user_id   int          not null,
-    name      varchar(200) not null
+    name      varchar(255) not null
 )
 
 -- Table structure for table `Notes`
@@ -31,5 +148,83 @@ create table Notes
             primary key,
     folder_id int          not null,
     data      varchar(max) not null,
-    name      varchar(200) not null
-)
\ No newline at end of file
+    name      varchar(255) not null,
+    -- The note's data key sealed under the user's key, NULL for notes sealed under the user's key directly
+    data_key  varchar(128),
+    -- Set once the note's words are in Note_Tokens, notes written before search are indexed at the next search
+    search_indexed bit not null default 0
+)
+-- Table structure for table `Account_Deletions`, an anonymous record of erased accounts with no user id or email
+create table dbo.Account_Deletions
+(
+    deletion_id     int identity not null
+        constraint Account_Deletions_pk
+            primary key,
+    deleted_at      datetime2    not null,
+    notes_deleted   int          not null,
+    folders_deleted int          not null
+)
+
+-- Table structure for table `User_Identities`, accounts linked to an OpenID Connect provider by its subject
+create table dbo.User_Identities
+(
+    issuer     varchar(255) not null,
+    subject    varchar(255) not null,
+    user_id    int          not null,
+    email      varchar(255),
+    created_at datetime2    not null,
+    constraint User_Identities_pk
+        primary key (issuer, subject)
+)
+
+create unique index User_Identities_user_index on dbo.User_Identities (user_id, issuer)
+
+-- Table structure for table `Login_Failures`, only used by the SQL login throttle store
+create table dbo.Login_Failures
+(
+    throttle_key varchar(320) not null,
+    failed_at    datetime2    not null
+)
+
+create index Login_Failures_key_index on dbo.Login_Failures (throttle_key, failed_at)
+
+-- Table structure for table `Key_Rotations`, a row lives from the request of a data key rotation until the new key is swapped in
+-- pending_key is the new key sealed under the current one, folders and notes up to the cursors are already under it
+create table dbo.Key_Rotations
+(
+    user_id       int          not null
+        constraint Key_Rotations_pk
+            primary key,
+    pending_key   varchar(128),
+    folder_cursor int          not null default 0,
+    note_cursor   int          not null default 0,
+    requested_at  datetime2    not null
+)
+
+-- Table structure for table `Audit_Events`, rows are only ever inserted and are deleted along with their account
+-- user_id is NULL for attempts which matched no account
+create table dbo.Audit_Events
+(
+    event_id   bigint identity not null
+        constraint Audit_Events_pk
+            primary key,
+    user_id    int,
+    event_type varchar(32)  not null,
+    outcome    varchar(16)  not null,
+    ip_address varchar(64)  not null,
+    user_agent varchar(512) not null,
+    created_at datetime2    not null
+)
+
+create index Audit_Events_user_id_index on dbo.Audit_Events (user_id, event_id)
+
+-- Table structure for table `Note_Tokens`, the blind search index: keyed hashes of the words of each note
+create table dbo.Note_Tokens
+(
+    note_id int         not null,
+    token   varchar(32) not null,
+    constraint Note_Tokens_pk
+        primary key (note_id, token)
+)
+
+create index Note_Tokens_token_index on dbo.Note_Tokens (token, note_id)